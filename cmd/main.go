@@ -1,16 +1,41 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"net"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 
+	"github.com/JonathanInTheClouds/goxfer"
+	"github.com/JonathanInTheClouds/goxfer/internal/crypto"
+	"github.com/JonathanInTheClouds/goxfer/internal/peers"
+	"github.com/JonathanInTheClouds/goxfer/internal/session"
 	"github.com/JonathanInTheClouds/goxfer/internal/transfer"
 	"github.com/JonathanInTheClouds/goxfer/internal/tunnel"
+	"github.com/JonathanInTheClouds/goxfer/internal/utils"
+	"golang.org/x/term"
 )
 
 var version = "dev"
 
+// Exit codes for send and receive, so scripts can tell failures apart.
+// Flag parsing errors exit with 2.
+const (
+	exitFailure      = 1
+	exitDeclined     = 3
+	exitCanceled     = 4
+	exitChecksum     = 5
+	exitPeerError    = 6
+	exitIncompatible = 7
+)
+
 func main() {
 	if len(os.Args) >= 2 {
 		switch os.Args[1] {
@@ -20,9 +45,21 @@ func main() {
 		case "receive":
 			runReceive(os.Args[2:])
 			return
+		case "expose":
+			runExpose(os.Args[2:])
+			return
+		case "forward":
+			runForward(os.Args[2:])
+			return
 		case "relay":
 			runRelay(os.Args[2:])
 			return
+		case "id":
+			runID(os.Args[2:])
+			return
+		case "peers":
+			runPeers(os.Args[2:])
+			return
 		}
 	}
 
@@ -39,8 +76,10 @@ func main() {
 	scpMkdir := flag.Bool("scp-mkdir", false, "Create destination directory if it doesn't exist (only for SCP)")
 	insecure := flag.Bool("insecure", false, "Skip host key verification (not recommended for production)")
 	knownHosts := flag.String("known-hosts", "~/.ssh/known_hosts", "Path to known_hosts file for host key verification")
+	output := outputFlag(flag.CommandLine)
 
 	flag.Parse()
+	out, events := outputMode(*output)
 
 	if *port == "" {
 		if *protocol == "ftps" {
@@ -51,38 +90,41 @@ func main() {
 	}
 
 	if *host == "" || *srcPath == "" || *destDir == "" || *username == "" {
-		fmt.Println("Error: host, username, source path, and destination directory must be specified.")
+		fmt.Fprintln(os.Stderr, "Error: host, username, source path, and destination directory must be specified.")
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	fmt.Printf("Starting transfer using %s protocol with up to %d parallel transfers and %d retries...\n", *protocol, *maxParallel, *maxRetries)
+	if *protocol != "sftp" && *protocol != "scp" && *protocol != "ftps" {
+		fmt.Fprintf(os.Stderr, "Error: unsupported protocol %s\n", *protocol)
+		os.Exit(1)
+	}
 
+	if out != nil {
+		fmt.Fprintf(out, "Starting transfer using %s protocol with up to %d parallel transfers and %d retries...\n", *protocol, *maxParallel, *maxRetries)
+	}
+
+	var err error
 	switch *protocol {
 	case "sftp":
-		err := transfer.SFTPTransfer(*username, *password, *host, *port, *key, *srcPath, *destDir, *knownHosts, *maxParallel, *maxRetries, *insecure)
-		if err != nil {
-			fmt.Printf("Error transferring: %v\n", err)
-			os.Exit(1)
-		}
+		err = transfer.SFTPTransfer(*username, *password, *host, *port, *key, *srcPath, *destDir, *knownHosts, *maxParallel, *maxRetries, *insecure, out, events)
 	case "scp":
-		err := transfer.SCPTransfer(*username, *password, *host, *port, *key, *srcPath, *destDir, *scpMkdir, *insecure)
-		if err != nil {
-			fmt.Printf("Error transferring: %v\n", err)
-			os.Exit(1)
-		}
+		err = transfer.SCPTransfer(*username, *password, *host, *port, *key, *srcPath, *destDir, *scpMkdir, *insecure, out, events)
 	case "ftps":
-		err := transfer.FTPSTransfer(*username, *password, *host, *port, *srcPath, *destDir, *maxRetries, *insecure)
-		if err != nil {
-			fmt.Printf("Error transferring: %v\n", err)
-			os.Exit(1)
+		err = transfer.FTPSTransfer(*username, *password, *host, *port, *srcPath, *destDir, *maxRetries, *insecure, out, events)
+	}
+	if err != nil {
+		if out != nil {
+			fmt.Fprintf(out, "Error transferring: %v\n", err)
+		} else {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		}
-	default:
-		fmt.Printf("Error: unsupported protocol %s\n", *protocol)
 		os.Exit(1)
 	}
 
-	fmt.Println("Transfer complete.")
+	if out != nil {
+		fmt.Fprintln(out, "Transfer complete.")
+	}
 }
 
 func runSend(args []string) {
@@ -90,36 +132,316 @@ func runSend(args []string) {
 	relayAddr := fs.String("relay", "", "Self-hosted relay address (default: use bore.pub)")
 	listenAddr := fs.String("listen", "", "Direct mode listen address, e.g. :9000 or 0.0.0.0:9000")
 	publicAddr := fs.String("public", "", "Public direct-mode address receivers should dial, e.g. host.example.com:9000")
-	resume := fs.Bool("resume", false, "Enable resumable transfer (both sides must use this flag)")
+	fs.Bool("resume", true, "Deprecated: resume is now negotiated automatically")
+	noResume := fs.Bool("no-resume", false, "Do not resume interrupted transfers")
+	identityPath := fs.String("identity", "", "Identity file (default: ~/.config/goxfer/identity)")
+	ephemeral := fs.Bool("ephemeral", false, "Use a throwaway identity instead of the persistent one")
+	expectFingerprint := fs.String("expect-fingerprint", "", "Abort unless the receiver's fingerprint matches")
+	to := fs.String("to", "", "Known peer alias the receiver must match (recorded on first use)")
+	verify := fs.Bool("verify", false, "Ask to confirm the verification symbols match the receiver's before sending")
+	idleTimeout := fs.Duration("idle-timeout", session.DefaultIdleTimeout, "Give up when the receiver is silent for this long")
+	reconnects := fs.Int("reconnect", goxfer.DefaultRetryPolicy.Attempts, "Wait for the receiver to reconnect up to this many times if the connection drops (0 disables)")
+	name := fs.String("name", "", "File name the receiver saves data sent from stdin as (default: stdin)")
+	maxReceivers := fs.Int("max-receivers", 1, "Keep accepting receivers, serving each at the same time, until this many have connected")
+	expires := fs.Duration("expires", 0, "Stop waiting for receivers after this long, e.g. 1h (default: no limit)")
+	code := fs.String("code", "", "Session code of a receiver waiting at the relay given as receiver address, or with --relay the code to wait under")
+	output := outputFlag(fs)
 	fs.Usage = func() {
-		fmt.Fprintln(os.Stderr, "Usage: goxfer send [--relay=host:port] [--listen=addr --public=host:port] [--resume] <srcPath>")
+		fmt.Fprintln(os.Stderr, "Usage: goxfer send [--relay=host:port] [--listen=addr --public=host:port] [--code=<code>] [--no-resume] [--identity=path | --ephemeral] [--expect-fingerprint=fp] [--to=alias] [--verify] [--reconnect=n] [--name=file] [--max-receivers=n] [--expires=duration] [--output=text|json] [<receiverAddress>] <srcPath>... | -")
 		fs.PrintDefaults()
 	}
 	fs.Parse(args)
-	if fs.NArg() != 1 {
+	if fs.NArg() < 1 {
 		fs.Usage()
 		os.Exit(1)
 	}
+	receiverAddr, srcPaths := splitReceiverAddr(fs.Args())
 	if *relayAddr != "" && *listenAddr != "" {
 		fmt.Fprintln(os.Stderr, "Error: --relay and --listen cannot be used together")
 		os.Exit(1)
 	}
+	if receiverAddr != "" && (*relayAddr != "" || *listenAddr != "") {
+		fmt.Fprintln(os.Stderr, "Error: a receiver address cannot be used with --relay or --listen")
+		os.Exit(1)
+	}
+	if receiverAddr != "" && (*maxReceivers != 1 || *expires != 0) {
+		fmt.Fprintln(os.Stderr, "Error: --max-receivers and --expires need receivers to connect to this sender")
+		os.Exit(1)
+	}
+	if *code != "" && receiverAddr == "" && *relayAddr == "" {
+		fmt.Fprintln(os.Stderr, "Error: --code needs --relay or a receiver address")
+		os.Exit(1)
+	}
+	if *maxReceivers < 1 || *expires < 0 {
+		fmt.Fprintln(os.Stderr, "Error: --max-receivers must be at least 1 and --expires not negative")
+		os.Exit(1)
+	}
 	if *publicAddr != "" && *listenAddr == "" {
 		fmt.Fprintln(os.Stderr, "Error: --public requires --listen")
 		os.Exit(1)
 	}
-	if err := transfer.P2PSend(fs.Arg(0), *relayAddr, *listenAddr, *publicAddr, *resume); err != nil {
+	if *name != "" && (len(srcPaths) != 1 || srcPaths[0] != "-") {
+		fmt.Fprintln(os.Stderr, "Error: --name only applies when sending stdin with -")
+		os.Exit(1)
+	}
+	identity, err := loadIdentity(*identityPath, *ephemeral)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	known, err := loadKnownPeers()
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
+	opts := []goxfer.Option{
+		goxfer.WithIdentity(identity),
+		outputOption(*output),
+		goxfer.WithRelay(*relayAddr),
+		goxfer.WithListen(*listenAddr, *publicAddr),
+		goxfer.WithReceiverAddr(receiverAddr),
+		goxfer.WithCode(*code),
+		goxfer.WithExpectedFingerprint(*expectFingerprint),
+		goxfer.WithKnownPeers(known, *to),
+		goxfer.WithIdleTimeout(*idleTimeout),
+		goxfer.WithRetry(retryPolicy(*reconnects)),
+		goxfer.WithPipeName(*name),
+		goxfer.WithMaxReceivers(*maxReceivers),
+		goxfer.WithExpiry(*expires),
+	}
+	if *noResume {
+		opts = append(opts, goxfer.WithoutResume())
+	}
+	if *verify {
+		opts = append(opts, goxfer.WithVerify(nil))
+	}
+	ctx, stop := interruptContext()
+	defer stop()
+	if err := goxfer.NewSender(opts...).Send(ctx, srcPaths...); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitCode(err))
+	}
 }
 
 func runReceive(args []string) {
 	fs := flag.NewFlagSet("receive", flag.ExitOnError)
 	code := fs.String("code", "", "Session code for self-hosted relay (not needed for bore.pub)")
-	resume := fs.Bool("resume", false, "Enable resumable transfer (both sides must use this flag)")
+	fs.Bool("resume", true, "Deprecated: resume is now negotiated automatically")
+	noResume := fs.Bool("no-resume", false, "Do not resume interrupted transfers")
+	identityPath := fs.String("identity", "", "Identity file (default: ~/.config/goxfer/identity)")
+	ephemeral := fs.Bool("ephemeral", false, "Use a throwaway identity instead of the persistent one")
+	expectFingerprint := fs.String("expect-fingerprint", "", "Abort unless the sender's fingerprint matches")
+	from := fs.String("from", "", "Known peer alias the sender must match (recorded on first use)")
+	verify := fs.Bool("verify", false, "Ask to confirm the verification symbols match the sender's before receiving")
+	yes := fs.Bool("yes", false, "Accept the sender's offer without prompting")
+	maxSize := fs.String("max-size", "", "Decline offers larger than this, e.g. 500M or 10G")
+	idleTimeout := fs.Duration("idle-timeout", session.DefaultIdleTimeout, "Give up when the sender is silent for this long")
+	reconnects := fs.Int("reconnect", goxfer.DefaultRetryPolicy.Attempts, "Redial the sender up to this many times if the connection drops (0 disables)")
+	var include, exclude patternList
+	fs.Var(&include, "include", "Only receive files of a directory matching this glob, e.g. '*.csv' (repeatable)")
+	fs.Var(&exclude, "exclude", "Skip files of a directory matching this glob (repeatable)")
+	pick := fs.Bool("pick", false, "Choose which files of a directory to receive from a list")
+	listenAddr := fs.String("listen", "", "Wait for the sender to dial this address, e.g. :9000, instead of dialing it")
+	publicAddr := fs.String("public", "", "Public address senders should dial, e.g. host.example.com:9000")
+	relayAddr := fs.String("relay", "", "Wait for the sender to dial in through this self-hosted relay instead of dialing it")
+	daemon := fs.Bool("daemon", false, "Keep receiving transfers from the --allow senders into --inbox until interrupted")
+	inbox := fs.String("inbox", "", "Directory a --daemon files each sender's transfers under, e.g. ~/Inbox")
+	var allow patternList
+	fs.Var(&allow, "allow", "Known peer alias or fingerprint of a sender a --daemon accepts (repeatable)")
+	output := outputFlag(fs)
 	fs.Usage = func() {
-		fmt.Fprintln(os.Stderr, "Usage: goxfer receive [--code=<code>] [--resume] <address> <destDir>")
+		fmt.Fprintln(os.Stderr, "Usage: goxfer receive [--code=<code>] [--no-resume] [--identity=path | --ephemeral] [--expect-fingerprint=fp] [--from=alias] [--verify] [--yes] [--max-size=size] [--reconnect=n] [--include=glob] [--exclude=glob] [--pick] [--output=text|json] <address> <destDir | ->")
+		fmt.Fprintln(os.Stderr, "       goxfer receive (--listen=addr [--public=host:port] | --relay=host:port [--code=<code>]) [options] <destDir | ->")
+		fmt.Fprintln(os.Stderr, "       goxfer receive --daemon --inbox=dir --allow=alias|fingerprint... (--listen=addr | --relay=host:port [--code=<code>]) [options]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	waiting := *listenAddr != "" || *relayAddr != ""
+	var addr, destDir string
+	switch {
+	case *daemon && fs.NArg() == 0:
+	case !*daemon && waiting && fs.NArg() == 1:
+		destDir = fs.Arg(0)
+	case !*daemon && !waiting && fs.NArg() == 2:
+		addr, destDir = fs.Arg(0), fs.Arg(1)
+	default:
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *relayAddr != "" && *listenAddr != "" {
+		fmt.Fprintln(os.Stderr, "Error: --relay and --listen cannot be used together")
+		os.Exit(1)
+	}
+	if *publicAddr != "" && *listenAddr == "" {
+		fmt.Fprintln(os.Stderr, "Error: --public requires --listen")
+		os.Exit(1)
+	}
+	if *code != "" && *listenAddr != "" {
+		fmt.Fprintln(os.Stderr, "Error: --code and --listen cannot be used together")
+		os.Exit(1)
+	}
+	if *daemon {
+		switch {
+		case *inbox == "" || len(allow) == 0 || !waiting:
+			fmt.Fprintln(os.Stderr, "Error: --daemon needs --inbox, at least one --allow, and --listen or --relay")
+			os.Exit(1)
+		case *verify || *pick || *from != "" || *expectFingerprint != "":
+			fmt.Fprintln(os.Stderr, "Error: --daemon checks senders against --allow and runs unattended, so it cannot be used with --verify, --pick, --from or --expect-fingerprint")
+			os.Exit(1)
+		}
+	} else if *inbox != "" || len(allow) > 0 {
+		fmt.Fprintln(os.Stderr, "Error: --inbox and --allow only apply with --daemon")
+		os.Exit(1)
+	}
+	if *output == "json" && (destDir == "-" || *pick) {
+		fmt.Fprintln(os.Stderr, "Error: --output=json needs stdout and the terminal, so it cannot be used with - or --pick")
+		os.Exit(1)
+	}
+	maxBytes, err := parseByteSize(*maxSize)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: --max-size: %v\n", err)
+		os.Exit(1)
+	}
+	identity, err := loadIdentity(*identityPath, *ephemeral)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	known, err := loadKnownPeers()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	opts := []goxfer.Option{
+		goxfer.WithIdentity(identity),
+		outputOption(*output),
+		goxfer.WithCode(*code),
+		goxfer.WithListen(*listenAddr, *publicAddr),
+		goxfer.WithRelay(*relayAddr),
+		goxfer.WithExpectedFingerprint(*expectFingerprint),
+		goxfer.WithKnownPeers(known, *from),
+		goxfer.WithMaxSize(maxBytes),
+		goxfer.WithIdleTimeout(*idleTimeout),
+		goxfer.WithInclude(include...),
+		goxfer.WithExclude(exclude...),
+		goxfer.WithRetry(retryPolicy(*reconnects)),
+	}
+	if *noResume {
+		opts = append(opts, goxfer.WithoutResume())
+	}
+	if *verify {
+		opts = append(opts, goxfer.WithVerify(nil))
+	}
+	if *yes || *daemon {
+		// A daemon has nobody to ask, so it takes every offer within
+		// --max-size.
+		opts = append(opts, goxfer.WithAcceptAll())
+	} else {
+		opts = append(opts, goxfer.WithAcceptOffer(nil))
+	}
+	if *pick {
+		opts = append(opts, goxfer.WithPick())
+	}
+	ctx, stop := interruptContext()
+	defer stop()
+	if *daemon {
+		dir, err := utils.ExpandHome(*inbox)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		for _, entry := range allow {
+			fp, name, err := allowedSender(known, entry)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: --allow: %v\n", err)
+				os.Exit(1)
+			}
+			opts = append(opts, goxfer.WithAllowedSender(fp, name))
+		}
+		if err := goxfer.NewReceiver(opts...).Serve(ctx, dir); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+		return
+	}
+	if err := goxfer.NewReceiver(opts...).Receive(ctx, addr, destDir); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+}
+
+func runExpose(args []string) {
+	fs := flag.NewFlagSet("expose", flag.ExitOnError)
+	relayAddr := fs.String("relay", "", "Self-hosted relay address (default: use bore.pub)")
+	listenAddr := fs.String("listen", "", "Direct mode listen address, e.g. :9000 or 0.0.0.0:9000")
+	publicAddr := fs.String("public", "", "Public direct-mode address the peer should dial, e.g. host.example.com:9000")
+	identityPath := fs.String("identity", "", "Identity file (default: ~/.config/goxfer/identity)")
+	ephemeral := fs.Bool("ephemeral", false, "Use a throwaway identity instead of the persistent one")
+	expectFingerprint := fs.String("expect-fingerprint", "", "Abort unless the peer's fingerprint matches")
+	to := fs.String("to", "", "Known peer alias the peer must match (recorded on first use)")
+	verify := fs.Bool("verify", false, "Ask to confirm the verification symbols match the peer's before forwarding")
+	idleTimeout := fs.Duration("idle-timeout", session.DefaultIdleTimeout, "Give up when the peer is silent for this long")
+	output := outputFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: goxfer expose [--relay=host:port] [--listen=addr --public=host:port] [--identity=path | --ephemeral] [--expect-fingerprint=fp] [--to=alias] [--verify] [--output=json] <[host:]port>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *relayAddr != "" && *listenAddr != "" {
+		fmt.Fprintln(os.Stderr, "Error: --relay and --listen cannot be used together")
+		os.Exit(1)
+	}
+	if *publicAddr != "" && *listenAddr == "" {
+		fmt.Fprintln(os.Stderr, "Error: --public requires --listen")
+		os.Exit(1)
+	}
+	identity, err := loadIdentity(*identityPath, *ephemeral)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	known, err := loadKnownPeers()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	out, events := outputMode(*output)
+	ctx, stop := interruptContext()
+	defer stop()
+	if err := transfer.Expose(ctx, portAddr(fs.Arg(0), "localhost"), transfer.ExposeOptions{
+		Identity:          identity,
+		RelayAddr:         *relayAddr,
+		ListenAddr:        *listenAddr,
+		PublicAddr:        *publicAddr,
+		ExpectFingerprint: *expectFingerprint,
+		To:                *to,
+		KnownPeers:        known,
+		Verify:            *verify,
+		IdleTimeout:       *idleTimeout,
+		Output:            out,
+		Events:            events,
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+}
+
+func runForward(args []string) {
+	fs := flag.NewFlagSet("forward", flag.ExitOnError)
+	code := fs.String("code", "", "Session code for self-hosted relay (not needed for bore.pub)")
+	identityPath := fs.String("identity", "", "Identity file (default: ~/.config/goxfer/identity)")
+	ephemeral := fs.Bool("ephemeral", false, "Use a throwaway identity instead of the persistent one")
+	expectFingerprint := fs.String("expect-fingerprint", "", "Abort unless the peer's fingerprint matches")
+	from := fs.String("from", "", "Known peer alias the peer must match (recorded on first use)")
+	verify := fs.Bool("verify", false, "Ask to confirm the verification symbols match the peer's before forwarding")
+	idleTimeout := fs.Duration("idle-timeout", session.DefaultIdleTimeout, "Give up when the peer is silent for this long")
+	output := outputFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: goxfer forward [--code=<code>] [--identity=path | --ephemeral] [--expect-fingerprint=fp] [--from=alias] [--verify] [--output=json] <address> <[host:]local-port>")
 		fs.PrintDefaults()
 	}
 	fs.Parse(args)
@@ -127,22 +449,472 @@ func runReceive(args []string) {
 		fs.Usage()
 		os.Exit(1)
 	}
-	if err := transfer.P2PReceive(fs.Arg(0), fs.Arg(1), *code, *resume); err != nil {
+	identity, err := loadIdentity(*identityPath, *ephemeral)
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
+	known, err := loadKnownPeers()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	out, events := outputMode(*output)
+	ctx, stop := interruptContext()
+	defer stop()
+	if err := transfer.Forward(ctx, fs.Arg(0), portAddr(fs.Arg(1), "127.0.0.1"), transfer.ForwardOptions{
+		Identity:          identity,
+		Code:              *code,
+		ExpectFingerprint: *expectFingerprint,
+		From:              *from,
+		KnownPeers:        known,
+		Verify:            *verify,
+		IdleTimeout:       *idleTimeout,
+		Output:            out,
+		Events:            events,
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+}
+
+// portAddr turns a bare port into an address on defaultHost; anything else
+// is taken as host:port.
+func portAddr(arg, defaultHost string) string {
+	if _, err := strconv.ParseUint(arg, 10, 16); err == nil {
+		return net.JoinHostPort(defaultHost, arg)
+	}
+	return arg
+}
+
+// patternList collects a repeatable glob flag. Commas also separate
+// patterns, so --include='*.csv,*.json' works too.
+type patternList []string
+
+func (p *patternList) String() string { return strings.Join(*p, ",") }
+
+func (p *patternList) Set(value string) error {
+	for _, pattern := range strings.Split(value, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			*p = append(*p, pattern)
+		}
+	}
+	return nil
+}
+
+// allowedSender resolves an --allow entry, a known peer alias or a
+// fingerprint, to the fingerprint and the inbox subdirectory of the sender.
+// A known peer is filed under its alias.
+func allowedSender(known *peers.KnownPeers, entry string) (string, string, error) {
+	if p, ok := known.Lookup(entry); ok {
+		return p.Fingerprint, p.Alias, nil
+	}
+	if fp, err := crypto.ParseFingerprint(entry); err == nil {
+		if p, ok := known.FindByFingerprint(fp); ok {
+			return fp, p.Alias, nil
+		}
+		return fp, "", nil
+	}
+	return "", "", fmt.Errorf("%q is neither a known peer alias nor a fingerprint; add it with goxfer peers add", entry)
+}
+
+// retryPolicy is the default reconnect policy with its attempts set to n.
+func retryPolicy(n int) goxfer.RetryPolicy {
+	p := goxfer.DefaultRetryPolicy
+	p.Attempts = max(n, 0)
+	return p
+}
+
+// outputFlag adds the --output flag to fs.
+func outputFlag(fs *flag.FlagSet) *string {
+	return fs.String("output", "text", "Output format: text, or json for one JSON event per line on stdout")
+}
+
+// outputMode returns where to print status and where to send events for
+// the --output format: text on stdout, or JSON events on stdout instead of
+// text and progress bars.
+func outputMode(format string) (io.Writer, func(goxfer.Event)) {
+	switch format {
+	case "text":
+		return os.Stdout, nil
+	case "json":
+		return nil, goxfer.JSONEvents(os.Stdout)
+	}
+	fmt.Fprintf(os.Stderr, "Error: --output must be text or json, not %q\n", format)
+	os.Exit(2)
+	return nil, nil
+}
+
+// outputOption configures a send or receive for the --output format.
+func outputOption(format string) goxfer.Option {
+	out, events := outputMode(format)
+	if events != nil {
+		return goxfer.WithEvents(events)
+	}
+	return goxfer.WithOutput(out)
+}
+
+// runRelayJSON runs the relay like tunnel.RunRelay, reporting where it
+// listens as an event.
+func runRelayJSON(addr string, events func(goxfer.Event)) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("relay listen: %w", err)
+	}
+	events(goxfer.Event{Kind: goxfer.EventListening, Addr: l.Addr().String()})
+	return tunnel.Serve(l)
+}
+
+// interruptContext is canceled by the first Ctrl-C, which cancels a
+// transfer cleanly; a second one exits at once.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	context.AfterFunc(ctx, stop)
+	return ctx, stop
+}
+
+// splitReceiverAddr separates a leading receiver address from send's
+// paths. With more than one argument, a first one that is not an existing
+// path but reads as host:port is a receiver waiting with --listen.
+func splitReceiverAddr(args []string) (string, []string) {
+	if len(args) < 2 {
+		return "", args
+	}
+	if _, err := os.Stat(args[0]); err == nil {
+		return "", args
+	}
+	_, port, err := net.SplitHostPort(args[0])
+	if err != nil {
+		return "", args
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", args
+	}
+	return args[0], args[1:]
 }
 
 func runRelay(args []string) {
 	fs := flag.NewFlagSet("relay", flag.ExitOnError)
 	addr := fs.String("addr", fmt.Sprintf(":%d", tunnel.DefaultRelayPort), "Address to listen on")
+	output := outputFlag(fs)
 	fs.Usage = func() {
-		fmt.Fprintln(os.Stderr, "Usage: goxfer relay [--addr=:7835]")
+		fmt.Fprintln(os.Stderr, "Usage: goxfer relay [--addr=:7835] [--output=text|json]")
 		fs.PrintDefaults()
 	}
 	fs.Parse(args)
+	if _, events := outputMode(*output); events != nil {
+		err := runRelayJSON(*addr, events)
+		if err != nil {
+			events(goxfer.Event{Kind: goxfer.EventError, Error: err.Error()})
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 	if err := tunnel.RunRelay(*addr); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 }
+
+func runID(args []string) {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage: goxfer id <show|init|rotate> [--identity=path] [--encrypt] [--force]")
+	}
+	if len(args) < 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	sub := args[0]
+	fs := flag.NewFlagSet("id "+sub, flag.ExitOnError)
+	identityPath := fs.String("identity", "", "Identity file (default: ~/.config/goxfer/identity)")
+	var encrypt, force *bool
+	if sub == "init" || sub == "rotate" {
+		encrypt = fs.Bool("encrypt", false, "Protect the identity with a passphrase (rotate keeps the current setting by default)")
+	}
+	if sub == "init" {
+		force = fs.Bool("force", false, "Overwrite an existing identity")
+	}
+	fs.Usage = func() {
+		usage()
+		fs.PrintDefaults()
+	}
+	fs.Parse(args[1:])
+
+	path, err := identityFilePath(*identityPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	switch sub {
+	case "show":
+		identity, err := openIdentity(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		encrypted, _ := crypto.IsIdentityEncrypted(path)
+		fmt.Printf("Identity    : %s\n", path)
+		fmt.Printf("Fingerprint : %s\n", identity.Fingerprint())
+		fmt.Printf("Encrypted   : %t\n", encrypted)
+
+	case "init":
+		if _, err := os.Stat(path); err == nil && !*force {
+			fmt.Fprintf(os.Stderr, "Error: identity already exists at %s (use --force to overwrite, or 'goxfer id rotate')\n", path)
+			os.Exit(1)
+		}
+		fingerprint, err := createIdentity(path, *encrypt)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Created identity at %s\n", path)
+		fmt.Printf("Fingerprint : %s\n", fingerprint)
+
+	case "rotate":
+		old, err := openIdentity(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		// The new key is protected like the old one unless --encrypt says otherwise.
+		protect := *encrypt
+		if !flagSet(fs, "encrypt") && old != nil {
+			protect, _ = crypto.IsIdentityEncrypted(path)
+		}
+		fingerprint, err := createIdentity(path, protect)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if old != nil {
+			fmt.Printf("Old fingerprint : %s\n", old.Fingerprint())
+		}
+		fmt.Printf("New fingerprint : %s\n", fingerprint)
+		fmt.Println("Peers that remembered your old fingerprint will need the new one.")
+
+	default:
+		usage()
+		os.Exit(1)
+	}
+}
+
+// flagSet reports whether the named flag was given on the command line.
+func flagSet(fs *flag.FlagSet, name string) bool {
+	found := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			found = true
+		}
+	})
+	return found
+}
+
+func runPeers(args []string) {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage: goxfer peers list")
+		fmt.Fprintln(os.Stderr, "       goxfer peers add <alias> <fingerprint>")
+		fmt.Fprintln(os.Stderr, "       goxfer peers remove <alias>")
+		fmt.Fprintln(os.Stderr, "       goxfer peers rename <old-alias> <new-alias>")
+	}
+	if len(args) < 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	known, err := loadKnownPeers()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	sub, rest := args[0], args[1:]
+	switch {
+	case sub == "list" && len(rest) == 0:
+		list := known.List()
+		if len(list) == 0 {
+			fmt.Printf("No known peers in %s\n", known.Path())
+			return
+		}
+		for _, p := range list {
+			added := ""
+			if !p.Added.IsZero() {
+				added = p.Added.Local().Format("2006-01-02")
+			}
+			fmt.Printf("%-20s %s  %s\n", p.Alias, p.Fingerprint, added)
+		}
+		return
+	case sub == "add" && len(rest) == 2:
+		err = known.Add(rest[0], rest[1])
+	case sub == "remove" && len(rest) == 1:
+		err = known.Remove(rest[0])
+	case sub == "rename" && len(rest) == 2:
+		err = known.Rename(rest[0], rest[1])
+	default:
+		usage()
+		os.Exit(1)
+	}
+
+	if err == nil {
+		err = known.Save()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// exitCode maps a send or receive error to the process exit code.
+func exitCode(err error) int {
+	var remote *goxfer.RemoteError
+	switch {
+	case errors.Is(err, goxfer.ErrDeclined):
+		return exitDeclined
+	case errors.Is(err, goxfer.ErrCanceled):
+		return exitCanceled
+	case errors.Is(err, goxfer.ErrChecksumMismatch):
+		return exitChecksum
+	case errors.Is(err, goxfer.ErrIncompatiblePeer):
+		return exitIncompatible
+	case errors.As(err, &remote):
+		return exitPeerError
+	default:
+		return exitFailure
+	}
+}
+
+// parseByteSize parses sizes like "1024", "500K", "20M" or "1.5G" (binary units).
+func parseByteSize(s string) (int64, error) {
+	s = strings.TrimSpace(strings.ToUpper(s))
+	if s == "" {
+		return 0, nil
+	}
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+
+	multiplier := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			s = s[:n-1]
+		}
+	}
+
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+func loadKnownPeers() (*peers.KnownPeers, error) {
+	path, err := peers.DefaultPath()
+	if err != nil {
+		return nil, err
+	}
+	return peers.Load(path)
+}
+
+// loadIdentity returns the persistent identity for send/receive, creating it
+// on first use. ephemeral=true skips the keystore entirely.
+func loadIdentity(path string, ephemeral bool) (*crypto.Identity, error) {
+	if ephemeral {
+		return crypto.GenerateIdentity()
+	}
+
+	path, err := identityFilePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	identity, err := openIdentity(path)
+	if errors.Is(err, os.ErrNotExist) {
+		identity, err = crypto.GenerateIdentity()
+		if err != nil {
+			return nil, fmt.Errorf("generate identity: %w", err)
+		}
+		if err := crypto.SaveIdentity(path, identity, nil); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(os.Stderr, "Created new identity at %s\n", path)
+		return identity, nil
+	}
+	return identity, err
+}
+
+func identityFilePath(path string) (string, error) {
+	if path == "" {
+		return crypto.DefaultIdentityPath()
+	}
+	return utils.ExpandHome(path)
+}
+
+// openIdentity loads the identity at path, prompting for a passphrase if it is encrypted.
+func openIdentity(path string) (*crypto.Identity, error) {
+	identity, err := crypto.LoadIdentity(path, nil)
+	if !errors.Is(err, crypto.ErrPassphraseRequired) {
+		return identity, err
+	}
+	passphrase, err := readPassphrase("Enter passphrase for identity: ")
+	if err != nil {
+		return nil, err
+	}
+	return crypto.LoadIdentity(path, passphrase)
+}
+
+func createIdentity(path string, encrypt bool) (string, error) {
+	var passphrase []byte
+	if encrypt {
+		var err error
+		passphrase, err = readPassphrase("New identity passphrase: ")
+		if err != nil {
+			return "", err
+		}
+		if os.Getenv("GOXFER_PASSPHRASE") == "" {
+			confirm, err := readPassphrase("Confirm passphrase: ")
+			if err != nil {
+				return "", err
+			}
+			if string(confirm) != string(passphrase) {
+				return "", errors.New("passphrases do not match")
+			}
+		}
+		if len(passphrase) == 0 {
+			return "", errors.New("passphrase must not be empty")
+		}
+	}
+
+	identity, err := crypto.GenerateIdentity()
+	if err != nil {
+		return "", fmt.Errorf("generate identity: %w", err)
+	}
+	if err := crypto.SaveIdentity(path, identity, passphrase); err != nil {
+		return "", err
+	}
+	return identity.Fingerprint(), nil
+}
+
+// readPassphrase reads a passphrase from GOXFER_PASSPHRASE or, failing that,
+// prompts on the terminal without echo.
+func readPassphrase(prompt string) ([]byte, error) {
+	if env := os.Getenv("GOXFER_PASSPHRASE"); env != "" {
+		return []byte(env), nil
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(int(syscall.Stdin))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read passphrase: %v", err)
+	}
+	return passphrase, nil
+}
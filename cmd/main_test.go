@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JonathanInTheClouds/goxfer"
+)
+
+// TestMain lets the test binary stand in for goxfer itself: run with
+// GOXFER_TEST_MAIN set, it runs main on its arguments instead of the tests.
+func TestMain(m *testing.M) {
+	if os.Getenv("GOXFER_TEST_MAIN") != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// goxferCommand returns a goxfer run with args, its config kept in a
+// directory of its own.
+func goxferCommand(t *testing.T, args ...string) *exec.Cmd {
+	t.Helper()
+	home := t.TempDir()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "GOXFER_TEST_MAIN=1", "HOME="+home, "XDG_CONFIG_HOME="+filepath.Join(home, ".config"))
+	return cmd
+}
+
+func TestLegacyMode_ErrorsGoToStderr(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"missing flags", nil, "host, username, source path, and destination directory must be specified"},
+		{"bad protocol", []string{"-protocol=gopher", "-host=h", "-username=u", "-srcPath=a", "-destDir=b"}, "unsupported protocol gopher"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			cmd := goxferCommand(t, tt.args...)
+			cmd.Stdout, cmd.Stderr = &stdout, &stderr
+			if err := cmd.Run(); err == nil {
+				t.Fatal("goxfer succeeded")
+			}
+			if stdout.Len() != 0 {
+				t.Errorf("stdout = %q, want nothing", stdout.String())
+			}
+			if !strings.Contains(stderr.String(), tt.want) {
+				t.Errorf("stderr = %q, want %q", stderr.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestReceive_JSONOutputAsksBeforeAccepting(t *testing.T) {
+	destDir := t.TempDir()
+	cmd := goxferCommand(t, "receive", "--ephemeral", "--output=json", "--listen=127.0.0.1:0", destDir)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	events := make(chan goxfer.Event)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			var e goxfer.Event
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				t.Errorf("line %q is not an event: %v", scanner.Text(), err)
+				continue
+			}
+			events <- e
+		}
+	}()
+	next := func(kind goxfer.EventKind) goxfer.Event {
+		t.Helper()
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					t.Fatalf("goxfer exited before a %s event; stderr: %s", kind, stderr.String())
+				}
+				if e.Kind == kind {
+					return e
+				}
+			case <-timeout:
+				t.Fatalf("no %s event", kind)
+			}
+		}
+	}
+
+	addr := next(goxfer.EventListening).Addr
+	src := filepath.Join(t.TempDir(), "notes.txt")
+	os.WriteFile(src, []byte("hello"), 0o644)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- goxfer.NewSender(goxfer.WithReceiverAddr(addr)).Send(context.Background(), src)
+	}()
+
+	if q := next(goxfer.EventPrompt).Question; !strings.HasPrefix(q, "Accept this transfer?") {
+		t.Errorf("prompt question = %q", q)
+	}
+	stdin.Write([]byte("y\n"))
+	next(goxfer.EventDone)
+	for range events {
+	}
+
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("receive: %v; stderr: %s", err, stderr.String())
+	}
+	if err := <-sent; err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if !strings.Contains(stderr.String(), "Accept this transfer? [y/N]") {
+		t.Errorf("stderr = %q, want the question", stderr.String())
+	}
+	if got, err := os.ReadFile(filepath.Join(destDir, "notes.txt")); err != nil || string(got) != "hello" {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
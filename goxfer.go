@@ -0,0 +1,181 @@
+// Package goxfer sends files and directories between two machines over an
+// end-to-end encrypted session, as the goxfer command does, for programs
+// that would rather embed a transfer than run the command.
+//
+// A Sender waits for its receiver at a rendezvous — bore.pub by default, a
+// self-hosted relay or a direct address — or dials a receiver that is
+// listening itself; a Receiver does the opposite. Both report what happens
+// as Events and stop when their context is canceled:
+//
+//	s := goxfer.NewSender(
+//		goxfer.WithRelay("relay.example.com:7835"),
+//		goxfer.WithEvents(func(e goxfer.Event) {
+//			if e.Kind == goxfer.EventListening {
+//				log.Printf("receive with: %s", e.Command)
+//			}
+//		}),
+//	)
+//	err := s.Send(ctx, "report.pdf")
+//
+// Nothing is printed unless WithOutput is given, and nothing is asked on
+// stdin unless an option says it does.
+package goxfer
+
+import (
+	"context"
+	"io"
+
+	"github.com/JonathanInTheClouds/goxfer/internal/crypto"
+	"github.com/JonathanInTheClouds/goxfer/internal/peers"
+	"github.com/JonathanInTheClouds/goxfer/internal/transfer"
+)
+
+type (
+	// Identity is a long-lived key pair that peers recognize by its
+	// fingerprint.
+	Identity = crypto.Identity
+	// KnownPeers maps aliases to the fingerprints they must match.
+	KnownPeers = peers.KnownPeers
+	// Event is something that happened during a transfer.
+	Event = transfer.Event
+	// EventKind says what an Event reports.
+	EventKind = transfer.EventKind
+	// Offer is what a sender proposes to send.
+	Offer = transfer.Offer
+	// RetryPolicy bounds reconnecting after the connection drops.
+	RetryPolicy = transfer.RetryPolicy
+	// RemoteError is a failure the peer reported.
+	RemoteError = transfer.RemoteError
+)
+
+// The events a transfer reports, in roughly the order they happen. Only
+// the Event fields named with a kind are set, along with Peer, the peer's
+// fingerprint, once one has connected.
+const (
+	// EventListening: this side waits for the peer, who runs Command to
+	// reach Addr, with Code through a relay. Fingerprint is this side's.
+	EventListening = transfer.EventListening
+	// EventConnected: the peer connected; Fingerprint is this side's.
+	EventConnected = transfer.EventConnected
+	// EventVerification: Symbols should match what the peer shows.
+	EventVerification = transfer.EventVerification
+	// EventOffer: the sender offered Offer.
+	EventOffer = transfer.EventOffer
+	// EventAccepted: the receiver accepted the offer.
+	EventAccepted = transfer.EventAccepted
+	// EventPrompt: this side waits for a yes or no on stdin to Question.
+	EventPrompt = transfer.EventPrompt
+	// EventFileStarted: file Name of Size bytes started, from Bytes when
+	// it resumes. Size is -1 while unknown.
+	EventFileStarted = transfer.EventFileStarted
+	// EventFileSkipped: file Name was already received in full.
+	EventFileSkipped = transfer.EventFileSkipped
+	// EventProgress: Bytes of Name's Size bytes have gone across.
+	EventProgress = transfer.EventProgress
+	// EventFileVerified: file Name arrived with Checksum intact; the
+	// receiver saved it at Path.
+	EventFileVerified = transfer.EventFileVerified
+	// EventDone: the transfer finished.
+	EventDone = transfer.EventDone
+	// EventError: the transfer failed with Error.
+	EventError = transfer.EventError
+)
+
+// Errors a transfer can end with, to check with errors.Is.
+var (
+	ErrCanceled         = transfer.ErrCanceled
+	ErrDeclined         = transfer.ErrDeclined
+	ErrChecksumMismatch = transfer.ErrChecksumMismatch
+	ErrIncompatiblePeer = transfer.ErrIncompatiblePeer
+	ErrOfferMismatch    = transfer.ErrOfferMismatch
+)
+
+// DefaultRetryPolicy rides out a few minutes of network trouble. Senders
+// and receivers use it unless WithRetry says otherwise.
+var DefaultRetryPolicy = transfer.DefaultRetryPolicy
+
+// GenerateIdentity returns a new random identity.
+func GenerateIdentity() (*Identity, error) {
+	return crypto.GenerateIdentity()
+}
+
+// LoadIdentity reads the identity saved at path, such as the one goxfer id
+// init creates; an empty path uses the command's default location. An
+// encrypted identity needs its passphrase.
+func LoadIdentity(path string, passphrase []byte) (*Identity, error) {
+	if path == "" {
+		var err error
+		if path, err = crypto.DefaultIdentityPath(); err != nil {
+			return nil, err
+		}
+	}
+	return crypto.LoadIdentity(path, passphrase)
+}
+
+// LoadKnownPeers reads the known peers saved at path; an empty path uses
+// the command's default location.
+func LoadKnownPeers(path string) (*KnownPeers, error) {
+	if path == "" {
+		var err error
+		if path, err = peers.DefaultPath(); err != nil {
+			return nil, err
+		}
+	}
+	return peers.Load(path)
+}
+
+// JSONEvents returns an event handler for WithEvents that writes each event
+// to w as one line of JSON, as goxfer --output=json does.
+func JSONEvents(w io.Writer) func(Event) {
+	return transfer.JSONEvents(w)
+}
+
+// Sender sends files and directories to a receiver.
+type Sender struct {
+	opts transfer.SendOptions
+}
+
+// NewSender returns a Sender configured by opts.
+func NewSender(opts ...Option) *Sender {
+	s := newSettings(opts)
+	return &Sender{opts: s.send}
+}
+
+// Send sends paths to a receiver in one session and returns once the
+// receiver has verified every file, or the transfer failed. The single path
+// "-" streams stdin. Canceling ctx stops waiting for the receiver and
+// cancels a transfer in progress, which then returns ErrCanceled.
+func (s *Sender) Send(ctx context.Context, paths ...string) error {
+	return transfer.P2PSend(ctx, paths, s.opts)
+}
+
+// Receiver receives files and directories from a sender.
+type Receiver struct {
+	opts transfer.ReceiveOptions
+}
+
+// NewReceiver returns a Receiver configured by opts.
+func NewReceiver(opts ...Option) *Receiver {
+	s := newSettings(opts)
+	return &Receiver{opts: s.recv}
+}
+
+// Receive receives what the sender at addr offers into destDir: addr is
+// the bore.pub or direct address the sender gave, or its relay with
+// WithCode, and is empty WithListen or WithRelay. The destDir "-" writes a single file
+// to stdout. Canceling ctx stops waiting for the sender and cancels a
+// transfer in progress, which then returns ErrCanceled.
+func (r *Receiver) Receive(ctx context.Context, addr, destDir string) error {
+	return transfer.P2PReceive(ctx, addr, destDir, r.opts)
+}
+
+// Serve runs an inbox: it waits WithListen or WithRelay for the senders
+// added WithAllowedSender and receives each of their transfers into that
+// sender's subdirectory of inbox, turning anyone else away, until ctx is
+// canceled. Offers within WithMaxSize are taken with WithAcceptAll or
+// decided by WithAcceptOffer, and declined without either; Serve never asks
+// on stdin, so WithAcceptOffer(nil) is an error. It returns nil once ctx is
+// canceled.
+func (r *Receiver) Serve(ctx context.Context, inbox string) error {
+	return transfer.ServeInbox(ctx, inbox, r.opts)
+}
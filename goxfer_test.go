@@ -0,0 +1,173 @@
+package goxfer_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JonathanInTheClouds/goxfer"
+)
+
+// events collects the events of one side of a transfer.
+type events struct {
+	mu  sync.Mutex
+	all []goxfer.Event
+	// listening receives the address of the first EventListening.
+	listening chan string
+}
+
+func newEvents() *events {
+	return &events{listening: make(chan string, 1)}
+}
+
+func (e *events) record(ev goxfer.Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.all = append(e.all, ev)
+	if ev.Kind == goxfer.EventListening {
+		select {
+		case e.listening <- ev.Addr:
+		default:
+		}
+	}
+}
+
+func (e *events) find(kind goxfer.EventKind) (goxfer.Event, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, ev := range e.all {
+		if ev.Kind == kind {
+			return ev, true
+		}
+	}
+	return goxfer.Event{}, false
+}
+
+func TestSendReceive(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "report.txt")
+	if err := os.WriteFile(src, []byte("quarterly numbers"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	destDir := t.TempDir()
+
+	recvEvents := newEvents()
+	var offered goxfer.Offer
+	receiver := goxfer.NewReceiver(
+		goxfer.WithListen("127.0.0.1:0", ""),
+		goxfer.WithEvents(recvEvents.record),
+		goxfer.WithAcceptOffer(func(o goxfer.Offer) (bool, error) {
+			offered = o
+			return true, nil
+		}),
+	)
+	recvErr := make(chan error, 1)
+	go func() {
+		recvErr <- receiver.Receive(context.Background(), "", destDir)
+	}()
+
+	var addr string
+	select {
+	case addr = <-recvEvents.listening:
+	case err := <-recvErr:
+		t.Fatalf("receive: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("receiver never started listening")
+	}
+
+	sendEvents := newEvents()
+	sender := goxfer.NewSender(goxfer.WithReceiverAddr(addr), goxfer.WithEvents(sendEvents.record))
+	if err := sender.Send(context.Background(), src); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if err := <-recvErr; err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(destDir, "report.txt"))
+	if err != nil || string(got) != "quarterly numbers" {
+		t.Fatalf("received %q, %v", got, err)
+	}
+	if len(offered.Items) != 1 || offered.Items[0] != "report.txt" || offered.Files != 1 {
+		t.Errorf("offer = %+v, want report.txt alone", offered)
+	}
+	for _, e := range []*events{sendEvents, recvEvents} {
+		verified, ok := e.find(goxfer.EventFileVerified)
+		if !ok || verified.Name != "report.txt" || verified.Checksum == "" {
+			t.Errorf("file_verified = %+v, %v", verified, ok)
+		}
+		if _, ok := e.find(goxfer.EventDone); !ok {
+			t.Error("no done event")
+		}
+	}
+	if verified, _ := recvEvents.find(goxfer.EventFileVerified); verified.Path != filepath.Join(destDir, "report.txt") {
+		t.Errorf("receiver saved at %q", verified.Path)
+	}
+}
+
+func TestReceiveCanceledWhileListening(t *testing.T) {
+	recvEvents := newEvents()
+	receiver := goxfer.NewReceiver(goxfer.WithListen("127.0.0.1:0", ""), goxfer.WithEvents(recvEvents.record))
+	ctx, cancel := context.WithCancel(context.Background())
+	recvErr := make(chan error, 1)
+	go func() {
+		recvErr <- receiver.Receive(ctx, "", t.TempDir())
+	}()
+
+	select {
+	case <-recvEvents.listening:
+	case <-time.After(5 * time.Second):
+		t.Fatal("receiver never started listening")
+	}
+	cancel()
+
+	select {
+	case err := <-recvErr:
+		if !errors.Is(err, goxfer.ErrCanceled) {
+			t.Fatalf("receive = %v, want ErrCanceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("receive did not stop after cancel")
+	}
+	if ev, ok := recvEvents.find(goxfer.EventError); !ok || ev.Error == "" {
+		t.Errorf("error event = %+v, %v", ev, ok)
+	}
+}
+
+func TestReceiverDeclinesWithoutAcceptPolicy(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "payload.bin")
+	if err := os.WriteFile(src, []byte("unasked"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	destDir := t.TempDir()
+
+	recvEvents := newEvents()
+	receiver := goxfer.NewReceiver(goxfer.WithListen("127.0.0.1:0", ""), goxfer.WithEvents(recvEvents.record))
+	recvErr := make(chan error, 1)
+	go func() {
+		recvErr <- receiver.Receive(context.Background(), "", destDir)
+	}()
+
+	var addr string
+	select {
+	case addr = <-recvEvents.listening:
+	case err := <-recvErr:
+		t.Fatalf("receive: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("receiver never started listening")
+	}
+
+	err := goxfer.NewSender(goxfer.WithReceiverAddr(addr)).Send(context.Background(), src)
+	if !errors.Is(err, goxfer.ErrDeclined) {
+		t.Errorf("send = %v, want ErrDeclined", err)
+	}
+	if err := <-recvErr; !errors.Is(err, goxfer.ErrDeclined) {
+		t.Errorf("receive = %v, want ErrDeclined", err)
+	}
+	if entries, _ := os.ReadDir(destDir); len(entries) != 0 {
+		t.Errorf("destination holds %v, want nothing", entries)
+	}
+}
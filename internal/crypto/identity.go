@@ -41,7 +41,13 @@ func GenerateIdentity() (*Identity, error) {
 }
 
 func (i *Identity) Fingerprint() string {
-	sum := sha256.Sum256(append(append([]byte(nil), i.SigningPublicKey...), i.KeyAgreementPublicKey...))
+	return Fingerprint(i.SigningPublicKey, i.KeyAgreementPublicKey)
+}
+
+// Fingerprint returns the colon-separated fingerprint for a pair of public keys.
+// It matches Identity.Fingerprint so a peer's keys can be compared against what they print.
+func Fingerprint(signingPublicKey, keyAgreementPublicKey []byte) string {
+	sum := sha256.Sum256(append(append([]byte(nil), signingPublicKey...), keyAgreementPublicKey...))
 	encoded := strings.ToUpper(hex.EncodeToString(sum[:16]))
 
 	parts := make([]string, 0, len(encoded)/2)
@@ -52,6 +58,34 @@ func (i *Identity) Fingerprint() string {
 	return strings.Join(parts, ":")
 }
 
+// FingerprintsMatch compares two fingerprints, ignoring case, colons and whitespace.
+func FingerprintsMatch(a, b string) bool {
+	na, nb := normalizeFingerprint(a), normalizeFingerprint(b)
+	return na != "" && na == nb
+}
+
+// ParseFingerprint accepts a fingerprint typed by a user (any case, with or
+// without separators) and returns it in the canonical "XX:XX:..." form.
+func ParseFingerprint(fp string) (string, error) {
+	normalized := normalizeFingerprint(fp)
+	if len(normalized) != 32 {
+		return "", fmt.Errorf("fingerprint must be 16 hex byte pairs, got %q", fp)
+	}
+	if _, err := hex.DecodeString(normalized); err != nil {
+		return "", fmt.Errorf("fingerprint is not hex: %q", fp)
+	}
+
+	parts := make([]string, 0, len(normalized)/2)
+	for idx := 0; idx < len(normalized); idx += 2 {
+		parts = append(parts, normalized[idx:idx+2])
+	}
+	return strings.Join(parts, ":"), nil
+}
+
+func normalizeFingerprint(fp string) string {
+	return strings.ToUpper(strings.NewReplacer(":", "", " ", "", "-", "").Replace(strings.TrimSpace(fp)))
+}
+
 func (i *Identity) NoiseStaticKeypair() noise.DHKey {
 	return noise.DHKey{
 		Private: append([]byte(nil), i.KeyAgreementPrivateKey...),
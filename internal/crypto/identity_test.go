@@ -73,3 +73,45 @@ func TestSignedStaticKey(t *testing.T) {
 		t.Fatal("signature verification failed")
 	}
 }
+
+func TestFingerprintsMatch(t *testing.T) {
+	id, _ := GenerateIdentity()
+	fp := id.Fingerprint()
+
+	if !FingerprintsMatch(fp, fp) {
+		t.Fatal("identical fingerprints should match")
+	}
+	if !FingerprintsMatch(fp, strings.ToLower(strings.ReplaceAll(fp, ":", ""))) {
+		t.Fatal("fingerprint should match regardless of case and separators")
+	}
+	if Fingerprint(id.SigningPublicKey, id.KeyAgreementPublicKey) != fp {
+		t.Fatal("Fingerprint(keys) differs from Identity.Fingerprint")
+	}
+
+	other, _ := GenerateIdentity()
+	if FingerprintsMatch(fp, other.Fingerprint()) {
+		t.Fatal("different fingerprints should not match")
+	}
+	if FingerprintsMatch("", "") {
+		t.Fatal("empty fingerprints should not match")
+	}
+}
+
+func TestParseFingerprint(t *testing.T) {
+	id, _ := GenerateIdentity()
+	fp := id.Fingerprint()
+
+	got, err := ParseFingerprint(strings.ToLower(strings.ReplaceAll(fp, ":", "")))
+	if err != nil {
+		t.Fatalf("ParseFingerprint: %v", err)
+	}
+	if got != fp {
+		t.Fatalf("got %s, want %s", got, fp)
+	}
+
+	for _, bad := range []string{"", "AB:CD", strings.Repeat("ZZ", 16)} {
+		if _, err := ParseFingerprint(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package crypto
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+const keystoreVersion = 1
+
+// scrypt parameters for passphrase-protected identities.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// Limits on the scrypt parameters accepted from an identity file, so a
+// crafted file cannot make loading it take gigabytes of memory. scrypt
+// needs 128*N*R bytes.
+const (
+	maxScryptN   = 1 << 20
+	maxScryptR   = 32
+	maxScryptP   = 16
+	maxScryptMem = 256 << 20
+)
+
+var (
+	// ErrPassphraseRequired is returned by LoadIdentity when the identity file
+	// is encrypted and no passphrase was supplied.
+	ErrPassphraseRequired = errors.New("identity is encrypted: passphrase required")
+	// ErrWrongPassphrase is returned when the passphrase does not decrypt the identity.
+	ErrWrongPassphrase = errors.New("wrong passphrase for identity")
+)
+
+// storedIdentity is the on-disk representation of an Identity. Only the
+// private halves are stored; public keys are derived on load.
+type storedIdentity struct {
+	Version      int            `json:"version"`
+	Fingerprint  string         `json:"fingerprint"`
+	SigningSeed  []byte         `json:"signing_seed,omitempty"`
+	KeyAgreement []byte         `json:"key_agreement,omitempty"`
+	Encrypted    *encryptedKeys `json:"encrypted,omitempty"`
+}
+
+type encryptedKeys struct {
+	KDF        string `json:"kdf"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// DefaultIdentityPath returns the default keystore location,
+// e.g. ~/.config/goxfer/identity on Linux.
+func DefaultIdentityPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("resolve config directory: %w", err)
+	}
+	return filepath.Join(dir, "goxfer", "identity"), nil
+}
+
+// SaveIdentity writes id to path with 0600 permissions. When passphrase is
+// non-empty the private keys are encrypted with a scrypt-derived key.
+func SaveIdentity(path string, id *Identity, passphrase []byte) error {
+	if err := id.Validate(); err != nil {
+		return err
+	}
+
+	stored := storedIdentity{
+		Version:     keystoreVersion,
+		Fingerprint: id.Fingerprint(),
+	}
+	secret := append(append([]byte(nil), id.SigningPrivateKey.Seed()...), id.KeyAgreementPrivateKey...)
+
+	if len(passphrase) > 0 {
+		enc, err := encryptKeys(secret, passphrase)
+		if err != nil {
+			return err
+		}
+		stored.Encrypted = enc
+	} else {
+		stored.SigningSeed = secret[:ed25519.SeedSize]
+		stored.KeyAgreement = secret[ed25519.SeedSize:]
+	}
+
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal identity: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("create identity directory: %w", err)
+	}
+
+	// Write to a temp file and rename so a crash never leaves a truncated key.
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".identity-*")
+	if err != nil {
+		return fmt.Errorf("create identity file: %w", err)
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return fmt.Errorf("set identity permissions: %w", err)
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write identity: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write identity: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("save identity: %w", err)
+	}
+	return nil
+}
+
+// LoadIdentity reads an identity written by SaveIdentity. It returns
+// ErrPassphraseRequired if the file is encrypted and passphrase is empty.
+func LoadIdentity(path string, passphrase []byte) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var stored storedIdentity
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("parse identity %s: %w", path, err)
+	}
+	if stored.Version != keystoreVersion {
+		return nil, fmt.Errorf("unsupported identity version %d", stored.Version)
+	}
+
+	var seed, keyAgreement []byte
+	if stored.Encrypted != nil {
+		if len(passphrase) == 0 {
+			return nil, ErrPassphraseRequired
+		}
+		secret, err := decryptKeys(stored.Encrypted, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		if len(secret) != ed25519.SeedSize+32 {
+			return nil, fmt.Errorf("invalid encrypted identity length: %d", len(secret))
+		}
+		seed, keyAgreement = secret[:ed25519.SeedSize], secret[ed25519.SeedSize:]
+	} else {
+		seed, keyAgreement = stored.SigningSeed, stored.KeyAgreement
+	}
+
+	id, err := identityFromPrivateKeys(seed, keyAgreement)
+	if err != nil {
+		return nil, fmt.Errorf("load identity %s: %w", path, err)
+	}
+	if stored.Fingerprint != "" && stored.Fingerprint != id.Fingerprint() {
+		return nil, fmt.Errorf("identity %s: stored fingerprint does not match keys", path)
+	}
+	return id, nil
+}
+
+// IsIdentityEncrypted reports whether the identity at path is passphrase protected.
+func IsIdentityEncrypted(path string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	var stored storedIdentity
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return false, fmt.Errorf("parse identity %s: %w", path, err)
+	}
+	return stored.Encrypted != nil, nil
+}
+
+func identityFromPrivateKeys(seed, keyAgreementPrivateKey []byte) (*Identity, error) {
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid ed25519 seed size: %d", len(seed))
+	}
+	signingPrivateKey := ed25519.NewKeyFromSeed(seed)
+
+	keyAgreement, err := ecdh.X25519().NewPrivateKey(keyAgreementPrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("parse x25519 private key: %w", err)
+	}
+
+	id := &Identity{
+		SigningPrivateKey:      signingPrivateKey,
+		SigningPublicKey:       signingPrivateKey.Public().(ed25519.PublicKey),
+		KeyAgreementPrivateKey: append([]byte(nil), keyAgreement.Bytes()...),
+		KeyAgreementPublicKey:  append([]byte(nil), keyAgreement.PublicKey().Bytes()...),
+	}
+	if err := id.Validate(); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+func encryptKeys(secret, passphrase []byte) (*encryptedKeys, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("generate salt: %w", err)
+	}
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("derive key: %w", err)
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, fmt.Errorf("create cipher: %w", err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generate nonce: %w", err)
+	}
+
+	return &encryptedKeys{
+		KDF:        "scrypt",
+		N:          scryptN,
+		R:          scryptR,
+		P:          scryptP,
+		Salt:       salt,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, secret, nil),
+	}, nil
+}
+
+func decryptKeys(enc *encryptedKeys, passphrase []byte) ([]byte, error) {
+	if enc.KDF != "scrypt" {
+		return nil, fmt.Errorf("unsupported identity kdf %q", enc.KDF)
+	}
+	if err := checkScryptParams(enc.N, enc.R, enc.P); err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key(passphrase, enc.Salt, enc.N, enc.R, enc.P, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("derive key: %w", err)
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, fmt.Errorf("create cipher: %w", err)
+	}
+	if len(enc.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid identity nonce size: %d", len(enc.Nonce))
+	}
+	secret, err := aead.Open(nil, enc.Nonce, enc.Ciphertext, nil)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return secret, nil
+}
+
+// checkScryptParams rejects scrypt parameters outside the limits above.
+func checkScryptParams(n, r, p int) error {
+	if n < 2 || n&(n-1) != 0 || n > maxScryptN ||
+		r < 1 || r > maxScryptR || p < 1 || p > maxScryptP ||
+		128*int64(n)*int64(r) > maxScryptMem {
+		return fmt.Errorf("identity scrypt parameters out of range (n=%d r=%d p=%d)", n, r, p)
+	}
+	return nil
+}
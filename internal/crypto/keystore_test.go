@@ -0,0 +1,107 @@
+package crypto
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSaveLoadIdentity_Plain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "goxfer", "identity")
+	id, _ := GenerateIdentity()
+
+	if err := SaveIdentity(path, id, nil); err != nil {
+		t.Fatalf("SaveIdentity: %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat identity: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Fatalf("identity permissions = %o, want 600", perm)
+	}
+
+	loaded, err := LoadIdentity(path, nil)
+	if err != nil {
+		t.Fatalf("LoadIdentity: %v", err)
+	}
+	if loaded.Fingerprint() != id.Fingerprint() {
+		t.Fatalf("fingerprint changed across save/load: got %s, want %s", loaded.Fingerprint(), id.Fingerprint())
+	}
+	if err := loaded.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+}
+
+func TestSaveLoadIdentity_Encrypted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity")
+	id, _ := GenerateIdentity()
+	passphrase := []byte("correct horse battery staple")
+
+	if err := SaveIdentity(path, id, passphrase); err != nil {
+		t.Fatalf("SaveIdentity: %v", err)
+	}
+
+	encrypted, err := IsIdentityEncrypted(path)
+	if err != nil {
+		t.Fatalf("IsIdentityEncrypted: %v", err)
+	}
+	if !encrypted {
+		t.Fatal("expected identity to be encrypted")
+	}
+
+	if _, err := LoadIdentity(path, nil); !errors.Is(err, ErrPassphraseRequired) {
+		t.Fatalf("load without passphrase: got %v, want ErrPassphraseRequired", err)
+	}
+	if _, err := LoadIdentity(path, []byte("wrong")); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("load with wrong passphrase: got %v, want ErrWrongPassphrase", err)
+	}
+
+	loaded, err := LoadIdentity(path, passphrase)
+	if err != nil {
+		t.Fatalf("LoadIdentity: %v", err)
+	}
+	if loaded.Fingerprint() != id.Fingerprint() {
+		t.Fatalf("fingerprint changed across save/load: got %s, want %s", loaded.Fingerprint(), id.Fingerprint())
+	}
+}
+
+func TestLoadIdentity_Missing(t *testing.T) {
+	_, err := LoadIdentity(filepath.Join(t.TempDir(), "nope"), nil)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("got %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestLoadIdentity_RejectsCostlyScryptParams(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity")
+	id, _ := GenerateIdentity()
+	if err := SaveIdentity(path, id, []byte("pw")); err != nil {
+		t.Fatalf("SaveIdentity: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, params := range [][2]string{
+		{`"n": 32768`, `"n": 1073741824`},
+		{`"n": 32768`, `"n": 1000`},
+		{`"r": 8`, `"r": 4096`},
+		{`"p": 1`, `"p": 0`},
+	} {
+		crafted := strings.Replace(string(data), params[0], params[1], 1)
+		if crafted == string(data) {
+			t.Fatalf("identity file has no %s", params[0])
+		}
+		if err := os.WriteFile(path, []byte(crafted), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadIdentity(path, []byte("pw")); err == nil || errors.Is(err, ErrWrongPassphrase) {
+			t.Errorf("%s: got %v, want parameter error", params[1], err)
+		}
+	}
+}
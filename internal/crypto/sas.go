@@ -0,0 +1,74 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// SASLength is the number of symbols in a short authentication string.
+// Each symbol carries 6 bits, so 7 symbols give 42 bits.
+const SASLength = 7
+
+// SASSymbol is one emoji/word pair of a short authentication string.
+type SASSymbol struct {
+	Emoji string
+	Word  string
+}
+
+// sasSymbols is the 64-entry table used to render a short authentication
+// string. It follows the emoji list used for SAS verification in Matrix.
+var sasSymbols = [64]SASSymbol{
+	{"🐶", "Dog"}, {"🐱", "Cat"}, {"🦁", "Lion"}, {"🐎", "Horse"},
+	{"🦄", "Unicorn"}, {"🐷", "Pig"}, {"🐘", "Elephant"}, {"🐰", "Rabbit"},
+	{"🐼", "Panda"}, {"🐓", "Rooster"}, {"🐧", "Penguin"}, {"🐢", "Turtle"},
+	{"🐟", "Fish"}, {"🐙", "Octopus"}, {"🦋", "Butterfly"}, {"🌷", "Flower"},
+	{"🌳", "Tree"}, {"🌵", "Cactus"}, {"🍄", "Mushroom"}, {"🌏", "Globe"},
+	{"🌙", "Moon"}, {"☁️", "Cloud"}, {"🔥", "Fire"}, {"🍌", "Banana"},
+	{"🍎", "Apple"}, {"🍓", "Strawberry"}, {"🌽", "Corn"}, {"🍕", "Pizza"},
+	{"🎂", "Cake"}, {"❤️", "Heart"}, {"😀", "Smiley"}, {"🤖", "Robot"},
+	{"🎩", "Hat"}, {"👓", "Glasses"}, {"🔧", "Spanner"}, {"🎅", "Santa"},
+	{"👍", "Thumbs Up"}, {"☂️", "Umbrella"}, {"⌛", "Hourglass"}, {"⏰", "Clock"},
+	{"🎁", "Gift"}, {"💡", "Light Bulb"}, {"📕", "Book"}, {"✏️", "Pencil"},
+	{"📎", "Paperclip"}, {"✂️", "Scissors"}, {"🔒", "Lock"}, {"🔑", "Key"},
+	{"🔨", "Hammer"}, {"☎️", "Telephone"}, {"🏁", "Flag"}, {"🚂", "Train"},
+	{"🚲", "Bicycle"}, {"✈️", "Aeroplane"}, {"🚀", "Rocket"}, {"🏆", "Trophy"},
+	{"⚽", "Ball"}, {"🎸", "Guitar"}, {"🎺", "Trumpet"}, {"🔔", "Bell"},
+	{"⚓", "Anchor"}, {"🎧", "Headphones"}, {"📁", "Folder"}, {"📌", "Pin"},
+}
+
+// ShortAuthString derives a short authentication string from a Noise
+// handshake hash. Both peers of the same session derive the same symbols;
+// a man-in-the-middle ends up with two different handshakes and so two
+// different strings.
+func ShortAuthString(handshakeHash []byte) []SASSymbol {
+	var bits [6]byte // 48 bits, 42 used
+	r := hkdf.New(sha256.New, handshakeHash, nil, []byte("goxfer short authentication string"))
+	if _, err := io.ReadFull(r, bits[:]); err != nil {
+		// hkdf only fails when asked for more than 255 hash lengths.
+		panic(err)
+	}
+
+	var acc uint64
+	for _, b := range bits {
+		acc = acc<<8 | uint64(b)
+	}
+
+	symbols := make([]SASSymbol, SASLength)
+	for i := range symbols {
+		shift := 48 - 6*(i+1)
+		symbols[i] = sasSymbols[(acc>>shift)&0x3f]
+	}
+	return symbols
+}
+
+// FormatSAS renders symbols as "🐶 Dog  🔑 Key  ..." for display.
+func FormatSAS(symbols []SASSymbol) string {
+	parts := make([]string, len(symbols))
+	for i, s := range symbols {
+		parts[i] = s.Emoji + " " + s.Word
+	}
+	return strings.Join(parts, "  ")
+}
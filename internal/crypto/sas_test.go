@@ -0,0 +1,29 @@
+package crypto
+
+import "testing"
+
+func TestShortAuthString(t *testing.T) {
+	hashA := make([]byte, 32)
+	hashB := make([]byte, 32)
+	hashB[31] = 1
+
+	a1 := ShortAuthString(hashA)
+	a2 := ShortAuthString(hashA)
+	if len(a1) != SASLength {
+		t.Fatalf("got %d symbols, want %d", len(a1), SASLength)
+	}
+	if FormatSAS(a1) != FormatSAS(a2) {
+		t.Fatal("short authentication string is not deterministic")
+	}
+	if FormatSAS(a1) == FormatSAS(ShortAuthString(hashB)) {
+		t.Fatal("different handshake hashes produced the same string")
+	}
+
+	seen := map[string]bool{}
+	for _, s := range sasSymbols {
+		if seen[s.Word] {
+			t.Fatalf("duplicate SAS word %q", s.Word)
+		}
+		seen[s.Word] = true
+	}
+}
@@ -0,0 +1,379 @@
+// Package mux multiplexes independent, flow-controlled streams over a single
+// encrypted session, so several files can be transferred at once and control
+// messages never wait behind bulk data.
+//
+// Every frame on the underlying session starts with a 5-byte header:
+//
+//	type (1) | stream ID (4, big-endian)
+//
+// followed by a type-specific body. Data on each stream is limited by a
+// receive window that the reader grows as it consumes data, so one slow
+// stream cannot starve the others or exhaust memory. Control messages use a
+// separate lane that is written ahead of any queued stream data.
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/JonathanInTheClouds/goxfer/internal/protocol"
+)
+
+// Frame types.
+const (
+	frameOpen    byte = 1 // open a new stream
+	frameData    byte = 2 // stream data
+	frameWindow  byte = 3 // 4-byte receive window increment
+	frameClose   byte = 4 // sender will write no more data on the stream
+	frameReset   byte = 5 // abort the stream; body is a reason
+	frameControl byte = 6 // control-lane protocol message; stream ID is 0
+)
+
+const headerSize = 5
+
+// maxDataSize is the most stream data carried by one frame. It leaves room
+// for the mux header and the session's frame type and authentication tag.
+const maxDataSize = protocol.MaxFrameSize - 64
+
+// initialWindow is how many unread bytes a stream may have in flight.
+const initialWindow = 1 << 20
+
+// Limits on what the peer can make this side queue: streams it opened that
+// have not been accepted yet, and control messages not yet received.
+const (
+	maxPendingStreams = 256
+	maxQueuedMessages = 256
+)
+
+// ErrClosed is returned by operations on a closed session.
+var ErrClosed = errors.New("mux session closed")
+
+// FrameConn is the transport a Session runs over. *session.SecureSession
+// implements it. ReadFrame must return a new buffer each time, since stream
+// data is kept without copying until it is read.
+type FrameConn interface {
+	WriteFrame(payload []byte) error
+	ReadFrame() ([]byte, error)
+	Close() error
+}
+
+// writeRequest is one frame for the writer goroutine. done, when set,
+// receives the write result; stream data is not waited for, and a failed
+// write surfaces as a session error on the next call instead.
+type writeRequest struct {
+	frame []byte
+	done  chan error
+}
+
+// Session multiplexes streams over a FrameConn. Both peers must create their
+// Session at the same point in the conversation; after that the FrameConn
+// must not be used directly.
+type Session struct {
+	conn FrameConn
+
+	control chan writeRequest // written before data
+	data    chan writeRequest
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	streams  map[uint32]*Stream
+	nextID   uint32
+	accepted []*Stream
+	messages []protocol.Message
+	err      error // set once the session is closed
+
+	closed     chan struct{}
+	closeOnce  sync.Once
+	writerDone chan struct{} // closed when writeLoop returns
+}
+
+// New starts a Session over conn. Exactly one side must pass initiator=true
+// so the two sides never pick the same stream ID.
+func New(conn FrameConn, initiator bool) *Session {
+	s := &Session{
+		conn:       conn,
+		control:    make(chan writeRequest, 64),
+		data:       make(chan writeRequest),
+		streams:    make(map[uint32]*Stream),
+		nextID:     2,
+		closed:     make(chan struct{}),
+		writerDone: make(chan struct{}),
+	}
+	if initiator {
+		s.nextID = 1
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	go s.writeLoop()
+	go s.readLoop()
+	return s
+}
+
+// OpenStream opens a new stream to the peer.
+func (s *Session) OpenStream() (*Stream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		err := s.err
+		s.mu.Unlock()
+		return nil, err
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if err := s.write(s.data, header(frameOpen, id, 0)); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// AcceptStream waits for the peer to open a stream.
+func (s *Session) AcceptStream() (*Stream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.accepted) == 0 {
+		if s.err != nil {
+			return nil, s.err
+		}
+		s.cond.Wait()
+	}
+	st := s.accepted[0]
+	s.accepted = s.accepted[1:]
+	return st, nil
+}
+
+// SendMessage sends msg on the control lane, ahead of any queued stream data.
+func (s *Session) SendMessage(msg protocol.Message) error {
+	payload, err := protocol.EncodeMessage(msg)
+	if err != nil {
+		return err
+	}
+	frame := append(header(frameControl, 0, len(payload)), payload...)
+	return s.write(s.control, frame)
+}
+
+// ReceiveMessage returns the next control-lane message. Messages that
+// arrived before the session closed are still returned.
+func (s *Session) ReceiveMessage() (protocol.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.messages) == 0 {
+		if s.err != nil {
+			return protocol.Message{}, s.err
+		}
+		s.cond.Wait()
+	}
+	msg := s.messages[0]
+	s.messages = s.messages[1:]
+	return msg, nil
+}
+
+// Close closes the session and the underlying connection. Blocked stream
+// operations return ErrClosed.
+func (s *Session) Close() error {
+	s.fail(ErrClosed)
+	return nil
+}
+
+// Done returns a channel that is closed when the session closes.
+func (s *Session) Done() <-chan struct{} {
+	return s.closed
+}
+
+// Err returns why the session closed, or nil while it is open.
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// fail closes the session with err; only the first error is kept.
+func (s *Session) fail(err error) {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		streams := make([]*Stream, 0, len(s.streams))
+		for _, st := range s.streams {
+			streams = append(streams, st)
+		}
+		s.cond.Broadcast()
+		s.mu.Unlock()
+
+		close(s.closed)
+		s.conn.Close()
+		for _, st := range streams {
+			st.fail(err)
+		}
+	})
+}
+
+// write queues frame on lane and waits until it has been written. A frame
+// the writer already sent is reported as written even if the session closed
+// straight afterwards.
+func (s *Session) write(lane chan writeRequest, frame []byte) error {
+	req := writeRequest{frame: frame, done: make(chan error, 1)}
+	select {
+	case lane <- req:
+	case <-s.closed:
+		return s.Err()
+	}
+	select {
+	case err := <-req.done:
+		return err
+	case <-s.writerDone:
+		select {
+		case err := <-req.done:
+			return err
+		default:
+			return s.Err()
+		}
+	}
+}
+
+// send queues frame on lane without waiting for it to be written, so bulk
+// data costs one hand-off to the writer per frame. It fails only if the
+// session has already closed.
+func (s *Session) send(lane chan writeRequest, frame []byte) error {
+	select {
+	case lane <- writeRequest{frame: frame}:
+		return nil
+	case <-s.closed:
+		return s.Err()
+	}
+}
+
+// writeLoop is the only writer on conn. Control frames always go first.
+func (s *Session) writeLoop() {
+	defer close(s.writerDone)
+	for {
+		var req writeRequest
+		select {
+		case req = <-s.control:
+		default:
+			select {
+			case req = <-s.control:
+			case req = <-s.data:
+			case <-s.closed:
+				return
+			}
+		}
+
+		err := s.conn.WriteFrame(req.frame)
+		if req.done != nil {
+			req.done <- err
+		}
+		if err != nil {
+			s.fail(err)
+			return
+		}
+	}
+}
+
+// readLoop is the only reader on conn. It never blocks on a stream, so
+// frames for other streams and the control lane keep flowing.
+func (s *Session) readLoop() {
+	for {
+		frame, err := s.conn.ReadFrame()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.EOF
+			}
+			s.fail(err)
+			return
+		}
+		if err := s.handleFrame(frame); err != nil {
+			s.fail(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handleFrame(frame []byte) error {
+	if len(frame) < headerSize {
+		return errors.New("mux: truncated frame header")
+	}
+	kind, id, body := frame[0], binary.BigEndian.Uint32(frame[1:5]), frame[headerSize:]
+
+	if kind == frameControl {
+		msg, err := protocol.DecodeMessage(body)
+		if err != nil {
+			return fmt.Errorf("mux: control message: %w", err)
+		}
+		s.mu.Lock()
+		if len(s.messages) >= maxQueuedMessages {
+			s.mu.Unlock()
+			return fmt.Errorf("mux: peer sent more than %d control messages that were not received", maxQueuedMessages)
+		}
+		s.messages = append(s.messages, msg)
+		s.cond.Broadcast()
+		s.mu.Unlock()
+		return nil
+	}
+
+	s.mu.Lock()
+	st := s.streams[id]
+	if kind == frameOpen {
+		switch {
+		case st != nil:
+			s.mu.Unlock()
+			return fmt.Errorf("mux: stream %d opened twice", id)
+		case id == 0 || id%2 == s.nextID%2:
+			// Each side opens streams of its own parity only.
+			s.mu.Unlock()
+			return fmt.Errorf("mux: peer opened stream %d, which only this side may open", id)
+		case len(s.accepted) >= maxPendingStreams:
+			s.mu.Unlock()
+			return fmt.Errorf("mux: peer opened more than %d streams that were not accepted", maxPendingStreams)
+		}
+		st = newStream(s, id)
+		s.streams[id] = st
+		s.accepted = append(s.accepted, st)
+		s.cond.Broadcast()
+		s.mu.Unlock()
+		return nil
+	}
+	s.mu.Unlock()
+
+	if st == nil {
+		// Late frames for a stream that has already been torn down.
+		return nil
+	}
+
+	switch kind {
+	case frameData:
+		return st.receiveData(body)
+	case frameWindow:
+		if len(body) != 4 {
+			return errors.New("mux: bad window update")
+		}
+		st.growWindow(binary.BigEndian.Uint32(body))
+	case frameClose:
+		st.receiveClose()
+	case frameReset:
+		st.fail(fmt.Errorf("stream reset by peer: %s", body))
+		s.forget(id)
+	default:
+		return fmt.Errorf("mux: unknown frame type %d", kind)
+	}
+	return nil
+}
+
+// forget drops a finished stream from the session.
+func (s *Session) forget(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+// header returns a frame header with room for bodyLen more bytes.
+func header(kind byte, id uint32, bodyLen int) []byte {
+	frame := make([]byte, headerSize, headerSize+bodyLen)
+	frame[0] = kind
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	return frame
+}
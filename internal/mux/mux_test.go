@@ -0,0 +1,286 @@
+package mux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JonathanInTheClouds/goxfer/internal/protocol"
+)
+
+// pipeConn carries plaintext frames over net.Pipe in place of a SecureSession.
+type pipeConn struct {
+	net.Conn
+}
+
+func (c pipeConn) WriteFrame(payload []byte) error {
+	frame, err := protocol.EncodeFrame(payload)
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(frame)
+	return err
+}
+
+func (c pipeConn) ReadFrame() ([]byte, error) {
+	return protocol.DecodeFrame(c.Conn)
+}
+
+func makeSessions(t *testing.T) (a, b *Session) {
+	t.Helper()
+	connA, connB := net.Pipe()
+	a, b = New(pipeConn{connA}, true), New(pipeConn{connB}, false)
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a, b
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestStream_RoundTripLargerThanWindow(t *testing.T) {
+	a, b := makeSessions(t)
+	want := randomBytes(t, 3*initialWindow+123)
+
+	go func() {
+		st, err := a.OpenStream()
+		if err != nil {
+			return
+		}
+		st.Write(want)
+		st.Close()
+	}()
+
+	st, err := b.AcceptStream()
+	if err != nil {
+		t.Fatalf("AcceptStream: %v", err)
+	}
+	got, err := io.ReadAll(st)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("stream data mismatch: got %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func TestStreams_Concurrent(t *testing.T) {
+	a, b := makeSessions(t)
+	const streams = 4
+	payloads := make([][]byte, streams)
+	for i := range payloads {
+		payloads[i] = randomBytes(t, 2*initialWindow+i)
+	}
+
+	for i := range payloads {
+		go func(data []byte) {
+			st, err := a.OpenStream()
+			if err != nil {
+				return
+			}
+			st.Write(data)
+			st.Close()
+		}(payloads[i])
+	}
+
+	var wg sync.WaitGroup
+	results := make(chan []byte, streams)
+	for i := 0; i < streams; i++ {
+		st, err := b.AcceptStream()
+		if err != nil {
+			t.Fatalf("AcceptStream: %v", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, _ := io.ReadAll(st)
+			results <- data
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	seen := 0
+	for got := range results {
+		for _, want := range payloads {
+			if bytes.Equal(got, want) {
+				seen++
+				break
+			}
+		}
+	}
+	if seen != streams {
+		t.Fatalf("%d of %d streams arrived intact", seen, streams)
+	}
+}
+
+func TestControl_NotBlockedByStalledStream(t *testing.T) {
+	a, b := makeSessions(t)
+
+	st, err := a.OpenStream()
+	if err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	wrote := make(chan struct{})
+	go func() {
+		// Nobody reads the other end, so this fills the window and blocks.
+		st.Write(make([]byte, 2*initialWindow))
+		close(wrote)
+	}()
+
+	select {
+	case <-wrote:
+		t.Fatal("write beyond the receive window should block")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := a.SendMessage(protocol.Message{Type: protocol.MessageTypeCancel, Reason: "stop"}); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	msg, err := b.ReceiveMessage()
+	if err != nil {
+		t.Fatalf("ReceiveMessage: %v", err)
+	}
+	if msg.Type != protocol.MessageTypeCancel || msg.Reason != "stop" {
+		t.Fatalf("control message = %+v", msg)
+	}
+}
+
+func TestStream_Messages(t *testing.T) {
+	a, b := makeSessions(t)
+
+	go func() {
+		st, err := a.OpenStream()
+		if err != nil {
+			return
+		}
+		st.SendMessage(protocol.Message{Type: protocol.MessageTypeFileChunk, FileID: "00000000000000000000000f", Index: 3, Chunk: []byte("data")})
+		st.Close()
+	}()
+
+	st, err := b.AcceptStream()
+	if err != nil {
+		t.Fatalf("AcceptStream: %v", err)
+	}
+	msg, err := st.ReceiveMessage()
+	if err != nil {
+		t.Fatalf("ReceiveMessage: %v", err)
+	}
+	if msg.FileID != "00000000000000000000000f" || msg.Index != 3 || string(msg.Chunk) != "data" {
+		t.Fatalf("message = %+v", msg)
+	}
+	if _, err := st.ReceiveMessage(); !errors.Is(err, io.EOF) {
+		t.Fatalf("after close: got %v, want io.EOF", err)
+	}
+}
+
+func TestSession_CloseUnblocksStreams(t *testing.T) {
+	a, b := makeSessions(t)
+
+	go func() {
+		if st, err := a.OpenStream(); err == nil {
+			st.Write([]byte("partial"))
+		}
+	}()
+	st, err := b.AcceptStream()
+	if err != nil {
+		t.Fatalf("AcceptStream: %v", err)
+	}
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(st)
+		readErr <- err
+	}()
+
+	a.Close()
+	select {
+	case err := <-readErr:
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("read after peer vanished: got %v, want io.ErrUnexpectedEOF", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("stream read did not return after the session closed")
+	}
+}
+
+// rawPeer returns a session and the raw frame connection of its peer, for
+// tests that send frames a well-behaved Session never would.
+func rawPeer(t *testing.T) (*Session, pipeConn) {
+	t.Helper()
+	connA, connB := net.Pipe()
+	s := New(pipeConn{connA}, true)
+	t.Cleanup(func() {
+		s.Close()
+		connB.Close()
+	})
+	// Drain what the session writes so it never blocks on the pipe.
+	go io.Copy(io.Discard, connB)
+	return s, pipeConn{connB}
+}
+
+func waitFailed(t *testing.T, s *Session) {
+	t.Helper()
+	select {
+	case <-s.Done():
+		if s.Err() == nil {
+			t.Fatal("session closed without an error")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("session did not fail")
+	}
+}
+
+func TestSession_RejectsStreamOfLocalParity(t *testing.T) {
+	s, peer := rawPeer(t)
+
+	// The initiator opens odd streams, so its peer may only open even ones.
+	if err := peer.WriteFrame(header(frameOpen, 3, 0)); err != nil {
+		t.Fatal(err)
+	}
+	waitFailed(t, s)
+}
+
+func TestSession_BoundsPendingStreams(t *testing.T) {
+	s, peer := rawPeer(t)
+
+	go func() {
+		for id := uint32(2); id <= 2*(maxPendingStreams+1); id += 2 {
+			if peer.WriteFrame(header(frameOpen, id, 0)) != nil {
+				return
+			}
+		}
+	}()
+	waitFailed(t, s)
+}
+
+func TestSession_BoundsQueuedMessages(t *testing.T) {
+	s, peer := rawPeer(t)
+
+	payload, err := protocol.EncodeMessage(protocol.Message{Type: protocol.MessageTypeCancel})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := append(header(frameControl, 0, len(payload)), payload...)
+	go func() {
+		for range maxQueuedMessages + 1 {
+			if peer.WriteFrame(frame) != nil {
+				return
+			}
+		}
+	}()
+	waitFailed(t, s)
+}
@@ -0,0 +1,283 @@
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/JonathanInTheClouds/goxfer/internal/protocol"
+)
+
+// Stream is one logical, ordered, flow-controlled byte stream. Reads and
+// writes may happen concurrently, but only one goroutine should read and
+// one should write at a time.
+type Stream struct {
+	id   uint32
+	sess *Session
+
+	mu           sync.Mutex
+	cond         *sync.Cond
+	queue        [][]byte // received data frames, not yet read
+	buffered     int      // bytes in queue
+	unacked      int      // bytes read since the last window update
+	sendWindow   int      // bytes the peer is ready to receive
+	remoteClosed bool     // peer sent frameClose
+	localClosed  bool     // we sent frameClose
+	err          error    // reset or session failure
+}
+
+func newStream(sess *Session, id uint32) *Stream {
+	st := &Stream{id: id, sess: sess, sendWindow: initialWindow}
+	st.cond = sync.NewCond(&st.mu)
+	return st
+}
+
+// ID returns the stream's identifier, unique within its session.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// Read reads stream data. It returns io.EOF once the peer has closed the
+// stream and all data has been read.
+func (st *Stream) Read(p []byte) (int, error) {
+	st.mu.Lock()
+	if err := st.waitData(); err != nil {
+		st.mu.Unlock()
+		return 0, err
+	}
+	n := 0
+	for n < len(p) && st.buffered > 0 {
+		c := copy(p[n:], st.queue[0])
+		st.consume(c)
+		n += c
+	}
+	increment := st.ack(n)
+	st.mu.Unlock()
+
+	st.updateWindow(increment)
+	return n, nil
+}
+
+// waitData waits until there is data to read, or returns io.EOF or the
+// stream's error once there will be none. st.mu must be held.
+func (st *Stream) waitData() error {
+	for st.buffered == 0 {
+		if st.remoteClosed {
+			return io.EOF
+		}
+		if st.err != nil {
+			return st.err
+		}
+		st.cond.Wait()
+	}
+	return nil
+}
+
+// consume drops the first n queued bytes, which must all be in the first
+// frame. st.mu must be held.
+func (st *Stream) consume(n int) {
+	st.queue[0] = st.queue[0][n:]
+	if len(st.queue[0]) == 0 {
+		st.queue[0] = nil
+		st.queue = st.queue[1:]
+	}
+	st.buffered -= n
+}
+
+// ack records n bytes as read and returns the window increment to send, if
+// one is due. st.mu must be held.
+func (st *Stream) ack(n int) int {
+	st.unacked += n
+	if st.unacked < initialWindow/2 {
+		return 0
+	}
+	increment := st.unacked
+	st.unacked = 0
+	return increment
+}
+
+// updateWindow lets the peer send increment more bytes.
+func (st *Stream) updateWindow(increment int) {
+	if increment == 0 {
+		return
+	}
+	frame := header(frameWindow, st.id, 4)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(increment))
+	// A failed update surfaces as a session error on the next call.
+	st.sess.write(st.sess.control, frame)
+}
+
+// Write writes p to the stream, blocking while the peer's receive window is
+// full.
+func (st *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n, err := st.reserve(min(len(p), maxDataSize), 1)
+		if err != nil {
+			return written, err
+		}
+		frame := append(header(frameData, st.id, n), p[:n]...)
+		if err := st.sess.send(st.sess.data, frame); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// reserve waits until the peer's receive window has room for at least least
+// bytes, then takes up to want bytes of it.
+func (st *Stream) reserve(want, least int) (int, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for st.sendWindow < least && st.err == nil && !st.localClosed {
+		st.cond.Wait()
+	}
+	if st.err != nil {
+		return 0, st.err
+	}
+	if st.localClosed {
+		return 0, errors.New("write on closed stream")
+	}
+	n := min(want, st.sendWindow)
+	st.sendWindow -= n
+	return n, nil
+}
+
+// Close tells the peer no more data will be written. The peer can still
+// write until it closes its side too.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.localClosed || st.err != nil {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	done := st.remoteClosed
+	st.cond.Broadcast()
+	st.mu.Unlock()
+
+	err := st.sess.write(st.sess.data, header(frameClose, st.id, 0))
+	if done {
+		st.sess.forget(st.id)
+	}
+	return err
+}
+
+// Reset aborts the stream in both directions.
+func (st *Stream) Reset(reason string) error {
+	st.fail(fmt.Errorf("stream reset: %s", reason))
+	st.sess.forget(st.id)
+	frame := append(header(frameReset, st.id, len(reason)), reason...)
+	return st.sess.write(st.sess.control, frame)
+}
+
+// SendMessage writes msg to the stream as a length-prefixed frame, so a
+// stream can carry the same messages as a session. A message that fits in
+// one data frame, such as a file chunk, is encoded straight into it and
+// sent whole.
+func (st *Stream) SendMessage(msg protocol.Message) error {
+	frame := header(frameData, st.id, 4+len(msg.Chunk)+64)
+	frame = append(frame, 0, 0, 0, 0)
+	frame, err := protocol.AppendMessage(frame, msg)
+	if err != nil {
+		return err
+	}
+	size := len(frame) - headerSize - 4
+	if size > protocol.MaxFrameSize {
+		return fmt.Errorf("payload exceeds max frame size of %d bytes", protocol.MaxFrameSize)
+	}
+	binary.BigEndian.PutUint32(frame[headerSize:], uint32(size))
+
+	body := frame[headerSize:]
+	if len(body) > maxDataSize {
+		_, err = st.Write(body)
+		return err
+	}
+	if _, err := st.reserve(len(body), len(body)); err != nil {
+		return err
+	}
+	return st.sess.send(st.sess.data, frame)
+}
+
+// ReceiveMessage reads the next message written with SendMessage. A
+// message that arrived in one data frame is decoded where it lies.
+func (st *Stream) ReceiveMessage() (protocol.Message, error) {
+	st.mu.Lock()
+	if err := st.waitData(); err != nil {
+		st.mu.Unlock()
+		return protocol.Message{}, err
+	}
+	if head := st.queue[0]; len(head) >= 4 {
+		size := int(binary.BigEndian.Uint32(head))
+		if size <= protocol.MaxFrameSize && 4+size <= len(head) {
+			payload := head[4 : 4+size : 4+size]
+			st.consume(4 + size)
+			increment := st.ack(4 + size)
+			st.mu.Unlock()
+			st.updateWindow(increment)
+			return protocol.DecodeMessage(payload)
+		}
+	}
+	st.mu.Unlock()
+
+	payload, err := protocol.DecodeFrame(st)
+	if err != nil {
+		return protocol.Message{}, err
+	}
+	return protocol.DecodeMessage(payload)
+}
+
+func (st *Stream) receiveData(data []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.remoteClosed {
+		return fmt.Errorf("mux: data on stream %d after close", st.id)
+	}
+	if st.buffered+len(data) > initialWindow {
+		return fmt.Errorf("mux: stream %d exceeded its receive window", st.id)
+	}
+	if st.err != nil || len(data) == 0 {
+		// Reset locally; drop the data.
+		return nil
+	}
+	st.queue = append(st.queue, data)
+	st.buffered += len(data)
+	st.cond.Broadcast()
+	return nil
+}
+
+func (st *Stream) growWindow(increment uint32) {
+	st.mu.Lock()
+	st.sendWindow += int(increment)
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+func (st *Stream) receiveClose() {
+	st.mu.Lock()
+	st.remoteClosed = true
+	done := st.localClosed
+	st.cond.Broadcast()
+	st.mu.Unlock()
+	if done {
+		st.sess.forget(st.id)
+	}
+}
+
+// fail ends the stream with err. A session that ends cleanly after the peer
+// closed this stream is not an error for its reader.
+func (st *Stream) fail(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		if errors.Is(err, io.EOF) && !st.remoteClosed {
+			err = io.ErrUnexpectedEOF
+		}
+		st.err = err
+	}
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
@@ -0,0 +1,207 @@
+package peers
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/JonathanInTheClouds/goxfer/internal/crypto"
+)
+
+var aliasPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._@-]*$`)
+
+var (
+	// ErrUnknownPeer is returned when an alias is not in the store.
+	ErrUnknownPeer = errors.New("unknown peer")
+	// ErrPeerExists is returned when adding an alias that is already in the store.
+	ErrPeerExists = errors.New("peer already exists")
+)
+
+// Peer is a single known_peers entry.
+type Peer struct {
+	Alias       string
+	Fingerprint string
+	Added       time.Time
+}
+
+// KnownPeers maps aliases to peer fingerprints, similar to SSH known_hosts.
+// Each line of the file is "<alias> <fingerprint> [added-at]".
+type KnownPeers struct {
+	path  string
+	peers []Peer
+}
+
+// DefaultPath returns the default store location,
+// e.g. ~/.config/goxfer/known_peers on Linux.
+func DefaultPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("resolve config directory: %w", err)
+	}
+	return filepath.Join(dir, "goxfer", "known_peers"), nil
+}
+
+// Load reads the store at path. A missing file is treated as an empty store.
+func Load(path string) (*KnownPeers, error) {
+	k := &KnownPeers{path: path}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open known peers: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected <alias> <fingerprint>", path, lineNo)
+		}
+		fingerprint, err := crypto.ParseFingerprint(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+		peer := Peer{Alias: fields[0], Fingerprint: fingerprint}
+		if len(fields) >= 3 {
+			if added, err := time.Parse(time.RFC3339, fields[2]); err == nil {
+				peer.Added = added
+			}
+		}
+		k.peers = append(k.peers, peer)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read known peers: %w", err)
+	}
+
+	return k, nil
+}
+
+// Path returns the file the store is loaded from and saved to.
+func (k *KnownPeers) Path() string {
+	return k.path
+}
+
+// Save writes the store back to disk with 0600 permissions.
+func (k *KnownPeers) Save() error {
+	var b strings.Builder
+	b.WriteString("# goxfer known peers: <alias> <fingerprint> [added]\n")
+	for _, p := range k.peers {
+		if p.Added.IsZero() {
+			fmt.Fprintf(&b, "%s %s\n", p.Alias, p.Fingerprint)
+		} else {
+			fmt.Fprintf(&b, "%s %s %s\n", p.Alias, p.Fingerprint, p.Added.UTC().Format(time.RFC3339))
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(k.path), 0o700); err != nil {
+		return fmt.Errorf("create known peers directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(k.path), ".known_peers-*")
+	if err != nil {
+		return fmt.Errorf("save known peers: %w", err)
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("save known peers: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("save known peers: %w", err)
+	}
+	if err := os.Chmod(tmpPath, 0o600); err != nil {
+		return fmt.Errorf("save known peers: %w", err)
+	}
+	if err := os.Rename(tmpPath, k.path); err != nil {
+		return fmt.Errorf("save known peers: %w", err)
+	}
+	return nil
+}
+
+// List returns all peers sorted by alias.
+func (k *KnownPeers) List() []Peer {
+	out := append([]Peer(nil), k.peers...)
+	sort.Slice(out, func(i, j int) bool { return out[i].Alias < out[j].Alias })
+	return out
+}
+
+// Lookup returns the peer stored under alias.
+func (k *KnownPeers) Lookup(alias string) (Peer, bool) {
+	for _, p := range k.peers {
+		if p.Alias == alias {
+			return p, true
+		}
+	}
+	return Peer{}, false
+}
+
+// FindByFingerprint returns the first peer whose fingerprint matches fp.
+func (k *KnownPeers) FindByFingerprint(fp string) (Peer, bool) {
+	for _, p := range k.peers {
+		if crypto.FingerprintsMatch(p.Fingerprint, fp) {
+			return p, true
+		}
+	}
+	return Peer{}, false
+}
+
+// Add records a new peer. It fails if alias is already taken.
+func (k *KnownPeers) Add(alias, fingerprint string) error {
+	if !aliasPattern.MatchString(alias) {
+		return fmt.Errorf("invalid alias %q: use letters, digits, '.', '_', '@' or '-'", alias)
+	}
+	fp, err := crypto.ParseFingerprint(fingerprint)
+	if err != nil {
+		return err
+	}
+	if _, ok := k.Lookup(alias); ok {
+		return fmt.Errorf("%w: %s", ErrPeerExists, alias)
+	}
+	k.peers = append(k.peers, Peer{Alias: alias, Fingerprint: fp, Added: time.Now()})
+	return nil
+}
+
+// Remove deletes the peer stored under alias.
+func (k *KnownPeers) Remove(alias string) error {
+	for i, p := range k.peers {
+		if p.Alias == alias {
+			k.peers = append(k.peers[:i], k.peers[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrUnknownPeer, alias)
+}
+
+// Rename changes a peer's alias, keeping its fingerprint.
+func (k *KnownPeers) Rename(oldAlias, newAlias string) error {
+	if !aliasPattern.MatchString(newAlias) {
+		return fmt.Errorf("invalid alias %q: use letters, digits, '.', '_', '@' or '-'", newAlias)
+	}
+	if _, ok := k.Lookup(newAlias); ok {
+		return fmt.Errorf("%w: %s", ErrPeerExists, newAlias)
+	}
+	for i, p := range k.peers {
+		if p.Alias == oldAlias {
+			k.peers[i].Alias = newAlias
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrUnknownPeer, oldAlias)
+}
@@ -0,0 +1,113 @@
+package peers
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/JonathanInTheClouds/goxfer/internal/crypto"
+)
+
+func newFingerprint(t *testing.T) string {
+	t.Helper()
+	id, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("GenerateIdentity: %v", err)
+	}
+	return id.Fingerprint()
+}
+
+func TestKnownPeers_LoadMissing(t *testing.T) {
+	k, err := Load(filepath.Join(t.TempDir(), "known_peers"))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(k.List()) != 0 {
+		t.Fatalf("expected empty store, got %d peers", len(k.List()))
+	}
+}
+
+func TestKnownPeers_SaveLoadRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "goxfer", "known_peers")
+	alice, bob := newFingerprint(t), newFingerprint(t)
+
+	k, _ := Load(path)
+	if err := k.Add("alice", alice); err != nil {
+		t.Fatalf("Add alice: %v", err)
+	}
+	// Fingerprints typed without separators are stored canonically.
+	if err := k.Add("bob", strings.ToLower(strings.ReplaceAll(bob, ":", ""))); err != nil {
+		t.Fatalf("Add bob: %v", err)
+	}
+	if err := k.Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Fatalf("known_peers permissions = %o, want 600", perm)
+	}
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	p, ok := loaded.Lookup("bob")
+	if !ok || p.Fingerprint != bob {
+		t.Fatalf("Lookup bob = %+v, %v; want fingerprint %s", p, ok, bob)
+	}
+	if p.Added.IsZero() {
+		t.Fatal("expected added timestamp to round-trip")
+	}
+	if p, ok := loaded.FindByFingerprint(alice); !ok || p.Alias != "alice" {
+		t.Fatalf("FindByFingerprint alice = %+v, %v", p, ok)
+	}
+}
+
+func TestKnownPeers_AddRemoveRename(t *testing.T) {
+	k, _ := Load(filepath.Join(t.TempDir(), "known_peers"))
+	fp := newFingerprint(t)
+
+	if err := k.Add("alice", fp); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := k.Add("alice", newFingerprint(t)); !errors.Is(err, ErrPeerExists) {
+		t.Fatalf("duplicate Add: got %v, want ErrPeerExists", err)
+	}
+	if err := k.Add("bad alias", fp); err == nil {
+		t.Fatal("expected error for alias with spaces")
+	}
+	if err := k.Add("carol", "not-a-fingerprint"); err == nil {
+		t.Fatal("expected error for invalid fingerprint")
+	}
+
+	if err := k.Rename("alice", "alice-laptop"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if _, ok := k.Lookup("alice"); ok {
+		t.Fatal("old alias still present after rename")
+	}
+	if p, ok := k.Lookup("alice-laptop"); !ok || p.Fingerprint != fp {
+		t.Fatalf("renamed peer = %+v, %v", p, ok)
+	}
+
+	if err := k.Remove("alice-laptop"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if err := k.Remove("alice-laptop"); !errors.Is(err, ErrUnknownPeer) {
+		t.Fatalf("second Remove: got %v, want ErrUnknownPeer", err)
+	}
+}
+
+func TestKnownPeers_LoadRejectsBadLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_peers")
+	os.WriteFile(path, []byte("# comment\nalice\n"), 0o600)
+	if _, err := Load(path); err == nil {
+		t.Fatal("expected error for line without fingerprint")
+	}
+}
@@ -0,0 +1,59 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+)
+
+// chunkTag marks a binary file_chunk encoding. JSON control messages always
+// start with '{', so the first byte tells the two encodings apart.
+const chunkTag byte = 0x01
+
+// chunkHeaderSize is the fixed part of a binary chunk:
+// tag (1) | file ID length (1) | index (4) | payload length (4).
+const chunkHeaderSize = 10
+
+// appendChunk appends a file_chunk packed as:
+//
+//	tag | len(file_id) | index | len(chunk) | file_id | chunk
+//
+// All integers are big-endian. This keeps bulk data out of JSON entirely.
+func appendChunk(dst []byte, message Message) ([]byte, error) {
+	if len(message.FileID) > math.MaxUint8 {
+		return nil, fmt.Errorf("file_chunk file_id longer than %d bytes", math.MaxUint8)
+	}
+	if int64(message.Index) > math.MaxUint32 {
+		return nil, errors.New("file_chunk index out of range")
+	}
+
+	dst = slices.Grow(dst, chunkHeaderSize+len(message.FileID)+len(message.Chunk))
+	dst = append(dst, chunkTag, byte(len(message.FileID)))
+	dst = binary.BigEndian.AppendUint32(dst, uint32(message.Index))
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(message.Chunk)))
+	dst = append(dst, message.FileID...)
+	return append(dst, message.Chunk...), nil
+}
+
+// decodeChunk is the inverse of appendChunk. The returned Chunk aliases payload.
+func decodeChunk(payload []byte) (Message, error) {
+	if len(payload) < chunkHeaderSize || payload[0] != chunkTag {
+		return Message{}, errors.New("truncated file_chunk header")
+	}
+	idLen := int(payload[1])
+	index := binary.BigEndian.Uint32(payload[2:6])
+	dataLen := binary.BigEndian.Uint32(payload[6:10])
+	if uint64(len(payload)) != uint64(chunkHeaderSize)+uint64(idLen)+uint64(dataLen) {
+		return Message{}, fmt.Errorf("file_chunk length mismatch: header says %d+%d bytes, got %d",
+			idLen, dataLen, len(payload)-chunkHeaderSize)
+	}
+
+	return Message{
+		Type:   MessageTypeFileChunk,
+		FileID: string(payload[chunkHeaderSize : chunkHeaderSize+idLen]),
+		Index:  int(index),
+		Chunk:  payload[chunkHeaderSize+idLen:],
+	}, nil
+}
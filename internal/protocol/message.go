@@ -8,39 +8,143 @@ import (
 
 const FileChunkSize = 32 * 1024
 
+// FileIDLength is the length of a file ID: 12 random or derived bytes in
+// lowercase hex. The receiver names resume state files after file IDs, so
+// nothing else is accepted.
+const FileIDLength = 24
+
+// ProtocolVersion is the wire protocol version this build speaks, announced
+// in the hello message. MinProtocolVersion is the oldest version it accepts.
+//
+// Version 2 carries file_chunk in a single binary frame instead of a JSON
+// header frame followed by a raw data frame. Version 3 sends keepalives
+// and rekey markers as typed session frames instead of ping, pong and
+// rekey messages.
+const (
+	ProtocolVersion    = 3
+	MinProtocolVersion = 3
+)
+
+// Capabilities a peer can announce in its hello message.
+const (
+	CapabilityResume    = "resume"
+	CapabilityMux       = "mux"       // streams multiplexed with internal/mux after the offer
+	CapabilityKeepalive = "keepalive" // ping and pong frames while the session is idle
+	CapabilityRekey     = "rekey"     // rekey frames switch to a new key
+	CapabilityTree      = "tree"      // directories sent as a manifest and one file_start per file
+	CapabilitySelect    = "select"    // the receiver answers a manifest with the files it wants
+	CapabilityParallel  = "parallel"  // a manifest's files spread over several mux streams
+	CapabilityBatch     = "batch"     // an offer may list several items; the sender ends with done
+	CapabilityPipe      = "pipe"      // a file of unknown size may be read from a pipe and saved as-is
+)
+
+// MaxLanes is the most extra streams a manifest's files may be spread over.
+const MaxLanes = 4
+
+// HashSHA256 names the checksum algorithm in hello messages.
+const HashSHA256 = "sha256"
+
 const (
 	MessageTypeFileStart    = "file_start"
 	MessageTypeFileChunk    = "file_chunk"
 	MessageTypeFileComplete = "file_complete"
 	MessageTypeFileChecksum = "file_checksum"
 	MessageTypeFileResume   = "file_resume"
+	MessageTypeFileSkip     = "file_skip"
 	MessageTypeReady        = "ready"
+	MessageTypeOffer        = "offer"
+	MessageTypeOfferAccept  = "offer_accept"
+	MessageTypeOfferDecline = "offer_decline"
+	MessageTypeError        = "error"
+	MessageTypeCancel       = "cancel"
+	MessageTypeHello        = "hello"
+	MessageTypeExpose       = "expose"
+	MessageTypeManifest     = "manifest"
+	MessageTypeSelect       = "manifest_select"
+	MessageTypeDone         = "done"
 )
 
+// Error codes carried by an error message.
+const (
+	ErrorCodeChecksumMismatch = "checksum_mismatch"
+	ErrorCodeIO               = "io_error"
+	ErrorCodeProtocol         = "protocol_error"
+	ErrorCodeIncompatible     = "incompatible"
+)
+
+// ManifestEntry is one directory or regular file in a manifest.
+type ManifestEntry struct {
+	Path  string `json:"path"`            // slash-separated, relative to the directory being sent
+	Dir   bool   `json:"dir,omitempty"`   // a directory rather than a regular file
+	Size  int64  `json:"size,omitempty"`  // regular files only
+	Mode  uint32 `json:"mode,omitempty"`  // permission bits
+	MTime int64  `json:"mtime,omitempty"` // modification time in Unix nanoseconds
+}
+
 type Message struct {
-	Type     string `json:"type"`
-	FileID   string `json:"file_id,omitempty"`
-	Name     string `json:"name,omitempty"`
-	Size     int64  `json:"size,omitempty"`
-	Index    int    `json:"index,omitempty"`
-	Chunk    []byte `json:"-"`
-	Checksum string `json:"checksum,omitempty"`
-	Resume   bool   `json:"resume,omitempty"` // file_start: sender supports resume handshake
-	Offset   int64  `json:"offset,omitempty"` // file_resume: byte offset to resume from
+	Type        string `json:"type"`
+	FileID      string `json:"file_id,omitempty"`
+	Name        string `json:"name,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	Index       int    `json:"index,omitempty"`
+	Chunk       []byte `json:"-"`                     // file_chunk: sent in the binary encoding, never JSON
+	Checksum    string `json:"checksum,omitempty"`    // file_checksum, and file_start when resuming
+	Resume      bool   `json:"resume,omitempty"`      // file_start: sender supports resume handshake
+	Pipe        bool   `json:"pipe,omitempty"`        // offer, file_start: data read from a pipe, Size -1 and never an archive
+	Offset      int64  `json:"offset,omitempty"`      // file_resume: byte offset to resume from (Index is the next chunk)
+	Count       int    `json:"count,omitempty"`       // offer: number of files
+	Fingerprint string `json:"fingerprint,omitempty"` // offer: sender's identity fingerprint
+	Reason      string `json:"reason,omitempty"`      // offer_decline, error, cancel: human-readable explanation
+	Code        string `json:"code,omitempty"`        // error: machine-readable error code
+
+	Path    string          `json:"path,omitempty"`    // file_start: location within a manifest's directory
+	Mode    uint32          `json:"mode,omitempty"`    // file_start: permission bits
+	MTime   int64           `json:"mtime,omitempty"`   // file_start: modification time in Unix nanoseconds
+	Entries []ManifestEntry `json:"entries,omitempty"` // manifest: directories first, then files in sending order; manifest_select: files wanted; offer: the items, when more than one
+	Lanes   int             `json:"lanes,omitempty"`   // manifest: extra streams the files arrive on, 0 for this one
+
+	Version      int      `json:"version,omitempty"`        // hello: protocol version
+	Capabilities []string `json:"capabilities,omitempty"`   // hello: optional features, e.g. "resume"
+	Hashes       []string `json:"hashes,omitempty"`         // hello: checksum algorithms, preferred first
+	MaxChunkSize int      `json:"max_chunk_size,omitempty"` // hello: largest file_chunk payload accepted
 }
 
+// EncodeMessage serializes message for one encrypted frame. file_chunk uses
+// a compact binary layout; every other message is JSON.
 func EncodeMessage(message Message) ([]byte, error) {
+	return AppendMessage(nil, message)
+}
+
+// AppendMessage appends the encoding of message to dst. A transport that
+// frames messages itself can encode a file chunk straight into its frame
+// instead of copying it again.
+func AppendMessage(dst []byte, message Message) ([]byte, error) {
 	if err := ValidateMessage(message); err != nil {
 		return nil, err
 	}
+	if message.Type == MessageTypeFileChunk {
+		return appendChunk(dst, message)
+	}
 	payload, err := json.Marshal(message)
 	if err != nil {
 		return nil, fmt.Errorf("marshal protocol message: %w", err)
 	}
-	return payload, nil
+	return append(dst, payload...), nil
 }
 
+// DecodeMessage parses a payload produced by EncodeMessage.
 func DecodeMessage(payload []byte) (Message, error) {
+	if len(payload) > 0 && payload[0] == chunkTag {
+		message, err := decodeChunk(payload)
+		if err != nil {
+			return Message{}, err
+		}
+		if err := ValidateMessage(message); err != nil {
+			return Message{}, err
+		}
+		return message, nil
+	}
+
 	var message Message
 	if err := json.Unmarshal(payload, &message); err != nil {
 		return Message{}, fmt.Errorf("unmarshal protocol message: %w", err)
@@ -52,11 +156,17 @@ func DecodeMessage(payload []byte) (Message, error) {
 }
 
 func ValidateMessage(message Message) error {
+	if message.FileID != "" && !ValidFileID(message.FileID) {
+		return fmt.Errorf("invalid file_id %q: want %d lowercase hex characters", message.FileID, FileIDLength)
+	}
 	switch message.Type {
 	case MessageTypeFileStart:
 		if message.FileID == "" || message.Name == "" || message.Size < -1 {
 			return errors.New("file_start requires file_id, name, and size >= -1")
 		}
+		if message.Pipe && message.Size != -1 {
+			return errors.New("piped file_start requires size -1")
+		}
 	case MessageTypeFileChunk:
 		if message.FileID == "" || message.Index < 0 {
 			return errors.New("file_chunk requires file_id and non-negative index")
@@ -69,14 +179,71 @@ func ValidateMessage(message Message) error {
 		if message.FileID == "" || message.Checksum == "" {
 			return errors.New("file_checksum requires file_id and checksum")
 		}
+	case MessageTypeFileSkip:
+		if message.FileID == "" {
+			return errors.New("file_skip requires file_id")
+		}
 	case MessageTypeFileResume:
 		if message.FileID == "" || message.Offset < 0 {
 			return errors.New("file_resume requires file_id and non-negative offset")
 		}
 	case MessageTypeReady:
 		// no fields required
+	case MessageTypeOffer:
+		if message.Name == "" || message.Size < -1 || message.Count < 1 || message.Fingerprint == "" {
+			return errors.New("offer requires name, size >= -1, count >= 1, and fingerprint")
+		}
+		if message.Pipe && (message.Size != -1 || message.Count != 1 || len(message.Entries) > 0) {
+			return errors.New("piped offer requires size -1 and a single file")
+		}
+		for _, e := range message.Entries {
+			if e.Path == "" || e.Size < 0 {
+				return errors.New("offer entries require path and size >= 0")
+			}
+		}
+	case MessageTypeOfferAccept, MessageTypeOfferDecline:
+		// no fields required
+	case MessageTypeError:
+		if message.Code == "" {
+			return errors.New("error requires code")
+		}
+	case MessageTypeCancel, MessageTypeExpose, MessageTypeDone:
+		// no fields required
+	case MessageTypeManifest:
+		if message.Name == "" || message.Lanes < 0 || message.Lanes > MaxLanes {
+			return fmt.Errorf("manifest requires name and 0 to %d lanes", MaxLanes)
+		}
+		for _, e := range message.Entries {
+			if e.Path == "" || e.Size < 0 {
+				return errors.New("manifest entries require path and size >= 0")
+			}
+		}
+	case MessageTypeSelect:
+		for _, e := range message.Entries {
+			if e.Path == "" {
+				return errors.New("manifest_select entries require path")
+			}
+		}
+	case MessageTypeHello:
+		if message.Version < 1 || len(message.Hashes) == 0 || message.MaxChunkSize <= 0 {
+			return errors.New("hello requires version >= 1, hashes, and max_chunk_size > 0")
+		}
 	default:
 		return fmt.Errorf("unknown protocol message type %q", message.Type)
 	}
 	return nil
 }
+
+// ValidFileID reports whether id is FileIDLength lowercase hex characters.
+func ValidFileID(id string) bool {
+	if len(id) != FileIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
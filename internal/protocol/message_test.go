@@ -1,6 +1,8 @@
 package protocol
 
 import (
+	"bytes"
+	"encoding/json"
 	"testing"
 )
 
@@ -11,28 +13,69 @@ func TestEncodeDecodeMessage_RoundTrip(t *testing.T) {
 	}{
 		{
 			name: "file_start",
-			msg:  Message{Type: MessageTypeFileStart, FileID: "abc123", Name: "test.txt", Size: 1024},
+			msg:  Message{Type: MessageTypeFileStart, FileID: "000000000000000000abc123", Name: "test.txt", Size: 1024},
 		},
 		{
 			name: "file_start streaming",
-			msg:  Message{Type: MessageTypeFileStart, FileID: "abc123", Name: "dir.tar.gz", Size: -1},
+			msg:  Message{Type: MessageTypeFileStart, FileID: "000000000000000000abc123", Name: "dir.tar.gz", Size: -1},
 		},
 		{
 			name: "file_chunk",
-			msg:  Message{Type: MessageTypeFileChunk, FileID: "abc123", Index: 0},
+			msg:  Message{Type: MessageTypeFileChunk, FileID: "000000000000000000abc123", Index: 0},
 		},
 		{
 			name: "file_complete",
-			msg:  Message{Type: MessageTypeFileComplete, FileID: "abc123"},
+			msg:  Message{Type: MessageTypeFileComplete, FileID: "000000000000000000abc123"},
 		},
 		{
 			name: "file_checksum",
-			msg:  Message{Type: MessageTypeFileChecksum, FileID: "abc123", Checksum: "deadbeef"},
+			msg:  Message{Type: MessageTypeFileChecksum, FileID: "000000000000000000abc123", Checksum: "deadbeef"},
+		},
+		{
+			name: "file_skip",
+			msg:  Message{Type: MessageTypeFileSkip, FileID: "000000000000000000abc123"},
 		},
 		{
 			name: "ready",
 			msg:  Message{Type: MessageTypeReady},
 		},
+		{
+			name: "offer",
+			msg:  Message{Type: MessageTypeOffer, Name: "photos", Size: 4096, Count: 3, Fingerprint: "AB:CD"},
+		},
+		{
+			name: "offer_decline",
+			msg:  Message{Type: MessageTypeOfferDecline, Reason: "too big"},
+		},
+		{
+			name: "error",
+			msg:  Message{Type: MessageTypeError, Code: ErrorCodeIO, Reason: "disk full"},
+		},
+		{
+			name: "cancel",
+			msg:  Message{Type: MessageTypeCancel, Reason: "interrupted by user"},
+		},
+		{
+			name: "manifest",
+			msg: Message{Type: MessageTypeManifest, Name: "photos", Entries: []ManifestEntry{
+				{Path: "2024", Dir: true, Mode: 0o755},
+				{Path: "2024/beach.jpg", Size: 2048, Mode: 0o644, MTime: 1700000000000000000},
+			}},
+		},
+		{
+			name: "manifest_select",
+			msg:  Message{Type: MessageTypeSelect, Entries: []ManifestEntry{{Path: "2024/beach.jpg"}}},
+		},
+		{
+			name: "hello",
+			msg: Message{
+				Type:         MessageTypeHello,
+				Version:      ProtocolVersion,
+				Capabilities: []string{CapabilityResume},
+				Hashes:       []string{HashSHA256},
+				MaxChunkSize: FileChunkSize,
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -52,20 +95,46 @@ func TestEncodeDecodeMessage_RoundTrip(t *testing.T) {
 	}
 }
 
-func TestEncodeMessage_ChunkNotInJSON(t *testing.T) {
-	msg := Message{Type: MessageTypeFileChunk, FileID: "abc", Index: 0, Chunk: []byte("secret")}
+func TestEncodeMessage_ChunkIsBinary(t *testing.T) {
+	msg := Message{Type: MessageTypeFileChunk, FileID: "000000000000000000000abc", Index: 7, Chunk: []byte("secret")}
 	encoded, err := EncodeMessage(msg)
 	if err != nil {
 		t.Fatal(err)
 	}
-	// Chunk data must not appear in the JSON output (json:"-" tag)
-	if contains(encoded, []byte("secret")) {
+	if encoded[0] != chunkTag {
+		t.Fatalf("file_chunk should use the binary encoding, got first byte %q", encoded[0])
+	}
+	if want := chunkHeaderSize + len(msg.FileID) + len(msg.Chunk); len(encoded) != want {
+		t.Fatalf("encoded length = %d, want %d", len(encoded), want)
+	}
+
+	got, err := DecodeMessage(encoded)
+	if err != nil {
+		t.Fatalf("DecodeMessage: %v", err)
+	}
+	if got.Type != msg.Type || got.FileID != msg.FileID || got.Index != msg.Index || !bytes.Equal(got.Chunk, msg.Chunk) {
+		t.Fatalf("roundtrip mismatch: got %+v, want %+v", got, msg)
+	}
+
+	// The chunk must never leak into the JSON encoding of a Message.
+	asJSON, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contains(asJSON, []byte("secret")) || contains(asJSON, []byte(`"chunk"`)) {
 		t.Fatal("chunk data leaked into JSON encoding")
 	}
-	// Check for the JSON key "chunk" (with quotes), not just the substring "chunk"
-	// which would falsely match the "file_chunk" type value.
-	if contains(encoded, []byte(`"chunk"`)) {
-		t.Fatal("chunk field appeared as JSON key in encoding")
+}
+
+func TestDecodeMessage_TruncatedChunk(t *testing.T) {
+	encoded, err := EncodeMessage(Message{Type: MessageTypeFileChunk, FileID: "000000000000000000000abc", Chunk: []byte("data")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{1, chunkHeaderSize, len(encoded) - 1} {
+		if _, err := DecodeMessage(encoded[:n]); err == nil {
+			t.Fatalf("expected error decoding %d of %d bytes", n, len(encoded))
+		}
 	}
 }
 
@@ -75,14 +144,26 @@ func TestValidateMessage_Invalid(t *testing.T) {
 		msg  Message
 	}{
 		{"unknown type", Message{Type: "bogus"}},
-		{"file_start missing name", Message{Type: MessageTypeFileStart, FileID: "x", Size: 0}},
+		{"file_start missing name", Message{Type: MessageTypeFileStart, FileID: "00000000000000000000000e", Size: 0}},
 		{"file_start missing file_id", Message{Type: MessageTypeFileStart, Name: "f", Size: 0}},
-		{"file_start bad size", Message{Type: MessageTypeFileStart, FileID: "x", Name: "f", Size: -2}},
+		{"file_start bad size", Message{Type: MessageTypeFileStart, FileID: "00000000000000000000000e", Name: "f", Size: -2}},
+		{"piped file_start with size", Message{Type: MessageTypeFileStart, FileID: "00000000000000000000000e", Name: "f", Size: 10, Pipe: true}},
 		{"file_chunk missing file_id", Message{Type: MessageTypeFileChunk, Index: 0}},
-		{"file_chunk negative index", Message{Type: MessageTypeFileChunk, FileID: "x", Index: -1}},
+		{"file_chunk negative index", Message{Type: MessageTypeFileChunk, FileID: "00000000000000000000000e", Index: -1}},
 		{"file_complete missing file_id", Message{Type: MessageTypeFileComplete}},
-		{"file_checksum missing checksum", Message{Type: MessageTypeFileChecksum, FileID: "x"}},
+		{"file_checksum missing checksum", Message{Type: MessageTypeFileChecksum, FileID: "00000000000000000000000e"}},
 		{"file_checksum missing file_id", Message{Type: MessageTypeFileChecksum, Checksum: "abc"}},
+		{"file_id path traversal", Message{Type: MessageTypeFileStart, FileID: "x/../../../tmp/evil", Name: "f", Size: 0}},
+		{"file_id too short", Message{Type: MessageTypeFileComplete, FileID: "abc123"}},
+		{"file_id uppercase", Message{Type: MessageTypeFileSkip, FileID: "0123456789ABCDEF01234567"}},
+		{"manifest file_id with separator", Message{Type: MessageTypeManifest, Name: "d", FileID: "0123456789abcdef0123/567"}},
+		{"manifest too many lanes", Message{Type: MessageTypeManifest, Name: "d", Lanes: MaxLanes + 1}},
+		{"offer missing fingerprint", Message{Type: MessageTypeOffer, Name: "f", Size: 1, Count: 1}},
+		{"offer zero count", Message{Type: MessageTypeOffer, Name: "f", Size: 1, Fingerprint: "AB"}},
+		{"piped offer of several files", Message{Type: MessageTypeOffer, Name: "f", Size: -1, Count: 2, Fingerprint: "AB", Pipe: true}},
+		{"error missing code", Message{Type: MessageTypeError, Reason: "boom"}},
+		{"hello missing hashes", Message{Type: MessageTypeHello, Version: 1, MaxChunkSize: FileChunkSize}},
+		{"hello zero version", Message{Type: MessageTypeHello, Hashes: []string{HashSHA256}, MaxChunkSize: FileChunkSize}},
 	}
 
 	for _, tt := range tests {
@@ -0,0 +1,140 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/JonathanInTheClouds/goxfer/internal/protocol"
+)
+
+// maxConnWrite is the most plaintext one typed frame can carry.
+const maxConnWrite = protocol.MaxFrameSize - 1 - noiseTagSize
+
+// Conn is a net.Conn that carries a byte stream over a SecureSession, so any
+// TCP protocol can be tunneled through a goxfer connection. Writes larger
+// than one frame are split; reads return frame contents in order, across as
+// many calls as needed.
+//
+// The stream travels in data frames, apart from the frames a session sends
+// for keepalives and rekeying, so no byte sequence is ever mistaken for
+// one. Once a Conn is in use, the session must not carry messages.
+type Conn struct {
+	sess *SecureSession
+
+	readMu sync.Mutex
+	buf    []byte // rest of the last frame
+
+	deadlineMu    sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+var _ net.Conn = (*Conn)(nil)
+
+// NewConn returns a net.Conn over sess. Closing it closes sess. Like
+// SetKeepalive it switches the session to typed frames, so both sides must
+// call it, or enable keepalives or rekeying, before the first Read.
+func NewConn(sess *SecureSession) *Conn {
+	sess.typed.Store(true)
+	return &Conn{sess: sess}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for len(c.buf) == 0 {
+		ctx, cancel := c.deadlineContext(c.getDeadline(&c.readDeadline))
+		frame, err := c.sess.readFrame(ctx)
+		cancel()
+		if err != nil {
+			return 0, connError(err)
+		}
+		c.buf = frame
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), maxConnWrite)
+		ctx, cancel := c.deadlineContext(c.getDeadline(&c.writeDeadline))
+		err := c.sess.writeFrame(ctx, frameData, p[:n])
+		cancel()
+		if err != nil {
+			return written, connError(err)
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (c *Conn) Close() error {
+	return c.sess.Close()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.sess.conn.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.sess.conn.RemoteAddr()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.deadlineMu.Unlock()
+	return nil
+}
+
+// SetReadDeadline applies to Read calls made after it; unlike a socket, it
+// does not interrupt a Read already in progress.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	c.readDeadline = t
+	c.deadlineMu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline applies to Write calls made after it.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	c.writeDeadline = t
+	c.deadlineMu.Unlock()
+	return nil
+}
+
+func (c *Conn) getDeadline(t *time.Time) time.Time {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	return *t
+}
+
+func (c *Conn) deadlineContext(deadline time.Time) (context.Context, context.CancelFunc) {
+	if deadline.IsZero() {
+		return context.Background(), func() {}
+	}
+	return context.WithDeadline(context.Background(), deadline)
+}
+
+// connError maps session errors to what net.Conn users expect: a bare
+// io.EOF at the end of the stream and os.ErrDeadlineExceeded on timeout.
+func connError(err error) error {
+	switch {
+	case errors.Is(err, io.EOF):
+		return io.EOF
+	case errors.Is(err, context.DeadlineExceeded):
+		return os.ErrDeadlineExceeded
+	}
+	return err
+}
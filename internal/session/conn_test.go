@@ -0,0 +1,100 @@
+package session
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestConn_RoundTripLargerThanFrame(t *testing.T) {
+	senderSess, receiverSess := makeSessions(t)
+	a, b := NewConn(senderSess), NewConn(receiverSess)
+
+	want := make([]byte, 5*maxConnWrite+17)
+	if _, err := rand.Read(want); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		a.Write(want)
+		a.Close()
+	}()
+
+	got, err := io.ReadAll(b)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func TestConn_SmallReads(t *testing.T) {
+	senderSess, receiverSess := makeSessions(t)
+	a, b := NewConn(senderSess), NewConn(receiverSess)
+
+	go a.Write([]byte("hello, tunnel"))
+
+	buf := make([]byte, 5)
+	var got []byte
+	for len(got) < len("hello, tunnel") {
+		n, err := b.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if string(got) != "hello, tunnel" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestConn_ReadDeadline(t *testing.T) {
+	senderSess, receiverSess := makeSessions(t)
+	a, b := NewConn(senderSess), NewConn(receiverSess)
+
+	b.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := b.Read(make([]byte, 1))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got %v, want os.ErrDeadlineExceeded", err)
+	}
+
+	// A timeout with nothing in flight leaves the connection usable.
+	b.SetReadDeadline(time.Time{})
+	go a.Write([]byte("x"))
+	buf := make([]byte, 1)
+	if _, err := b.Read(buf); err != nil || buf[0] != 'x' {
+		t.Fatalf("Read after timeout = %q, %v", buf, err)
+	}
+}
+
+func TestConn_SessionFramesStayOutOfTheStream(t *testing.T) {
+	senderSess, receiverSess := makeSessions(t)
+	for _, sess := range []*SecureSession{senderSess, receiverSess} {
+		sess.SetKeepalive(5*time.Millisecond, time.Second)
+		sess.SetRekey(RekeyPolicy{Frames: 2})
+	}
+	a, b := NewConn(senderSess), NewConn(receiverSess)
+
+	// Payloads that look like session frames are only data.
+	want := []byte{framePing, framePong, frameRekey}
+	want = append(want, `{"type":"ping"}`...)
+	go func() {
+		for _, c := range want {
+			a.Write([]byte{c})
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(b, got); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,110 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// DefaultIdleTimeout is how long a session may go without hearing from the
+// peer before it is considered dead.
+const DefaultIdleTimeout = 15 * time.Second
+
+// ErrIdleTimeout is returned when nothing arrives from the peer within the
+// idle timeout set by SetKeepalive.
+var ErrIdleTimeout = errors.New("peer unresponsive")
+
+// SetKeepalive bounds every read and write by timeout and starts sending a
+// ping whenever nothing has been sent for interval. Pings received from the
+// peer are answered with a pong. Pings and pongs are typed frames, so like
+// SetRekey it switches the session to typed frames. Only enable it when the
+// peer understands keepalives (protocol.CapabilityKeepalive), and before
+// the next read; call it at most once. An interval of zero or less sends
+// no pings, though pings from the peer are still answered.
+func (s *SecureSession) SetKeepalive(interval, timeout time.Duration) {
+	s.typed.Store(true)
+	s.idleTimeout.Store(int64(timeout))
+	s.keepaliveOn.Store(true)
+	s.lastSend.Store(time.Now().UnixNano())
+	go s.keepalive(interval)
+}
+
+func (s *SecureSession) keepalive(interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(max(interval/2, time.Nanosecond))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		var kind byte
+		select {
+		case <-s.closed:
+			return
+		case <-s.pongDue:
+			kind = framePong
+		case <-tick:
+			if time.Since(time.Unix(0, s.lastSend.Load())) < interval {
+				continue
+			}
+			kind = framePing
+		}
+		if err := s.writeFrame(context.Background(), kind, nil); err != nil {
+			// The next read or write on the session reports the failure.
+			return
+		}
+	}
+}
+
+func (s *SecureSession) idle() time.Duration {
+	return time.Duration(s.idleTimeout.Load())
+}
+
+// deadline applies the idle timeout to one read or write and interrupts it
+// early if ctx is canceled.
+type deadline struct {
+	ctx     context.Context
+	set     func(time.Time) error
+	timeout time.Duration
+	stopCtx func() bool
+	fired   chan struct{}
+}
+
+func newDeadline(ctx context.Context, set func(time.Time) error, timeout time.Duration) *deadline {
+	d := &deadline{ctx: ctx, set: set, timeout: timeout}
+	if timeout > 0 {
+		set(time.Now().Add(timeout))
+	}
+	if ctx.Done() != nil {
+		d.fired = make(chan struct{})
+		d.stopCtx = context.AfterFunc(ctx, func() {
+			// A deadline in the past makes the blocked call return at once.
+			set(time.Unix(1, 0))
+			close(d.fired)
+		})
+	}
+	return d
+}
+
+// stop clears the deadline and explains err: a canceled context wins over
+// an expired idle timeout.
+func (d *deadline) stop(err error) error {
+	if d.stopCtx != nil && !d.stopCtx() {
+		<-d.fired
+	}
+	if d.timeout > 0 || d.fired != nil {
+		d.set(time.Time{})
+	}
+	if err == nil {
+		return nil
+	}
+	if ctxErr := d.ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) && d.timeout > 0 {
+		return fmt.Errorf("%w: no response for %s", ErrIdleTimeout, d.timeout)
+	}
+	return err
+}
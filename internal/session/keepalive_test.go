@@ -0,0 +1,217 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JonathanInTheClouds/goxfer/internal/protocol"
+)
+
+func TestReceiveMessageContext_Cancel(t *testing.T) {
+	senderSess, receiverSess := makeSessions(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := receiverSess.ReceiveMessageContext(ctx)
+		errCh <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("got %v, want context.Canceled", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ReceiveMessageContext did not return after cancel")
+	}
+
+	// Nothing had arrived, so the session is still usable.
+	go senderSess.SendMessage(protocol.Message{Type: protocol.MessageTypeReady})
+	msg, err := receiverSess.ReceiveMessage()
+	if err != nil {
+		t.Fatalf("ReceiveMessage after cancel: %v", err)
+	}
+	if msg.Type != protocol.MessageTypeReady {
+		t.Fatalf("got %q, want ready", msg.Type)
+	}
+}
+
+func TestSendMessageContext_AlreadyCanceled(t *testing.T) {
+	senderSess, _ := makeSessions(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := senderSess.SendMessageContext(ctx, protocol.Message{Type: protocol.MessageTypeReady})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+}
+
+func TestKeepalive_IdleTimeout(t *testing.T) {
+	_, receiverSess := makeSessions(t)
+	// The sender never answers, so nothing arrives within the timeout.
+	receiverSess.SetKeepalive(time.Hour, 100*time.Millisecond)
+
+	start := time.Now()
+	_, err := receiverSess.ReceiveMessage()
+	if !errors.Is(err, ErrIdleTimeout) {
+		t.Fatalf("got %v, want ErrIdleTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("idle timeout took %v", elapsed)
+	}
+}
+
+func TestKeepalive_KeepsIdleSessionAlive(t *testing.T) {
+	senderSess, receiverSess := makeSessions(t)
+	senderSess.SetKeepalive(20*time.Millisecond, 150*time.Millisecond)
+	receiverSess.SetKeepalive(20*time.Millisecond, 150*time.Millisecond)
+
+	// Both sides read, as they do during a transfer, so pings are answered.
+	senderErr := make(chan error, 1)
+	go func() {
+		_, err := senderSess.ReceiveMessage()
+		senderErr <- err
+	}()
+
+	go func() {
+		time.Sleep(600 * time.Millisecond)
+		senderSess.SendMessage(protocol.Message{Type: protocol.MessageTypeReady})
+	}()
+
+	msg, err := receiverSess.ReceiveMessage()
+	if err != nil {
+		t.Fatalf("ReceiveMessage: %v", err)
+	}
+	if msg.Type != protocol.MessageTypeReady {
+		t.Fatalf("got %q; keepalives must not be returned", msg.Type)
+	}
+	select {
+	case err := <-senderErr:
+		t.Fatalf("sender read ended early: %v", err)
+	default:
+	}
+}
+
+func TestKeepalive_TinyAndZeroIntervals(t *testing.T) {
+	senderSess, receiverSess := makeSessions(t)
+	// Half of a one-nanosecond interval used to make the ticker panic.
+	senderSess.SetKeepalive(time.Nanosecond, time.Second)
+	receiverSess.SetKeepalive(0, time.Second)
+
+	go senderSess.SendMessage(protocol.Message{Type: protocol.MessageTypeReady})
+	msg, err := receiverSess.ReceiveMessage()
+	if err != nil {
+		t.Fatalf("ReceiveMessage: %v", err)
+	}
+	if msg.Type != protocol.MessageTypeReady {
+		t.Fatalf("got %q", msg.Type)
+	}
+}
+
+func TestTypedFrames_PayloadsNeverTakenForControl(t *testing.T) {
+	senderSess, receiverSess := makeSessions(t)
+	for _, s := range []*SecureSession{senderSess, receiverSess} {
+		s.SetKeepalive(time.Hour, 0)
+		s.SetRekey(RekeyPolicy{Frames: 2})
+	}
+
+	// What version 2 sent as keepalives and rekey markers, and payloads
+	// that start with a frame type, are all just data now.
+	payloads := [][]byte{
+		[]byte(`{"type":"ping"}`),
+		[]byte(`{"type":"pong"}`),
+		[]byte(`{"type":"rekey"}`),
+		{framePing},
+		{frameRekey, 0, 0},
+		{},
+	}
+	go func() {
+		for _, p := range payloads {
+			if senderSess.WriteFrame(p) != nil {
+				return
+			}
+		}
+	}()
+	for i, want := range payloads {
+		got, err := receiverSess.ReadFrame()
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("frame %d = %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestTypedFrames_TypeIsAuthenticated(t *testing.T) {
+	senderSess, receiverSess := makeSessions(t)
+	senderSess.SetRekey(RekeyPolicy{})
+	receiverSess.SetRekey(RekeyPolicy{})
+
+	// A data frame relabeled on the wire as a rekey marker must fail to
+	// decrypt rather than switch keys.
+	frame := []byte{0, 0, 0, 0, frameRekey}
+	frame, err := senderSess.send.Encrypt(frame, []byte{frameData}, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+	go senderSess.conn.Write(frame)
+
+	if _, err := receiverSess.ReadFrame(); err == nil {
+		t.Fatal("frame with an altered type was accepted")
+	}
+}
+
+func TestFullDuplex_ConcurrentSendAndReceive(t *testing.T) {
+	senderSess, receiverSess := makeSessions(t)
+	const n = 200
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for _, pair := range []struct{ from, to *SecureSession }{
+		{senderSess, receiverSess},
+		{receiverSess, senderSess},
+	} {
+		wg.Add(2)
+		go func(s *SecureSession) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				msg := protocol.Message{Type: protocol.MessageTypeFileComplete, FileID: fmt.Sprintf("%024x", i)}
+				if err := s.SendMessage(msg); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(pair.from)
+		go func(s *SecureSession) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				msg, err := s.ReceiveMessage()
+				if err != nil {
+					errs <- err
+					return
+				}
+				if msg.FileID != fmt.Sprintf("%024x", i) {
+					errs <- fmt.Errorf("message %d arrived as %q", i, msg.FileID)
+					return
+				}
+			}
+		}(pair.to)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,54 @@
+package session
+
+import "time"
+
+// RekeyPolicy says when a session replaces its send key. Each direction is
+// rekeyed independently by its sender; a zero field disables that trigger.
+type RekeyPolicy struct {
+	Bytes    int64         // payload bytes sent under one key
+	Frames   int64         // frames sent under one key
+	Interval time.Duration // age of the key when the next frame is sent
+}
+
+// DefaultRekeyPolicy rekeys well before any practical limit of the cipher,
+// while costing next to nothing on a fast link.
+var DefaultRekeyPolicy = RekeyPolicy{
+	Bytes:    1 << 30,
+	Frames:   1 << 20,
+	Interval: 10 * time.Minute,
+}
+
+// SetRekey turns on rekeying with policy. Before each frame, when a limit
+// is reached, the session sends a rekey marker and switches to a new send
+// key derived from the old one with Noise's Rekey; the peer switches its
+// receive key when it reads the marker. The marker is a typed frame, so
+// SetRekey switches the session to typed frames, like SetKeepalive. Only
+// enable it when the peer understands rekey markers
+// (protocol.CapabilityRekey), and before the next read, since the peer may
+// rekey as soon as it has negotiated.
+func (s *SecureSession) SetRekey(policy RekeyPolicy) {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	s.typed.Store(true)
+	s.rekeyPolicy = policy
+	s.rekeyed()
+	s.rekeyOn.Store(true)
+}
+
+// rekeyDue reports whether the send key has reached a limit. sendMu must
+// be held.
+func (s *SecureSession) rekeyDue() bool {
+	if !s.rekeyOn.Load() {
+		return false
+	}
+	p := s.rekeyPolicy
+	return (p.Bytes > 0 && s.sentBytes >= p.Bytes) ||
+		(p.Frames > 0 && s.sentFrames >= p.Frames) ||
+		(p.Interval > 0 && time.Since(s.lastRekey) >= p.Interval)
+}
+
+// rekeyed resets the limits for a fresh send key. sendMu must be held.
+func (s *SecureSession) rekeyed() {
+	s.sentBytes, s.sentFrames = 0, 0
+	s.lastRekey = time.Now()
+}
@@ -0,0 +1,107 @@
+package session
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JonathanInTheClouds/goxfer/internal/protocol"
+)
+
+func TestRekey_ManyTimesBothDirections(t *testing.T) {
+	senderSess, receiverSess := makeSessions(t)
+	policy := RekeyPolicy{Bytes: 256 << 10}
+	senderSess.SetRekey(policy)
+	receiverSess.SetRekey(policy)
+
+	const frames = 200
+	payloads := make([][]byte, frames)
+	for i := range payloads {
+		payloads[i] = make([]byte, 16<<10)
+		if _, err := rand.Read(payloads[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for _, pair := range []struct{ from, to *SecureSession }{
+		{senderSess, receiverSess},
+		{receiverSess, senderSess},
+	} {
+		wg.Add(2)
+		go func(s *SecureSession) {
+			defer wg.Done()
+			for i, data := range payloads {
+				msg := protocol.Message{Type: protocol.MessageTypeFileChunk, FileID: "00000000000000000000000f", Index: i, Chunk: data}
+				if err := s.SendMessage(msg); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(pair.from)
+		go func(s *SecureSession) {
+			defer wg.Done()
+			for i := range payloads {
+				msg, err := s.ReceiveMessage()
+				if err != nil {
+					errs <- fmt.Errorf("frame %d: %w", i, err)
+					return
+				}
+				if msg.Index != i || !bytes.Equal(msg.Chunk, payloads[i]) {
+					errs <- fmt.Errorf("frame %d corrupted", i)
+					return
+				}
+			}
+		}(pair.to)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// 200 frames of 16 KiB is about 3.2 MiB, so each side rekeyed 12 times.
+	for name, s := range map[string]*SecureSession{"sender": senderSess, "receiver": receiverSess} {
+		s.sendMu.Lock()
+		rekeys := s.rekeys
+		s.sendMu.Unlock()
+		if rekeys < 10 {
+			t.Errorf("%s rekeyed %d times, want at least 10", name, rekeys)
+		}
+	}
+}
+
+func TestRekey_FrameAndIntervalLimits(t *testing.T) {
+	senderSess, receiverSess := makeSessions(t)
+	senderSess.SetRekey(RekeyPolicy{Frames: 3, Interval: 20 * time.Millisecond})
+	receiverSess.SetRekey(RekeyPolicy{})
+
+	go func() {
+		for i := 0; i < 10; i++ {
+			if i == 5 {
+				time.Sleep(30 * time.Millisecond)
+			}
+			senderSess.SendMessage(protocol.Message{Type: protocol.MessageTypeReady})
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		msg, err := receiverSess.ReceiveMessage()
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if msg.Type != protocol.MessageTypeReady {
+			t.Fatalf("message %d: got %q; rekey markers must not be returned", i, msg.Type)
+		}
+	}
+
+	senderSess.sendMu.Lock()
+	defer senderSess.sendMu.Unlock()
+	// Every third frame, plus once for the pause before frame 5.
+	if senderSess.rekeys < 3 {
+		t.Fatalf("rekeyed %d times, want at least 3", senderSess.rekeys)
+	}
+}
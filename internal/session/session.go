@@ -1,27 +1,106 @@
 package session
 
 import (
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/JonathanInTheClouds/goxfer/internal/crypto"
 	"github.com/JonathanInTheClouds/goxfer/internal/protocol"
 	"github.com/flynn/noise"
+	"golang.org/x/crypto/argon2"
 )
 
 const prologue = "github.com/JonathanInTheClouds/goxfer/v1"
 
+// noiseTagSize is the authentication tag the cipher adds to each message.
+const noiseTagSize = 16
+
+// Frame types. Once keepalive or rekeying is enabled, every frame starts
+// with one, in the clear but authenticated as associated data, so the
+// session's own frames never share a namespace with the payloads it
+// carries. Before that, as during the hello exchange, frames hold only the
+// encrypted payload.
+const (
+	frameData  byte = 0
+	framePing  byte = 1
+	framePong  byte = 2
+	frameRekey byte = 3
+)
+
+// pskPlacement puts the PSK at the end of XX message 2 (XXpsk2), so both
+// sides detect a wrong code during the handshake: the initiator when it
+// reads message 2, the responder when it reads message 3.
+const pskPlacement = 2
+
+// handshakeTimeout bounds the whole handshake, so a peer that connects and
+// then stays silent cannot hold the other side.
+var handshakeTimeout = 30 * time.Second
+
+// ErrSessionCodeMismatch is returned by NewPasswordSession when the peer did
+// not use the same session code.
+var ErrSessionCodeMismatch = errors.New("session code mismatch: wrong code, or someone is intercepting the connection")
+
 type Listener struct {
 	inner    net.Listener
 	identity *crypto.Identity
 }
 
+// SecureSession is a full-duplex encrypted connection. One goroutine may
+// send while another receives; concurrent calls in the same direction are
+// serialized.
 type SecureSession struct {
 	conn    net.Conn
 	send    *noise.CipherState
 	receive *noise.CipherState
+
+	sendMu sync.Mutex
+	recvMu sync.Mutex
+
+	// idleTimeout bounds how long a read may wait for any frame, and a write
+	// for the peer to make room. Zero means no limit.
+	idleTimeout atomic.Int64
+	keepaliveOn atomic.Bool
+	lastSend    atomic.Int64 // unix nanoseconds
+	pongDue     chan struct{}
+	// typed is set once frames carry a type; see frameData.
+	typed atomic.Bool
+
+	// Rekeying state; the counters and policy are guarded by sendMu.
+	rekeyOn     atomic.Bool
+	rekeyPolicy RekeyPolicy
+	sentBytes   int64
+	sentFrames  int64
+	lastRekey   time.Time
+	rekeys      int // completed rekeys of the send key
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	// broken is set when a canceled or timed-out read or write left a
+	// partial frame on the wire; the session cannot be used after that.
+	broken atomic.Pointer[error]
+
+	initiator      bool
+	peerStatic     []byte
+	peerSigningKey ed25519.PublicKey
+	handshakeHash  []byte
+}
+
+// handshakePayload is carried in the encrypted XX handshake messages
+// (message 2 from the responder, message 3 from the initiator). It binds the
+// sender's ed25519 signing key to its Noise static key: Signature is the
+// signing key's signature over the X25519 static public key.
+type handshakePayload struct {
+	SigningKey []byte `json:"signing_key"`
+	Signature  []byte `json:"signature"`
 }
 
 // Bind starts a TCP listener on addr (use ":0" to let the OS pick a port).
@@ -37,11 +116,28 @@ func Bind(addr string, identity *crypto.Identity) (*Listener, int, error) {
 
 // Accept blocks until one peer connects, then runs the Noise XX handshake as responder.
 func (l *Listener) Accept() (*SecureSession, error) {
+	conn, err := l.AcceptConn()
+	if err != nil {
+		return nil, err
+	}
+	return l.Handshake(conn)
+}
+
+// AcceptConn blocks until one peer connects and returns the connection
+// before any handshake, so a listener serving several peers can hand each
+// to Handshake on its own goroutine.
+func (l *Listener) AcceptConn() (net.Conn, error) {
 	conn, err := l.inner.Accept()
 	if err != nil {
 		return nil, fmt.Errorf("accept: %w", err)
 	}
-	sess, err := newSession(conn, l.identity, false)
+	return conn, nil
+}
+
+// Handshake runs the Noise XX handshake as responder over a connection from
+// AcceptConn. The connection is closed if the handshake fails.
+func (l *Listener) Handshake(conn net.Conn) (*SecureSession, error) {
+	sess, err := newSession(conn, l.identity, false, nil)
 	if err != nil {
 		conn.Close()
 		return nil, err
@@ -53,13 +149,31 @@ func (l *Listener) Close() error {
 	return l.inner.Close()
 }
 
+// SetDeadline makes Accept give up waiting for a connection once t has
+// passed. The zero time waits forever.
+func (l *Listener) SetDeadline(t time.Time) error {
+	tl, ok := l.inner.(*net.TCPListener)
+	if !ok {
+		return errors.New("listener does not support deadlines")
+	}
+	return tl.SetDeadline(t)
+}
+
 // Dial connects to addr and runs the Noise XX handshake as initiator.
-func Dial(addr string, identity *crypto.Identity) (*SecureSession, error) {
-	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+// Canceling ctx abandons the dial or the handshake.
+func Dial(ctx context.Context, addr string, identity *crypto.Identity) (*SecureSession, error) {
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
 	if err != nil {
 		return nil, fmt.Errorf("dial: %w", err)
 	}
-	sess, err := newSession(conn, identity, true)
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	sess, err := newSession(conn, identity, true, nil)
+	if !stop() {
+		// ctx was canceled, during the handshake or just after it.
+		conn.Close()
+		return nil, ctx.Err()
+	}
 	if err != nil {
 		conn.Close()
 		return nil, err
@@ -68,9 +182,10 @@ func Dial(addr string, identity *crypto.Identity) (*SecureSession, error) {
 }
 
 // NewSession runs the Noise XX handshake over an existing connection.
-// Use initiator=true for the receiver side, initiator=false for the sender side.
+// Exactly one side passes initiator=true, usually the one that dialed; it
+// does not depend on which way files go.
 func NewSession(conn net.Conn, identity *crypto.Identity, initiator bool) (*SecureSession, error) {
-	sess, err := newSession(conn, identity, initiator)
+	sess, err := newSession(conn, identity, initiator, nil)
 	if err != nil {
 		conn.Close()
 		return nil, err
@@ -78,146 +193,401 @@ func NewSession(conn net.Conn, identity *crypto.Identity, initiator bool) (*Secu
 	return sess, nil
 }
 
-func newSession(conn net.Conn, identity *crypto.Identity, initiator bool) (*SecureSession, error) {
-	handshake, err := noise.NewHandshakeState(noise.Config{
+// NewPasswordSession runs a Noise XXpsk2 handshake keyed from a shared session
+// code. A peer that does not know the code cannot complete the handshake, so
+// the code authenticates the session as well as pairing it.
+func NewPasswordSession(conn net.Conn, identity *crypto.Identity, initiator bool, code string) (*SecureSession, error) {
+	if code == "" {
+		conn.Close()
+		return nil, errors.New("session code must not be empty")
+	}
+	sess, err := newSession(conn, identity, initiator, derivePSK(code))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return sess, nil
+}
+
+// derivePSK stretches a short session code into a 32-byte Noise PSK. Argon2id
+// makes guessing the code from a captured handshake expensive.
+func derivePSK(code string) []byte {
+	return argon2.IDKey([]byte(code), []byte(prologue), 2, 32*1024, 2, 32)
+}
+
+func newSession(conn net.Conn, identity *crypto.Identity, initiator bool, psk []byte) (*SecureSession, error) {
+	config := noise.Config{
 		CipherSuite:   noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256),
 		Pattern:       noise.HandshakeXX,
 		Initiator:     initiator,
 		StaticKeypair: identity.NoiseStaticKeypair(),
-	})
+	}
+	if psk != nil {
+		config.PresharedKey = psk
+		config.PresharedKeyPlacement = pskPlacement
+	}
+	handshake, err := noise.NewHandshakeState(config)
 	if err != nil {
 		return nil, fmt.Errorf("create handshake state: %w", err)
 	}
 
-	sendCipher, receiveCipher, err := runHandshake(conn, handshake, initiator)
+	localPayload, err := json.Marshal(handshakePayload{
+		SigningKey: identity.SigningPublicKey,
+		Signature:  identity.SignedStaticKey(),
+	})
 	if err != nil {
+		return nil, fmt.Errorf("encode handshake payload: %w", err)
+	}
+
+	// The deadline is lifted once the handshake is done; after that the
+	// session's own idle timeout, if any, applies.
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	sendCipher, receiveCipher, peerPayload, err := runHandshake(conn, handshake, initiator, localPayload)
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		if psk != nil {
+			var msgErr *handshakeMessageError
+			if errors.As(err, &msgErr) {
+				return nil, fmt.Errorf("%w (%v)", ErrSessionCodeMismatch, err)
+			}
+			if errors.Is(err, io.EOF) {
+				return nil, fmt.Errorf("%w (peer closed the connection during the handshake)", ErrSessionCodeMismatch)
+			}
+		}
 		return nil, err
 	}
 	if !initiator {
 		sendCipher, receiveCipher = receiveCipher, sendCipher
 	}
 
+	peerStatic := append([]byte(nil), handshake.PeerStatic()...)
+	peerSigningKey, err := verifyPeerPayload(peerPayload, peerStatic)
+	if err != nil {
+		return nil, err
+	}
+
 	return &SecureSession{
-		conn:    conn,
-		send:    sendCipher,
-		receive: receiveCipher,
+		conn:           conn,
+		send:           sendCipher,
+		receive:        receiveCipher,
+		initiator:      initiator,
+		peerStatic:     peerStatic,
+		peerSigningKey: peerSigningKey,
+		handshakeHash:  append([]byte(nil), handshake.ChannelBinding()...),
+		pongDue:        make(chan struct{}, 1),
+		closed:         make(chan struct{}),
 	}, nil
 }
 
+// verifyPeerPayload decodes the peer's handshake payload and checks that its
+// signing key signed the static key the peer used in the handshake.
+func verifyPeerPayload(payload, peerStatic []byte) (ed25519.PublicKey, error) {
+	var peer handshakePayload
+	if err := json.Unmarshal(payload, &peer); err != nil {
+		return nil, fmt.Errorf("decode peer handshake payload: %w", err)
+	}
+	if len(peer.SigningKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid peer signing key size: %d", len(peer.SigningKey))
+	}
+	if len(peer.Signature) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("invalid peer static key signature size: %d", len(peer.Signature))
+	}
+	if !crypto.VerifySignedStaticKey(peer.SigningKey, peerStatic, peer.Signature) {
+		return nil, errors.New("peer static key signature is invalid")
+	}
+	return ed25519.PublicKey(peer.SigningKey), nil
+}
+
+// Initiator reports whether this side ran the handshake as initiator. The
+// two sides of a session always give different answers, so it can break
+// ties such as who speaks first.
+func (s *SecureSession) Initiator() bool {
+	return s.initiator
+}
+
+// PeerStaticKey returns the remote peer's X25519 static key from the handshake.
+func (s *SecureSession) PeerStaticKey() []byte {
+	return append([]byte(nil), s.peerStatic...)
+}
+
+// PeerSigningKey returns the remote peer's ed25519 public key.
+func (s *SecureSession) PeerSigningKey() ed25519.PublicKey {
+	return append(ed25519.PublicKey(nil), s.peerSigningKey...)
+}
+
+// HandshakeHash returns the Noise handshake hash. It is identical on both
+// sides of a session and differs for every session.
+func (s *SecureSession) HandshakeHash() []byte {
+	return append([]byte(nil), s.handshakeHash...)
+}
+
+// ShortAuthString returns the session's short authentication string, for
+// the two users to compare out of band.
+func (s *SecureSession) ShortAuthString() []crypto.SASSymbol {
+	return crypto.ShortAuthString(s.handshakeHash)
+}
+
+// PeerFingerprint returns the remote peer's fingerprint, in the same format
+// the peer prints for its own identity.
+func (s *SecureSession) PeerFingerprint() string {
+	return crypto.Fingerprint(s.peerSigningKey, s.peerStatic)
+}
+
+// SendMessage encodes msg and sends it as one encrypted frame.
 func (s *SecureSession) SendMessage(msg protocol.Message) error {
-	chunkData := msg.Chunk
-	msg.Chunk = nil
+	return s.SendMessageContext(context.Background(), msg)
+}
 
+// SendMessageContext is SendMessage with cancellation. If ctx is canceled
+// after part of the frame was written the session is left unusable.
+func (s *SecureSession) SendMessageContext(ctx context.Context, msg protocol.Message) error {
 	payload, err := protocol.EncodeMessage(msg)
 	if err != nil {
 		return err
 	}
-	ciphertext, err := s.send.Encrypt(nil, nil, payload)
+	return s.writeFrame(ctx, frameData, payload)
+}
+
+// ReceiveMessage reads and decodes the next encrypted frame. Once
+// SetKeepalive is enabled, keepalive messages are handled internally and
+// never returned.
+func (s *SecureSession) ReceiveMessage() (protocol.Message, error) {
+	return s.ReceiveMessageContext(context.Background())
+}
+
+// ReceiveMessageContext is ReceiveMessage with cancellation. If ctx is
+// canceled after part of a frame was read the session is left unusable.
+func (s *SecureSession) ReceiveMessageContext(ctx context.Context) (protocol.Message, error) {
+	payload, err := s.readFrame(ctx)
 	if err != nil {
-		return fmt.Errorf("encrypt message: %w", err)
+		return protocol.Message{}, err
 	}
-	frame, err := protocol.EncodeFrame(ciphertext)
-	if err != nil {
-		return err
+	return protocol.DecodeMessage(payload)
+}
+
+// WriteFrame encrypts payload and sends it as one frame. It is the raw
+// transport under SendMessage, for layers such as internal/mux that define
+// their own payload format.
+func (s *SecureSession) WriteFrame(payload []byte) error {
+	return s.writeFrame(context.Background(), frameData, payload)
+}
+
+// ReadFrame reads and decrypts the next frame, skipping keepalives and
+// rekey markers once those features are enabled.
+func (s *SecureSession) ReadFrame() ([]byte, error) {
+	return s.readFrame(context.Background())
+}
+
+func (s *SecureSession) writeFrame(ctx context.Context, kind byte, payload []byte) error {
+	if 1+len(payload)+noiseTagSize > protocol.MaxFrameSize {
+		return fmt.Errorf("payload exceeds max frame size of %d bytes", protocol.MaxFrameSize)
 	}
-	if _, err := s.conn.Write(frame); err != nil {
-		return fmt.Errorf("write encrypted frame: %w", err)
+
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if err := s.usable(ctx); err != nil {
+		return err
 	}
 
-	// For file_chunk, send raw binary data as a second encrypted frame.
-	// This avoids the ~33% base64 overhead of JSON encoding.
-	if msg.Type == protocol.MessageTypeFileChunk {
-		ciphertext, err := s.send.Encrypt(nil, nil, chunkData)
-		if err != nil {
-			return fmt.Errorf("encrypt chunk data: %w", err)
-		}
-		frame, err := protocol.EncodeFrame(ciphertext)
-		if err != nil {
+	if s.rekeyDue() {
+		// The marker goes out under the old key; everything after it uses
+		// the new one, and the peer switches when it reads the marker.
+		if err := s.writeFrameLocked(ctx, frameRekey, nil); err != nil {
 			return err
 		}
-		if _, err := s.conn.Write(frame); err != nil {
-			return fmt.Errorf("write chunk data frame: %w", err)
-		}
+		s.send.Rekey()
+		s.rekeyed()
+		s.rekeys++
 	}
-
+	if err := s.writeFrameLocked(ctx, kind, payload); err != nil {
+		return err
+	}
+	s.sentBytes += int64(len(payload))
+	s.sentFrames++
 	return nil
 }
 
-func (s *SecureSession) ReceiveMessage() (protocol.Message, error) {
-	frame, err := protocol.DecodeFrame(s.conn)
-	if err != nil {
-		return protocol.Message{}, fmt.Errorf("read encrypted frame: %w", err)
+// writeFrameLocked encrypts and writes one frame of the given type.
+// sendMu must be held.
+func (s *SecureSession) writeFrameLocked(ctx context.Context, kind byte, payload []byte) error {
+	// Encrypt straight into the frame buffer, after the length prefix and
+	// type, so a file chunk costs one encryption and one write.
+	nonce := s.send.Nonce()
+	frame := make([]byte, 4, 5+len(payload)+noiseTagSize)
+	var ad []byte
+	if s.typed.Load() {
+		frame = append(frame, kind)
+		ad = frame[4:]
+	} else if kind != frameData {
+		return fmt.Errorf("session frame type %d needs typed frames", kind)
 	}
-	plaintext, err := s.receive.Decrypt(nil, nil, frame)
+	frame, err := s.send.Encrypt(frame, ad, payload)
 	if err != nil {
-		return protocol.Message{}, fmt.Errorf("decrypt message: %w", err)
+		return fmt.Errorf("encrypt message: %w", err)
 	}
-	msg, err := protocol.DecodeMessage(plaintext)
-	if err != nil {
-		return protocol.Message{}, err
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(frame)-4))
+
+	deadline := newDeadline(ctx, s.conn.SetWriteDeadline, s.idle())
+	n, err := s.conn.Write(frame)
+	if err := deadline.stop(err); err != nil {
+		if n == 0 {
+			// Nothing reached the peer, so drop the frame and reuse its nonce.
+			s.send.SetNonce(nonce)
+		} else {
+			s.breakOn(err)
+		}
+		return fmt.Errorf("write encrypted frame: %w", err)
 	}
+	s.lastSend.Store(time.Now().UnixNano())
+	return nil
+}
 
-	// For file_chunk, read the second raw binary frame.
-	if msg.Type == protocol.MessageTypeFileChunk {
-		frame, err := protocol.DecodeFrame(s.conn)
-		if err != nil {
-			return protocol.Message{}, fmt.Errorf("read chunk data frame: %w", err)
+func (s *SecureSession) readFrame(ctx context.Context) ([]byte, error) {
+	s.recvMu.Lock()
+	defer s.recvMu.Unlock()
+
+	for {
+		if err := s.usable(ctx); err != nil {
+			return nil, err
 		}
-		msg.Chunk, err = s.receive.Decrypt(nil, nil, frame)
+
+		deadline := newDeadline(ctx, s.conn.SetReadDeadline, s.idle())
+		r := &countingReader{r: s.conn}
+		frame, err := protocol.DecodeFrame(r)
+		if err := deadline.stop(err); err != nil {
+			if r.n > 0 {
+				s.breakOn(err)
+			}
+			return nil, fmt.Errorf("read encrypted frame: %w", err)
+		}
+		kind, ad := frameData, []byte(nil)
+		if s.typed.Load() {
+			if len(frame) == 0 {
+				return nil, errors.New("decrypt message: frame has no type")
+			}
+			kind, ad, frame = frame[0], frame[:1], frame[1:]
+		}
+		plaintext, err := s.receive.Decrypt(frame[:0], ad, frame)
 		if err != nil {
-			return protocol.Message{}, fmt.Errorf("decrypt chunk data: %w", err)
+			return nil, fmt.Errorf("decrypt message: %w", err)
+		}
+
+		if kind == frameData {
+			return plaintext, nil
+		}
+		if err := s.internalFrame(kind); err != nil {
+			return nil, err
 		}
 	}
+}
+
+// internalFrame handles a frame the session consumes itself. Each type is
+// only accepted once the feature that sends it is enabled. recvMu must be
+// held.
+func (s *SecureSession) internalFrame(kind byte) error {
+	switch {
+	case kind == framePing && s.keepaliveOn.Load():
+		select {
+		case s.pongDue <- struct{}{}:
+		default:
+		}
+	case kind == framePong && s.keepaliveOn.Load():
+		// Any frame proves the peer is alive; nothing else to do.
+	case kind == frameRekey && s.rekeyOn.Load():
+		s.receive.Rekey()
+	default:
+		return fmt.Errorf("unexpected session frame type %d", kind)
+	}
+	return nil
+}
+
+// countingReader tells readFrame whether an interrupted read consumed part
+// of a frame.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+// usable reports why the session cannot be used, if it cannot.
+func (s *SecureSession) usable(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if broken := s.broken.Load(); broken != nil {
+		return *broken
+	}
+	return nil
+}
 
-	return msg, nil
+// breakOn marks the session unusable when err interrupted a frame part way:
+// after a cancellation or timeout the peer may have seen half of it.
+func (s *SecureSession) breakOn(err error) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrIdleTimeout) {
+		broken := fmt.Errorf("session unusable after interrupted I/O: %w", err)
+		s.broken.CompareAndSwap(nil, &broken)
+	}
 }
 
 func (s *SecureSession) Close() error {
-	return s.conn.Close()
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = s.conn.Close()
+	})
+	return err
 }
 
-func runHandshake(conn net.Conn, handshake *noise.HandshakeState, initiator bool) (*noise.CipherState, *noise.CipherState, error) {
+// runHandshake drives the three XX messages. localPayload is sent in the first
+// encrypted message this side writes; the returned payload is the peer's.
+func runHandshake(conn net.Conn, handshake *noise.HandshakeState, initiator bool, localPayload []byte) (*noise.CipherState, *noise.CipherState, []byte, error) {
 	var (
 		writeCipher *noise.CipherState
 		readCipher  *noise.CipherState
+		peerPayload []byte
 		err         error
 	)
 
 	if initiator {
 		if writeCipher, readCipher, err = writeHandshakeMessage(conn, handshake, []byte(prologue)); err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 		if writeCipher == nil && readCipher == nil {
-			if writeCipher, readCipher, err = readHandshakeMessage(conn, handshake); err != nil {
-				return nil, nil, err
+			if writeCipher, readCipher, peerPayload, err = readHandshakeMessage(conn, handshake); err != nil {
+				return nil, nil, nil, err
 			}
 		}
 		if writeCipher == nil && readCipher == nil {
-			if writeCipher, readCipher, err = writeHandshakeMessage(conn, handshake, nil); err != nil {
-				return nil, nil, err
+			if writeCipher, readCipher, err = writeHandshakeMessage(conn, handshake, localPayload); err != nil {
+				return nil, nil, nil, err
 			}
 		}
 	} else {
-		if writeCipher, readCipher, err = readHandshakeMessage(conn, handshake); err != nil {
-			return nil, nil, err
+		if writeCipher, readCipher, _, err = readHandshakeMessage(conn, handshake); err != nil {
+			return nil, nil, nil, err
 		}
 		if writeCipher == nil && readCipher == nil {
-			if writeCipher, readCipher, err = writeHandshakeMessage(conn, handshake, []byte(prologue)); err != nil {
-				return nil, nil, err
+			if writeCipher, readCipher, err = writeHandshakeMessage(conn, handshake, localPayload); err != nil {
+				return nil, nil, nil, err
 			}
 		}
 		if writeCipher == nil && readCipher == nil {
-			if writeCipher, readCipher, err = readHandshakeMessage(conn, handshake); err != nil {
-				return nil, nil, err
+			if writeCipher, readCipher, peerPayload, err = readHandshakeMessage(conn, handshake); err != nil {
+				return nil, nil, nil, err
 			}
 		}
 	}
 
 	if writeCipher == nil || readCipher == nil {
-		return nil, nil, errors.New("handshake did not produce transport cipher states")
+		return nil, nil, nil, errors.New("handshake did not produce transport cipher states")
 	}
 
-	return writeCipher, readCipher, nil
+	return writeCipher, readCipher, peerPayload, nil
 }
 
 func writeHandshakeMessage(conn net.Conn, handshake *noise.HandshakeState, payload []byte) (*noise.CipherState, *noise.CipherState, error) {
@@ -235,14 +605,28 @@ func writeHandshakeMessage(conn net.Conn, handshake *noise.HandshakeState, paylo
 	return sendCipher, recvCipher, nil
 }
 
-func readHandshakeMessage(conn net.Conn, handshake *noise.HandshakeState) (*noise.CipherState, *noise.CipherState, error) {
+func readHandshakeMessage(conn net.Conn, handshake *noise.HandshakeState) (*noise.CipherState, *noise.CipherState, []byte, error) {
 	frame, err := protocol.DecodeFrame(conn)
 	if err != nil {
-		return nil, nil, fmt.Errorf("read handshake frame: %w", err)
+		return nil, nil, nil, fmt.Errorf("read handshake frame: %w", err)
 	}
-	_, sendCipher, recvCipher, err := handshake.ReadMessage(nil, frame)
+	payload, sendCipher, recvCipher, err := handshake.ReadMessage(nil, frame)
 	if err != nil {
-		return nil, nil, fmt.Errorf("read handshake message: %w", err)
+		return nil, nil, nil, &handshakeMessageError{err: err}
 	}
-	return sendCipher, recvCipher, nil
+	return sendCipher, recvCipher, payload, nil
+}
+
+// handshakeMessageError reports a handshake message that arrived but could not
+// be processed, as opposed to a transport failure.
+type handshakeMessageError struct {
+	err error
+}
+
+func (e *handshakeMessageError) Error() string {
+	return "read handshake message: " + e.err.Error()
+}
+
+func (e *handshakeMessageError) Unwrap() error {
+	return e.err
 }
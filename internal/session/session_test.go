@@ -1,8 +1,12 @@
 package session
 
 import (
+	"encoding/json"
+	"errors"
 	"net"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/JonathanInTheClouds/goxfer/internal/crypto"
 	"github.com/JonathanInTheClouds/goxfer/internal/protocol"
@@ -10,7 +14,7 @@ import (
 
 // makeSessions creates a pair of connected SecureSessions using an in-memory pipe.
 // sender = Noise responder, receiver = Noise initiator (matches p2p.go convention).
-func makeSessions(t *testing.T) (senderSess, receiverSess *SecureSession) {
+func makeSessions(t testing.TB) (senderSess, receiverSess *SecureSession) {
 	t.Helper()
 	senderID, err := crypto.GenerateIdentity()
 	if err != nil {
@@ -20,7 +24,11 @@ func makeSessions(t *testing.T) (senderSess, receiverSess *SecureSession) {
 	if err != nil {
 		t.Fatalf("GenerateIdentity receiver: %v", err)
 	}
+	return makeSessionsWithIdentities(t, senderID, receiverID)
+}
 
+func makeSessionsWithIdentities(t testing.TB, senderID, receiverID *crypto.Identity) (senderSess, receiverSess *SecureSession) {
+	t.Helper()
 	connA, connB := net.Pipe()
 
 	type result struct {
@@ -29,11 +37,11 @@ func makeSessions(t *testing.T) (senderSess, receiverSess *SecureSession) {
 	}
 	ch := make(chan result, 1)
 	go func() {
-		s, err := newSession(connA, senderID, false) // responder
+		s, err := newSession(connA, senderID, false, nil) // responder
 		ch <- result{s, err}
 	}()
 
-	recvSess, err := newSession(connB, receiverID, true) // initiator
+	recvSess, err := newSession(connB, receiverID, true, nil) // initiator
 	if err != nil {
 		connA.Close()
 		connB.Close()
@@ -83,7 +91,7 @@ func TestBinaryChunkRoundTrip(t *testing.T) {
 	chunkData := []byte("binary chunk payload — not base64")
 	want := protocol.Message{
 		Type:   protocol.MessageTypeFileChunk,
-		FileID: "testfile42",
+		FileID: "000000000000000000000042",
 		Index:  7,
 		Chunk:  chunkData,
 	}
@@ -119,6 +127,34 @@ func TestBinaryChunkRoundTrip(t *testing.T) {
 	}
 }
 
+func BenchmarkSendFileChunk(b *testing.B) {
+	senderSess, receiverSess := makeSessions(b)
+	defer senderSess.Close()
+	defer receiverSess.Close()
+
+	go func() {
+		for {
+			if _, err := receiverSess.ReceiveMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	msg := protocol.Message{
+		Type:   protocol.MessageTypeFileChunk,
+		FileID: "0123456789abcdef01234567",
+		Chunk:  make([]byte, protocol.FileChunkSize),
+	}
+	b.SetBytes(protocol.FileChunkSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		msg.Index = i
+		if err := senderSess.SendMessage(msg); err != nil {
+			b.Fatalf("SendMessage: %v", err)
+		}
+	}
+}
+
 func TestBidirectionalMessages(t *testing.T) {
 	senderSess, receiverSess := makeSessions(t)
 
@@ -142,7 +178,7 @@ func TestBidirectionalMessages(t *testing.T) {
 	go func() {
 		done <- receiverSess.SendMessage(protocol.Message{
 			Type:     protocol.MessageTypeFileChecksum,
-			FileID:   "f",
+			FileID:   "00000000000000000000000f",
 			Checksum: "abc123",
 		})
 	}()
@@ -161,10 +197,10 @@ func TestBidirectionalMessages(t *testing.T) {
 func TestAllMessageTypes(t *testing.T) {
 	tests := []protocol.Message{
 		{Type: protocol.MessageTypeReady},
-		{Type: protocol.MessageTypeFileStart, FileID: "id1", Name: "a.txt", Size: 512},
-		{Type: protocol.MessageTypeFileStart, FileID: "id2", Name: "dir.tar.gz", Size: -1},
-		{Type: protocol.MessageTypeFileComplete, FileID: "id1"},
-		{Type: protocol.MessageTypeFileChecksum, FileID: "id1", Checksum: "deadbeef"},
+		{Type: protocol.MessageTypeFileStart, FileID: "0000000000000000000000a1", Name: "a.txt", Size: 512},
+		{Type: protocol.MessageTypeFileStart, FileID: "0000000000000000000000a2", Name: "dir.tar.gz", Size: -1},
+		{Type: protocol.MessageTypeFileComplete, FileID: "0000000000000000000000a1"},
+		{Type: protocol.MessageTypeFileChecksum, FileID: "0000000000000000000000a1", Checksum: "deadbeef"},
 	}
 
 	for _, want := range tests {
@@ -188,3 +224,144 @@ func TestAllMessageTypes(t *testing.T) {
 		}
 	}
 }
+
+func TestPeerFingerprint(t *testing.T) {
+	senderID, _ := crypto.GenerateIdentity()
+	receiverID, _ := crypto.GenerateIdentity()
+	senderSess, receiverSess := makeSessionsWithIdentities(t, senderID, receiverID)
+
+	if got, want := senderSess.PeerFingerprint(), receiverID.Fingerprint(); got != want {
+		t.Fatalf("sender sees peer fingerprint %s, want %s", got, want)
+	}
+	if got, want := receiverSess.PeerFingerprint(), senderID.Fingerprint(); got != want {
+		t.Fatalf("receiver sees peer fingerprint %s, want %s", got, want)
+	}
+	if string(senderSess.PeerStaticKey()) != string(receiverID.KeyAgreementPublicKey) {
+		t.Fatal("sender sees wrong peer static key")
+	}
+	if !receiverSess.PeerSigningKey().Equal(senderID.SigningPublicKey) {
+		t.Fatal("receiver sees wrong peer signing key")
+	}
+}
+
+func TestShortAuthString_MatchesAcrossPeers(t *testing.T) {
+	senderSess, receiverSess := makeSessions(t)
+
+	senderSAS := crypto.FormatSAS(senderSess.ShortAuthString())
+	receiverSAS := crypto.FormatSAS(receiverSess.ShortAuthString())
+	if senderSAS != receiverSAS {
+		t.Fatalf("SAS differs: sender %q, receiver %q", senderSAS, receiverSAS)
+	}
+
+	otherSender, _ := makeSessions(t)
+	if crypto.FormatSAS(otherSender.ShortAuthString()) == senderSAS {
+		t.Fatal("two sessions produced the same SAS")
+	}
+}
+
+func TestVerifyPeerPayload(t *testing.T) {
+	id, _ := crypto.GenerateIdentity()
+	other, _ := crypto.GenerateIdentity()
+
+	encode := func(p handshakePayload) []byte {
+		data, err := json.Marshal(p)
+		if err != nil {
+			t.Fatalf("marshal payload: %v", err)
+		}
+		return data
+	}
+
+	valid := encode(handshakePayload{SigningKey: id.SigningPublicKey, Signature: id.SignedStaticKey()})
+	key, err := verifyPeerPayload(valid, id.KeyAgreementPublicKey)
+	if err != nil {
+		t.Fatalf("valid payload: %v", err)
+	}
+	if !key.Equal(id.SigningPublicKey) {
+		t.Fatal("returned signing key does not match")
+	}
+
+	tampered := id.SignedStaticKey()
+	tampered[0] ^= 0xff
+
+	tests := []struct {
+		name    string
+		payload []byte
+		static  []byte
+	}{
+		{"tampered signature", encode(handshakePayload{SigningKey: id.SigningPublicKey, Signature: tampered}), id.KeyAgreementPublicKey},
+		{"signature for another static key", valid, other.KeyAgreementPublicKey},
+		{"signing key swapped", encode(handshakePayload{SigningKey: other.SigningPublicKey, Signature: id.SignedStaticKey()}), id.KeyAgreementPublicKey},
+		{"missing signature", encode(handshakePayload{SigningKey: id.SigningPublicKey}), id.KeyAgreementPublicKey},
+		{"garbage", []byte("github.com/JonathanInTheClouds/goxfer/v1"), id.KeyAgreementPublicKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := verifyPeerPayload(tt.payload, tt.static); err == nil {
+				t.Fatal("expected verification error, got nil")
+			}
+		})
+	}
+}
+
+func runPasswordHandshake(t *testing.T, senderCode, receiverCode string) (senderErr, receiverErr error) {
+	t.Helper()
+	senderID, _ := crypto.GenerateIdentity()
+	receiverID, _ := crypto.GenerateIdentity()
+
+	connA, connB := net.Pipe()
+	ch := make(chan error, 1)
+	go func() {
+		s, err := NewPasswordSession(connA, senderID, false, senderCode)
+		if err == nil {
+			s.Close()
+		}
+		ch <- err
+	}()
+
+	r, err := NewPasswordSession(connB, receiverID, true, receiverCode)
+	if err == nil {
+		r.Close()
+	}
+	return <-ch, err
+}
+
+func TestPasswordSession_MatchingCode(t *testing.T) {
+	senderErr, receiverErr := runPasswordHandshake(t, "ab12cd34-k7f2q9xw", "ab12cd34-k7f2q9xw")
+	if senderErr != nil {
+		t.Fatalf("sender: %v", senderErr)
+	}
+	if receiverErr != nil {
+		t.Fatalf("receiver: %v", receiverErr)
+	}
+}
+
+func TestPasswordSession_WrongCode(t *testing.T) {
+	senderErr, receiverErr := runPasswordHandshake(t, "ab12cd34-k7f2q9xw", "ab12cd34-wrongone")
+	if !errors.Is(receiverErr, ErrSessionCodeMismatch) {
+		t.Fatalf("receiver: got %v, want ErrSessionCodeMismatch", receiverErr)
+	}
+	if !errors.Is(senderErr, ErrSessionCodeMismatch) {
+		t.Fatalf("sender: got %v, want ErrSessionCodeMismatch", senderErr)
+	}
+}
+
+func TestHandshake_SilentPeerTimesOut(t *testing.T) {
+	defer func(d time.Duration) { handshakeTimeout = d }(handshakeTimeout)
+	handshakeTimeout = 50 * time.Millisecond
+
+	identity, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, silent := net.Pipe()
+	defer silent.Close()
+
+	// The peer connects but never writes a handshake message.
+	start := time.Now()
+	if _, err := NewSession(conn, identity, false); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got %v, want a handshake timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("handshake gave up after %v", elapsed)
+	}
+}
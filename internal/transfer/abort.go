@@ -0,0 +1,164 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"time"
+
+	"github.com/JonathanInTheClouds/goxfer/internal/protocol"
+)
+
+// abortTimeout bounds how long a failing side waits to deliver, or hear, the
+// reason a transfer stopped before it gives up on the connection.
+const abortTimeout = 2 * time.Second
+
+var (
+	// ErrCanceled is returned when either side cancels a transfer in progress.
+	ErrCanceled = errors.New("transfer canceled")
+	// ErrChecksumMismatch is returned when the received data does not match
+	// the sender's checksum.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+)
+
+// RemoteError is a failure the peer reported with an error message.
+type RemoteError struct {
+	Code   string
+	Reason string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("peer aborted the transfer (%s): %s", e.Code, e.Reason)
+}
+
+// Is lets errors.Is match a failure the peer detected against the same
+// sentinel the local side would have used, e.g. ErrChecksumMismatch.
+func (e *RemoteError) Is(target error) bool {
+	switch e.Code {
+	case protocol.ErrorCodeChecksumMismatch:
+		return target == ErrChecksumMismatch
+	case protocol.ErrorCodeIncompatible:
+		return target == ErrIncompatiblePeer
+	}
+	return false
+}
+
+// peerAbort returns the error carried by an error or cancel message, or nil
+// for any other message.
+func peerAbort(msg protocol.Message) error {
+	switch msg.Type {
+	case protocol.MessageTypeError:
+		return &RemoteError{Code: msg.Code, Reason: msg.Reason}
+	case protocol.MessageTypeCancel:
+		if msg.Reason != "" {
+			return fmt.Errorf("%w by peer: %s", ErrCanceled, msg.Reason)
+		}
+		return fmt.Errorf("%w by peer", ErrCanceled)
+	}
+	return nil
+}
+
+// receiveMessage reads the next message, turning an error or cancel from the
+// peer into a Go error.
+func receiveMessage(sess messageConn) (protocol.Message, error) {
+	msg, err := sess.ReceiveMessage()
+	if err != nil {
+		return protocol.Message{}, err
+	}
+	if err := peerAbort(msg); err != nil {
+		return protocol.Message{}, err
+	}
+	return msg, nil
+}
+
+// abortTransfer tells the peer why the transfer failed and returns the error
+// to report locally. Failures the peer reported itself are not echoed back.
+// If the connection is already broken, the peer most likely hung up after
+// sending its own error, so abortTransfer looks for it and returns it instead.
+func abortTransfer(sess messageConn, err error) error {
+	var remote *RemoteError
+	if errors.As(err, &remote) || errors.Is(err, ErrCanceled) {
+		return err
+	}
+
+	sent := sendWithTimeout(sess, protocol.Message{
+		Type:   protocol.MessageTypeError,
+		Code:   errorCode(err),
+		Reason: err.Error(),
+	})
+	if sent {
+		return err
+	}
+	if peerErr := readPeerAbort(sess); peerErr != nil {
+		return peerErr
+	}
+	return err
+}
+
+// errorCode classifies err for the error message sent to the peer.
+func errorCode(err error) string {
+	var pathErr *fs.PathError
+	switch {
+	case errors.Is(err, ErrChecksumMismatch):
+		return protocol.ErrorCodeChecksumMismatch
+	case errors.Is(err, ErrIncompatiblePeer):
+		return protocol.ErrorCodeIncompatible
+	case errors.As(err, &pathErr):
+		return protocol.ErrorCodeIO
+	default:
+		return protocol.ErrorCodeProtocol
+	}
+}
+
+// sendWithTimeout sends msg, giving up after abortTimeout so a peer that has
+// stopped reading cannot hold up the exit. It reports whether msg was sent.
+func sendWithTimeout(sess messageConn, msg protocol.Message) bool {
+	done := make(chan error, 1)
+	go func() { done <- sess.SendMessage(msg) }()
+	select {
+	case err := <-done:
+		return err == nil
+	case <-time.After(abortTimeout):
+		return false
+	}
+}
+
+// readPeerAbort waits briefly for an error or cancel message from the peer.
+func readPeerAbort(sess messageConn) error {
+	done := make(chan error, 1)
+	go func() {
+		msg, err := sess.ReceiveMessage()
+		if err != nil {
+			done <- nil
+			return
+		}
+		done <- peerAbort(msg)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(abortTimeout):
+		return nil
+	}
+}
+
+// cancelWhenDone sends a cancel message and closes sess once ctx is done,
+// telling r; what names the work being canceled. The returned function
+// stops watching and reports whether ctx ended the work.
+func cancelWhenDone(ctx context.Context, sess controlConn, what string, r *reporter) func() bool {
+	finished := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(finished)
+		r.printf("\nCanceling %s...\n", what)
+		sendWithTimeout(sess, protocol.Message{Type: protocol.MessageTypeCancel, Reason: "interrupted by user"})
+		sess.Close()
+	})
+	return func() bool {
+		if stop() {
+			return false
+		}
+		<-finished
+		return true
+	}
+}
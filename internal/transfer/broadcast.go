@@ -0,0 +1,158 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/JonathanInTheClouds/goxfer/internal/protocol"
+)
+
+// acceptRetryDelay paces serveReceivers after a receiver fails to connect,
+// so a relay that is down is not redialed in a tight loop.
+const acceptRetryDelay = time.Second
+
+// serveReceivers sends items to each receiver that connects through w, over
+// a session of its own, until opts.MaxReceivers have connected or
+// opts.Expires has passed, then waits for the transfers still running. A
+// receiver that reconnects after a drop resumes without taking another
+// place. The transfers overlap, so r prints one line per receiver rather
+// than progress of its own; events are still reported for each receiver.
+// Canceling ctx stops accepting, and each transfer running cancels itself.
+func serveReceivers(ctx context.Context, w *peerWaiter, items []sendItem, offer protocol.Message, opts SendOptions, r *reporter) error {
+	quiet := &reporter{events: r.events, self: r.self}
+	w.report = quiet
+
+	var deadline time.Time
+	until := ""
+	if opts.Expires > 0 {
+		deadline = time.Now().Add(opts.Expires)
+		until = " until " + deadline.Format("15:04")
+	}
+	r.printf("\nServing %s to up to %d receivers%s\n", offerSummary(offer), opts.MaxReceivers, until)
+	defer context.AfterFunc(ctx, func() { w.Close() })()
+
+	check := peerCheck{
+		idleTimeout:       opts.IdleTimeout,
+		expectFingerprint: opts.ExpectFingerprint,
+		knownPeers:        opts.KnownPeers,
+		report:            quiet,
+	}
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		seen    = make(map[string]int) // receiver number by fingerprint
+		results = make(map[int]error)  // latest outcome per receiver
+	)
+	full := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(seen) >= opts.MaxReceivers
+	}
+	// Handshakes still running once no more receivers are wanted are cut
+	// short.
+	handshakes, stopHandshakes := context.WithCancel(ctx)
+	defer stopHandshakes()
+	for !full() {
+		var timeout time.Duration
+		if !deadline.IsZero() {
+			if timeout = time.Until(deadline); timeout <= 0 {
+				break
+			}
+		}
+		mu.Lock()
+		w.pairings = opts.MaxReceivers - len(seen)
+		mu.Unlock()
+		conn, err := w.acceptConn(timeout)
+		if ctx.Err() != nil || full() {
+			if conn != nil {
+				conn.Close()
+			}
+			break
+		}
+		if err != nil {
+			if !deadline.IsZero() && !time.Now().Before(deadline) {
+				break
+			}
+			r.printf("A receiver failed to connect: %v\n", err)
+			time.Sleep(acceptRetryDelay)
+			continue
+		}
+
+		// The handshake runs beside the loop, so a receiver that connects
+		// and says nothing cannot keep the others waiting.
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sess, err := w.handshake(handshakes, conn)
+			if err != nil {
+				if handshakes.Err() == nil {
+					r.printf("A receiver failed to connect: %v\n", err)
+				}
+				return
+			}
+
+			fp := sess.PeerFingerprint()
+			mu.Lock()
+			n, again := seen[fp]
+			if !again && len(seen) >= opts.MaxReceivers {
+				mu.Unlock()
+				abortTransfer(sess, fmt.Errorf("this send already has its %d receivers", opts.MaxReceivers))
+				sess.Close()
+				return
+			}
+			if !again {
+				n = len(seen) + 1
+				seen[fp] = n
+			}
+			last := len(seen) == opts.MaxReceivers
+			mu.Unlock()
+			if again {
+				r.printf("Receiver %d reconnected\n", n)
+			} else {
+				r.printf("Receiver %d connected: %s\n", n, fp)
+				if last {
+					// Wakes the loop, which stops waiting.
+					w.Close()
+				}
+			}
+
+			err = sendSession(ctx, sess, items, offer, !opts.NoResume, check)
+			mu.Lock()
+			results[n] = err
+			mu.Unlock()
+			if err != nil {
+				quiet.forPeer(fp).emit(Event{Kind: EventError, Error: err.Error()})
+				r.printf("✗  Receiver %d: %v\n", n, err)
+			} else {
+				quiet.forPeer(fp).emit(Event{Kind: EventDone})
+				r.printf("✓  Receiver %d has everything — checksum verified\n", n)
+			}
+		}()
+	}
+	stopHandshakes()
+	if !full() && ctx.Err() == nil {
+		r.println("Stopped waiting for receivers")
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return ErrCanceled
+	}
+	var failed int
+	for _, err := range results {
+		if err != nil {
+			failed++
+		}
+	}
+	r.printf("\nSent to %d of %d receivers\n", len(seen)-failed, len(seen))
+	switch {
+	case len(seen) == 0:
+		return errors.New("no receiver connected before the send expired")
+	case failed > 0:
+		return fmt.Errorf("%d of %d receivers did not receive everything", failed, len(seen))
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/JonathanInTheClouds/goxfer/internal/crypto"
+	"github.com/JonathanInTheClouds/goxfer/internal/tunnel"
+)
+
+func TestServeReceivers_OverRelay(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tunnel.Serve(l)
+	t.Cleanup(func() { l.Close() })
+
+	srcPath := filepath.Join(t.TempDir(), "build.zip")
+	os.WriteFile(srcPath, []byte("artifact"), 0o644)
+	items, err := statItems([]string{srcPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer, err := buildOffer(items, identity.Fingerprint())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const receivers = 3
+	rv := rendezvous{relayAddr: l.Addr().String(), pairings: receivers}
+	w, err := listenForPeer(context.Background(), identity, rv, peerPrompt{command: "goxfer receive", arg: "<dest-dir>", peer: "receiver"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	sendErr := make(chan error, 1)
+	go func() {
+		sendErr <- serveReceivers(context.Background(), w, items, offer, SendOptions{MaxReceivers: receivers}, newReporter(nil, nil))
+	}()
+
+	// All receivers use the one code, at the same time.
+	destDirs := make([]string, receivers)
+	recvErr := make(chan error, receivers)
+	for i := range destDirs {
+		destDirs[i] = t.TempDir()
+		go func(dir string) {
+			recvErr <- P2PReceive(context.Background(), rv.relayAddr, dir, ReceiveOptions{Code: w.code, Yes: true})
+		}(destDirs[i])
+	}
+	for range destDirs {
+		if err := <-recvErr; err != nil {
+			t.Fatalf("receive: %v", err)
+		}
+	}
+	if err := <-sendErr; err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	for _, dir := range destDirs {
+		if got, err := os.ReadFile(filepath.Join(dir, "build.zip")); err != nil || string(got) != "artifact" {
+			t.Errorf("%s: got %q, %v", dir, got, err)
+		}
+	}
+}
+
+func TestP2PSend_ExpiresWithoutReceivers(t *testing.T) {
+	srcPath := filepath.Join(t.TempDir(), "build.zip")
+	os.WriteFile(srcPath, []byte("artifact"), 0o644)
+
+	start := time.Now()
+	err := P2PSend(context.Background(), []string{srcPath}, SendOptions{ListenAddr: "127.0.0.1:0", MaxReceivers: 2, Expires: 200 * time.Millisecond})
+	if err == nil || errors.Is(err, ErrCanceled) {
+		t.Fatalf("send = %v, want it to fail for want of receivers", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("send took %s to expire", elapsed)
+	}
+}
+
+func TestServeReceivers_SilentConnectionDoesNotBlockOthers(t *testing.T) {
+	srcPath := filepath.Join(t.TempDir(), "build.zip")
+	os.WriteFile(srcPath, []byte("artifact"), 0o644)
+
+	listening := make(chan string, 1)
+	events := func(e Event) {
+		if e.Kind == EventListening {
+			listening <- e.Addr
+		}
+	}
+	sendErr := make(chan error, 1)
+	go func() {
+		sendErr <- P2PSend(context.Background(), []string{srcPath}, SendOptions{ListenAddr: "127.0.0.1:0", MaxReceivers: 2, Events: events})
+	}()
+	var addr string
+	select {
+	case addr = <-listening:
+	case err := <-sendErr:
+		t.Fatalf("send: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("sender never started listening")
+	}
+
+	// Connects first and never sends a handshake message.
+	silent, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	recvErr := make(chan error, 2)
+	destDirs := []string{t.TempDir(), t.TempDir()}
+	for _, dir := range destDirs {
+		go func() {
+			recvErr <- P2PReceive(context.Background(), addr, dir, ReceiveOptions{Yes: true})
+		}()
+	}
+	for range destDirs {
+		select {
+		case err := <-recvErr:
+			if err != nil {
+				t.Fatalf("receive: %v", err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("a silent connection kept the receivers waiting")
+		}
+	}
+	select {
+	case err := <-sendErr:
+		if err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("send did not finish after its receivers")
+	}
+	for _, dir := range destDirs {
+		if got, err := os.ReadFile(filepath.Join(dir, "build.zip")); err != nil || string(got) != "artifact" {
+			t.Errorf("%s: got %q, %v", dir, got, err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package transfer
+
+import (
+	"time"
+
+	"github.com/JonathanInTheClouds/goxfer/internal/mux"
+	"github.com/JonathanInTheClouds/goxfer/internal/protocol"
+	"github.com/JonathanInTheClouds/goxfer/internal/session"
+)
+
+// messageConn is what a file transfer runs over: the SecureSession itself,
+// or one mux stream when both peers support multiplexing.
+type messageConn interface {
+	SendMessage(protocol.Message) error
+	ReceiveMessage() (protocol.Message, error)
+}
+
+// controlConn carries session-wide messages such as cancel. With mux this
+// is the control lane, which is never queued behind file data.
+type controlConn interface {
+	messageConn
+	Close() error
+}
+
+// laneConn is a data connection that can spread a directory's files over
+// extra streams, so one slow or small file does not hold up the rest. The
+// sender opens the lanes and the receiver accepts them.
+type laneConn interface {
+	messageConn
+	openLane() (lane, error)
+	acceptLane() (lane, error)
+}
+
+// lane is one extra stream of a laneConn. Close ends it cleanly; Reset
+// stops the peer's side at once after a failure.
+type lane interface {
+	messageConn
+	Close() error
+	Reset(reason string) error
+}
+
+// muxData is the transfer stream of a mux session, with lanes as further
+// streams of the same session.
+type muxData struct {
+	*mux.Stream
+	ms *mux.Session
+}
+
+func (d muxData) openLane() (lane, error)   { return d.ms.OpenStream() }
+func (d muxData) acceptLane() (lane, error) { return d.ms.AcceptStream() }
+
+// transferConn is the connection set up once the offer is accepted.
+type transferConn struct {
+	data    messageConn
+	control controlConn
+	// peerError closes the connection and returns any error or cancel the
+	// peer sent on the control lane. Call it only after a failure.
+	peerError func() error
+	// close ends a successful transfer.
+	close func() error
+}
+
+// openTransfer prepares sess for the file transfer. With mux the sender
+// opens a stream for the files and the receiver accepts it, whichever of
+// them dialed.
+func openTransfer(sess *session.SecureSession, feat features, receiver bool) (*transferConn, error) {
+	if !feat.mux {
+		return &transferConn{
+			data:      sess,
+			control:   sess,
+			peerError: func() error { return nil },
+			close:     func() error { return nil },
+		}, nil
+	}
+
+	ms := mux.New(sess, sess.Initiator())
+	var (
+		stream *mux.Stream
+		err    error
+	)
+	if receiver {
+		stream, err = ms.AcceptStream()
+	} else {
+		stream, err = ms.OpenStream()
+	}
+	if err != nil {
+		ms.Close()
+		return nil, err
+	}
+
+	var data messageConn = stream
+	if feat.parallel {
+		data = muxData{Stream: stream, ms: ms}
+	}
+	tc := &transferConn{
+		data:      data,
+		control:   ms,
+		peerError: watchControl(ms),
+		close:     func() error { return nil },
+	}
+	if !receiver {
+		// Closing the stream lets the receiver read a clean end of transfer
+		// before the connection goes away.
+		tc.close = stream.Close
+	}
+	return tc, nil
+}
+
+// watchControl reads the mux control lane. An error or cancel from the peer
+// closes the session, so blocked stream reads and writes return at once.
+func watchControl(ms *mux.Session) func() error {
+	done := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := ms.ReceiveMessage()
+			if err != nil {
+				done <- nil
+				return
+			}
+			if err := peerAbort(msg); err != nil {
+				done <- err
+				ms.Close()
+				return
+			}
+		}
+	}()
+
+	return func() error {
+		ms.Close()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(abortTimeout):
+			return nil
+		}
+	}
+}
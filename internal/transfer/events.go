@@ -0,0 +1,236 @@
+package transfer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/JonathanInTheClouds/goxfer/internal/protocol"
+	"github.com/schollz/progressbar/v3"
+)
+
+// EventKind says what an Event reports.
+type EventKind string
+
+// The events a send or receive reports, in roughly the order they happen.
+const (
+	// EventListening: this side waits for the peer, who runs Command to
+	// reach Addr, with Code through a relay. Fingerprint is this side's.
+	EventListening EventKind = "listening"
+	// EventConnected: the peer, identified by Peer, connected to this
+	// side, identified by Fingerprint.
+	EventConnected EventKind = "connected"
+	// EventVerification: Symbols should match what the peer shows.
+	EventVerification EventKind = "verification"
+	// EventOffer: the sender offered Offer to the receiver.
+	EventOffer EventKind = "offer"
+	// EventAccepted: the receiver accepted the offer.
+	EventAccepted EventKind = "accepted"
+	// EventPrompt: this side waits for a yes or no on stdin to Question.
+	EventPrompt EventKind = "prompt"
+	// EventFileStarted: file Name of Size bytes started, from Bytes when
+	// it resumes. Size is -1 while unknown.
+	EventFileStarted EventKind = "file_started"
+	// EventFileSkipped: file Name was already received in full.
+	EventFileSkipped EventKind = "file_skipped"
+	// EventProgress: Bytes of Name's Size bytes have gone across.
+	EventProgress EventKind = "progress"
+	// EventFileVerified: file Name arrived intact, with Checksum when
+	// checksums were compared; the receiver saved it at Path.
+	EventFileVerified EventKind = "file_verified"
+	// EventDone: the transfer finished.
+	EventDone EventKind = "done"
+	// EventError: the transfer failed with Error, or only file Name did
+	// when Name is set.
+	EventError EventKind = "error"
+)
+
+// Event is something that happened during a transfer. Only the fields its
+// Kind describes are set.
+type Event struct {
+	Kind EventKind `json:"event"`
+	// Peer is the fingerprint of the peer the event is about, once one
+	// has connected.
+	Peer        string `json:"peer,omitempty"`
+	Addr        string `json:"addr,omitempty"`
+	Code        string `json:"code,omitempty"`
+	Command     string `json:"command,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Symbols     string `json:"symbols,omitempty"`
+	Question    string `json:"question,omitempty"`
+	Offer       *Offer `json:"offer,omitempty"`
+	Name        string `json:"name,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	Bytes       int64  `json:"bytes,omitempty"`
+	Checksum    string `json:"checksum,omitempty"`
+	Path        string `json:"path,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Offer is what a sender proposes to send.
+type Offer struct {
+	// Items names each file or directory offered; directories end in "/".
+	Items []string `json:"items"`
+	// Size is the total of every file, or -1 for data streamed from a pipe.
+	Size int64 `json:"size"`
+	// Files is how many files the items hold.
+	Files int `json:"files"`
+	// Fingerprint is the sender's.
+	Fingerprint string `json:"fingerprint"`
+}
+
+// newOffer describes the offer message msg.
+func newOffer(msg protocol.Message) Offer {
+	return Offer{Items: offerItems(msg), Size: msg.Size, Files: msg.Count, Fingerprint: msg.Fingerprint}
+}
+
+// progressInterval is the least time between two progress events for the
+// same file.
+const progressInterval = 250 * time.Millisecond
+
+// reporter is where a transfer tells its user what is happening: as text
+// and progress bars for a person, and as events for a program. A nil
+// reporter, or one without out or events, reports nothing that way.
+type reporter struct {
+	out    io.Writer
+	events func(Event)
+	peer   string
+	self   string // this side's fingerprint, once known
+}
+
+func newReporter(out io.Writer, events func(Event)) *reporter {
+	return &reporter{out: out, events: events}
+}
+
+// forPeer returns a reporter whose events are about the peer with
+// fingerprint.
+func (r *reporter) forPeer(fingerprint string) *reporter {
+	if r == nil {
+		return nil
+	}
+	return &reporter{out: r.out, events: r.events, peer: fingerprint, self: r.self}
+}
+
+func (r *reporter) printf(format string, a ...any) {
+	if r != nil && r.out != nil {
+		fmt.Fprintf(r.out, format, a...)
+	}
+}
+
+func (r *reporter) println(a ...any) {
+	if r != nil && r.out != nil {
+		fmt.Fprintln(r.out, a...)
+	}
+}
+
+func (r *reporter) emit(e Event) {
+	if r == nil || r.events == nil {
+		return
+	}
+	if e.Peer == "" {
+		e.Peer = r.peer
+	}
+	r.events(e)
+}
+
+// fileFailed reports a failure with file name that does not end the
+// transfer.
+func (r *reporter) fileFailed(name, format string, a ...any) {
+	msg := fmt.Sprintf(format, a...)
+	r.println(msg)
+	r.emit(Event{Kind: EventError, Name: name, Error: msg})
+}
+
+// finish reports how the transfer ended.
+func (r *reporter) finish(err error) {
+	if err != nil {
+		r.emit(Event{Kind: EventError, Error: err.Error()})
+		return
+	}
+	r.emit(Event{Kind: EventDone})
+}
+
+// JSONEvents returns an event handler that writes each event to w as one
+// line of JSON. It may be called from several goroutines at once.
+func JSONEvents(w io.Writer) func(Event) {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	return func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		enc.Encode(e)
+	}
+}
+
+// progress follows name on its way: a bar for a person and a progress
+// event at most every progressInterval. Files sent or received at the same
+// time may share one.
+type progress struct {
+	r    *reporter
+	name string
+	size int64
+	bar  *progressbar.ProgressBar // nil without text output
+
+	mu   sync.Mutex
+	done int64
+	last time.Time
+}
+
+// newProgress starts following size bytes of name; size is -1 while
+// unknown.
+func (r *reporter) newProgress(name string, size int64) *progress {
+	p := &progress{r: r, name: name, size: size}
+	if r != nil && r.out != nil {
+		p.bar = newBar(r.out, size)
+	}
+	return p
+}
+
+// Write counts len(b) bytes as gone, so a progress can sit behind an
+// io.TeeReader.
+func (p *progress) Write(b []byte) (int, error) {
+	p.add(int64(len(b)))
+	return len(b), nil
+}
+
+// add counts n more bytes as gone.
+func (p *progress) add(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done += n
+	if p.bar != nil {
+		p.bar.Add64(n)
+	}
+	if time.Since(p.last) >= progressInterval {
+		p.last = time.Now()
+		p.r.emit(Event{Kind: EventProgress, Name: p.name, Size: p.size, Bytes: p.done})
+	}
+}
+
+// finish completes the bar and reports the final count.
+func (p *progress) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.bar != nil {
+		p.bar.Finish()
+	}
+	p.r.emit(Event{Kind: EventProgress, Name: p.name, Size: p.size, Bytes: p.done})
+}
+
+// newBar returns a progress bar suitable for file transfer output.
+func newBar(w io.Writer, size int64) *progressbar.ProgressBar {
+	return progressbar.NewOptions64(size,
+		progressbar.OptionSetWriter(w),
+		progressbar.OptionSetWidth(40),
+		progressbar.OptionShowBytes(true),
+		progressbar.OptionShowCount(),
+		progressbar.OptionSetItsString("B"),
+		progressbar.OptionSetPredictTime(true),
+		progressbar.OptionSetElapsedTime(true),
+		progressbar.OptionShowElapsedTimeOnFinish(),
+		progressbar.OptionUseIECUnits(true),
+		progressbar.OptionFullWidth(),
+	)
+}
@@ -0,0 +1,83 @@
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestJSONEvents_OneObjectPerLine(t *testing.T) {
+	var buf bytes.Buffer
+	emit := JSONEvents(&buf)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			emit(Event{Kind: EventProgress, Name: "big.iso", Size: 100, Bytes: 50})
+		}()
+	}
+	wg.Wait()
+	emit(Event{Kind: EventListening, Addr: "bore.pub:4242", Fingerprint: "ab:cd"})
+
+	var lines []map[string]any
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var line map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("line %q is not JSON: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 21 {
+		t.Fatalf("got %d lines, want 21", len(lines))
+	}
+	last := lines[20]
+	if last["event"] != "listening" || last["addr"] != "bore.pub:4242" || last["fingerprint"] != "ab:cd" {
+		t.Errorf("listening line = %v", last)
+	}
+	if _, ok := last["code"]; ok {
+		t.Errorf("empty fields should be left out: %v", last)
+	}
+}
+
+func TestReporter_FileFailedKeepsGoing(t *testing.T) {
+	var out bytes.Buffer
+	var got []Event
+	r := newReporter(&out, func(e Event) { got = append(got, e) })
+
+	r.fileFailed("a.txt", "Checksum mismatch for file %s", "a.txt")
+	r.finish(nil)
+
+	if out.String() != "Checksum mismatch for file a.txt\n" {
+		t.Errorf("printed %q", out.String())
+	}
+	if len(got) != 2 || got[0].Kind != EventError || got[0].Name != "a.txt" || got[1].Kind != EventDone {
+		t.Errorf("events = %+v, want a file error then done", got)
+	}
+}
+
+func TestPromptYesNo_EventsOnlyAskOnStderr(t *testing.T) {
+	origIn, origOut := promptInput, promptOutput
+	defer func() { promptInput, promptOutput = origIn, origOut }()
+	var asked bytes.Buffer
+	promptInput = bufio.NewReader(strings.NewReader("y\n"))
+	promptOutput = &asked
+
+	var got []Event
+	r := newReporter(nil, func(e Event) { got = append(got, e) })
+	ok, err := promptYesNo(r, "Accept this transfer? [y/N]: ")
+	if !ok || err != nil {
+		t.Fatalf("promptYesNo = %v, %v", ok, err)
+	}
+	if asked.String() != "Accept this transfer? [y/N]: " {
+		t.Errorf("asked %q", asked.String())
+	}
+	if len(got) != 1 || got[0].Kind != EventPrompt || got[0].Question != "Accept this transfer? [y/N]:" {
+		t.Errorf("events = %+v, want one prompt", got)
+	}
+}
@@ -0,0 +1,299 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/JonathanInTheClouds/goxfer/internal/crypto"
+	"github.com/JonathanInTheClouds/goxfer/internal/mux"
+	"github.com/JonathanInTheClouds/goxfer/internal/peers"
+	"github.com/JonathanInTheClouds/goxfer/internal/protocol"
+	"github.com/JonathanInTheClouds/goxfer/internal/session"
+)
+
+// dialTargetTimeout bounds how long Expose waits to reach its target.
+const dialTargetTimeout = 10 * time.Second
+
+// ExposeOptions configures Expose. Rendezvous, peer checks and reporting
+// work as in SendOptions.
+type ExposeOptions struct {
+	// Identity is the local peer identity. nil generates an ephemeral one.
+	Identity          *crypto.Identity
+	RelayAddr         string
+	ListenAddr        string
+	PublicAddr        string
+	ExpectFingerprint string
+	To                string
+	KnownPeers        *peers.KnownPeers
+	Verify            bool
+	IdleTimeout       time.Duration
+	Output            io.Writer
+	Events            func(Event)
+}
+
+// ForwardOptions configures Forward. Peer checks and reporting work as in
+// ReceiveOptions.
+type ForwardOptions struct {
+	// Identity is the local peer identity. nil generates an ephemeral one.
+	Identity          *crypto.Identity
+	Code              string
+	ExpectFingerprint string
+	From              string
+	KnownPeers        *peers.KnownPeers
+	Verify            bool
+	IdleTimeout       time.Duration
+	Output            io.Writer
+	Events            func(Event)
+}
+
+// Expose makes the TCP service at target reachable by one peer running
+// Forward, like the remote end of ssh -L. Every connection the peer forwards
+// arrives as a mux stream and is connected to target. It returns when the
+// peer disconnects or ctx is canceled; canceling ctx before the tunnel is
+// up returns ErrCanceled, and after that it just closes the tunnel.
+func Expose(ctx context.Context, target string, opts ExposeOptions) (err error) {
+	r := newReporter(opts.Output, opts.Events)
+	// ctx is replaced below by one canceled on return; only the caller's
+	// says whether the tunnel was canceled.
+	parent := ctx
+	defer func() {
+		if err != nil && parent.Err() != nil {
+			err = ErrCanceled
+		}
+		r.finish(err)
+	}()
+
+	identity, err := resolveIdentity(opts.Identity)
+	if err != nil {
+		return err
+	}
+	r.self = identity.Fingerprint()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	rv := rendezvous{relayAddr: opts.RelayAddr, listenAddr: opts.ListenAddr, publicAddr: opts.PublicAddr}
+	sess, err := awaitPeer(ctx, identity, rv, peerPrompt{command: "goxfer forward", arg: "<local-port>", peer: "peer"}, r)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	r = r.forPeer(sess.PeerFingerprint())
+	r.emit(Event{Kind: EventConnected, Fingerprint: r.self})
+
+	r.println("Peer connected!")
+	check := peerCheck{
+		idleTimeout:       opts.IdleTimeout,
+		expectFingerprint: opts.ExpectFingerprint,
+		knownPeers:        opts.KnownPeers,
+		alias:             opts.To,
+		verify:            opts.Verify,
+		report:            r,
+	}
+	stop := cancelWhenDone(ctx, sess, "tunnel", r)
+	err = negotiateExpose(sess, check)
+	if stop() {
+		return ErrCanceled
+	}
+	if err != nil {
+		return err
+	}
+
+	ms := mux.New(sess, false)
+	peerError := watchControl(ms)
+	stop = cancelWhenDone(ctx, ms, "tunnel", r)
+	r.printf("\nExposing %s to the peer. Press Ctrl-C to stop.\n", target)
+
+	for {
+		st, err := ms.AcceptStream()
+		if err != nil {
+			break
+		}
+		go func() {
+			conn, err := net.DialTimeout("tcp", target, dialTargetTimeout)
+			if err != nil {
+				r.printf("Cannot reach %s: %v\n", target, err)
+				st.Reset(fmt.Sprintf("cannot reach %s", target))
+				return
+			}
+			splice(conn, st)
+		}()
+	}
+	return endTunnel(stop(), peerError(), ms.Err(), r)
+}
+
+// negotiateExpose authenticates the peer and has it agree to forward
+// connections to this side.
+func negotiateExpose(sess *session.SecureSession, check peerCheck) error {
+	feat, err := authenticatePeer(sess, localHello(false), check)
+	if err != nil {
+		return err
+	}
+	if !feat.mux {
+		return abortTransfer(sess, fmt.Errorf("%w: peer cannot multiplex connections", ErrIncompatiblePeer))
+	}
+
+	if err := sess.SendMessage(protocol.Message{Type: protocol.MessageTypeExpose}); err != nil {
+		return fmt.Errorf("send expose: %w", err)
+	}
+	reply, err := receiveMessage(sess)
+	if err != nil {
+		return fmt.Errorf("receive expose reply: %w", err)
+	}
+	if reply.Type != protocol.MessageTypeReady {
+		return fmt.Errorf("expected ready, got %q", reply.Type)
+	}
+	return check.remember(sess)
+}
+
+// Forward connects to a peer running Expose and listens on localAddr; each
+// local connection is carried to the peer's target over its own mux stream.
+// It returns when the peer disconnects or ctx is canceled, as Expose does.
+func Forward(ctx context.Context, addr, localAddr string, opts ForwardOptions) (err error) {
+	r := newReporter(opts.Output, opts.Events)
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = ErrCanceled
+		}
+		r.finish(err)
+	}()
+
+	identity, err := resolveIdentity(opts.Identity)
+	if err != nil {
+		return err
+	}
+	r.self = identity.Fingerprint()
+
+	// Listen first so a busy port fails before the peer is involved.
+	listener, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		return fmt.Errorf("listen on %s: %w", localAddr, err)
+	}
+	defer listener.Close()
+
+	r.printf("Connecting to peer at %s...\n", addr)
+	sess, err := dialPeer(ctx, addr, opts.Code, identity)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	r = r.forPeer(sess.PeerFingerprint())
+	r.emit(Event{Kind: EventConnected, Fingerprint: r.self})
+
+	r.printf("Connected. Your fingerprint: %s\n", identity.Fingerprint())
+	check := peerCheck{
+		idleTimeout:       opts.IdleTimeout,
+		expectFingerprint: opts.ExpectFingerprint,
+		knownPeers:        opts.KnownPeers,
+		alias:             opts.From,
+		verify:            opts.Verify,
+		report:            r,
+	}
+	stop := cancelWhenDone(ctx, sess, "tunnel", r)
+	err = negotiateForward(sess, check)
+	if stop() {
+		return ErrCanceled
+	}
+	if err != nil {
+		return err
+	}
+
+	ms := mux.New(sess, true)
+	peerError := watchControl(ms)
+	stop = cancelWhenDone(ctx, ms, "tunnel", r)
+	go func() {
+		<-ms.Done()
+		listener.Close()
+	}()
+	r.printf("\nForwarding %s to the peer. Press Ctrl-C to stop.\n", listener.Addr())
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			break
+		}
+		go func() {
+			st, err := ms.OpenStream()
+			if err != nil {
+				conn.Close()
+				return
+			}
+			splice(conn, st)
+		}()
+	}
+	return endTunnel(stop(), peerError(), ms.Err(), r)
+}
+
+// negotiateForward authenticates the peer and agrees to carry connections
+// to the port it exposes.
+func negotiateForward(sess *session.SecureSession, check peerCheck) error {
+	if _, err := authenticatePeer(sess, localHello(false), check); err != nil {
+		return err
+	}
+
+	msg, err := receiveMessage(sess)
+	if err != nil {
+		return fmt.Errorf("receive expose: %w", err)
+	}
+	switch msg.Type {
+	case protocol.MessageTypeExpose:
+	case protocol.MessageTypeOffer:
+		return abortTransfer(sess, errors.New("peer is sending files, not exposing a port; use goxfer receive"))
+	default:
+		return fmt.Errorf("expected expose, got %q", msg.Type)
+	}
+	if err := sess.SendMessage(protocol.Message{Type: protocol.MessageTypeReady}); err != nil {
+		return fmt.Errorf("send ready: %w", err)
+	}
+	return check.remember(sess)
+}
+
+// endTunnel turns how a tunnel ended into its result, telling r. Canceling
+// ctx or the peer closing the tunnel is a normal end; anything else is
+// reported.
+func endTunnel(canceled bool, peerErr, sessErr error, r *reporter) error {
+	switch {
+	case canceled:
+		return nil
+	case errors.Is(peerErr, ErrCanceled):
+		r.println("Peer closed the tunnel.")
+		return nil
+	case peerErr != nil:
+		return peerErr
+	case sessErr == nil, errors.Is(sessErr, io.EOF), errors.Is(sessErr, mux.ErrClosed):
+		r.println("Peer disconnected.")
+		return nil
+	}
+	return sessErr
+}
+
+// splice copies between a local TCP connection and a stream until both
+// directions are done. End of input in one direction is passed on as a
+// half-close, so request/response protocols that shut down writing still
+// get their answer.
+func splice(conn net.Conn, st *mux.Stream) {
+	defer conn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := io.Copy(st, conn); err != nil {
+			st.Reset("local connection failed")
+			conn.Close()
+			return
+		}
+		st.Close()
+	}()
+
+	if _, err := io.Copy(conn, st); err != nil {
+		// The stream was reset or the session died; drop the connection so
+		// the copy above returns too.
+		conn.Close()
+	} else if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	}
+	<-done
+}
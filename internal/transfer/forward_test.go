@@ -0,0 +1,236 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/JonathanInTheClouds/goxfer/internal/mux"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (client, server *net.TCPConn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	s := <-accepted
+	if s == nil {
+		t.Fatal("Accept failed")
+	}
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+	return c.(*net.TCPConn), s.(*net.TCPConn)
+}
+
+func TestSplice_RequestResponseWithHalfClose(t *testing.T) {
+	exposeSess, forwardSess := makePair(t)
+	exposeMux, forwardMux := mux.New(exposeSess, false), mux.New(forwardSess, true)
+	defer exposeMux.Close()
+	defer forwardMux.Close()
+
+	// Forward side: a local client connection is spliced onto a new stream.
+	client, local := tcpPair(t)
+	go func() {
+		st, err := forwardMux.OpenStream()
+		if err != nil {
+			local.Close()
+			return
+		}
+		splice(local, st)
+	}()
+
+	// Expose side: the stream is spliced onto a connection to the target,
+	// which answers only after its input ends.
+	target, server := tcpPair(t)
+	go func() {
+		st, err := exposeMux.AcceptStream()
+		if err != nil {
+			return
+		}
+		splice(target, st)
+	}()
+	go func() {
+		data, _ := io.ReadAll(server)
+		fmt.Fprintf(server, "got %d bytes", len(data))
+		server.Close()
+	}()
+
+	if _, err := client.Write([]byte("hello through the tunnel")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	client.CloseWrite()
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(reply) != "got 24 bytes" {
+		t.Fatalf("reply = %q", reply)
+	}
+}
+
+func TestEndTunnel(t *testing.T) {
+	if err := endTunnel(true, nil, mux.ErrClosed, nil); err != nil {
+		t.Errorf("canceled: got %v, want nil", err)
+	}
+	if err := endTunnel(false, fmt.Errorf("%w by peer", ErrCanceled), mux.ErrClosed, nil); err != nil {
+		t.Errorf("peer canceled: got %v, want nil", err)
+	}
+	if err := endTunnel(false, nil, io.EOF, nil); err != nil {
+		t.Errorf("peer disconnected: got %v, want nil", err)
+	}
+	remote := &RemoteError{Code: "io_error", Reason: "boom"}
+	if err := endTunnel(false, remote, mux.ErrClosed, nil); err != remote {
+		t.Errorf("peer error: got %v, want %v", err, remote)
+	}
+	if err := endTunnel(false, nil, io.ErrUnexpectedEOF, nil); err != io.ErrUnexpectedEOF {
+		t.Errorf("session failure: got %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestExposeForward_CanceledContextClosesTheTunnel(t *testing.T) {
+	// The exposed service echoes each connection back.
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	listening := make(chan string, 1)
+	exposed := make(chan error, 1)
+	go func() {
+		exposed <- Expose(context.Background(), target.Addr().String(), ExposeOptions{
+			ListenAddr: "127.0.0.1:0",
+			Events: func(e Event) {
+				if e.Kind == EventListening {
+					listening <- e.Addr
+				}
+			},
+		})
+	}()
+	var addr string
+	select {
+	case addr = <-listening:
+	case err := <-exposed:
+		t.Fatalf("expose: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expose never started listening")
+	}
+
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	localAddr := local.Addr().String()
+	local.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	connected := make(chan struct{}, 1)
+	forwarded := make(chan error, 1)
+	go func() {
+		forwarded <- Forward(ctx, addr, localAddr, ForwardOptions{
+			Events: func(e Event) {
+				if e.Kind == EventConnected {
+					connected <- struct{}{}
+				}
+			},
+		})
+	}()
+	select {
+	case <-connected:
+	case err := <-forwarded:
+		t.Fatalf("forward: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("forward never connected")
+	}
+
+	conn, err := net.Dial("tcp", localAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+		t.Fatalf("reply = %q, %v", reply, err)
+	}
+
+	cancel()
+	for name, done := range map[string]chan error{"forward": forwarded, "expose": exposed} {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("%s = %v, want nil once the tunnel is closed", name, err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s did not stop after cancel", name)
+		}
+	}
+}
+
+func TestExpose_CanceledWhileWaiting(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	listening := make(chan struct{}, 1)
+	exposed := make(chan error, 1)
+	go func() {
+		exposed <- Expose(ctx, "127.0.0.1:1", ExposeOptions{
+			ListenAddr: "127.0.0.1:0",
+			Events: func(e Event) {
+				if e.Kind == EventListening {
+					listening <- struct{}{}
+				}
+			},
+		})
+	}()
+	select {
+	case <-listening:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expose never started listening")
+	}
+	cancel()
+
+	select {
+	case err := <-exposed:
+		if !errors.Is(err, ErrCanceled) {
+			t.Fatalf("expose = %v, want ErrCanceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expose did not stop after cancel")
+	}
+}
@@ -8,11 +8,14 @@ import (
 	"path/filepath"
 
 	"github.com/jlaffaye/ftp"
-	"github.com/schollz/progressbar/v3"
 )
 
-// FTPSTransfer handles file or directory transfer over explicit FTPS (FTP with TLS)
-func FTPSTransfer(username, password, host, port, srcPath, destDir string, maxRetries int, insecure bool) error {
+// FTPSTransfer handles file or directory transfer over explicit FTPS (FTP with TLS).
+// Status and progress bars are printed to out and events passed to events; either may be nil.
+func FTPSTransfer(username, password, host, port, srcPath, destDir string, maxRetries int, insecure bool, out io.Writer, events func(Event)) (err error) {
+	r := newReporter(out, events)
+	defer func() { r.finish(err) }()
+
 	tlsConfig := &tls.Config{
 		InsecureSkipVerify: insecure,
 		ServerName:         host,
@@ -44,7 +47,7 @@ func FTPSTransfer(username, password, host, port, srcPath, destDir string, maxRe
 		}
 
 		if info.IsDir() {
-			fmt.Printf("Creating directory: %s\n", remotePath)
+			r.printf("Creating directory: %s\n", remotePath)
 			_ = conn.MakeDir(remotePath)
 			return nil
 		}
@@ -52,50 +55,53 @@ func FTPSTransfer(username, password, host, port, srcPath, destDir string, maxRe
 		parentDir := filepath.Dir(remotePath)
 		_ = conn.MakeDir(parentDir)
 
-		return transferFileWithRetry(conn, path, remotePath, info, maxRetries)
+		return transferFileWithRetry(r, conn, path, remotePath, info, maxRetries)
 	})
 }
 
-func transferFileWithRetry(conn *ftp.ServerConn, localPath, remotePath string, info os.FileInfo, maxRetries int) error {
+func transferFileWithRetry(r *reporter, conn *ftp.ServerConn, localPath, remotePath string, info os.FileInfo, maxRetries int) error {
 	for attempt := 1; attempt <= maxRetries+1; attempt++ {
 		if attempt > 1 {
-			fmt.Printf("Retrying transfer of %s (attempt %d of %d)...\n", localPath, attempt, maxRetries+1)
+			r.printf("Retrying transfer of %s (attempt %d of %d)...\n", localPath, attempt, maxRetries+1)
 		}
 
-		fmt.Printf("Transferring file: %s to %s\n", localPath, remotePath)
+		r.printf("Transferring file: %s to %s\n", localPath, remotePath)
+		r.emit(Event{Kind: EventFileStarted, Name: localPath, Size: info.Size(), Path: remotePath})
 
 		srcFile, err := os.Open(localPath)
 		if err != nil {
 			return fmt.Errorf("failed to open local file %s: %v", localPath, err)
 		}
 
-		bar := progressbar.DefaultBytes(info.Size(), "Transferring")
+		bar := r.newProgress(localPath, info.Size())
 		err = conn.Stor(remotePath, io.TeeReader(srcFile, bar))
+		bar.finish()
 		srcFile.Close()
 
 		if err != nil {
 			if attempt == maxRetries+1 {
 				return fmt.Errorf("failed to transfer %s after %d attempts: %v", localPath, maxRetries+1, err)
 			}
-			fmt.Printf("Transfer failed for %s: %v\n", localPath, err)
+			r.fileFailed(localPath, "Transfer failed for %s: %v", localPath, err)
 			continue
 		}
 
 		remoteSize, err := conn.FileSize(remotePath)
 		if err != nil {
-			fmt.Printf("Warning: could not verify size of %s: %v\n", remotePath, err)
+			r.printf("Warning: could not verify size of %s: %v\n", remotePath, err)
 			return nil
 		}
 
 		if remoteSize != info.Size() {
-			fmt.Printf("Size mismatch for %s: local=%d remote=%d\n", localPath, info.Size(), remoteSize)
+			r.fileFailed(localPath, "Size mismatch for %s: local=%d remote=%d", localPath, info.Size(), remoteSize)
 			if attempt == maxRetries+1 {
 				return fmt.Errorf("failed to verify %s after %d attempts", localPath, maxRetries+1)
 			}
 			continue
 		}
 
-		fmt.Printf("Successfully transferred: %s (size verified)\n", localPath)
+		r.printf("Successfully transferred: %s (size verified)\n", localPath)
+		r.emit(Event{Kind: EventFileVerified, Name: localPath, Size: info.Size(), Path: remotePath})
 		return nil
 	}
 	return nil
@@ -0,0 +1,130 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/JonathanInTheClouds/goxfer/internal/protocol"
+	"github.com/JonathanInTheClouds/goxfer/internal/session"
+)
+
+// ErrIncompatiblePeer is returned when the two sides cannot agree on a
+// protocol version or a required feature.
+var ErrIncompatiblePeer = errors.New("incompatible peer")
+
+// features are what both peers agreed to use for this session.
+type features struct {
+	version   int
+	resume    bool
+	hash      string
+	chunkSize int
+	mux       bool
+	keepalive bool
+	rekey     bool
+	tree      bool
+	selection bool
+	parallel  bool // only with mux
+	batch     bool
+	pipe      bool
+}
+
+// localHello announces what this build supports. Resume can be turned off
+// locally, which turns it off for the session.
+func localHello(resume bool) protocol.Message {
+	hello := protocol.Message{
+		Type:         protocol.MessageTypeHello,
+		Version:      protocol.ProtocolVersion,
+		Hashes:       []string{protocol.HashSHA256},
+		MaxChunkSize: protocol.FileChunkSize,
+		Capabilities: []string{protocol.CapabilityMux, protocol.CapabilityKeepalive, protocol.CapabilityRekey, protocol.CapabilityTree, protocol.CapabilitySelect, protocol.CapabilityParallel, protocol.CapabilityBatch, protocol.CapabilityPipe},
+	}
+	if resume {
+		hello.Capabilities = append(hello.Capabilities, protocol.CapabilityResume)
+	}
+	return hello
+}
+
+// negotiate picks the features both hellos support. It gives the same answer
+// on both sides regardless of which hello is local.
+func negotiate(local, remote protocol.Message) (features, error) {
+	version := min(local.Version, remote.Version)
+	if version < protocol.MinProtocolVersion {
+		return features{}, fmt.Errorf("%w: peer speaks protocol version %d, this goxfer needs %d to %d; upgrade goxfer on the older side",
+			ErrIncompatiblePeer, remote.Version, protocol.MinProtocolVersion, protocol.ProtocolVersion)
+	}
+
+	// Both sides must pick the same hash, so take the lowest-sorted shared one.
+	var hash string
+	for _, h := range local.Hashes {
+		if slices.Contains(remote.Hashes, h) && (hash == "" || h < hash) {
+			hash = h
+		}
+	}
+	if hash == "" {
+		return features{}, fmt.Errorf("%w: no checksum algorithm in common (peer supports %v)", ErrIncompatiblePeer, remote.Hashes)
+	}
+
+	has := func(capability string) bool {
+		return slices.Contains(local.Capabilities, capability) && slices.Contains(remote.Capabilities, capability)
+	}
+	return features{
+		version:   version,
+		resume:    has(protocol.CapabilityResume),
+		hash:      hash,
+		chunkSize: min(local.MaxChunkSize, remote.MaxChunkSize),
+		mux:       has(protocol.CapabilityMux),
+		keepalive: has(protocol.CapabilityKeepalive),
+		rekey:     has(protocol.CapabilityRekey),
+		tree:      has(protocol.CapabilityTree),
+		selection: has(protocol.CapabilitySelect),
+		parallel:  has(protocol.CapabilityMux) && has(protocol.CapabilityParallel),
+		batch:     has(protocol.CapabilityBatch),
+		pipe:      has(protocol.CapabilityPipe),
+	}, nil
+}
+
+// startKeepalive bounds how long sess waits on a silent peer. Peers that
+// cannot answer pings get no idle timeout, as before.
+func startKeepalive(sess *session.SecureSession, feat features, idleTimeout time.Duration) {
+	if !feat.keepalive {
+		return
+	}
+	if idleTimeout <= 0 {
+		idleTimeout = session.DefaultIdleTimeout
+	}
+	sess.SetKeepalive(idleTimeout/3, idleTimeout)
+}
+
+// exchangeHello swaps hello messages right after the handshake. The
+// handshake initiator speaks first; a side that cannot work with the other
+// answers with an error message instead so both report the same reason.
+func exchangeHello(sess *session.SecureSession, local protocol.Message) (features, error) {
+	if sess.Initiator() {
+		if err := sess.SendMessage(local); err != nil {
+			return features{}, fmt.Errorf("send hello: %w", err)
+		}
+	}
+
+	remote, err := receiveMessage(sess)
+	if err != nil {
+		return features{}, fmt.Errorf("receive hello: %w", err)
+	}
+	if remote.Type != protocol.MessageTypeHello {
+		err := fmt.Errorf("%w: expected hello, got %q; the peer is likely running an older goxfer", ErrIncompatiblePeer, remote.Type)
+		return features{}, abortTransfer(sess, err)
+	}
+
+	feat, err := negotiate(local, remote)
+	if err != nil {
+		return features{}, abortTransfer(sess, err)
+	}
+
+	if !sess.Initiator() {
+		if err := sess.SendMessage(local); err != nil {
+			return features{}, fmt.Errorf("send hello: %w", err)
+		}
+	}
+	return feat, nil
+}
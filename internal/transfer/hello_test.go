@@ -0,0 +1,107 @@
+package transfer
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/JonathanInTheClouds/goxfer/internal/protocol"
+)
+
+func TestNegotiate(t *testing.T) {
+	small := localHello(true)
+	small.MaxChunkSize = 8 * 1024
+
+	tests := []struct {
+		name       string
+		local      protocol.Message
+		remote     protocol.Message
+		wantResume bool
+		wantChunk  int
+	}{
+		{"both resume", localHello(true), localHello(true), true, protocol.FileChunkSize},
+		{"local opts out of resume", localHello(false), localHello(true), false, protocol.FileChunkSize},
+		{"remote opts out of resume", localHello(true), localHello(false), false, protocol.FileChunkSize},
+		{"smaller peer chunk size wins", localHello(true), small, true, 8 * 1024},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			feat, err := negotiate(tt.local, tt.remote)
+			if err != nil {
+				t.Fatalf("negotiate: %v", err)
+			}
+			if feat.resume != tt.wantResume || feat.chunkSize != tt.wantChunk || feat.hash != protocol.HashSHA256 {
+				t.Fatalf("negotiate = %+v, want resume=%v chunkSize=%d hash=%s", feat, tt.wantResume, tt.wantChunk, protocol.HashSHA256)
+			}
+			// Both sides must reach the same answer.
+			if other, _ := negotiate(tt.remote, tt.local); other != feat {
+				t.Fatalf("negotiate is not symmetric: %+v vs %+v", feat, other)
+			}
+		})
+	}
+}
+
+func TestNegotiate_Incompatible(t *testing.T) {
+	old := localHello(true)
+	old.Version = protocol.MinProtocolVersion - 1
+	if _, err := negotiate(localHello(true), old); !errors.Is(err, ErrIncompatiblePeer) {
+		t.Fatalf("old version: got %v, want ErrIncompatiblePeer", err)
+	}
+
+	noHash := localHello(true)
+	noHash.Hashes = []string{"md5"}
+	if _, err := negotiate(localHello(true), noHash); !errors.Is(err, ErrIncompatiblePeer) {
+		t.Fatalf("no shared hash: got %v, want ErrIncompatiblePeer", err)
+	}
+}
+
+func TestExchangeHello(t *testing.T) {
+	senderSess, receiverSess := makePair(t)
+	defer senderSess.Close()
+	defer receiverSess.Close()
+
+	type result struct {
+		feat features
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		feat, err := exchangeHello(senderSess, localHello(true))
+		ch <- result{feat, err}
+	}()
+
+	recvFeat, err := exchangeHello(receiverSess, localHello(false))
+	if err != nil {
+		t.Fatalf("receiver exchangeHello: %v", err)
+	}
+	r := <-ch
+	if r.err != nil {
+		t.Fatalf("sender exchangeHello: %v", r.err)
+	}
+	if r.feat != recvFeat {
+		t.Fatalf("sides disagree: sender %+v, receiver %+v", r.feat, recvFeat)
+	}
+	if recvFeat.resume {
+		t.Fatal("resume should be off when the receiver opts out")
+	}
+}
+
+func TestExchangeHello_IncompatiblePeerReportedToBothSides(t *testing.T) {
+	senderSess, receiverSess := makePair(t)
+	defer senderSess.Close()
+	defer receiverSess.Close()
+
+	sendErr := make(chan error, 1)
+	go func() {
+		_, err := exchangeHello(senderSess, localHello(true))
+		sendErr <- err
+	}()
+
+	future := localHello(true)
+	future.Hashes = []string{"blake3"}
+	if _, err := exchangeHello(receiverSess, future); !errors.Is(err, ErrIncompatiblePeer) {
+		t.Fatalf("receiver got %v, want ErrIncompatiblePeer", err)
+	}
+	if err := <-sendErr; !errors.Is(err, ErrIncompatiblePeer) {
+		t.Fatalf("sender got %v, want ErrIncompatiblePeer", err)
+	}
+}
@@ -0,0 +1,183 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JonathanInTheClouds/goxfer/internal/crypto"
+)
+
+// inboxPairings is how many senders an inbox's relay code pairs with before
+// the inbox registers it again. More than one keeps the code alive at the
+// relay between two transfers.
+const inboxPairings = 100
+
+// ServeInbox keeps receiving transfers from the senders in opts.Allowed,
+// each into its own subdirectory of inbox, until ctx is canceled. Senders
+// dial in, directly to opts.ListenAddr or through the relay at
+// opts.RelayAddr, and may deliver at the same time; anyone else is turned
+// away before offering anything. Offers within opts.MaxSize are accepted
+// with opts.Yes or as opts.AcceptOffer decides; nobody is there to ask.
+// ServeInbox returns nil once ctx is canceled, after the transfers still
+// running have been canceled too.
+func ServeInbox(ctx context.Context, inbox string, opts ReceiveOptions) (err error) {
+	r := newReporter(opts.Output, opts.Events)
+	defer func() { r.finish(err) }()
+
+	switch {
+	case opts.ListenAddr == "" && opts.RelayAddr == "":
+		return errors.New("an inbox waits for senders: give a ListenAddr or a RelayAddr")
+	case opts.ListenAddr != "" && opts.RelayAddr != "":
+		return errors.New("wait on either a ListenAddr or a RelayAddr, not both")
+	case opts.Verify || opts.Pick:
+		return errors.New("an inbox runs unattended, so it cannot confirm verification symbols or pick files")
+	case !opts.Yes && opts.AcceptOffer == nil:
+		return errors.New("an inbox runs unattended, so it needs Yes or AcceptOffer to decide offers")
+	}
+	allowed, err := inboxSenders(opts.Allowed)
+	if err != nil {
+		return err
+	}
+	for _, patterns := range [][]string{opts.Include, opts.Exclude} {
+		if err := validatePatterns(patterns); err != nil {
+			return err
+		}
+	}
+	identity, err := resolveIdentity(opts.Identity)
+	if err != nil {
+		return err
+	}
+	r.self = identity.Fingerprint()
+
+	rv := rendezvous{relayAddr: opts.RelayAddr, listenAddr: opts.ListenAddr, publicAddr: opts.PublicAddr, pairings: inboxPairings, code: opts.Code}
+	w, err := listenForPeer(ctx, identity, rv, peerPrompt{command: "goxfer send", arg: "<path>", peer: "sender"}, r)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	serveSenders(ctx, w, inbox, allowed, opts, r)
+	return nil
+}
+
+// inboxSenders checks the allow-list of an inbox and returns it keyed by
+// canonical fingerprint. A sender without a name is filed under its
+// fingerprint.
+func inboxSenders(allowed map[string]string) (map[string]string, error) {
+	if len(allowed) == 0 {
+		return nil, errors.New("an inbox needs at least one allowed sender")
+	}
+	senders := make(map[string]string, len(allowed))
+	for fp, name := range allowed {
+		canonical, err := crypto.ParseFingerprint(fp)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			name = strings.ReplaceAll(canonical, ":", "")
+		}
+		if name == "." || name == ".." || name != filepath.Base(name) || strings.ContainsAny(name, `/\`) {
+			return nil, fmt.Errorf("cannot file transfers from %s under %q: use a plain directory name", canonical, name)
+		}
+		senders[canonical] = name
+	}
+	return senders, nil
+}
+
+// serveSenders receives from each allowed sender that connects through w
+// into its subdirectory of inbox until ctx is canceled, then waits for the
+// transfers still running. Transfers from different senders overlap, so r
+// prints one line per transfer rather than progress; events are still
+// reported for each. Each handshake runs on its own goroutine, so a
+// connection that stays silent holds up no one else. A sender's transfers
+// run one at a time, so one that reconnects after a drop resumes once the
+// broken session has ended.
+func serveSenders(ctx context.Context, w *peerWaiter, inbox string, allowed map[string]string, opts ReceiveOptions, r *reporter) {
+	quiet := &reporter{events: r.events, self: r.self}
+	w.report = quiet
+
+	r.printf("\nFiling transfers from %d allowed senders into %s\n", len(allowed), inbox)
+	defer context.AfterFunc(ctx, func() { w.Close() })()
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		locks = make(map[string]*sync.Mutex) // one transfer at a time per sender
+	)
+	for {
+		w.pairings = inboxPairings
+		conn, err := w.acceptConn(0)
+		if ctx.Err() != nil {
+			if conn != nil {
+				conn.Close()
+			}
+			break
+		}
+		if err != nil {
+			// The relay drops a code nobody has used for a while; it is
+			// registered again without fuss.
+			if !errors.Is(err, io.EOF) {
+				r.printf("A sender failed to connect: %v\n", err)
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(acceptRetryDelay):
+			}
+			continue
+		}
+
+		// The handshake runs beside the loop, so a sender that connects and
+		// says nothing cannot keep the others out.
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sess, err := w.handshake(ctx, conn)
+			if err != nil {
+				if ctx.Err() == nil {
+					r.printf("A sender failed to connect: %v\n", err)
+				}
+				return
+			}
+
+			fp := sess.PeerFingerprint()
+			name, ok := allowed[fp]
+			if !ok {
+				refused := fmt.Errorf("this inbox does not accept transfers from %s", fp)
+				quiet.forPeer(fp).emit(Event{Kind: EventError, Error: refused.Error()})
+				r.printf("✗  Refused a transfer from %s\n", fp)
+				abortTransfer(sess, refused)
+				sess.Close()
+				return
+			}
+			mu.Lock()
+			lock, ok := locks[fp]
+			if !ok {
+				lock = &sync.Mutex{}
+				locks[fp] = lock
+			}
+			mu.Unlock()
+			lock.Lock()
+			defer lock.Unlock()
+
+			dir := filepath.Join(inbox, name)
+			r.printf("%s connected\n", name)
+			policy := offerPolicy{yes: opts.Yes, maxSize: opts.MaxSize, accept: opts.AcceptOffer}
+			check := peerCheck{idleTimeout: opts.IdleTimeout, report: quiet}
+			filter := &fileFilter{include: opts.Include, exclude: opts.Exclude}
+			err = receiveSession(ctx, sess, dir, !opts.NoResume, check, &policy, filter)
+			if err != nil {
+				quiet.forPeer(fp).emit(Event{Kind: EventError, Error: err.Error()})
+				r.printf("✗  %s: %v\n", name, err)
+			} else {
+				quiet.forPeer(fp).emit(Event{Kind: EventDone})
+				r.printf("✓  Received from %s into %s — checksum verified\n", name, dir)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,180 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JonathanInTheClouds/goxfer/internal/crypto"
+	"github.com/JonathanInTheClouds/goxfer/internal/tunnel"
+)
+
+// startInbox runs ServeInbox until the test ends and returns the address
+// it tells senders to dial.
+func startInbox(t *testing.T, inbox string, opts ReceiveOptions) string {
+	t.Helper()
+	listening := make(chan string, 1)
+	opts.Events = func(e Event) {
+		if e.Kind == EventListening {
+			listening <- e.Addr
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- ServeInbox(ctx, inbox, opts) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-served; err != nil {
+			t.Errorf("inbox: %v", err)
+		}
+	})
+
+	select {
+	case addr := <-listening:
+		return addr
+	case err := <-served:
+		t.Fatalf("inbox: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("inbox never started listening")
+	}
+	return ""
+}
+
+func newTestIdentity(t *testing.T) *crypto.Identity {
+	t.Helper()
+	identity, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity
+}
+
+func writeTestFile(t *testing.T, name, data string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestServeInbox_FilesAllowedSendersAndRefusesOthers(t *testing.T) {
+	alice, mallory := newTestIdentity(t), newTestIdentity(t)
+	inbox := t.TempDir()
+	addr := startInbox(t, inbox, ReceiveOptions{
+		ListenAddr: "127.0.0.1:0",
+		Yes:        true,
+		Allowed:    map[string]string{alice.Fingerprint(): "alice"},
+	})
+
+	// The inbox keeps listening after each transfer.
+	for _, name := range []string{"notes.txt", "photo.jpg"} {
+		src := writeTestFile(t, name, "from alice: "+name)
+		if err := P2PSend(context.Background(), []string{src}, SendOptions{ReceiverAddr: addr, Identity: alice}); err != nil {
+			t.Fatalf("send %s: %v", name, err)
+		}
+		got, err := os.ReadFile(filepath.Join(inbox, "alice", name))
+		if err != nil || string(got) != "from alice: "+name {
+			t.Errorf("%s: got %q, %v", name, got, err)
+		}
+	}
+
+	src := writeTestFile(t, "payload.exe", "unwanted")
+	err := P2PSend(context.Background(), []string{src}, SendOptions{ReceiverAddr: addr, Identity: mallory, Retry: RetryPolicy{}})
+	var remote *RemoteError
+	if !errors.As(err, &remote) {
+		t.Fatalf("send from a stranger = %v, want the inbox to refuse it", err)
+	}
+	entries, _ := os.ReadDir(inbox)
+	if len(entries) != 1 || entries[0].Name() != "alice" {
+		t.Errorf("inbox holds %v, want only alice's directory", entries)
+	}
+}
+
+func TestServeInbox_OverRelayWithFixedCode(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tunnel.Serve(l)
+	t.Cleanup(func() { l.Close() })
+	relayAddr := l.Addr().String()
+
+	bob := newTestIdentity(t)
+	inbox := t.TempDir()
+	const code = "inbox-correct-horse-battery"
+	startInbox(t, inbox, ReceiveOptions{
+		RelayAddr: relayAddr,
+		Code:      code,
+		Yes:       true,
+		Allowed:   map[string]string{bob.Fingerprint(): ""},
+	})
+
+	// Without a name, the sender is filed under its fingerprint.
+	dir := filepath.Join(inbox, strings.ReplaceAll(bob.Fingerprint(), ":", ""))
+	for _, name := range []string{"a.csv", "b.csv"} {
+		src := writeTestFile(t, name, name)
+		if err := P2PSend(context.Background(), []string{src}, SendOptions{ReceiverAddr: relayAddr, Code: code, Identity: bob}); err != nil {
+			t.Fatalf("send %s: %v", name, err)
+		}
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(got) != name {
+			t.Errorf("%s: got %q, %v", name, got, err)
+		}
+	}
+}
+
+func TestInboxSenders(t *testing.T) {
+	fp := newTestIdentity(t).Fingerprint()
+	if _, err := inboxSenders(nil); err == nil {
+		t.Error("an empty allow-list was accepted")
+	}
+	for _, name := range []string{"..", "a/b", `a\b`} {
+		if _, err := inboxSenders(map[string]string{fp: name}); err == nil {
+			t.Errorf("subdirectory %q was accepted", name)
+		}
+	}
+	if _, err := inboxSenders(map[string]string{"not-a-fingerprint": "x"}); err == nil {
+		t.Error("a bad fingerprint was accepted")
+	}
+}
+
+func TestServeInbox_SilentConnectionDoesNotBlockSenders(t *testing.T) {
+	alice := newTestIdentity(t)
+	inbox := t.TempDir()
+	addr := startInbox(t, inbox, ReceiveOptions{
+		ListenAddr: "127.0.0.1:0",
+		Yes:        true,
+		Allowed:    map[string]string{alice.Fingerprint(): "alice"},
+	})
+
+	// Connects first and never sends a handshake message.
+	silent, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	src := writeTestFile(t, "notes.txt", "from alice")
+	sent := make(chan error, 1)
+	go func() {
+		sent <- P2PSend(context.Background(), []string{src}, SendOptions{ReceiverAddr: addr, Identity: alice})
+	}()
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("a silent connection kept the sender waiting")
+	}
+	if got, err := os.ReadFile(filepath.Join(inbox, "alice", "notes.txt")); err != nil || string(got) != "from alice" {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
@@ -0,0 +1,414 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/JonathanInTheClouds/goxfer/internal/crypto"
+	"github.com/JonathanInTheClouds/goxfer/internal/protocol"
+	"github.com/JonathanInTheClouds/goxfer/internal/session"
+)
+
+// ErrDeclined is returned on both sides when the receiver declines the
+// sender's offer.
+var ErrDeclined = errors.New("offer declined")
+
+// offerPolicy decides how the receiver answers an incoming offer.
+type offerPolicy struct {
+	yes     bool  // accept without prompting
+	maxSize int64 // decline offers larger than this; 0 means no limit
+	// accept decides an offer within maxSize instead of asking on stdin.
+	accept func(Offer) (bool, error)
+	// expect is the offer accepted before the connection dropped. A
+	// reconnecting sender must make the same offer, which is then
+	// accepted without asking again.
+	expect *protocol.Message
+	// single declines offers of more than one file, for a receiver
+	// writing to stdout.
+	single bool
+}
+
+// sendItem is one path given to send: a file or a directory, or data
+// read from pipe and named path.
+type sendItem struct {
+	path string
+	info os.FileInfo
+	pipe io.Reader
+}
+
+// statItems resolves the paths given to send. Each item arrives under its
+// base name, so no two may share one.
+func statItems(paths []string) ([]sendItem, error) {
+	items := make([]sendItem, 0, len(paths))
+	seen := make(map[string]string)
+	for _, p := range paths {
+		if p == "-" {
+			return nil, errors.New("- sends stdin and must be the only path")
+		}
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, fmt.Errorf("stat source: %w", err)
+		}
+		name := filepath.Base(p)
+		if other, dup := seen[name]; dup {
+			return nil, fmt.Errorf("%s and %s would both arrive as %q; send them separately", other, p, name)
+		}
+		seen[name] = p
+		items = append(items, sendItem{path: p, info: info})
+	}
+	return items, nil
+}
+
+// buildOffer describes items for the receiver: their name, total size and
+// number of files. An offer of several items also lists each of them, and
+// is named after the first.
+func buildOffer(items []sendItem, fingerprint string) (protocol.Message, error) {
+	offer := protocol.Message{
+		Type:        protocol.MessageTypeOffer,
+		Name:        filepath.Base(items[0].path),
+		Fingerprint: fingerprint,
+	}
+	if items[0].pipe != nil {
+		offer.Size, offer.Count, offer.Pipe = -1, 1, true
+		return offer, nil
+	}
+	for _, item := range items {
+		size, count, err := measureItem(item)
+		if err != nil {
+			return protocol.Message{}, err
+		}
+		offer.Size += size
+		offer.Count += count
+		if len(items) > 1 {
+			offer.Entries = append(offer.Entries, protocol.ManifestEntry{
+				Path: filepath.Base(item.path),
+				Dir:  item.info.IsDir(),
+				Size: size,
+			})
+		}
+	}
+	return offer, nil
+}
+
+// measureItem returns the total size and number of files of item.
+func measureItem(item sendItem) (int64, int, error) {
+	if !item.info.IsDir() {
+		return item.info.Size(), 1, nil
+	}
+
+	var size int64
+	var count int
+	err := filepath.Walk(item.path, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("scan directory: %w", err)
+	}
+	if count == 0 {
+		// An empty directory is still one item to create.
+		count = 1
+	}
+	return size, count, nil
+}
+
+// offerItems lists the names of the items in offer.
+func offerItems(offer protocol.Message) []string {
+	if len(offer.Entries) == 0 {
+		return []string{offer.Name}
+	}
+	names := make([]string, len(offer.Entries))
+	for i, e := range offer.Entries {
+		names[i] = e.Path
+		if e.Dir {
+			names[i] += "/"
+		}
+	}
+	return names
+}
+
+// offerSummary describes the size of an offer, e.g. "1.2 GiB, 3 files".
+func offerSummary(offer protocol.Message) string {
+	if offer.Pipe {
+		return "streamed from a pipe, size unknown"
+	}
+	files := "1 file"
+	if offer.Count != 1 {
+		files = fmt.Sprintf("%d files", offer.Count)
+	}
+	return fmt.Sprintf("%s, %s", formatBytes(offer.Size), files)
+}
+
+// sendOffer sends the offer and waits for the receiver's answer.
+func sendOffer(r *reporter, sess *session.SecureSession, offer protocol.Message) error {
+	if err := sess.SendMessage(offer); err != nil {
+		return fmt.Errorf("send offer: %w", err)
+	}
+
+	o := newOffer(offer)
+	r.emit(Event{Kind: EventOffer, Offer: &o})
+	r.println("Waiting for receiver to accept...")
+	reply, err := receiveMessage(sess)
+	if err != nil {
+		return fmt.Errorf("receive offer reply: %w", err)
+	}
+
+	switch reply.Type {
+	case protocol.MessageTypeOfferAccept:
+		r.println("✓  Receiver accepted")
+		r.emit(Event{Kind: EventAccepted})
+		return nil
+	case protocol.MessageTypeOfferDecline:
+		if reply.Reason != "" {
+			return fmt.Errorf("%w: %s", ErrDeclined, reply.Reason)
+		}
+		return ErrDeclined
+	default:
+		return fmt.Errorf("expected offer reply, got %q", reply.Type)
+	}
+}
+
+// awaitOffer reads the sender's offer and accepts or declines it according
+// to policy, prompting the user when needed. It returns the accepted offer.
+func awaitOffer(r *reporter, sess *session.SecureSession, policy offerPolicy) (protocol.Message, error) {
+	offer, err := receiveMessage(sess)
+	if err != nil {
+		return protocol.Message{}, fmt.Errorf("receive offer: %w", err)
+	}
+	if offer.Type == protocol.MessageTypeExpose {
+		return protocol.Message{}, abortTransfer(sess, errors.New("peer is exposing a port, not sending files; use goxfer forward"))
+	}
+	if offer.Type != protocol.MessageTypeOffer {
+		return protocol.Message{}, fmt.Errorf("expected offer, got %q", offer.Type)
+	}
+
+	if !crypto.FingerprintsMatch(offer.Fingerprint, sess.PeerFingerprint()) {
+		decline(sess, "offer fingerprint does not match session")
+		return protocol.Message{}, fmt.Errorf("offer claims fingerprint %s but the session peer is %s", offer.Fingerprint, sess.PeerFingerprint())
+	}
+
+	if policy.expect != nil {
+		if offer.Name != policy.expect.Name || offer.Size != policy.expect.Size || offer.Count != policy.expect.Count ||
+			!slices.Equal(offerItems(offer), offerItems(*policy.expect)) {
+			reason := "offer changed since the connection dropped"
+			decline(sess, reason)
+			return protocol.Message{}, fmt.Errorf("%w: %s", ErrDeclined, reason)
+		}
+		if err := sess.SendMessage(protocol.Message{Type: protocol.MessageTypeOfferAccept}); err != nil {
+			return protocol.Message{}, fmt.Errorf("send offer accept: %w", err)
+		}
+		return offer, nil
+	}
+
+	o := newOffer(offer)
+	r.emit(Event{Kind: EventOffer, Offer: &o})
+	r.printf("\nIncoming offer   : %s  (%s)\n", strings.Join(offerItems(offer), ", "), offerSummary(offer))
+
+	if policy.single && (offer.Count != 1 || len(offer.Entries) > 0) {
+		reason := "receiver writes to stdout and takes a single file"
+		decline(sess, reason)
+		return protocol.Message{}, fmt.Errorf("%w: %s", ErrDeclined, reason)
+	}
+
+	if policy.maxSize > 0 && offer.Size > policy.maxSize {
+		reason := fmt.Sprintf("offer of %s exceeds the receiver's limit of %s", formatBytes(offer.Size), formatBytes(policy.maxSize))
+		decline(sess, reason)
+		return protocol.Message{}, fmt.Errorf("%w: %s", ErrDeclined, reason)
+	}
+
+	if !policy.yes {
+		var ok bool
+		if policy.accept != nil {
+			ok, err = policy.accept(o)
+		} else {
+			ok, err = promptYesNo(r, "Accept this transfer? [y/N]: ")
+		}
+		if err != nil {
+			decline(sess, "receiver did not answer")
+			return protocol.Message{}, fmt.Errorf("answer offer: %w", err)
+		}
+		if !ok {
+			decline(sess, "declined by user")
+			return protocol.Message{}, fmt.Errorf("%w by user", ErrDeclined)
+		}
+	}
+
+	if err := sess.SendMessage(protocol.Message{Type: protocol.MessageTypeOfferAccept}); err != nil {
+		return protocol.Message{}, fmt.Errorf("send offer accept: %w", err)
+	}
+	r.emit(Event{Kind: EventAccepted})
+	return offer, nil
+}
+
+// decline tells the sender the offer was refused. Errors are ignored since
+// the receiver is about to give up on the session anyway.
+func decline(sess *session.SecureSession, reason string) {
+	sess.SendMessage(protocol.Message{Type: protocol.MessageTypeOfferDecline, Reason: reason})
+}
+
+// ErrOfferMismatch is returned when the sender sends something other than
+// the offer the receiver accepted.
+var ErrOfferMismatch = errors.New("transfer does not match the accepted offer")
+
+// offerLimit holds the sender to the accepted offer, so that --max-size and
+// the accept prompt cannot be talked around: each item that arrives must be
+// one of those offered, and all of it must not add up to more files or
+// bytes than offered.
+type offerLimit struct {
+	offer   protocol.Message
+	pending map[string]bool // offered items not yet started
+	mu      sync.Mutex      // files and bytes are counted from every lane
+	files   int             // file_starts seen in this session
+	bytes   int64           // file data received in this session
+	// unpacked counts the files and bytes extracted from a tar.gz.
+	unpackedFiles int
+	unpackedBytes int64
+	// budget is how much data may arrive. It exceeds the offer's size only
+	// for a streamed tar.gz, which carries headers and padding, and piped
+	// data of unknown size, which only --max-size bounds.
+	budget int64
+}
+
+func newOfferLimit(offer protocol.Message) *offerLimit {
+	l := &offerLimit{offer: offer, pending: make(map[string]bool), budget: offer.Size}
+	if offer.Pipe {
+		l.budget = math.MaxInt64
+	}
+	if len(offer.Entries) == 0 {
+		l.pending[offer.Name] = true
+	}
+	for _, e := range offer.Entries {
+		l.pending[e.Path] = true
+	}
+	return l
+}
+
+// claim marks the offered item name as arriving. Each item arrives once.
+func (l *offerLimit) claim(kind, name string) error {
+	if !l.pending[name] {
+		return fmt.Errorf("%w: got %s %q, which was not offered or already arrived", ErrOfferMismatch, kind, name)
+	}
+	delete(l.pending, name)
+	return nil
+}
+
+// complete reports whether every offered item has arrived.
+func (l *offerLimit) complete() error {
+	if l == nil || len(l.pending) == 0 {
+		return nil
+	}
+	missing := make([]string, 0, len(l.pending))
+	for name := range l.pending {
+		missing = append(missing, name)
+	}
+	slices.Sort(missing)
+	return fmt.Errorf("%w: sender finished without sending %s", ErrOfferMismatch, strings.Join(missing, ", "))
+}
+
+// archiveOverhead bounds how much larger than its files' contents a tar.gz
+// of count files can be: a header and padding per file, a little for each
+// directory and the trailer, and gzip's worst-case growth.
+func archiveOverhead(size int64, count int) int64 {
+	return int64(count)*1024 + 1<<20 + size/64
+}
+
+// checkStart admits a file_start outside a directory: an offered file, or,
+// from a sender without the tree feature, an offered directory as one
+// tar.gz. A nil limit admits everything.
+func (l *offerLimit) checkStart(start protocol.Message, archive bool) error {
+	if l == nil {
+		return nil
+	}
+	name := filepath.Base(start.Name)
+	if start.Pipe != l.offer.Pipe {
+		return fmt.Errorf("%w: piped and regular data mixed up in %q", ErrOfferMismatch, start.Name)
+	}
+	if archive {
+		dir, ok := strings.CutSuffix(name, ".tar.gz")
+		if !ok {
+			return fmt.Errorf("%w: got archive %q without a .tar.gz name", ErrOfferMismatch, start.Name)
+		}
+		if err := l.claim("archive of", dir); err != nil {
+			return err
+		}
+		l.budget = l.offer.Size + archiveOverhead(l.offer.Size, l.offer.Count)
+	} else if err := l.claim("file", name); err != nil {
+		return err
+	}
+	return l.countFile()
+}
+
+// checkManifest admits a directory's manifest: it must be an offered
+// directory and list no more files or bytes than the offer.
+func (l *offerLimit) checkManifest(manifest protocol.Message) error {
+	if l == nil {
+		return nil
+	}
+	if err := l.claim("directory", manifest.Name); err != nil {
+		return err
+	}
+	count := countFiles(manifest)
+	if count > l.offer.Count || manifestSize(manifest) > l.offer.Size {
+		return fmt.Errorf("%w: directory lists %d files and %s, offer was %d files and %s", ErrOfferMismatch,
+			count, formatBytes(manifestSize(manifest)), l.offer.Count, formatBytes(l.offer.Size))
+	}
+	return nil
+}
+
+// countFile records one more file_start.
+func (l *offerLimit) countFile() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.files++
+	if l.files > l.offer.Count {
+		return fmt.Errorf("%w: more than the %d files offered", ErrOfferMismatch, l.offer.Count)
+	}
+	return nil
+}
+
+// add records n more bytes of file data.
+func (l *offerLimit) add(n int) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bytes += int64(n)
+	if l.bytes > l.budget {
+		if l.offer.Pipe {
+			return fmt.Errorf("%w: piped data exceeds the receiver's limit of %s", ErrOfferMismatch, formatBytes(l.budget))
+		}
+		return fmt.Errorf("%w: more than the %s offered", ErrOfferMismatch, formatBytes(l.offer.Size))
+	}
+	return nil
+}
+
+// unpack records a file about to be extracted from a streamed tar.gz, whose
+// contents count against the offer like files sent one by one.
+func (l *offerLimit) unpack(size int64) error {
+	if l == nil {
+		return nil
+	}
+	l.unpackedFiles++
+	l.unpackedBytes += size
+	if l.unpackedFiles > l.offer.Count || l.unpackedBytes > l.offer.Size {
+		return fmt.Errorf("%w: archive holds more than the %d files and %s offered", ErrOfferMismatch, l.offer.Count, formatBytes(l.offer.Size))
+	}
+	return nil
+}
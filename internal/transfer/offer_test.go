@@ -0,0 +1,272 @@
+package transfer
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/JonathanInTheClouds/goxfer/internal/protocol"
+)
+
+func TestBuildOffer_Directory(t *testing.T) {
+	srcDir := t.TempDir()
+	os.MkdirAll(filepath.Join(srcDir, "sub"), 0o750)
+	os.WriteFile(filepath.Join(srcDir, "a.txt"), []byte("12345"), 0o644)
+	os.WriteFile(filepath.Join(srcDir, "sub", "b.txt"), []byte("123"), 0o644)
+
+	items, err := statItems([]string{srcDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer, err := buildOffer(items, "AB:CD")
+	if err != nil {
+		t.Fatalf("buildOffer: %v", err)
+	}
+	if offer.Count != 2 || offer.Size != 8 {
+		t.Fatalf("offer count=%d size=%d, want 2 files / 8 bytes", offer.Count, offer.Size)
+	}
+	if offer.Name != filepath.Base(srcDir) || len(offer.Entries) != 0 {
+		t.Fatalf("offer name = %q with %d entries, want %q alone", offer.Name, len(offer.Entries), filepath.Base(srcDir))
+	}
+}
+
+func TestBuildOffer_SeveralItems(t *testing.T) {
+	root := t.TempDir()
+	logPath := filepath.Join(root, "a.log")
+	os.WriteFile(logPath, []byte("1234"), 0o644)
+	reports := filepath.Join(root, "reports")
+	os.MkdirAll(filepath.Join(reports, "q1"), 0o750)
+	os.WriteFile(filepath.Join(reports, "q1", "x.pdf"), []byte("123"), 0o644)
+	os.WriteFile(filepath.Join(reports, "y.pdf"), []byte("12"), 0o644)
+
+	items, err := statItems([]string{logPath, reports})
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer, err := buildOffer(items, "AB:CD")
+	if err != nil {
+		t.Fatalf("buildOffer: %v", err)
+	}
+	if offer.Count != 3 || offer.Size != 9 {
+		t.Fatalf("offer count=%d size=%d, want 3 files / 9 bytes", offer.Count, offer.Size)
+	}
+	if got := strings.Join(offerItems(offer), ","); got != "a.log,reports/" {
+		t.Fatalf("offer items = %q", got)
+	}
+	if err := protocol.ValidateMessage(offer); err != nil {
+		t.Fatalf("offer does not validate: %v", err)
+	}
+
+	other := filepath.Join(root, "other")
+	os.MkdirAll(other, 0o750)
+	os.WriteFile(filepath.Join(other, "a.log"), nil, 0o644)
+	if _, err := statItems([]string{logPath, filepath.Join(other, "a.log")}); err == nil {
+		t.Fatal("two items with the same name were accepted")
+	}
+}
+
+func TestP2P_SeveralItems(t *testing.T) {
+	root := t.TempDir()
+	logPath := filepath.Join(root, "a.log")
+	os.WriteFile(logPath, []byte("log data"), 0o644)
+	isoPath := filepath.Join(root, "b.iso")
+	os.WriteFile(isoPath, bytes.Repeat([]byte("i"), 3*protocol.FileChunkSize), 0o644)
+	reports := filepath.Join(root, "reports")
+	os.MkdirAll(reports, 0o750)
+	os.WriteFile(filepath.Join(reports, "q1.pdf"), []byte("pdf"), 0o644)
+
+	items, err := statItems([]string{logPath, isoPath, reports})
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer, err := buildOffer(items, "AB:CD")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(t *testing.T, send []sendItem) (sendErr, recvErr error, destDir string) {
+		senderSess, receiverSess := makePair(t)
+		destDir = t.TempDir()
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- sendItems(senderSess, send, offer, sendConfig{feat: testFeatures(false)})
+		}()
+		recvErr = receiveFiles(receiverSess, destDir, receiveConfig{feat: testFeatures(false), limit: newOfferLimit(offer)})
+		receiverSess.Close()
+		return <-errCh, recvErr, destDir
+	}
+
+	t.Run("all items", func(t *testing.T) {
+		sendErr, recvErr, destDir := run(t, items)
+		if sendErr != nil || recvErr != nil {
+			t.Fatalf("send=%v recv=%v", sendErr, recvErr)
+		}
+		for _, rel := range []string{"a.log", "b.iso", "reports/q1.pdf"} {
+			if _, err := os.Stat(filepath.Join(destDir, rel)); err != nil {
+				t.Errorf("%s not received: %v", rel, err)
+			}
+		}
+	})
+
+	t.Run("done before every item", func(t *testing.T) {
+		_, recvErr, _ := run(t, items[:2])
+		if !errors.Is(recvErr, ErrOfferMismatch) {
+			t.Fatalf("receiver got %v, want ErrOfferMismatch", recvErr)
+		}
+	})
+}
+
+// exchangeOffer runs sendOffer and awaitOffer against each other.
+func exchangeOffer(t *testing.T, size int64, policy offerPolicy) (sendErr, recvErr error) {
+	t.Helper()
+	senderSess, receiverSess := makePair(t)
+	defer senderSess.Close()
+	defer receiverSess.Close()
+
+	offer := protocol.Message{
+		Type:        protocol.MessageTypeOffer,
+		Name:        "big.iso",
+		Size:        size,
+		Count:       1,
+		Fingerprint: receiverSess.PeerFingerprint(),
+	}
+
+	ch := make(chan error, 1)
+	go func() { ch <- sendOffer(nil, senderSess, offer) }()
+	_, recvErr = awaitOffer(nil, receiverSess, policy)
+	return <-ch, recvErr
+}
+
+func TestOffer_AcceptWithYes(t *testing.T) {
+	sendErr, recvErr := exchangeOffer(t, 1024, offerPolicy{yes: true})
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("send=%v recv=%v, want both nil", sendErr, recvErr)
+	}
+}
+
+func TestOffer_DeclineOverMaxSize(t *testing.T) {
+	sendErr, recvErr := exchangeOffer(t, 10<<20, offerPolicy{yes: true, maxSize: 1 << 20})
+	if !errors.Is(sendErr, ErrDeclined) {
+		t.Fatalf("sender got %v, want ErrDeclined", sendErr)
+	}
+	if recvErr == nil {
+		t.Fatal("receiver should report the decline")
+	}
+}
+
+func TestOffer_PromptDecline(t *testing.T) {
+	orig := promptInput
+	defer func() { promptInput = orig }()
+	promptInput = bufio.NewReader(strings.NewReader("n\n"))
+
+	sendErr, _ := exchangeOffer(t, 1024, offerPolicy{})
+	if !errors.Is(sendErr, ErrDeclined) {
+		t.Fatalf("sender got %v, want ErrDeclined", sendErr)
+	}
+}
+
+func TestOffer_PromptAccept(t *testing.T) {
+	orig := promptInput
+	defer func() { promptInput = orig }()
+	promptInput = bufio.NewReader(strings.NewReader("yes\n"))
+
+	sendErr, recvErr := exchangeOffer(t, 1024, offerPolicy{})
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("send=%v recv=%v, want both nil", sendErr, recvErr)
+	}
+}
+
+func TestReceiveFiles_HoldsSenderToOffer(t *testing.T) {
+	offer := protocol.Message{Type: protocol.MessageTypeOffer, Name: "a.txt", Size: 5, Count: 1}
+	empty := sha256.Sum256(nil)
+	emptyFile := []protocol.Message{
+		{Type: protocol.MessageTypeFileStart, FileID: "0000000000000000000000f1", Name: "a.txt", Size: 0},
+		{Type: protocol.MessageTypeFileComplete, FileID: "0000000000000000000000f1"},
+		{Type: protocol.MessageTypeFileChecksum, FileID: "0000000000000000000000f1", Checksum: hex.EncodeToString(empty[:])},
+	}
+	tests := []struct {
+		name string
+		msgs []protocol.Message
+	}{
+		{"other name", []protocol.Message{
+			{Type: protocol.MessageTypeFileStart, FileID: "0000000000000000000000f1", Name: "b.txt", Size: 5},
+		}},
+		{"archive instead of file", []protocol.Message{
+			{Type: protocol.MessageTypeFileStart, FileID: "0000000000000000000000f1", Name: "b.txt.tar.gz", Size: -1},
+		}},
+		{"directory instead of file", []protocol.Message{
+			{Type: protocol.MessageTypeManifest, Name: "a.txt", Entries: []protocol.ManifestEntry{{Path: "x", Size: 6}}},
+		}},
+		{"more than the file announced", []protocol.Message{
+			{Type: protocol.MessageTypeFileStart, FileID: "0000000000000000000000f1", Name: "a.txt", Size: 5},
+			{Type: protocol.MessageTypeFileChunk, FileID: "0000000000000000000000f1", Chunk: []byte("0123456789")},
+		}},
+		{"more than offered", []protocol.Message{
+			{Type: protocol.MessageTypeFileStart, FileID: "0000000000000000000000f1", Name: "a.txt", Size: 100},
+			{Type: protocol.MessageTypeFileChunk, FileID: "0000000000000000000000f1", Chunk: []byte("0123456789")},
+		}},
+		{"more files than offered", append(append([]protocol.Message{}, emptyFile...), emptyFile[0])},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			senderSess, receiverSess := makePair(t)
+			defer senderSess.Close()
+
+			recvErr := make(chan error, 1)
+			go func() {
+				cfg := receiveConfig{feat: testFeatures(false), limit: newOfferLimit(offer)}
+				recvErr <- receiveFiles(receiverSess, t.TempDir(), cfg)
+				receiverSess.Close()
+			}()
+			go func() {
+				for {
+					if _, err := senderSess.ReceiveMessage(); err != nil {
+						return
+					}
+				}
+			}()
+			for _, msg := range tt.msgs {
+				if err := senderSess.SendMessage(msg); err != nil {
+					break
+				}
+			}
+			if err := <-recvErr; !errors.Is(err, ErrOfferMismatch) {
+				t.Fatalf("receiver got %v, want ErrOfferMismatch", err)
+			}
+		})
+	}
+}
+
+func TestExtractTarGz_HoldsArchiveToOffer(t *testing.T) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, name := range []string{"dir/a.txt", "dir/b.txt"} {
+		tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Size: 4, Mode: 0o644})
+		tw.Write([]byte("data"))
+	}
+	tw.Close()
+	gw.Close()
+	path := filepath.Join(t.TempDir(), "dir.tar.gz")
+	os.WriteFile(path, buf.Bytes(), 0o644)
+
+	for _, offer := range []protocol.Message{
+		{Name: "dir", Size: 8, Count: 1},
+		{Name: "dir", Size: 7, Count: 2},
+	} {
+		if err := extractTarGz(path, t.TempDir(), newOfferLimit(offer)); !errors.Is(err, ErrOfferMismatch) {
+			t.Errorf("offer of %d files, %d bytes: got %v, want ErrOfferMismatch", offer.Count, offer.Size, err)
+		}
+	}
+	if err := extractTarGz(path, t.TempDir(), newOfferLimit(protocol.Message{Name: "dir", Size: 8, Count: 2})); err != nil {
+		t.Fatalf("archive matching the offer: %v", err)
+	}
+}
@@ -2,115 +2,471 @@ package transfer
 
 import (
 	"archive/tar"
+	"bufio"
 	"compress/gzip"
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/JonathanInTheClouds/goxfer/internal/crypto"
+	"github.com/JonathanInTheClouds/goxfer/internal/peers"
 	"github.com/JonathanInTheClouds/goxfer/internal/protocol"
 	"github.com/JonathanInTheClouds/goxfer/internal/session"
-	"github.com/JonathanInTheClouds/goxfer/internal/tunnel"
 	"github.com/JonathanInTheClouds/goxfer/internal/utils"
-	"github.com/schollz/progressbar/v3"
 )
 
-// P2PSend sends srcPath to a peer. relayAddr="" and listenAddr="" uses bore.pub;
-// relayAddr uses a self-hosted relay; listenAddr accepts a direct receiver connection.
-// When resume=true the file ID is deterministic so a retry can pick up where it left off.
-func P2PSend(srcPath, relayAddr, listenAddr, publicAddr string, resume bool) error {
-	identity, err := crypto.GenerateIdentity()
+// SendOptions configures P2PSend.
+type SendOptions struct {
+	// Identity is the local peer identity. nil generates an ephemeral one.
+	Identity   *crypto.Identity
+	RelayAddr  string
+	ListenAddr string
+	PublicAddr string
+	// NoResume turns off resumable transfers, which are otherwise used
+	// whenever the receiver supports them.
+	NoResume bool
+	// ExpectFingerprint aborts the transfer unless the receiver's fingerprint matches.
+	ExpectFingerprint string
+	// To names the receiver in KnownPeers; it is recorded on first use and
+	// must match on every later transfer.
+	To         string
+	KnownPeers *peers.KnownPeers
+	// Verify prompts the user to confirm the short authentication string
+	// matches the receiver's before any data is sent.
+	Verify bool
+	// IdleTimeout abandons the transfer when the receiver goes silent for
+	// this long; 0 uses session.DefaultIdleTimeout.
+	IdleTimeout time.Duration
+	// Retry is how long to wait for the receiver to reconnect when the
+	// connection drops.
+	Retry RetryPolicy
+	// PipeName is what the receiver calls data sent from stdin with the
+	// path "-"; empty uses "stdin".
+	PipeName string
+	// ReceiverAddr dials a receiver waiting with its own ListenAddr or
+	// RelayAddr instead of waiting for the receiver to connect.
+	ReceiverAddr string
+	// Code is the session code of a receiver waiting at the relay
+	// ReceiverAddr. With RelayAddr it is the code to wait under instead of
+	// a new one.
+	Code string
+	// MaxReceivers above one keeps accepting receivers, each served over
+	// its own session at the same time, until that many have connected.
+	MaxReceivers int
+	// Expires stops waiting for receivers after this long; 0 waits until
+	// enough have connected. Transfers already running carry on.
+	Expires time.Duration
+	// Output receives status and progress bars for a person to read; nil
+	// prints nothing. Status written to stdout moves to stderr while
+	// data is piped.
+	Output io.Writer
+	// Events is called with each Event of the transfer; nil reports none.
+	// It runs on the transfer's goroutines and must not block for long.
+	Events func(Event)
+	// ConfirmSymbols answers whether the verification symbols match the
+	// receiver's when Verify is set; nil asks on stdin.
+	ConfirmSymbols func(symbols string) (bool, error)
+}
+
+// ReceiveOptions configures P2PReceive.
+type ReceiveOptions struct {
+	// Identity is the local peer identity. nil generates an ephemeral one.
+	Identity *crypto.Identity
+	// Code is the session code of a sender waiting at a relay. With
+	// RelayAddr it is the code to wait under instead of a new one.
+	Code string
+	// NoResume turns off resumable transfers, which are otherwise used
+	// whenever the sender supports them.
+	NoResume bool
+	// ExpectFingerprint aborts the transfer unless the sender's fingerprint matches.
+	ExpectFingerprint string
+	// From names the sender in KnownPeers; it is recorded on first use and
+	// must match on every later transfer.
+	From       string
+	KnownPeers *peers.KnownPeers
+	// Verify prompts the user to confirm the short authentication string
+	// matches the sender's before any data is received.
+	Verify bool
+	// Yes accepts the sender's offer without prompting.
+	Yes bool
+	// MaxSize declines offers larger than this many bytes; 0 means no limit.
+	MaxSize int64
+	// IdleTimeout abandons the transfer when the sender goes silent for
+	// this long; 0 uses session.DefaultIdleTimeout.
+	IdleTimeout time.Duration
+	// Include and Exclude choose which files of a directory to receive by
+	// glob pattern; Pick also asks the user. They need a sender that can
+	// send a selection.
+	Include []string
+	Exclude []string
+	Pick    bool
+	// Retry is how often to redial the sender when the connection drops.
+	// The transfer resumes where it stopped when both sides support resume.
+	Retry RetryPolicy
+	// ListenAddr waits for the sender to dial this direct address instead
+	// of dialing the sender; PublicAddr is the address to tell it.
+	ListenAddr string
+	PublicAddr string
+	// RelayAddr waits for the sender to dial in through this self-hosted
+	// relay instead of dialing the sender.
+	RelayAddr string
+	// Allowed maps the fingerprint of each sender ServeInbox accepts
+	// transfers from to the subdirectory of the inbox they are filed in.
+	Allowed map[string]string
+	// Output, Events and ConfirmSymbols work as in SendOptions.
+	Output         io.Writer
+	Events         func(Event)
+	ConfirmSymbols func(symbols string) (bool, error)
+	// AcceptOffer decides an offer within MaxSize instead of asking on
+	// stdin; Yes accepts without either.
+	AcceptOffer func(Offer) (bool, error)
+}
+
+// P2PSend sends the files and directories at srcPaths to a peer in one
+// session. Empty RelayAddr and ListenAddr uses bore.pub; RelayAddr uses a
+// self-hosted relay; ListenAddr accepts a direct receiver connection;
+// ReceiverAddr dials a receiver that is listening itself.
+// When both sides support resume the file ID is deterministic so a retry can
+// pick up where it left off. The single path "-" streams stdin instead.
+// Canceling ctx stops waiting for the receiver and cancels the transfer.
+func P2PSend(ctx context.Context, srcPaths []string, opts SendOptions) (err error) {
+	r := newReporter(opts.Output, opts.Events)
+	// ctx is replaced below by one canceled on return; only the caller's
+	// says whether the transfer was canceled.
+	parent := ctx
+	defer func() {
+		if err != nil && parent.Err() != nil {
+			err = ErrCanceled
+		}
+		r.finish(err)
+	}()
+
+	if opts.ReceiverAddr != "" && (opts.RelayAddr != "" || opts.ListenAddr != "") {
+		return errors.New("a receiver address cannot be combined with a relay or listen address")
+	}
+	if opts.Code != "" && opts.ReceiverAddr == "" && opts.RelayAddr == "" {
+		return errors.New("a session code needs a relay to wait at or a receiver address to dial")
+	}
+	if opts.ReceiverAddr != "" && (opts.MaxReceivers > 1 || opts.Expires > 0) {
+		return errors.New("a sender that dials the receiver cannot wait for more receivers")
+	}
+	if opts.MaxReceivers > 1 && opts.To != "" {
+		return errors.New("a known peer alias names a single receiver; check several receivers by fingerprint instead")
+	}
+	if opts.MaxReceivers > 1 && opts.Verify {
+		return errors.New("cannot confirm verification symbols with several receivers at once")
+	}
+	identity, err := resolveIdentity(opts.Identity)
 	if err != nil {
-		return fmt.Errorf("generate identity: %w", err)
+		return err
 	}
+	r.self = identity.Fingerprint()
 
-	var sess *session.SecureSession
-
-	if listenAddr != "" {
-		listener, actualAddr, err := bindDirectListener(listenAddr, identity)
+	var items []sendItem
+	if len(srcPaths) == 1 && srcPaths[0] == "-" {
+		item, err := pipeItem(opts)
 		if err != nil {
 			return err
 		}
-		defer listener.Close()
-
-		receiverAddr := publicAddr
-		if receiverAddr == "" {
-			receiverAddr = directReceiverAddr(actualAddr)
+		items = []sendItem{item}
+		if r.out == os.Stdout {
+			r.out = os.Stderr
 		}
+	} else if items, err = statItems(srcPaths); err != nil {
+		return err
+	}
+	offer, err := buildOffer(items, identity.Fingerprint())
+	if err != nil {
+		return err
+	}
+	if offer.Pipe && opts.MaxReceivers > 1 {
+		return errors.New("piped data can only go to one receiver")
+	}
 
-		printReceiverCommand("goxfer receive", resume, "", receiverAddr)
-		fmt.Printf("Your fingerprint : %s\n", identity.Fingerprint())
-		fmt.Printf("Listening directly on %s\n", actualAddr)
-		fmt.Println("\nWaiting for receiver to connect...")
-
-		sess, err = listener.Accept()
+	retry := opts.Retry
+	if offer.Pipe {
+		// What was read from stdin cannot be read again.
+		retry = RetryPolicy{}
+	}
+	// A bore.pub tunnel lives as long as this context.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var link peerLink
+	if opts.ReceiverAddr != "" {
+		link = newDialingLink(opts.ReceiverAddr, opts.Code, identity, "receiver", retry, r)
+	} else {
+		rv := rendezvous{relayAddr: opts.RelayAddr, listenAddr: opts.ListenAddr, publicAddr: opts.PublicAddr, pairings: opts.MaxReceivers, code: opts.Code}
+		waiter, err := listenForPeer(ctx, identity, rv, peerPrompt{command: "goxfer receive", arg: "<dest-dir>", peer: "receiver"}, r)
 		if err != nil {
-			return fmt.Errorf("accept connection: %w", err)
+			return err
 		}
-	} else if relayAddr == "" {
-		listener, localPort, err := session.Bind(":0", identity)
-		if err != nil {
-			return fmt.Errorf("bind local listener: %w", err)
+		if opts.MaxReceivers > 1 {
+			defer waiter.Close()
+			return serveReceivers(ctx, waiter, items, offer, opts, r)
 		}
-		defer listener.Close()
+		link = newWaitingLink(waiter, opts.Expires, retry)
+	}
+	defer link.Close()
 
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
+	sess, err := link.connect(ctx)
+	if err != nil {
+		return err
+	}
+	check := peerCheck{
+		idleTimeout:       opts.IdleTimeout,
+		expectFingerprint: opts.ExpectFingerprint,
+		knownPeers:        opts.KnownPeers,
+		alias:             opts.To,
+		verify:            opts.Verify,
+		confirm:           opts.ConfirmSymbols,
+		report:            r,
+	}
 
-		publicAddr, err := tunnel.Start(ctx, localPort)
-		if err != nil {
-			return fmt.Errorf("start bore.pub tunnel: %w", err)
+	for {
+		err := sendSession(ctx, sess, items, offer, !opts.NoResume, check)
+		if !connectionLost(err) || link.left() == 0 {
+			return err
 		}
+		r.printf("\nConnection lost: %v\n", err)
 
-		printReceiverCommand("goxfer receive", resume, "", publicAddr)
-		fmt.Printf("Your fingerprint : %s\n", identity.Fingerprint())
-		fmt.Println("\nWaiting for receiver to connect...")
-
-		sess, err = listener.Accept()
-		if err != nil {
-			return fmt.Errorf("accept connection: %w", err)
+		// Only the receiver that was already verified may pick up again.
+		check = peerCheck{idleTimeout: opts.IdleTimeout, expectFingerprint: sess.PeerFingerprint(), report: r}
+		if sess, err = link.reconnect(ctx); err != nil {
+			return err
 		}
-	} else {
-		conn, code, err := tunnel.ConnectAsSender(relayAddr)
-		if err != nil {
-			return fmt.Errorf("connect to relay: %w", err)
+	}
+}
+
+// sendSession runs the transfer over one connection and closes it. Its
+// events are about the receiver on sess.
+func sendSession(ctx context.Context, sess *session.SecureSession, items []sendItem, offer protocol.Message, resume bool, check peerCheck) error {
+	defer sess.Close()
+	r := check.report.forPeer(sess.PeerFingerprint())
+	check.report = r
+	r.emit(Event{Kind: EventConnected, Fingerprint: r.self})
+
+	stop := cancelWhenDone(ctx, sess, "transfer", r)
+	feat, err := negotiateSend(sess, items, offer, resume, check)
+	if stop() {
+		return ErrCanceled
+	}
+	if err != nil {
+		return err
+	}
+	r.println()
+
+	tc, err := openTransfer(sess, feat, false)
+	if err != nil {
+		return fmt.Errorf("open transfer stream: %w", err)
+	}
+	stop = cancelWhenDone(ctx, tc.control, "transfer", r)
+	err = sendItems(tc.data, items, offer, sendConfig{feat: feat, report: r})
+	if stop() {
+		return ErrCanceled
+	}
+	if err != nil {
+		if peerErr := tc.peerError(); peerErr != nil {
+			return peerErr
 		}
+		return err
+	}
+	return tc.close()
+}
 
-		printReceiverCommand("goxfer receive", resume, code, relayAddr)
-		fmt.Printf("Your fingerprint : %s\n", identity.Fingerprint())
-		fmt.Println("\nWaiting for receiver to connect...")
+// negotiateSend authenticates the receiver and has it accept offer,
+// returning the features both sides support.
+func negotiateSend(sess *session.SecureSession, items []sendItem, offer protocol.Message, resume bool, check peerCheck) (features, error) {
+	feat, err := authenticatePeer(sess, localHello(resume), check)
+	if err != nil {
+		return features{}, err
+	}
+	if len(items) > 1 && !feat.batch {
+		return features{}, abortTransfer(sess, fmt.Errorf("%w: receiver takes one path per send; upgrade goxfer on the receiving side or send the paths one at a time", ErrIncompatiblePeer))
+	}
+	if offer.Pipe && !feat.pipe {
+		return features{}, abortTransfer(sess, fmt.Errorf("%w: receiver cannot take piped data; upgrade goxfer on the receiving side", ErrIncompatiblePeer))
+	}
+	if err := sendOffer(check.report, sess, offer); err != nil {
+		return features{}, err
+	}
+	if err := check.remember(sess); err != nil {
+		return features{}, err
+	}
+	return feat, nil
+}
+
+// pipeItem is the item for sending stdin, named after opts.PipeName.
+func pipeItem(opts SendOptions) (sendItem, error) {
+	if opts.Verify {
+		return sendItem{}, errors.New("cannot confirm verification symbols while stdin carries the data; check the receiver with a fingerprint or known peer instead")
+	}
+	name := opts.PipeName
+	if name == "" {
+		name = "stdin"
+	}
+	if name != filepath.Base(name) || name == "." || name == ".." || name == "-" {
+		return sendItem{}, fmt.Errorf("invalid name %q for piped data: want a plain file name", name)
+	}
+	return sendItem{path: name, pipe: pipeIn}, nil
+}
+
+// resolveIdentity returns identity, or a fresh ephemeral identity when nil.
+func resolveIdentity(identity *crypto.Identity) (*crypto.Identity, error) {
+	if identity != nil {
+		return identity, nil
+	}
+	identity, err := crypto.GenerateIdentity()
+	if err != nil {
+		return nil, fmt.Errorf("generate identity: %w", err)
+	}
+	return identity, nil
+}
+
+// verifyPeer prints the remote fingerprint and, when expected is set, refuses
+// to continue unless it matches. It runs before any file data is exchanged.
+func verifyPeer(r *reporter, sess *session.SecureSession, expected string) error {
+	peer := sess.PeerFingerprint()
+	r.printf("Peer fingerprint : %s\n", peer)
+	if expected == "" {
+		return nil
+	}
+	if !crypto.FingerprintsMatch(peer, expected) {
+		return fmt.Errorf("peer fingerprint mismatch: got %s, expected %s (possible man-in-the-middle)", peer, expected)
+	}
+	r.println("✓  Peer fingerprint verified")
+	return nil
+}
 
-		if err := tunnel.WaitForReceiver(conn); err != nil {
-			return fmt.Errorf("wait for receiver: %w", err)
+// trustPeer applies the known_peers policy. With an alias, a peer already
+// recorded under it must match the stored fingerprint; a new alias is only
+// recorded by rememberPeer once the transfer is accepted. Without an alias, a
+// peer that is already known is identified by name.
+func trustPeer(r *reporter, sess *session.SecureSession, known *peers.KnownPeers, alias string) error {
+	fingerprint := sess.PeerFingerprint()
+	if known == nil {
+		if alias != "" {
+			return fmt.Errorf("no known peers store to check %q against", alias)
 		}
+		return nil
+	}
 
-		sess, err = session.NewSession(conn, identity, false)
-		if err != nil {
-			return fmt.Errorf("establish session: %w", err)
+	if alias == "" {
+		if p, ok := known.FindByFingerprint(fingerprint); ok {
+			r.printf("Peer is known as %s\n", p.Alias)
 		}
+		return nil
+	}
+
+	p, ok := known.Lookup(alias)
+	if !ok {
+		r.printf("New peer %s — it will be remembered once the transfer is accepted\n", alias)
+		return nil
 	}
-	defer sess.Close()
 
-	fmt.Print("Receiver connected!\n\n")
+	if !crypto.FingerprintsMatch(p.Fingerprint, fingerprint) {
+		r.printf("\n@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@\n")
+		r.printf("@    WARNING: PEER FINGERPRINT FOR %s HAS CHANGED!\n", strings.ToUpper(alias))
+		r.printf("@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@\n")
+		r.printf("Someone could be intercepting this transfer, or %s rotated their identity.\n", alias)
+		r.printf("Expected : %s\nGot      : %s\n", p.Fingerprint, fingerprint)
+		r.printf("If the change is legitimate, update it with: goxfer peers remove %s\n\n", alias)
+		return fmt.Errorf("fingerprint for peer %s has changed, refusing to continue", alias)
+	}
+	r.printf("✓  Peer verified as %s\n", alias)
+	return nil
+}
 
-	info, err := os.Stat(srcPath)
+// rememberPeer records the peer under alias on first use. It runs only
+// after the peer passed every check and the transfer was accepted, so a
+// rejected or impostor peer is never pinned.
+func rememberPeer(r *reporter, sess *session.SecureSession, known *peers.KnownPeers, alias string) error {
+	if known == nil || alias == "" {
+		return nil
+	}
+	if _, ok := known.Lookup(alias); ok {
+		return nil
+	}
+	if err := known.Add(alias, sess.PeerFingerprint()); err != nil {
+		return err
+	}
+	if err := known.Save(); err != nil {
+		return err
+	}
+	r.printf("Recorded new peer %s in %s\n", alias, known.Path())
+	return nil
+}
+
+// checkShortAuthString shows the session's short authentication string and,
+// when verify is set, has confirm, or the user when nil, confirm it matches
+// the other side.
+func checkShortAuthString(r *reporter, sess *session.SecureSession, verify bool, confirm func(symbols string) (bool, error)) error {
+	symbols := crypto.FormatSAS(sess.ShortAuthString())
+	r.printf("Verification     : %s\n", symbols)
+	r.emit(Event{Kind: EventVerification, Symbols: symbols})
+	if !verify {
+		return nil
+	}
+	var ok bool
+	var err error
+	if confirm != nil {
+		ok, err = confirm(symbols)
+	} else {
+		ok, err = promptYesNo(r, "Does the other side show the same symbols? [y/N]: ")
+	}
 	if err != nil {
-		return fmt.Errorf("stat source: %w", err)
+		return fmt.Errorf("read verification answer: %w", err)
 	}
+	if !ok {
+		return errors.New("verification failed: short authentication strings do not match, aborting")
+	}
+	r.println("✓  Verification confirmed")
+	return nil
+}
+
+// promptInput is where interactive answers are read from, and
+// promptOutput where questions go when only events are reported.
+var (
+	promptInput            = bufio.NewReader(os.Stdin)
+	promptOutput io.Writer = os.Stderr
+)
+
+// pipeIn and pipeOut carry the data of a transfer sent from "-" or received
+// into "-".
+var (
+	pipeIn  io.Reader = os.Stdin
+	pipeOut io.Writer = os.Stdout
+)
 
-	if info.IsDir() {
-		return sendDirectory(sess, srcPath)
+// promptYesNo asks question and reports whether the user answered yes. It
+// is reported as an event too; with events on stdout, the question itself
+// goes to stderr so a person still sees what is being asked.
+func promptYesNo(r *reporter, question string) (bool, error) {
+	r.emit(Event{Kind: EventPrompt, Question: strings.TrimSpace(question)})
+	if r != nil && r.out == nil && r.events != nil {
+		fmt.Fprint(promptOutput, question)
 	}
-	return sendSingleFile(sess, srcPath, info, resume)
+	r.printf("%s", question)
+	answer, err := promptInput.ReadString('\n')
+	if err != nil && answer == "" {
+		return false, err
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	}
+	return false, nil
 }
 
 func bindDirectListener(addr string, identity *crypto.Identity) (*session.Listener, string, error) {
@@ -142,53 +498,228 @@ func directReceiverAddr(listenAddr string) string {
 	return net.JoinHostPort(host, port)
 }
 
-// P2PReceive connects to a sender and downloads files into destDir.
-// For bore.pub: addr=bore.pub:NNNNN, code="".
-// For self-hosted relay: addr=relay:port, code=<code>.
-func P2PReceive(addr, destDir, code string, resume bool) error {
-	identity, err := crypto.GenerateIdentity()
+// P2PReceive connects to a sender and downloads files into destDir. The
+// destDir "-" writes a single file to stdout once its checksum is
+// verified. Canceling ctx stops waiting for the sender and cancels the
+// transfer.
+// For bore.pub: addr=bore.pub:NNNNN, empty Code.
+// For self-hosted relay: addr=relay:port, Code=<code>.
+// For a sender that dials in: empty addr, ListenAddr=:port, or
+// RelayAddr=relay:port with an optional fixed Code.
+func P2PReceive(ctx context.Context, addr, destDir string, opts ReceiveOptions) (err error) {
+	r := newReporter(opts.Output, opts.Events)
+	// ctx is replaced below by one canceled on return; only the caller's
+	// says whether the transfer was canceled.
+	parent := ctx
+	defer func() {
+		if err != nil && parent.Err() != nil {
+			err = ErrCanceled
+		}
+		r.finish(err)
+	}()
+
+	if opts.ListenAddr != "" && opts.RelayAddr != "" {
+		return errors.New("wait on either a ListenAddr or a RelayAddr, not both")
+	}
+	if (addr == "") == (opts.ListenAddr == "" && opts.RelayAddr == "") {
+		return errors.New("give either the sender's address or a ListenAddr or RelayAddr to wait on")
+	}
+	identity, err := resolveIdentity(opts.Identity)
 	if err != nil {
-		return fmt.Errorf("generate identity: %w", err)
+		return err
 	}
+	r.self = identity.Fingerprint()
 
-	var sess *session.SecureSession
+	filter := &fileFilter{include: opts.Include, exclude: opts.Exclude, pick: opts.Pick}
+	for _, patterns := range [][]string{opts.Include, opts.Exclude} {
+		if err := validatePatterns(patterns); err != nil {
+			return err
+		}
+	}
 
-	fmt.Printf("Connecting to sender at %s...\n", addr)
+	policy := offerPolicy{yes: opts.Yes, maxSize: opts.MaxSize, accept: opts.AcceptOffer}
+	if destDir == "-" {
+		// There is no directory to keep a partial file in, and a file
+		// sent again after a reconnect would reach stdout twice.
+		if r.out == os.Stdout {
+			r.out = os.Stderr
+		}
+		policy.single = true
+		opts.NoResume = true
+		opts.Retry = RetryPolicy{}
+	}
 
-	if code == "" {
-		sess, err = session.Dial(addr, identity)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var link peerLink
+	if addr == "" {
+		rv := rendezvous{relayAddr: opts.RelayAddr, listenAddr: opts.ListenAddr, publicAddr: opts.PublicAddr, code: opts.Code}
+		waiter, err := listenForPeer(ctx, identity, rv, peerPrompt{command: "goxfer send", arg: "<path>", peer: "sender"}, r)
 		if err != nil {
-			return fmt.Errorf("connect to sender: %w", err)
+			return err
 		}
+		link = newWaitingLink(waiter, 0, opts.Retry)
 	} else {
-		conn, err := tunnel.ConnectAsReceiver(addr, code)
-		if err != nil {
-			return fmt.Errorf("connect to relay: %w", err)
+		link = newDialingLink(addr, opts.Code, identity, "sender", opts.Retry, r)
+	}
+	defer link.Close()
+
+	sess, err := link.connect(ctx)
+	if err != nil {
+		return err
+	}
+	check := peerCheck{
+		idleTimeout:       opts.IdleTimeout,
+		expectFingerprint: opts.ExpectFingerprint,
+		knownPeers:        opts.KnownPeers,
+		alias:             opts.From,
+		verify:            opts.Verify,
+		confirm:           opts.ConfirmSymbols,
+		report:            r,
+	}
+
+	for {
+		err := receiveSession(ctx, sess, destDir, !opts.NoResume, check, &policy, filter)
+		if !connectionLost(err) || link.left() == 0 {
+			return err
 		}
-		sess, err = session.NewSession(conn, identity, true)
-		if err != nil {
-			return fmt.Errorf("establish session: %w", err)
+		r.printf("\nConnection lost: %v\n", err)
+
+		// Only the sender that was already verified may pick up again, and
+		// only with the offer that was already accepted.
+		check = peerCheck{idleTimeout: opts.IdleTimeout, expectFingerprint: sess.PeerFingerprint(), report: r}
+		if sess, err = link.reconnect(ctx); err != nil {
+			return err
 		}
 	}
-	defer sess.Close()
+}
 
-	fmt.Printf("Connected. Your fingerprint: %s\n\n", identity.Fingerprint())
+// receiveSession runs the transfer over one connection and closes it. The
+// first offer accepted is recorded in policy so a reconnect only resumes
+// the same transfer. Its events are about the sender on sess.
+func receiveSession(ctx context.Context, sess *session.SecureSession, destDir string, resume bool, check peerCheck, policy *offerPolicy, filter *fileFilter) error {
+	defer sess.Close()
+	r := check.report.forPeer(sess.PeerFingerprint())
+	check.report = r
+	r.emit(Event{Kind: EventConnected, Fingerprint: r.self})
+
+	stop := cancelWhenDone(ctx, sess, "transfer", r)
+	feat, offer, err := negotiateReceive(sess, resume, check, *policy)
+	if stop() {
+		return ErrCanceled
+	}
+	if err != nil {
+		return err
+	}
+	policy.expect = &offer
+	r.println()
 
-	if err := os.MkdirAll(destDir, 0o750); err != nil {
+	cfg := receiveConfig{feat: feat, filter: filter, limit: newOfferLimit(offer), report: r}
+	if offer.Pipe && policy.maxSize > 0 {
+		cfg.limit.budget = policy.maxSize
+	}
+	if destDir == "-" {
+		cfg.sink = pipeOut
+	} else if err := os.MkdirAll(destDir, 0o750); err != nil {
 		return fmt.Errorf("create destination directory: %w", err)
 	}
 
-	return receiveFiles(sess, destDir, resume)
+	tc, err := openTransfer(sess, feat, true)
+	if err != nil {
+		return fmt.Errorf("open transfer stream: %w", err)
+	}
+	stop = cancelWhenDone(ctx, tc.control, "transfer", r)
+	err = receiveFiles(tc.data, destDir, cfg)
+	if stop() {
+		return ErrCanceled
+	}
+	if err != nil {
+		if peerErr := tc.peerError(); peerErr != nil {
+			return peerErr
+		}
+		return err
+	}
+	if len(offer.Entries) > 1 {
+		r.printf("\n✓  Received %d items — %s\n", len(offer.Entries), offerSummary(offer))
+	}
+	return tc.close()
+}
+
+// negotiateReceive authenticates the sender and answers its offer
+// according to policy, returning the features both sides support and the
+// offer accepted.
+func negotiateReceive(sess *session.SecureSession, resume bool, check peerCheck, policy offerPolicy) (features, protocol.Message, error) {
+	feat, err := authenticatePeer(sess, localHello(resume), check)
+	if err != nil {
+		return features{}, protocol.Message{}, err
+	}
+	offer, err := awaitOffer(check.report, sess, policy)
+	if err != nil {
+		return features{}, protocol.Message{}, err
+	}
+	if err := check.remember(sess); err != nil {
+		return features{}, protocol.Message{}, err
+	}
+	return feat, offer, nil
 }
 
-func sendSingleFile(sess *session.SecureSession, path string, info os.FileInfo, resume bool) error {
+// sendItems sends each item in turn and, when the receiver understands it,
+// marks the end of the batch with a done message.
+func sendItems(sess messageConn, items []sendItem, offer protocol.Message, cfg sendConfig) error {
+	var sent int64
+	for i, item := range items {
+		if len(items) > 1 {
+			cfg.report.printf("\n[%d/%d] %s  (%s of %s sent so far)\n", i+1, len(items), offerItems(offer)[i], formatBytes(sent), formatBytes(offer.Size))
+			sent += offer.Entries[i].Size
+		}
+		var err error
+		if item.pipe != nil {
+			err = sendPipe(sess, item.path, item.pipe, cfg)
+		} else if item.info.IsDir() {
+			err = sendDirectory(sess, item.path, cfg)
+		} else {
+			err = sendSingleFile(sess, item.path, item.info, cfg)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.feat.batch {
+		if err := sess.SendMessage(protocol.Message{Type: protocol.MessageTypeDone}); err != nil {
+			return fmt.Errorf("send done: %w", err)
+		}
+	}
+	if len(items) > 1 {
+		cfg.report.printf("\n✓  Sent %d items — %s\n", len(items), offerSummary(offer))
+	}
+	return nil
+}
+
+// sendSingleFile sends one regular file. On failure the receiver is told why
+// with an error message.
+func sendSingleFile(sess messageConn, path string, info os.FileInfo, cfg sendConfig) error {
+	return sendFile(sess, path, info, protocol.Message{Name: filepath.Base(path)}, cfg, nil)
+}
+
+// sendFile sends the regular file at path, announced with the name, path
+// and metadata already set in start. Progress goes to bar, shared by files
+// sent at the same time, or to a bar of the file's own when bar is nil. On
+// failure the receiver is told why with an error message.
+func sendFile(sess messageConn, path string, info os.FileInfo, start protocol.Message, cfg sendConfig, bar *progress) (err error) {
+	defer func() {
+		if err != nil {
+			err = abortTransfer(sess, err)
+		}
+	}()
+
 	localChecksum, err := utils.CalculateLocalFileChecksum(path)
 	if err != nil {
 		return fmt.Errorf("checksum local file: %w", err)
 	}
 
+	feat, r := cfg.feat, cfg.report
 	var fileID string
-	if resume {
+	if feat.resume {
 		fileID = deterministicFileID(path, info.Size())
 	} else {
 		fileID, err = randomFileID()
@@ -197,27 +728,34 @@ func sendSingleFile(sess *session.SecureSession, path string, info os.FileInfo,
 		}
 	}
 
-	if err := sess.SendMessage(protocol.Message{
-		Type:   protocol.MessageTypeFileStart,
-		FileID: fileID,
-		Name:   filepath.Base(path),
-		Size:   info.Size(),
-		Resume: resume,
-	}); err != nil {
+	start.Type = protocol.MessageTypeFileStart
+	start.FileID = fileID
+	start.Size = info.Size()
+	start.Resume = feat.resume
+	if feat.resume {
+		// Lets the receiver skip a file it already has in full.
+		start.Checksum = localChecksum
+	}
+	if err := sess.SendMessage(start); err != nil {
 		return err
 	}
 
 	// When resume is on, wait for the receiver's ack before sending data.
 	var startOffset int64
 	var startIndex int
-	if resume {
-		ack, err := sess.ReceiveMessage()
+	if feat.resume {
+		ack, err := receiveMessage(sess)
 		if err != nil {
 			return fmt.Errorf("receive resume ack: %w", err)
 		}
-		if ack.Type == protocol.MessageTypeFileResume {
+		switch ack.Type {
+		case protocol.MessageTypeFileResume:
 			startOffset = ack.Offset
-			startIndex = int(startOffset / protocol.FileChunkSize)
+			startIndex = ack.Index
+		case protocol.MessageTypeFileSkip:
+			r.printf("Skipping %s — already received\n", fileLabel(start))
+			r.emit(Event{Kind: EventFileSkipped, Name: fileLabel(start), Size: info.Size()})
+			return nil
 		}
 		// MessageTypeReady means start from zero — defaults are already 0
 	}
@@ -232,16 +770,22 @@ func sendSingleFile(sess *session.SecureSession, path string, info os.FileInfo,
 		if _, err := f.Seek(startOffset, io.SeekStart); err != nil {
 			return fmt.Errorf("seek to resume offset: %w", err)
 		}
-		fmt.Printf("Resuming from %s / %s\n", formatBytes(startOffset), formatBytes(info.Size()))
+		r.printf("Resuming from %s / %s\n", formatBytes(startOffset), formatBytes(info.Size()))
 	}
 
-	fmt.Printf("Sending  %s  (%s)\n", filepath.Base(path), formatBytes(info.Size()))
-	bar := newBar(info.Size())
-	bar.Set64(startOffset)
-	if err := sendChunks(sess, fileID, io.TeeReader(f, bar), startIndex); err != nil {
+	r.emit(Event{Kind: EventFileStarted, Name: fileLabel(start), Size: info.Size(), Bytes: startOffset})
+	shared := bar != nil
+	if !shared {
+		r.printf("Sending  %s  (%s)\n", fileLabel(start), formatBytes(info.Size()))
+		bar = r.newProgress(fileLabel(start), info.Size())
+	}
+	bar.add(startOffset)
+	if err := sendChunks(sess, fileID, io.TeeReader(f, bar), startIndex, feat.chunkSize); err != nil {
 		return err
 	}
-	bar.Finish()
+	if !shared {
+		bar.finish()
+	}
 
 	if err := sess.SendMessage(protocol.Message{
 		Type:   protocol.MessageTypeFileComplete,
@@ -258,45 +802,38 @@ func sendSingleFile(sess *session.SecureSession, path string, info os.FileInfo,
 		return err
 	}
 
-	ack, err := sess.ReceiveMessage()
+	ack, err := receiveMessage(sess)
 	if err != nil {
 		return fmt.Errorf("receive checksum ack: %w", err)
 	}
 	if ack.Type != protocol.MessageTypeFileChecksum || ack.Checksum != localChecksum {
-		return fmt.Errorf("checksum mismatch confirmed by receiver")
+		return fmt.Errorf("%w confirmed by receiver", ErrChecksumMismatch)
 	}
 
-	fmt.Printf("\n✓  Sent successfully — checksum verified\n")
+	r.emit(Event{Kind: EventFileVerified, Name: fileLabel(start), Size: info.Size(), Checksum: localChecksum})
+	if !shared {
+		r.printf("\n✓  Sent successfully — checksum verified\n")
+	}
 	return nil
 }
 
-// sendDirectory streams srcPath as a tar.gz. Resume is not supported for directories
-// because the archive is generated on the fly and cannot be seeked.
-func sendDirectory(sess *session.SecureSession, srcPath string) error {
-	fileID, err := randomFileID()
-	if err != nil {
-		return err
-	}
-
-	archiveName := filepath.Base(srcPath) + ".tar.gz"
-
-	if err := sess.SendMessage(protocol.Message{
-		Type:   protocol.MessageTypeFileStart,
-		FileID: fileID,
-		Name:   archiveName,
-		Size:   -1,
-	}); err != nil {
-		return err
+// sendDirectory sends the tree at srcPath file by file, or as one tar.gz to
+// peers that cannot receive a tree.
+func sendDirectory(sess messageConn, srcPath string, cfg sendConfig) error {
+	if cfg.feat.tree {
+		return sendTree(sess, srcPath, cfg)
 	}
+	return sendArchive(sess, srcPath, cfg)
+}
 
+// sendArchive streams srcPath as a tar.gz. Resume is not supported for archives
+// because the archive is generated on the fly and cannot be seeked.
+func sendArchive(sess messageConn, srcPath string, cfg sendConfig) error {
 	pr, pw := io.Pipe()
-	hasher := sha256.New()
-
-	var archiveErr error
 	go func() {
 		gw := gzip.NewWriter(pw)
 		tw := tar.NewWriter(gw)
-		archiveErr = filepath.Walk(srcPath, func(path string, info os.FileInfo, err error) error {
+		err := filepath.Walk(srcPath, func(path string, info os.FileInfo, err error) error {
 			if err != nil {
 				return err
 			}
@@ -326,19 +863,53 @@ func sendDirectory(sess *session.SecureSession, srcPath string) error {
 		})
 		tw.Close()
 		gw.Close()
-		pw.CloseWithError(archiveErr)
+		if err != nil {
+			err = fmt.Errorf("archive directory: %w", err)
+		}
+		pw.CloseWithError(err)
 	}()
+	defer pr.Close()
+
+	start := protocol.Message{Name: filepath.Base(srcPath) + ".tar.gz"}
+	return sendStream(sess, start, pr, filepath.Base(srcPath)+"/", cfg)
+}
 
-	fmt.Printf("Sending  %s/  (streaming)\n", filepath.Base(srcPath))
-	bar := newBar(-1)
-	if err := sendChunks(sess, fileID, io.TeeReader(io.TeeReader(pr, hasher), bar), 0); err != nil {
+// sendPipe sends everything read from r as the file name. Its size is
+// only known once r ends, so it cannot resume.
+func sendPipe(sess messageConn, name string, r io.Reader, cfg sendConfig) error {
+	return sendStream(sess, protocol.Message{Name: name, Pipe: true}, r, name, cfg)
+}
+
+// sendStream sends everything read from r as one file of unknown size,
+// announced with the name set in start and shown as label. On failure the
+// receiver is told why with an error message.
+func sendStream(sess messageConn, start protocol.Message, src io.Reader, label string, cfg sendConfig) (err error) {
+	defer func() {
+		if err != nil {
+			err = abortTransfer(sess, err)
+		}
+	}()
+
+	fileID, err := randomFileID()
+	if err != nil {
+		return err
+	}
+	start.Type = protocol.MessageTypeFileStart
+	start.FileID = fileID
+	start.Size = -1
+	if err := sess.SendMessage(start); err != nil {
 		return err
 	}
-	bar.Finish()
 
-	if archiveErr != nil {
-		return fmt.Errorf("archive directory: %w", archiveErr)
+	r := cfg.report
+	hasher := sha256.New()
+	r.printf("Sending  %s  (streaming)\n", label)
+	r.emit(Event{Kind: EventFileStarted, Name: label, Size: -1})
+	bar := r.newProgress(label, -1)
+	if err := sendChunks(sess, fileID, io.TeeReader(io.TeeReader(src, hasher), bar), 0, cfg.feat.chunkSize); err != nil {
+		return err
 	}
+	bar.finish()
 
 	checksum := hex.EncodeToString(hasher.Sum(nil))
 
@@ -357,37 +928,38 @@ func sendDirectory(sess *session.SecureSession, srcPath string) error {
 		return err
 	}
 
-	ack, err := sess.ReceiveMessage()
+	ack, err := receiveMessage(sess)
 	if err != nil {
 		return fmt.Errorf("receive checksum ack: %w", err)
 	}
 	if ack.Type != protocol.MessageTypeFileChecksum || ack.Checksum != checksum {
-		return fmt.Errorf("checksum mismatch confirmed by receiver")
+		return fmt.Errorf("%w confirmed by receiver", ErrChecksumMismatch)
 	}
 
-	fmt.Printf("\n✓  Sent successfully — checksum verified\n")
+	r.emit(Event{Kind: EventFileVerified, Name: label, Size: bar.done, Checksum: checksum})
+	r.printf("\n✓  Sent successfully — checksum verified\n")
 	return nil
 }
 
-func sendChunks(sess *session.SecureSession, fileID string, r io.Reader, startIndex int) error {
-	buf := make([]byte, protocol.FileChunkSize)
+func sendChunks(sess messageConn, fileID string, r io.Reader, startIndex, chunkSize int) error {
+	buf := make([]byte, chunkSize)
 	index := startIndex
 	for {
-		n, readErr := r.Read(buf)
+		// Fill whole chunks so each frame carries as much data as allowed.
+		// SendMessage encodes the chunk before returning, so buf is reused.
+		n, readErr := io.ReadFull(r, buf)
 		if n > 0 {
-			chunk := make([]byte, n)
-			copy(chunk, buf[:n])
 			if err := sess.SendMessage(protocol.Message{
 				Type:   protocol.MessageTypeFileChunk,
 				FileID: fileID,
 				Index:  index,
-				Chunk:  chunk,
+				Chunk:  buf[:n],
 			}); err != nil {
 				return err
 			}
 			index++
 		}
-		if readErr == io.EOF {
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
 			break
 		}
 		if readErr != nil {
@@ -397,29 +969,100 @@ func sendChunks(sess *session.SecureSession, fileID string, r io.Reader, startIn
 	return nil
 }
 
-func receiveFiles(sess *session.SecureSession, destDir string, resume bool) error {
+// sendConfig is how the sender sends: the negotiated features, and where
+// to report what it sends.
+type sendConfig struct {
+	feat   features
+	report *reporter
+}
+
+// receiveConfig is how the receiver handles what the sender sends. The
+// negotiated features decide whether files resume and whether the sender
+// waits for a manifest_select after each manifest.
+type receiveConfig struct {
+	feat   features
+	filter *fileFilter // nil receives every file
+	limit  *offerLimit // nil accepts whatever the sender sends
+	report *reporter
+	// bar, when set, is shared by files received at the same time, which
+	// then print no progress of their own.
+	bar *progress
+	// sink, when set, takes the single file received once its checksum is
+	// verified, instead of destDir.
+	sink io.Writer
+}
+
+// receiveFiles receives files until the sender says it is done or closes
+// the session. Only a clean end between files, once everything offered has
+// arrived, counts as success.
+func receiveFiles(sess messageConn, destDir string, cfg receiveConfig) error {
 	for {
-		msg, err := sess.ReceiveMessage()
+		msg, err := receiveMessage(sess)
+		if errors.Is(err, io.EOF) {
+			return cfg.limit.complete()
+		}
 		if err != nil {
-			return nil
+			return fmt.Errorf("receive file_start: %w", err)
 		}
 
-		if msg.Type != protocol.MessageTypeFileStart {
-			return fmt.Errorf("expected file_start, got %q", msg.Type)
+		switch msg.Type {
+		case protocol.MessageTypeManifest:
+			if cfg.sink != nil {
+				return abortTransfer(sess, fmt.Errorf("cannot write directory %s to stdout", msg.Name))
+			}
+			if err := cfg.limit.checkManifest(msg); err != nil {
+				return abortTransfer(sess, err)
+			}
+			err = receiveTree(sess, destDir, msg, cfg)
+		case protocol.MessageTypeFileStart:
+			// Only a sender without the tree feature streams a directory,
+			// as a tar.gz of unknown size; piped data is saved as-is.
+			archive := msg.Size == -1 && !msg.Pipe
+			if archive && cfg.sink != nil {
+				return abortTransfer(sess, fmt.Errorf("cannot write directory %s to stdout", strings.TrimSuffix(msg.Name, ".tar.gz")))
+			}
+			if archive && cfg.filter.active() {
+				return abortTransfer(sess, fmt.Errorf("%w: sender can only send the whole directory; upgrade goxfer on the sending side or drop the file selection", ErrIncompatiblePeer))
+			}
+			if err := cfg.limit.checkStart(msg, archive); err != nil {
+				return abortTransfer(sess, err)
+			}
+			name := filepath.Base(msg.Name)
+			if reservedName(name) {
+				return abortTransfer(sess, fmt.Errorf("rejected reserved file name %q", msg.Name))
+			}
+			err = receiveOneFile(sess, destDir, filepath.Join(destDir, name), msg, cfg, archive)
+		case protocol.MessageTypeDone:
+			if err := cfg.limit.complete(); err != nil {
+				return abortTransfer(sess, err)
+			}
+			return nil
+		default:
+			return abortTransfer(sess, fmt.Errorf("expected file_start, got %q", msg.Type))
 		}
-
-		if err := receiveOneFile(sess, destDir, msg, resume); err != nil {
+		if err != nil {
 			return err
 		}
 	}
 }
 
-func receiveOneFile(sess *session.SecureSession, destDir string, start protocol.Message, resume bool) error {
-	isArchive := strings.HasSuffix(start.Name, ".tar.gz")
+// receiveOneFile receives the file announced by start and saves it as
+// destPath, or writes it to cfg.sink when set. With archive set it is a
+// streamed tar.gz from a sender without the tree feature and is extracted
+// into destDir instead; a file's name never decides that. On failure the
+// sender is told why with an error message.
+func receiveOneFile(sess messageConn, destDir, destPath string, start protocol.Message, cfg receiveConfig, archive bool) (err error) {
+	defer func() {
+		if err != nil {
+			err = abortTransfer(sess, err)
+		}
+	}()
+	resume, r := cfg.feat.resume, cfg.report
 
 	// Attempt to resume only for regular files where the sender also opted in.
+	resumable := resume && start.Resume && !archive && validFileID(start.FileID)
 	var state *resumeState
-	if resume && start.Resume && !isArchive {
+	if resumable {
 		state = loadResumeState(destDir, start.FileID)
 	}
 
@@ -427,13 +1070,14 @@ func receiveOneFile(sess *session.SecureSession, destDir string, start protocol.
 		tmp       *os.File
 		hasher    hash.Hash
 		nextIndex int
+		received  int64
 	)
 
 	if state != nil {
-		// Re-open the existing temp file and restore state.
-		existing, err := os.OpenFile(state.TempPath, os.O_RDWR, 0o600)
+		// Re-open the existing partial file and restore state.
+		existing, err := openPartial(destDir, start.FileID)
 		if err != nil {
-			// Temp file gone — fall back to fresh start.
+			// Partial file gone — fall back to fresh start.
 			state = nil
 		} else {
 			resumeOffset := state.byteOffset()
@@ -448,13 +1092,15 @@ func receiveOneFile(sess *session.SecureSession, destDir string, start protocol.
 			} else {
 				tmp = existing
 				nextIndex = state.NextIndex
+				received = resumeOffset
 				hasher = sha256.New()
-				fmt.Printf("Restoring checksum for %s (%s already received)...\n",
+				r.printf("Restoring checksum for %s (%s already received)...\n",
 					start.Name, formatBytes(resumeOffset))
-				if err := rehashFile(state.TempPath, resumeOffset, hasher); err != nil {
+				if err := rehashFile(existing.Name(), resumeOffset, hasher); err != nil {
 					tmp.Close()
 					state = nil
 					nextIndex = 0
+					received = 0
 					hasher = nil
 				}
 			}
@@ -462,43 +1108,63 @@ func receiveOneFile(sess *session.SecureSession, destDir string, start protocol.
 	}
 
 	if state == nil {
-		// Fresh start.
-		newTmp, err := os.CreateTemp("", "goxfer-recv-*")
-		if err != nil {
-			return fmt.Errorf("create temp file: %w", err)
+		// Fresh start. A partial file that may be resumed is kept where the
+		// next attempt finds it; without resume any temp file will do.
+		var newTmp *os.File
+		if resumable {
+			newTmp, err = createPartial(destDir, start.FileID)
+			if err == nil {
+				state = &resumeState{
+					FileID:    start.FileID,
+					Name:      start.Name,
+					Size:      start.Size,
+					NextIndex: 0,
+				}
+				saveResumeState(destDir, state)
+			}
+		}
+		if newTmp == nil {
+			newTmp, err = os.CreateTemp("", "goxfer-recv-*")
+			if err != nil {
+				return fmt.Errorf("create temp file: %w", err)
+			}
 		}
 		tmp = newTmp
 		hasher = sha256.New()
 		nextIndex = 0
-
-		if resume && start.Resume && !isArchive {
-			state = &resumeState{
-				FileID:    start.FileID,
-				Name:      start.Name,
-				Size:      start.Size,
-				NextIndex: 0,
-				TempPath:  tmp.Name(),
-			}
-			saveResumeState(destDir, state)
-		}
+		received = 0
 	}
 
 	tmpPath := tmp.Name()
-	defer func() { os.Remove(tmpPath) }()
+	defer func() {
+		// A partial file stays behind for the next attempt to resume,
+		// unless its contents turned out to be wrong.
+		if err != nil && state != nil {
+			if !errors.Is(err, ErrChecksumMismatch) {
+				return
+			}
+			deleteResumeState(destDir, start.FileID)
+		}
+		os.Remove(tmpPath)
+		if state != nil {
+			// Only goes once no other partial file is left in it.
+			os.Remove(filepath.Dir(tmpPath))
+		}
+	}()
 
 	// Ack the sender when resume handshake is active.
 	if start.Resume {
 		if nextIndex > 0 {
-			resumeOffset := int64(nextIndex) * protocol.FileChunkSize
 			if err := sess.SendMessage(protocol.Message{
 				Type:   protocol.MessageTypeFileResume,
 				FileID: start.FileID,
-				Offset: resumeOffset,
+				Index:  nextIndex,
+				Offset: received,
 			}); err != nil {
 				tmp.Close()
 				return fmt.Errorf("send file_resume: %w", err)
 			}
-			fmt.Printf("Resuming from %s\n", formatBytes(resumeOffset))
+			r.printf("Resuming from %s\n", formatBytes(received))
 		} else {
 			if err := sess.SendMessage(protocol.Message{Type: protocol.MessageTypeReady}); err != nil {
 				tmp.Close()
@@ -507,21 +1173,24 @@ func receiveOneFile(sess *session.SecureSession, destDir string, start protocol.
 		}
 	}
 
-	label := start.Name
-	if isArchive {
+	label := fileLabel(start)
+	if archive {
 		label = strings.TrimSuffix(start.Name, ".tar.gz") + "/"
 	}
-	if start.Size > 0 {
-		fmt.Printf("Receiving  %s  (%s)\n", label, formatBytes(start.Size))
-	} else {
-		fmt.Printf("Receiving  %s  (streaming)\n", label)
+	r.emit(Event{Kind: EventFileStarted, Name: label, Size: start.Size, Bytes: received})
+	bar, shared := cfg.bar, cfg.bar != nil
+	if !shared {
+		if start.Size > 0 {
+			r.printf("Receiving  %s  (%s)\n", label, formatBytes(start.Size))
+		} else {
+			r.printf("Receiving  %s  (streaming)\n", label)
+		}
+		bar = r.newProgress(label, start.Size)
 	}
-
-	bar := newBar(start.Size)
-	bar.Set64(int64(nextIndex) * protocol.FileChunkSize)
+	bar.add(received)
 
 	for {
-		msg, err := sess.ReceiveMessage()
+		msg, err := receiveMessage(sess)
 		if err != nil {
 			tmp.Close()
 			return fmt.Errorf("receive chunk: %w", err)
@@ -537,16 +1206,26 @@ func receiveOneFile(sess *session.SecureSession, destDir string, start protocol.
 				tmp.Close()
 				return fmt.Errorf("out-of-order chunk: got %d, want %d", msg.Index, nextIndex)
 			}
+			if start.Size >= 0 && received+int64(len(msg.Chunk)) > start.Size {
+				tmp.Close()
+				return fmt.Errorf("%w: %s is larger than the announced %s", ErrOfferMismatch, fileLabel(start), formatBytes(start.Size))
+			}
+			if err := cfg.limit.add(len(msg.Chunk)); err != nil {
+				tmp.Close()
+				return err
+			}
 			if _, err := tmp.Write(msg.Chunk); err != nil {
 				tmp.Close()
 				return fmt.Errorf("write chunk: %w", err)
 			}
 			hasher.Write(msg.Chunk)
-			bar.Add(len(msg.Chunk))
+			bar.add(int64(len(msg.Chunk)))
 			nextIndex++
+			received += int64(len(msg.Chunk))
 
 			if state != nil {
 				state.NextIndex = nextIndex
+				state.Offset = received
 				saveResumeState(destDir, state)
 			}
 
@@ -556,7 +1235,7 @@ func receiveOneFile(sess *session.SecureSession, destDir string, start protocol.
 				return fmt.Errorf("unexpected file_id in file_complete")
 			}
 
-			checksumMsg, err := sess.ReceiveMessage()
+			checksumMsg, err := receiveMessage(sess)
 			if err != nil {
 				return fmt.Errorf("receive checksum: %w", err)
 			}
@@ -566,7 +1245,7 @@ func receiveOneFile(sess *session.SecureSession, destDir string, start protocol.
 
 			localChecksum := hex.EncodeToString(hasher.Sum(nil))
 			if localChecksum != checksumMsg.Checksum {
-				return fmt.Errorf("checksum mismatch: got %s, want %s", localChecksum, checksumMsg.Checksum)
+				return fmt.Errorf("%w: got %s, want %s", ErrChecksumMismatch, localChecksum, checksumMsg.Checksum)
 			}
 
 			if err := sess.SendMessage(protocol.Message{
@@ -581,23 +1260,40 @@ func receiveOneFile(sess *session.SecureSession, destDir string, start protocol.
 				deleteResumeState(destDir, start.FileID)
 			}
 
-			bar.Finish()
-			fmt.Println()
+			if !shared {
+				bar.finish()
+				r.println()
+			}
 
-			if isArchive {
-				fmt.Printf("Extracting %s...\n", start.Name)
-				if err := extractTarGz(tmpPath, destDir); err != nil {
+			verified := Event{Kind: EventFileVerified, Name: label, Size: received, Checksum: localChecksum, Path: destPath}
+			if archive {
+				r.printf("Extracting %s...\n", start.Name)
+				if err := extractTarGz(tmpPath, destDir, cfg.limit); err != nil {
 					return fmt.Errorf("extract archive: %w", err)
 				}
-				fmt.Printf("✓  Saved to %s — checksum verified\n", destDir)
+				verified.Path = destDir
+				r.emit(verified)
+				r.printf("✓  Saved to %s — checksum verified\n", destDir)
+			} else if cfg.sink != nil {
+				if err := copyTo(cfg.sink, tmpPath); err != nil {
+					return fmt.Errorf("write to stdout: %w", err)
+				}
+				verified.Path = "-"
+				r.emit(verified)
+				r.printf("✓  Wrote %s (%s) to stdout — checksum verified\n", fileLabel(start), formatBytes(received))
 			} else {
-				destPath := filepath.Join(destDir, filepath.Base(start.Name))
 				if err := os.Rename(tmpPath, destPath); err != nil {
 					if err2 := copyFile(tmpPath, destPath); err2 != nil {
 						return fmt.Errorf("save file: %w", err2)
 					}
 				}
-				fmt.Printf("✓  Saved to %s — checksum verified\n", destPath)
+				if err := setMetadata(destPath, start.Mode, start.MTime); err != nil {
+					return fmt.Errorf("save file: %w", err)
+				}
+				r.emit(verified)
+				if !shared {
+					r.printf("✓  Saved to %s — checksum verified\n", destPath)
+				}
 			}
 			return nil
 
@@ -608,7 +1304,9 @@ func receiveOneFile(sess *session.SecureSession, destDir string, start protocol.
 	}
 }
 
-func extractTarGz(srcPath, destDir string) error {
+// extractTarGz unpacks the tar.gz at srcPath into destDir. It stops at the
+// first file that takes it past limit; a nil limit unpacks everything.
+func extractTarGz(srcPath, destDir string, limit *offerLimit) error {
 	f, err := os.Open(srcPath)
 	if err != nil {
 		return err
@@ -640,6 +1338,9 @@ func extractTarGz(srcPath, destDir string) error {
 		if strings.HasPrefix(clean, "..") || filepath.IsAbs(clean) {
 			return fmt.Errorf("rejected unsafe tar entry: %q", hdr.Name)
 		}
+		if slices.ContainsFunc(strings.Split(filepath.ToSlash(clean), "/"), reservedName) {
+			return fmt.Errorf("rejected reserved tar entry: %q", hdr.Name)
+		}
 
 		target := filepath.Join(absDestDir, clean)
 		if !strings.HasPrefix(target, absDestDir+string(filepath.Separator)) {
@@ -652,6 +1353,9 @@ func extractTarGz(srcPath, destDir string) error {
 				return err
 			}
 		case tar.TypeReg:
+			if err := limit.unpack(hdr.Size); err != nil {
+				return err
+			}
 			if err := os.MkdirAll(filepath.Dir(target), 0o750); err != nil {
 				return err
 			}
@@ -670,6 +1374,17 @@ func extractTarGz(srcPath, destDir string) error {
 	return nil
 }
 
+// copyTo writes the contents of the file at src to w.
+func copyTo(w io.Writer, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
 func copyFile(src, dst string) error {
 	in, err := os.Open(src)
 	if err != nil {
@@ -686,16 +1401,23 @@ func copyFile(src, dst string) error {
 }
 
 // resumeState is persisted alongside a partial download so the receiver can
-// hand the correct byte offset back to the sender on reconnect.
+// hand the correct byte offset back to the sender on reconnect. It records
+// no path: the partial file's location follows from the file ID alone, so a
+// state file planted in the destination cannot point anywhere else.
 type resumeState struct {
 	FileID    string `json:"file_id"`
 	Name      string `json:"name"`
 	Size      int64  `json:"size"`
 	NextIndex int    `json:"next_index"`
-	TempPath  string `json:"temp_path"`
+	Offset    int64  `json:"offset,omitempty"`
 }
 
+// byteOffset returns how much of the file has been received. State files
+// written before chunk sizes were negotiated only record the chunk index.
 func (s *resumeState) byteOffset() int64 {
+	if s.Offset > 0 {
+		return s.Offset
+	}
 	return int64(s.NextIndex) * protocol.FileChunkSize
 }
 
@@ -703,6 +1425,76 @@ func resumeStatePath(destDir, fileID string) string {
 	return filepath.Join(destDir, ".goxfer-"+fileID+".state")
 }
 
+// reservedPrefix starts the name of everything goxfer keeps in a
+// destination for itself: resume state files and the partial directory.
+const reservedPrefix = ".goxfer-"
+
+// reservedName reports whether a sender is barred from delivering a file or
+// directory called name, since it could pass for goxfer's own bookkeeping.
+func reservedName(name string) bool {
+	return strings.HasPrefix(name, reservedPrefix)
+}
+
+// validFileID reports whether id is shaped like the IDs senders generate.
+// Only those name a state or partial file, so no ID reaches outside destDir.
+func validFileID(id string) bool {
+	if len(id) != 24 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil && strings.ToLower(id) == id
+}
+
+// partialDir is where partial downloads wait to be resumed. It sits in the
+// destination, so a finished file is renamed into place, under a reserved
+// name no sender can deliver.
+func partialDir(destDir string) string {
+	return filepath.Join(destDir, reservedPrefix+"partial")
+}
+
+// createPartial creates an empty partial file for fileID, replacing any
+// earlier one. The file is created afresh so an existing link is never
+// followed.
+func createPartial(destDir, fileID string) (*os.File, error) {
+	dir := partialDir(destDir)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	if info, err := os.Lstat(dir); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	p := filepath.Join(dir, fileID)
+	os.Remove(p)
+	return os.OpenFile(p, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+}
+
+// openPartial opens the partial file for fileID, refusing anything but a
+// regular file inside a real partial directory.
+func openPartial(destDir, fileID string) (*os.File, error) {
+	dir := partialDir(destDir)
+	if info, err := os.Lstat(dir); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	p := filepath.Join(dir, fileID)
+	before, err := os.Lstat(p)
+	if err != nil {
+		return nil, err
+	}
+	if !before.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", p)
+	}
+	f, err := os.OpenFile(p, os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	// The file must not have been swapped between the check and the open.
+	if after, err := f.Stat(); err != nil || !os.SameFile(before, after) {
+		f.Close()
+		return nil, fmt.Errorf("%s changed while being opened", p)
+	}
+	return f, nil
+}
+
 func loadResumeState(destDir, fileID string) *resumeState {
 	data, err := os.ReadFile(resumeStatePath(destDir, fileID))
 	if err != nil {
@@ -747,6 +1539,31 @@ func rehashFile(path string, n int64, h hash.Hash) error {
 	return err
 }
 
+// newCodeSecret returns the secret half of a relay session code. The
+// alphabet leaves out characters that are easy to confuse when read aloud.
+func newCodeSecret() (string, error) {
+	const chars = "23456789abcdefghjkmnpqrstuvwxyz"
+	var raw [8]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return "", fmt.Errorf("generate session code: %w", err)
+	}
+	secret := make([]byte, len(raw))
+	for i, b := range raw {
+		secret[i] = chars[int(b)%len(chars)]
+	}
+	return string(secret), nil
+}
+
+// codeNameplate returns the part of a "<nameplate>-<secret>" session code
+// that is sent to the relay for pairing.
+func codeNameplate(code string) (string, error) {
+	nameplate, secret, ok := strings.Cut(code, "-")
+	if !ok || nameplate == "" || secret == "" {
+		return "", fmt.Errorf("invalid session code %q: expected <nameplate>-<secret> as printed by the sender", code)
+	}
+	return nameplate, nil
+}
+
 func randomFileID() (string, error) {
 	var raw [12]byte
 	if _, err := rand.Read(raw[:]); err != nil {
@@ -755,36 +1572,21 @@ func randomFileID() (string, error) {
 	return hex.EncodeToString(raw[:]), nil
 }
 
-// printReceiverCommand prints a clearly bordered block with the command
-// the receiver needs to run. Flags are placed before positional arguments
-// so Go's flag parser picks them up correctly.
-func printReceiverCommand(base string, resume bool, code, addr string) {
-	cmd := base
+// listening tells the user the command the other side needs to run to
+// reach addr, in a clearly bordered block, and this side's fingerprint.
+// Flags are placed before positional arguments so Go's flag parser picks
+// them up correctly.
+func (r *reporter) listening(prompt peerPrompt, code, addr string, identity *crypto.Identity) {
+	cmd := prompt.command
 	if code != "" {
 		cmd += " --code=" + code
 	}
-	if resume {
-		cmd += " --resume"
-	}
-	cmd += " " + addr + " <dest-dir>"
+	cmd += " " + addr + " " + prompt.arg
 	border := strings.Repeat("─", len(cmd)+4)
-	fmt.Printf("\n┌%s┐\n│  %s  │\n└%s┘\n\n", border, cmd, border)
-	fmt.Println("  Run the command above on the receiving machine.")
-}
-
-// newBar returns a progress bar suitable for file transfer output.
-func newBar(size int64) *progressbar.ProgressBar {
-	return progressbar.NewOptions64(size,
-		progressbar.OptionSetWidth(40),
-		progressbar.OptionShowBytes(true),
-		progressbar.OptionShowCount(),
-		progressbar.OptionSetItsString("B"),
-		progressbar.OptionSetPredictTime(true),
-		progressbar.OptionSetElapsedTime(true),
-		progressbar.OptionShowElapsedTimeOnFinish(),
-		progressbar.OptionUseIECUnits(true),
-		progressbar.OptionFullWidth(),
-	)
+	r.printf("\n┌%s┐\n│  %s  │\n└%s┘\n\n", border, cmd, border)
+	r.println("  Run the command above on the other machine.")
+	r.printf("Your fingerprint : %s\n", identity.Fingerprint())
+	r.emit(Event{Kind: EventListening, Addr: addr, Code: code, Command: cmd, Fingerprint: identity.Fingerprint()})
 }
 
 // formatBytes returns a human-readable byte size string.
@@ -2,16 +2,25 @@ package transfer
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/JonathanInTheClouds/goxfer/internal/crypto"
+	"github.com/JonathanInTheClouds/goxfer/internal/mux"
+	"github.com/JonathanInTheClouds/goxfer/internal/peers"
 	"github.com/JonathanInTheClouds/goxfer/internal/protocol"
 	"github.com/JonathanInTheClouds/goxfer/internal/session"
 )
@@ -57,6 +66,15 @@ func makePair(t *testing.T) (senderSess, receiverSess *session.SecureSession) {
 	return r.sess, recvSess
 }
 
+// testFeatures returns what two peers running this build negotiate.
+func testFeatures(resume bool) features {
+	feat, err := negotiate(localHello(resume), localHello(resume))
+	if err != nil {
+		panic(err)
+	}
+	return feat
+}
+
 func TestDirectReceiverAddr(t *testing.T) {
 	tests := []struct {
 		name string
@@ -113,12 +131,12 @@ func TestP2P_SingleFile(t *testing.T) {
 			sendErr <- err
 			return
 		}
-		err = sendSingleFile(senderSess, srcPath, info, false)
+		err = sendSingleFile(senderSess, srcPath, info, sendConfig{feat: testFeatures(false)})
 		senderSess.Close() // signal EOF to receiver
 		sendErr <- err
 	}()
 	go func() {
-		recvErr <- receiveFiles(receiverSess, destDir, false)
+		recvErr <- receiveFiles(receiverSess, destDir, receiveConfig{feat: testFeatures(false)})
 	}()
 
 	if err := <-sendErr; err != nil {
@@ -166,12 +184,12 @@ func TestP2P_ChecksumVerification(t *testing.T) {
 
 	go func() {
 		info, _ := os.Stat(srcPath)
-		err := sendSingleFile(senderSess, srcPath, info, false)
+		err := sendSingleFile(senderSess, srcPath, info, sendConfig{feat: testFeatures(false)})
 		senderSess.Close()
 		sendErr <- err
 	}()
 	go func() {
-		recvErr <- receiveFiles(receiverSess, destDir, false)
+		recvErr <- receiveFiles(receiverSess, destDir, receiveConfig{feat: testFeatures(false)})
 	}()
 
 	if err := <-sendErr; err != nil {
@@ -215,12 +233,12 @@ func TestP2P_Directory(t *testing.T) {
 	recvErr := make(chan error, 1)
 
 	go func() {
-		err := sendDirectory(senderSess, srcDir)
+		err := sendDirectory(senderSess, srcDir, sendConfig{feat: testFeatures(false)})
 		senderSess.Close()
 		sendErr <- err
 	}()
 	go func() {
-		recvErr <- receiveFiles(receiverSess, destDir, false)
+		recvErr <- receiveFiles(receiverSess, destDir, receiveConfig{feat: testFeatures(false)})
 	}()
 
 	if err := <-sendErr; err != nil {
@@ -266,14 +284,13 @@ func TestP2P_Resume(t *testing.T) {
 	info, _ := os.Stat(srcPath)
 	fileID := deterministicFileID(srcPath, info.Size())
 
-	// Create a partial temp file containing the first chunk.
-	partialTmp, err := os.CreateTemp("", "goxfer-resume-tmp-*")
+	// Create a partial file containing the first chunk.
+	partial, err := createPartial(destDir, fileID)
 	if err != nil {
-		t.Fatalf("create partial temp: %v", err)
+		t.Fatalf("create partial file: %v", err)
 	}
-	partialTmp.Write(content[:protocol.FileChunkSize])
-	partialTmp.Close()
-	defer os.Remove(partialTmp.Name())
+	partial.Write(content[:protocol.FileChunkSize])
+	partial.Close()
 
 	// Write a state file that says one chunk has been received.
 	state := &resumeState{
@@ -281,7 +298,6 @@ func TestP2P_Resume(t *testing.T) {
 		Name:      filepath.Base(srcPath),
 		Size:      info.Size(),
 		NextIndex: 1,
-		TempPath:  partialTmp.Name(),
 	}
 	saveResumeState(destDir, state)
 
@@ -292,12 +308,12 @@ func TestP2P_Resume(t *testing.T) {
 	recvErr := make(chan error, 1)
 
 	go func() {
-		err := sendSingleFile(senderSess, srcPath, info, true)
+		err := sendSingleFile(senderSess, srcPath, info, sendConfig{feat: testFeatures(true)})
 		senderSess.Close()
 		sendErr <- err
 	}()
 	go func() {
-		recvErr <- receiveFiles(receiverSess, destDir, true)
+		recvErr <- receiveFiles(receiverSess, destDir, receiveConfig{feat: testFeatures(true)})
 	}()
 
 	if err := <-sendErr; err != nil {
@@ -320,6 +336,76 @@ func TestP2P_Resume(t *testing.T) {
 	if _, err := os.Stat(resumeStatePath(destDir, fileID)); !os.IsNotExist(err) {
 		t.Fatal("state file should be deleted after successful transfer")
 	}
+	if _, err := os.Stat(partialDir(destDir)); !os.IsNotExist(err) {
+		t.Fatal("partial directory should be removed after successful transfer")
+	}
+}
+
+func TestReceiveFiles_PlantedStateFileCannotReachOutside(t *testing.T) {
+	// A malicious sender plants a state file naming a file outside the
+	// destination, then asks to resume it.
+	outside := filepath.Join(t.TempDir(), "precious.txt")
+	if err := os.WriteFile(outside, []byte("keep me"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	const fileID = "0123456789abcdef01234567"
+	planted, _ := json.Marshal(map[string]any{
+		"file_id": fileID, "name": "x", "size": 10, "next_index": 0, "temp_path": outside,
+	})
+	sum := sha256.Sum256(planted)
+	stateName := filepath.Base(resumeStatePath("", fileID))
+
+	drain := func(sess *session.SecureSession) {
+		for {
+			if _, err := sess.ReceiveMessage(); err != nil {
+				return
+			}
+		}
+	}
+
+	destDir := t.TempDir()
+	senderSess, receiverSess := makePair(t)
+	defer senderSess.Close()
+	recvErr := make(chan error, 1)
+	go func() {
+		recvErr <- receiveFiles(receiverSess, destDir, receiveConfig{feat: testFeatures(true)})
+		receiverSess.Close()
+	}()
+	go drain(senderSess)
+	for _, msg := range []protocol.Message{
+		{Type: protocol.MessageTypeFileStart, FileID: "00000000000000000000aaaa", Name: stateName, Size: int64(len(planted)), Resume: true},
+		{Type: protocol.MessageTypeFileChunk, FileID: "00000000000000000000aaaa", Chunk: planted},
+		{Type: protocol.MessageTypeFileComplete, FileID: "00000000000000000000aaaa"},
+		{Type: protocol.MessageTypeFileChecksum, FileID: "00000000000000000000aaaa", Checksum: hex.EncodeToString(sum[:])},
+	} {
+		if err := senderSess.SendMessage(msg); err != nil {
+			break
+		}
+	}
+	if err := <-recvErr; err == nil {
+		t.Fatal("receiver accepted a file named like a resume state file")
+	}
+	if _, err := os.Stat(resumeStatePath(destDir, fileID)); !os.IsNotExist(err) {
+		t.Fatal("the planted state file was saved")
+	}
+
+	// Even a state file that got there some other way names no path.
+	os.WriteFile(resumeStatePath(destDir, fileID), planted, 0o600)
+	senderSess, receiverSess = makePair(t)
+	defer senderSess.Close()
+	go func() {
+		recvErr <- receiveFiles(receiverSess, destDir, receiveConfig{feat: testFeatures(true)})
+		receiverSess.Close()
+	}()
+	go drain(senderSess)
+	senderSess.SendMessage(protocol.Message{Type: protocol.MessageTypeFileStart, FileID: fileID, Name: "x", Size: 10, Resume: true})
+	senderSess.SendMessage(protocol.Message{Type: protocol.MessageTypeFileChunk, FileID: fileID, Chunk: []byte("overwrite!")})
+	senderSess.Close()
+	<-recvErr
+
+	if got, err := os.ReadFile(outside); err != nil || string(got) != "keep me" {
+		t.Fatalf("file outside the destination changed: %q, %v", got, err)
+	}
 }
 
 func TestExtractTarGz_ZipSlip(t *testing.T) {
@@ -357,7 +443,7 @@ func TestExtractTarGz_ZipSlip(t *testing.T) {
 			defer os.Remove(tmp.Name())
 
 			destDir := t.TempDir()
-			if err := extractTarGz(tmp.Name(), destDir); err == nil {
+			if err := extractTarGz(tmp.Name(), destDir, nil); err == nil {
 				t.Fatalf("expected zip-slip error for %q, got nil", tt.tarName)
 			}
 		})
@@ -399,7 +485,7 @@ func TestExtractTarGz_ValidArchive(t *testing.T) {
 	defer os.Remove(tmp.Name())
 
 	destDir := t.TempDir()
-	if err := extractTarGz(tmp.Name(), destDir); err != nil {
+	if err := extractTarGz(tmp.Name(), destDir, nil); err != nil {
 		t.Fatalf("extractTarGz: %v", err)
 	}
 
@@ -413,3 +499,421 @@ func TestExtractTarGz_ValidArchive(t *testing.T) {
 		}
 	}
 }
+
+func TestDialPeer_CanceledWhileThePeerIsSilent(t *testing.T) {
+	// Accepts connections, directly or as a relay, and never answers.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	identity, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, code := range []string{"", "ab12cd34-k7f2q9xw"} {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		start := time.Now()
+		_, err := dialPeer(ctx, l.Addr().String(), code, identity)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("code %q: got %v, want the dial canceled", code, err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("code %q: dial gave up after %v", code, elapsed)
+		}
+	}
+}
+
+func TestVerifyPeer(t *testing.T) {
+	senderSess, receiverSess := makePair(t)
+	defer senderSess.Close()
+	defer receiverSess.Close()
+
+	if err := verifyPeer(nil, receiverSess, ""); err != nil {
+		t.Fatalf("no expectation: %v", err)
+	}
+	if err := verifyPeer(nil, receiverSess, receiverSess.PeerFingerprint()); err != nil {
+		t.Fatalf("matching fingerprint: %v", err)
+	}
+
+	other, _ := crypto.GenerateIdentity()
+	if err := verifyPeer(nil, receiverSess, other.Fingerprint()); err == nil {
+		t.Fatal("expected mismatch error for wrong fingerprint")
+	}
+}
+
+func TestTrustPeer_FirstUseThenChange(t *testing.T) {
+	known, err := peers.Load(filepath.Join(t.TempDir(), "known_peers"))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	senderSess, receiverSess := makePair(t)
+	defer senderSess.Close()
+	defer receiverSess.Close()
+
+	// First use passes, but nothing is recorded until the transfer is
+	// accepted.
+	if err := trustPeer(nil, receiverSess, known, "alice"); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if _, ok := known.Lookup("alice"); ok {
+		t.Fatal("alice recorded before the transfer was accepted")
+	}
+	if err := rememberPeer(nil, receiverSess, known, "alice"); err != nil {
+		t.Fatalf("rememberPeer: %v", err)
+	}
+	p, ok := known.Lookup("alice")
+	if !ok || p.Fingerprint != receiverSess.PeerFingerprint() {
+		t.Fatalf("alice not recorded: %+v, %v", p, ok)
+	}
+
+	// Same peer again is accepted.
+	if err := trustPeer(nil, receiverSess, known, "alice"); err != nil {
+		t.Fatalf("second use: %v", err)
+	}
+
+	// A different peer claiming to be alice is refused.
+	otherSender, otherReceiver := makePair(t)
+	defer otherSender.Close()
+	defer otherReceiver.Close()
+	if err := trustPeer(nil, otherReceiver, known, "alice"); err == nil {
+		t.Fatal("expected changed-fingerprint error, got nil")
+	}
+
+	// Without an alias nothing is required.
+	if err := trustPeer(nil, otherReceiver, known, ""); err != nil {
+		t.Fatalf("no alias: %v", err)
+	}
+}
+
+func TestCodeNameplate(t *testing.T) {
+	secret, err := newCodeSecret()
+	if err != nil {
+		t.Fatalf("newCodeSecret: %v", err)
+	}
+	if len(secret) != 8 {
+		t.Fatalf("secret %q has length %d, want 8", secret, len(secret))
+	}
+
+	nameplate, err := codeNameplate("ab12cd34-" + secret)
+	if err != nil {
+		t.Fatalf("codeNameplate: %v", err)
+	}
+	if nameplate != "ab12cd34" {
+		t.Fatalf("nameplate = %q, want ab12cd34", nameplate)
+	}
+
+	for _, bad := range []string{"ab12cd34", "-secret", "ab12cd34-"} {
+		if _, err := codeNameplate(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestCheckShortAuthString_Verify(t *testing.T) {
+	senderSess, receiverSess := makePair(t)
+	defer senderSess.Close()
+	defer receiverSess.Close()
+
+	orig := promptInput
+	defer func() { promptInput = orig }()
+
+	promptInput = bufio.NewReader(strings.NewReader("y\n"))
+	if err := checkShortAuthString(nil, receiverSess, true, nil); err != nil {
+		t.Fatalf("confirmed SAS: %v", err)
+	}
+
+	promptInput = bufio.NewReader(strings.NewReader("n\n"))
+	if err := checkShortAuthString(nil, receiverSess, true, nil); err == nil {
+		t.Fatal("expected error when user rejects SAS")
+	}
+
+	// Without --verify no answer is read.
+	promptInput = bufio.NewReader(strings.NewReader(""))
+	if err := checkShortAuthString(nil, receiverSess, false, nil); err != nil {
+		t.Fatalf("no verify: %v", err)
+	}
+}
+
+func TestAuthenticatePeer_RejectedSASIsNotRemembered(t *testing.T) {
+	known, err := peers.Load(filepath.Join(t.TempDir(), "known_peers"))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	senderSess, receiverSess := makePair(t)
+	defer senderSess.Close()
+	defer receiverSess.Close()
+
+	orig := promptInput
+	defer func() { promptInput = orig }()
+	promptInput = bufio.NewReader(strings.NewReader("n\n"))
+
+	go authenticatePeer(senderSess, localHello(false), peerCheck{})
+	check := peerCheck{knownPeers: known, alias: "alice", verify: true}
+	if _, err := authenticatePeer(receiverSess, localHello(false), check); err == nil {
+		t.Fatal("expected error when user rejects SAS")
+	}
+	if _, ok := known.Lookup("alice"); ok {
+		t.Fatal("peer recorded although the verification was rejected")
+	}
+}
+
+func TestP2P_ReceiverReportsChecksumMismatch(t *testing.T) {
+	senderSess, receiverSess := makePair(t)
+	defer senderSess.Close()
+
+	recvErr := make(chan error, 1)
+	go func() {
+		recvErr <- receiveFiles(receiverSess, t.TempDir(), receiveConfig{feat: testFeatures(false)})
+		receiverSess.Close()
+	}()
+
+	for _, msg := range []protocol.Message{
+		{Type: protocol.MessageTypeFileStart, FileID: "0000000000000000000000f1", Name: "a.txt", Size: 5},
+		{Type: protocol.MessageTypeFileChunk, FileID: "0000000000000000000000f1", Index: 0, Chunk: []byte("hello")},
+		{Type: protocol.MessageTypeFileComplete, FileID: "0000000000000000000000f1"},
+		{Type: protocol.MessageTypeFileChecksum, FileID: "0000000000000000000000f1", Checksum: "not-the-checksum"},
+	} {
+		if err := senderSess.SendMessage(msg); err != nil {
+			t.Fatalf("send %s: %v", msg.Type, err)
+		}
+	}
+
+	_, err := receiveMessage(senderSess)
+	var remote *RemoteError
+	if !errors.As(err, &remote) || remote.Code != protocol.ErrorCodeChecksumMismatch {
+		t.Fatalf("sender got %v, want RemoteError with code %s", err, protocol.ErrorCodeChecksumMismatch)
+	}
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatal("RemoteError should match ErrChecksumMismatch")
+	}
+	if err := <-recvErr; !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("receiver got %v, want ErrChecksumMismatch", err)
+	}
+}
+
+func TestP2P_SenderCancel(t *testing.T) {
+	senderSess, receiverSess := makePair(t)
+	defer senderSess.Close()
+	defer receiverSess.Close()
+
+	recvErr := make(chan error, 1)
+	go func() {
+		recvErr <- receiveFiles(receiverSess, t.TempDir(), receiveConfig{feat: testFeatures(false)})
+	}()
+
+	senderSess.SendMessage(protocol.Message{Type: protocol.MessageTypeFileStart, FileID: "0000000000000000000000f1", Name: "a.txt", Size: 10})
+	senderSess.SendMessage(protocol.Message{Type: protocol.MessageTypeFileChunk, FileID: "0000000000000000000000f1", Index: 0, Chunk: []byte("hello")})
+	senderSess.SendMessage(protocol.Message{Type: protocol.MessageTypeCancel, Reason: "interrupted by user"})
+
+	err := <-recvErr
+	if !errors.Is(err, ErrCanceled) {
+		t.Fatalf("receiver got %v, want ErrCanceled", err)
+	}
+	if !strings.Contains(err.Error(), "interrupted by user") {
+		t.Fatalf("error %q should carry the sender's reason", err)
+	}
+}
+
+func TestReceiveFiles_TruncatedTransferFails(t *testing.T) {
+	senderSess, receiverSess := makePair(t)
+
+	recvErr := make(chan error, 1)
+	go func() {
+		recvErr <- receiveFiles(receiverSess, t.TempDir(), receiveConfig{feat: testFeatures(false)})
+	}()
+
+	senderSess.SendMessage(protocol.Message{Type: protocol.MessageTypeFileStart, FileID: "0000000000000000000000f1", Name: "a.txt", Size: 10})
+	senderSess.SendMessage(protocol.Message{Type: protocol.MessageTypeFileChunk, FileID: "0000000000000000000000f1", Index: 0, Chunk: []byte("hello")})
+	senderSess.Close()
+
+	if err := <-recvErr; err == nil {
+		t.Fatal("expected an error when the sender disconnects mid-file")
+	}
+}
+
+func TestP2P_ConcurrentFilesOverMux(t *testing.T) {
+	senderSess, receiverSess := makePair(t)
+	senderMux, receiverMux := mux.New(senderSess, false), mux.New(receiverSess, true)
+	defer senderMux.Close()
+	defer receiverMux.Close()
+
+	srcDir, destDir := t.TempDir(), t.TempDir()
+	contents := map[string][]byte{
+		"a.bin": bytes.Repeat([]byte("a"), 5*protocol.FileChunkSize+17),
+		"b.bin": bytes.Repeat([]byte("b"), 3*protocol.FileChunkSize+5),
+	}
+	for name, data := range contents {
+		os.WriteFile(filepath.Join(srcDir, name), data, 0o644)
+	}
+
+	sendErr := make(chan error, len(contents))
+	for name := range contents {
+		go func(path string) {
+			stream, err := senderMux.OpenStream()
+			if err != nil {
+				sendErr <- err
+				return
+			}
+			info, _ := os.Stat(path)
+			err = sendSingleFile(stream, path, info, sendConfig{feat: testFeatures(false)})
+			stream.Close()
+			sendErr <- err
+		}(filepath.Join(srcDir, name))
+	}
+
+	recvErr := make(chan error, len(contents))
+	for range contents {
+		stream, err := receiverMux.AcceptStream()
+		if err != nil {
+			t.Fatalf("AcceptStream: %v", err)
+		}
+		go func() { recvErr <- receiveFiles(stream, destDir, receiveConfig{feat: testFeatures(false)}) }()
+	}
+
+	for range contents {
+		if err := <-sendErr; err != nil {
+			t.Fatalf("send error: %v", err)
+		}
+		if err := <-recvErr; err != nil {
+			t.Fatalf("receive error: %v", err)
+		}
+	}
+	for name, want := range contents {
+		got, err := os.ReadFile(filepath.Join(destDir, name))
+		if err != nil {
+			t.Fatalf("read %s: %v", name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s: content mismatch", name)
+		}
+	}
+}
+
+func TestP2P_Pipe(t *testing.T) {
+	data := bytes.Repeat([]byte("row\n"), protocol.FileChunkSize)
+	item := sendItem{path: "dump.sql", pipe: bytes.NewReader(data)}
+	offer, err := buildOffer([]sendItem{item}, "AB:CD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !offer.Pipe || offer.Size != -1 || offer.Count != 1 {
+		t.Fatalf("offer = %+v, want a piped offer of one file of unknown size", offer)
+	}
+
+	run := func(t *testing.T, cfg receiveConfig) (destDir string) {
+		senderSess, receiverSess := makePair(t)
+		destDir = t.TempDir()
+		item.pipe = bytes.NewReader(data)
+		sendErr := make(chan error, 1)
+		go func() {
+			sendErr <- sendItems(senderSess, []sendItem{item}, offer, sendConfig{feat: testFeatures(false)})
+		}()
+		cfg.feat, cfg.limit = testFeatures(false), newOfferLimit(offer)
+		if err := receiveFiles(receiverSess, destDir, cfg); err != nil {
+			t.Fatalf("receive error: %v", err)
+		}
+		receiverSess.Close()
+		if err := <-sendErr; err != nil {
+			t.Fatalf("send error: %v", err)
+		}
+		return destDir
+	}
+
+	t.Run("to stdout", func(t *testing.T) {
+		var out bytes.Buffer
+		destDir := run(t, receiveConfig{sink: &out})
+		if !bytes.Equal(out.Bytes(), data) {
+			t.Fatalf("sink got %d bytes, want %d", out.Len(), len(data))
+		}
+		if entries, _ := os.ReadDir(destDir); len(entries) != 0 {
+			t.Fatalf("destDir holds %d entries, want none", len(entries))
+		}
+	})
+
+	t.Run("to a directory", func(t *testing.T) {
+		// Piped data of unknown size is saved as-is, never extracted.
+		destDir := run(t, receiveConfig{})
+		got, err := os.ReadFile(filepath.Join(destDir, "dump.sql"))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("saved %d bytes, %v; want %d", len(got), err, len(data))
+		}
+	})
+}
+
+func TestPipeItem(t *testing.T) {
+	item, err := pipeItem(SendOptions{})
+	if err != nil || item.path != "stdin" || item.pipe == nil {
+		t.Fatalf("pipeItem = %+v, %v; want stdin read from the pipe", item, err)
+	}
+	if item, err := pipeItem(SendOptions{PipeName: "db.sql"}); err != nil || item.path != "db.sql" {
+		t.Fatalf("pipeItem with name = %+v, %v", item, err)
+	}
+	for _, name := range []string{"../db.sql", "a/b", "..", "-"} {
+		if _, err := pipeItem(SendOptions{PipeName: name}); err == nil {
+			t.Errorf("pipeItem accepted name %q", name)
+		}
+	}
+	// Answering the verification prompt would eat the data on stdin.
+	if _, err := pipeItem(SendOptions{Verify: true}); err == nil {
+		t.Error("pipeItem accepted Verify")
+	}
+}
+
+func TestP2P_ReceiverListens(t *testing.T) {
+	srcDir := filepath.Join(t.TempDir(), "artifacts")
+	files := map[string]string{"app.bin": "binary", "logs/build.log": "ok"}
+	for name, data := range files {
+		p := filepath.Join(srcDir, name)
+		os.MkdirAll(filepath.Dir(p), 0o750)
+		os.WriteFile(p, []byte(data), 0o644)
+	}
+	destDir := t.TempDir()
+
+	// Reserve a port for the receiver's direct listener.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listenAddr := ln.Addr().String()
+	ln.Close()
+
+	recvErr := make(chan error, 1)
+	go func() {
+		recvErr <- P2PReceive(context.Background(), "", destDir, ReceiveOptions{ListenAddr: listenAddr, Yes: true})
+	}()
+	var sendErr error
+	for i := 0; i < 50; i++ {
+		// The receiver may not be listening yet.
+		time.Sleep(20 * time.Millisecond)
+		// The sender dials, so it runs the handshake as initiator and the
+		// transfer direction no longer follows the Noise roles.
+		if sendErr = P2PSend(context.Background(), []string{srcDir}, SendOptions{ReceiverAddr: listenAddr}); !errors.Is(sendErr, syscall.ECONNREFUSED) {
+			break
+		}
+	}
+	if sendErr != nil {
+		t.Fatalf("send: %v", sendErr)
+	}
+	if err := <-recvErr; err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	for name, want := range files {
+		got, err := os.ReadFile(filepath.Join(destDir, "artifacts", name))
+		if err != nil || string(got) != want {
+			t.Errorf("%s: got %q, %v; want %q", name, got, err, want)
+		}
+	}
+}
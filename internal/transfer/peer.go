@@ -0,0 +1,422 @@
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JonathanInTheClouds/goxfer/internal/crypto"
+	"github.com/JonathanInTheClouds/goxfer/internal/peers"
+	"github.com/JonathanInTheClouds/goxfer/internal/protocol"
+	"github.com/JonathanInTheClouds/goxfer/internal/session"
+	"github.com/JonathanInTheClouds/goxfer/internal/tunnel"
+)
+
+// rendezvous is how the waiting side makes itself reachable. Empty
+// relayAddr and listenAddr uses bore.pub.
+type rendezvous struct {
+	relayAddr  string
+	listenAddr string
+	publicAddr string
+	// pairings is how many peers a relay code may pair with; 0 means one.
+	pairings int
+	// code is the relay code to wait under, <nameplate>-<secret>; empty
+	// for a new one.
+	code string
+}
+
+// peerPrompt describes the command the other side should run, e.g.
+// "goxfer receive <addr> <dest-dir>", and what to call that side.
+type peerPrompt struct {
+	command string
+	arg     string
+	peer    string
+}
+
+// awaitPeer makes this side reachable through rv, tells r the command for
+// the other side and waits for it to connect, or for ctx to be canceled.
+// A bore.pub tunnel lives until ctx is canceled, so ctx must outlive the
+// session.
+func awaitPeer(ctx context.Context, identity *crypto.Identity, rv rendezvous, prompt peerPrompt, r *reporter) (*session.SecureSession, error) {
+	w, err := listenForPeer(ctx, identity, rv, prompt, r)
+	if err != nil {
+		return nil, err
+	}
+	defer w.Close()
+	defer context.AfterFunc(ctx, func() { w.Close() })()
+	return w.accept(ctx, 0)
+}
+
+// peerWaiter holds the rendezvous open so the same peer can connect again
+// after a dropped connection: the direct or bore.pub listener stays bound,
+// and a relay code can be registered again.
+type peerWaiter struct {
+	identity *crypto.Identity
+	rv       rendezvous
+	peer     string
+	report   *reporter
+
+	listener *session.Listener
+
+	mu        sync.Mutex // guards relayConn and closed, which Close may race with accept
+	relayConn net.Conn   // registered with the relay, not yet paired
+	closed    bool
+	nameplate string
+	code      string
+	// pairings is how many more peers the relay code should pair with.
+	pairings int
+}
+
+// listenForPeer makes this side reachable through rv and tells r the
+// command for the other side. A bore.pub tunnel lives until ctx is canceled.
+func listenForPeer(ctx context.Context, identity *crypto.Identity, rv rendezvous, prompt peerPrompt, r *reporter) (*peerWaiter, error) {
+	w := &peerWaiter{identity: identity, rv: rv, peer: prompt.peer, report: r, pairings: max(rv.pairings, 1)}
+
+	switch {
+	case rv.listenAddr != "":
+		listener, actualAddr, err := bindDirectListener(rv.listenAddr, identity)
+		if err != nil {
+			return nil, err
+		}
+		w.listener = listener
+
+		peerAddr := rv.publicAddr
+		if peerAddr == "" {
+			peerAddr = directReceiverAddr(actualAddr)
+		}
+
+		r.listening(prompt, "", peerAddr, identity)
+		r.printf("Listening directly on %s\n", actualAddr)
+
+	case rv.relayAddr == "":
+		listener, localPort, err := session.Bind(":0", identity)
+		if err != nil {
+			return nil, fmt.Errorf("bind local listener: %w", err)
+		}
+		w.listener = listener
+
+		publicAddr, err := tunnel.Start(ctx, localPort)
+		if err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("start bore.pub tunnel: %w", err)
+		}
+
+		r.listening(prompt, "", publicAddr, identity)
+
+	case rv.code != "":
+		// A fixed code lets the peer reach this side the same way every
+		// time.
+		nameplate, err := codeNameplate(rv.code)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := tunnel.ReconnectAsSender(rv.relayAddr, nameplate, w.pairings)
+		if err != nil {
+			return nil, fmt.Errorf("connect to relay: %w", err)
+		}
+		w.relayConn, w.nameplate, w.code = conn, nameplate, rv.code
+
+		r.listening(prompt, w.code, rv.relayAddr, identity)
+
+	default:
+		conn, nameplate, err := tunnel.RegisterSender(rv.relayAddr, "", w.pairings)
+		if err != nil {
+			return nil, fmt.Errorf("connect to relay: %w", err)
+		}
+
+		// The relay only ever sees the nameplate; the secret half of the
+		// code stays between the two peers and keys the handshake.
+		secret, err := newCodeSecret()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		w.relayConn, w.nameplate = conn, nameplate
+		w.code = nameplate + "-" + secret
+
+		r.listening(prompt, w.code, rv.relayAddr, identity)
+	}
+	return w, nil
+}
+
+// accept waits for the peer to connect and completes the handshake. A
+// positive timeout bounds the wait; canceling ctx abandons the handshake.
+func (w *peerWaiter) accept(ctx context.Context, timeout time.Duration) (*session.SecureSession, error) {
+	conn, err := w.acceptConn(timeout)
+	if err != nil {
+		return nil, err
+	}
+	return w.handshake(ctx, conn)
+}
+
+// acceptConn waits for the peer to connect, without the handshake. A
+// positive timeout bounds the wait. Serving several peers, the caller runs
+// each handshake on its own goroutine so a peer that connects and says
+// nothing cannot keep the others out.
+func (w *peerWaiter) acceptConn(timeout time.Duration) (net.Conn, error) {
+	w.report.printf("\nWaiting for %s to connect...\n", w.peer)
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	if w.listener != nil {
+		if err := w.listener.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+		conn, err := w.listener.AcceptConn()
+		if err != nil {
+			return nil, fmt.Errorf("accept connection: %w", err)
+		}
+		return conn, nil
+	}
+
+	w.mu.Lock()
+	conn := w.relayConn
+	w.mu.Unlock()
+	if conn == nil {
+		var err error
+		conn, err = tunnel.ReconnectAsSender(w.rv.relayAddr, w.nameplate, w.pairings)
+		if err != nil {
+			return nil, err
+		}
+		w.mu.Lock()
+		if w.closed {
+			w.mu.Unlock()
+			conn.Close()
+			return nil, net.ErrClosed
+		}
+		w.relayConn = conn
+		w.mu.Unlock()
+	}
+	conn.SetDeadline(deadline)
+	err := tunnel.WaitForReceiver(conn)
+	// Paired or not, this connection is never waited on again.
+	w.mu.Lock()
+	w.relayConn = nil
+	w.mu.Unlock()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("wait for %s: %w", w.peer, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// handshake establishes the session over a connection from acceptConn.
+// Canceling ctx closes the connection until the handshake is done.
+func (w *peerWaiter) handshake(ctx context.Context, conn net.Conn) (*session.SecureSession, error) {
+	defer context.AfterFunc(ctx, func() { conn.Close() })()
+	var (
+		sess *session.SecureSession
+		err  error
+	)
+	if w.listener != nil {
+		sess, err = w.listener.Handshake(conn)
+	} else {
+		sess, err = session.NewPasswordSession(conn, w.identity, false, w.code)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("establish session: %w", err)
+	}
+	return sess, nil
+}
+
+// Close stops accepting peers. Sessions already accepted are unaffected.
+func (w *peerWaiter) Close() error {
+	w.mu.Lock()
+	w.closed = true
+	if w.relayConn != nil {
+		w.relayConn.Close()
+	}
+	w.mu.Unlock()
+	if w.listener != nil {
+		return w.listener.Close()
+	}
+	return nil
+}
+
+// peerLink is how this side reaches the peer: by waiting for it at a
+// rendezvous or by dialing it. A dropped connection is picked up again the
+// same way.
+type peerLink interface {
+	// connect returns the first session.
+	connect(ctx context.Context) (*session.SecureSession, error)
+	// left reports how many reconnects remain.
+	left() int
+	// reconnect returns a new session after the connection dropped.
+	reconnect(ctx context.Context) (*session.SecureSession, error)
+	Close() error
+}
+
+// waitingLink waits for the peer to connect, up to timeout when positive,
+// and after a drop for as long as the peer's reconnect attempts can take.
+type waitingLink struct {
+	w        *peerWaiter
+	timeout  time.Duration
+	retry    RetryPolicy
+	attempts int
+}
+
+func newWaitingLink(w *peerWaiter, timeout time.Duration, retry RetryPolicy) *waitingLink {
+	return &waitingLink{w: w, timeout: timeout, retry: retry, attempts: retry.Attempts}
+}
+
+// connect and reconnect stop waiting for good once ctx is done.
+func (l *waitingLink) connect(ctx context.Context) (*session.SecureSession, error) {
+	defer context.AfterFunc(ctx, func() { l.w.Close() })()
+	sess, err := l.w.accept(ctx, l.timeout)
+	if err != nil {
+		return nil, err
+	}
+	l.w.report.printf("%s%s connected!\n", strings.ToUpper(l.w.peer[:1]), l.w.peer[1:])
+	return sess, nil
+}
+
+func (l *waitingLink) left() int {
+	return l.attempts
+}
+
+func (l *waitingLink) reconnect(ctx context.Context) (*session.SecureSession, error) {
+	defer context.AfterFunc(ctx, func() { l.w.Close() })()
+	sess, err := l.w.accept(ctx, l.retry.window(l.attempts))
+	if err != nil {
+		return nil, fmt.Errorf("%s did not reconnect: %w", l.w.peer, err)
+	}
+	l.attempts--
+	l.w.report.println("Reconnected.")
+	return sess, nil
+}
+
+func (l *waitingLink) Close() error {
+	return l.w.Close()
+}
+
+// dialingLink dials a waiting peer, and redials with backoff after a drop.
+type dialingLink struct {
+	addr     string
+	code     string
+	identity *crypto.Identity
+	peer     string
+	retry    *reconnector
+	report   *reporter
+}
+
+func newDialingLink(addr, code string, identity *crypto.Identity, peer string, retry RetryPolicy, r *reporter) *dialingLink {
+	return &dialingLink{addr: addr, code: code, identity: identity, peer: peer, retry: &reconnector{policy: retry, report: r}, report: r}
+}
+
+func (l *dialingLink) dial(ctx context.Context) (*session.SecureSession, error) {
+	return dialPeer(ctx, l.addr, l.code, l.identity)
+}
+
+// connect and reconnect give up dialing and the handshake once ctx is done.
+func (l *dialingLink) connect(ctx context.Context) (*session.SecureSession, error) {
+	l.report.printf("Connecting to %s at %s...\n", l.peer, l.addr)
+	sess, err := l.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	l.report.printf("Connected. Your fingerprint: %s\n", l.identity.Fingerprint())
+	return sess, nil
+}
+
+func (l *dialingLink) left() int {
+	return l.retry.left()
+}
+
+func (l *dialingLink) reconnect(ctx context.Context) (*session.SecureSession, error) {
+	sess, err := l.retry.dial(ctx, l.dial)
+	if err != nil {
+		return nil, err
+	}
+	l.report.println("Reconnected.")
+	return sess, nil
+}
+
+func (l *dialingLink) Close() error {
+	return nil
+}
+
+// dialPeer connects to a waiting peer: directly or through bore.pub when
+// code is empty, through a self-hosted relay otherwise. Canceling ctx
+// abandons the dial or the handshake.
+func dialPeer(ctx context.Context, addr, code string, identity *crypto.Identity) (*session.SecureSession, error) {
+	if code == "" {
+		sess, err := session.Dial(ctx, addr, identity)
+		if err != nil {
+			return nil, fmt.Errorf("connect to peer: %w", err)
+		}
+		return sess, nil
+	}
+
+	nameplate, err := codeNameplate(code)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := tunnel.ConnectAsReceiver(ctx, addr, nameplate)
+	if err != nil {
+		return nil, fmt.Errorf("connect to relay: %w", err)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	sess, err := session.NewPasswordSession(conn, identity, true, code)
+	if !stop() {
+		if sess != nil {
+			sess.Close()
+		}
+		return nil, fmt.Errorf("establish session: %w", ctx.Err())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("establish session: %w", err)
+	}
+	return sess, nil
+}
+
+// peerCheck is how much to trust the peer before using the session, and
+// whom to tell about it.
+type peerCheck struct {
+	idleTimeout       time.Duration
+	expectFingerprint string
+	knownPeers        *peers.KnownPeers
+	alias             string
+	verify            bool
+	// confirm answers whether the verification symbols match; nil asks
+	// on stdin.
+	confirm func(symbols string) (bool, error)
+	report  *reporter
+}
+
+// authenticatePeer negotiates features and checks the peer's identity
+// according to check. Nothing else should be sent before it returns.
+func authenticatePeer(sess *session.SecureSession, hello protocol.Message, check peerCheck) (features, error) {
+	feat, err := exchangeHello(sess, hello)
+	if err != nil {
+		return features{}, err
+	}
+	startKeepalive(sess, feat, check.idleTimeout)
+	if feat.rekey {
+		sess.SetRekey(session.DefaultRekeyPolicy)
+	}
+	if err := verifyPeer(check.report, sess, check.expectFingerprint); err != nil {
+		return features{}, err
+	}
+	if err := checkShortAuthString(check.report, sess, check.verify, check.confirm); err != nil {
+		return features{}, err
+	}
+	if err := trustPeer(check.report, sess, check.knownPeers, check.alias); err != nil {
+		return features{}, err
+	}
+	return feat, nil
+}
+
+// remember records a new peer alias once the other side has been
+// authenticated and the transfer or tunnel accepted.
+func (c peerCheck) remember(sess *session.SecureSession) error {
+	return rememberPeer(c.report, sess, c.knownPeers, c.alias)
+}
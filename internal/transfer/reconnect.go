@@ -0,0 +1,119 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/JonathanInTheClouds/goxfer/internal/session"
+)
+
+// reconnectDialSlack is how long one reconnect attempt is allowed to take
+// on top of its backoff delay, covering the dial and the handshake.
+const reconnectDialSlack = 10 * time.Second
+
+// RetryPolicy bounds how P2PSend and P2PReceive reconnect after the
+// connection drops. The zero value never reconnects.
+type RetryPolicy struct {
+	// Attempts is how many times to reconnect over the whole transfer.
+	Attempts int
+	// Backoff is the delay before the first attempt; it doubles after each
+	// consecutive failure, up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy rides out a few minutes of network trouble.
+var DefaultRetryPolicy = RetryPolicy{Attempts: 8, Backoff: time.Second, MaxBackoff: 30 * time.Second}
+
+// delay returns how long to wait after failures consecutive failed attempts.
+func (p RetryPolicy) delay(failures int) time.Duration {
+	d := p.Backoff
+	for i := 0; i < failures && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+// window is how long the waiting side keeps the rendezvous open for the
+// dialing side to spend attempts reconnect attempts.
+func (p RetryPolicy) window(attempts int) time.Duration {
+	var total time.Duration
+	for i := 0; i < attempts; i++ {
+		total += p.delay(i) + reconnectDialSlack
+	}
+	return total
+}
+
+// connectionLost reports whether err means the connection dropped, as
+// opposed to the peer or the user ending the transfer on purpose. Only a
+// lost connection is worth reconnecting for.
+func connectionLost(err error) bool {
+	var remote *RemoteError
+	switch {
+	case err == nil,
+		errors.As(err, &remote),
+		errors.Is(err, ErrCanceled),
+		errors.Is(err, ErrDeclined),
+		errors.Is(err, ErrChecksumMismatch),
+		errors.Is(err, ErrIncompatiblePeer):
+		return false
+	case errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, session.ErrIdleTimeout),
+		errors.Is(err, net.ErrClosed),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.EPIPE):
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// reconnector spends a RetryPolicy's attempts across a whole transfer.
+// Backoff starts over after every successful reconnect.
+type reconnector struct {
+	policy RetryPolicy
+	used   int
+	report *reporter
+}
+
+// left reports how many attempts remain.
+func (r *reconnector) left() int {
+	return r.policy.Attempts - r.used
+}
+
+// dial calls dial until it succeeds or the attempts run out, waiting with
+// backoff before each call. It gives up early once ctx is done.
+func (r *reconnector) dial(ctx context.Context, dial func(context.Context) (*session.SecureSession, error)) (*session.SecureSession, error) {
+	err := errors.New("no reconnect attempts left")
+	for failures := 0; r.left() > 0; failures++ {
+		delay := r.policy.delay(failures)
+		r.used++
+		r.report.printf("Reconnecting in %s (attempt %d of %d)...\n", delay, r.used, r.policy.Attempts)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ErrCanceled
+		}
+
+		var sess *session.SecureSession
+		sess, err = dial(ctx)
+		if err == nil {
+			return sess, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ErrCanceled
+		}
+		r.report.printf("Reconnect failed: %v\n", err)
+	}
+	return nil, fmt.Errorf("reconnect: %w", err)
+}
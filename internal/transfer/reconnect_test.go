@@ -0,0 +1,191 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/JonathanInTheClouds/goxfer/internal/session"
+)
+
+func TestConnectionLost(t *testing.T) {
+	lost := []error{
+		io.EOF,
+		fmt.Errorf("receive chunk: %w", io.ErrUnexpectedEOF),
+		fmt.Errorf("receive chunk: %w", session.ErrIdleTimeout),
+		&net.OpError{Op: "write", Net: "tcp", Err: syscall.EPIPE},
+		syscall.ECONNRESET,
+	}
+	for _, err := range lost {
+		if !connectionLost(err) {
+			t.Errorf("connectionLost(%v) = false, want true", err)
+		}
+	}
+
+	kept := []error{
+		nil,
+		ErrCanceled,
+		fmt.Errorf("%w by user", ErrDeclined),
+		fmt.Errorf("%w: got a, want b", ErrChecksumMismatch),
+		&RemoteError{Code: "io_error", Reason: "disk full"},
+		errors.New("peer fingerprint mismatch"),
+	}
+	for _, err := range kept {
+		if connectionLost(err) {
+			t.Errorf("connectionLost(%v) = true, want false", err)
+		}
+	}
+}
+
+func TestRetryPolicy_Delay(t *testing.T) {
+	p := RetryPolicy{Attempts: 5, Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, w := range want {
+		if got := p.delay(i); got != w {
+			t.Errorf("delay(%d) = %s, want %s", i, got, w)
+		}
+	}
+	if got, want := p.window(2), 3*time.Second+2*reconnectDialSlack; got != want {
+		t.Errorf("window(2) = %s, want %s", got, want)
+	}
+}
+
+// dropProxy forwards connections to target and cuts the first one after
+// limit bytes have gone from target to the client.
+type dropProxy struct {
+	ln     net.Listener
+	target string
+	limit  int64
+
+	mu    sync.Mutex
+	conns int
+	// forwarded counts bytes sent to the client on each connection.
+	forwarded []*atomic.Int64
+}
+
+func newDropProxy(t *testing.T, target string, limit int64) *dropProxy {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	p := &dropProxy{ln: ln, target: target, limit: limit}
+	t.Cleanup(func() { ln.Close() })
+	go p.serve()
+	return p
+}
+
+// connections reports how many connections reached the target.
+func (p *dropProxy) connections() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.conns
+}
+
+func (p *dropProxy) serve() {
+	for {
+		client, err := p.ln.Accept()
+		if err != nil {
+			return
+		}
+		server, err := net.Dial("tcp", p.target)
+		if err != nil {
+			client.Close()
+			continue
+		}
+		p.mu.Lock()
+		first := p.conns == 0
+		p.conns++
+		n := new(atomic.Int64)
+		p.forwarded = append(p.forwarded, n)
+		p.mu.Unlock()
+
+		go func() {
+			io.Copy(server, client)
+			server.Close()
+		}()
+		go func() {
+			var src io.Reader = server
+			if first {
+				src = io.LimitReader(server, p.limit)
+			}
+			c, _ := io.Copy(client, src)
+			n.Add(c)
+			// Cut both ends, as a dropped network path would.
+			client.Close()
+			server.Close()
+		}()
+	}
+}
+
+func TestP2P_ReconnectAfterDrop(t *testing.T) {
+	content := make([]byte, 4<<20)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	srcPath := filepath.Join(t.TempDir(), "payload.bin")
+	if err := os.WriteFile(srcPath, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	destDir := t.TempDir()
+
+	// Reserve a port for the sender's direct listener.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listenAddr := ln.Addr().String()
+	ln.Close()
+
+	retry := RetryPolicy{Attempts: 3, Backoff: 20 * time.Millisecond, MaxBackoff: 100 * time.Millisecond}
+	sendErr := make(chan error, 1)
+	go func() {
+		sendErr <- P2PSend(context.Background(), []string{srcPath}, SendOptions{ListenAddr: listenAddr, Retry: retry})
+	}()
+
+	proxy := newDropProxy(t, listenAddr, 1<<20)
+	var recvErr error
+	for i := 0; i < 50; i++ {
+		// The sender may not be listening yet.
+		time.Sleep(20 * time.Millisecond)
+		recvErr = P2PReceive(context.Background(), proxy.ln.Addr().String(), destDir, ReceiveOptions{Yes: true, Retry: retry})
+		if recvErr == nil || proxy.connections() > 0 {
+			break
+		}
+	}
+	if recvErr != nil {
+		t.Fatalf("receive: %v", recvErr)
+	}
+	if err := <-sendErr; err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(destDir, "payload.bin"))
+	if err != nil {
+		t.Fatalf("read received file: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("content mismatch: got %d bytes, want %d", len(got), len(content))
+	}
+
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	if proxy.conns != 2 {
+		t.Fatalf("proxy saw %d connections, want 2", proxy.conns)
+	}
+	// The second connection resumed rather than sending everything again.
+	if n := proxy.forwarded[1].Load(); n >= int64(len(content)) {
+		t.Fatalf("second connection carried %d bytes, want less than %d", n, len(content))
+	}
+}
@@ -3,16 +3,21 @@ package transfer
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"os/exec"
 	"path/filepath"
 )
 
-// SCPTransfer handles file transfer using the SCP protocol and creates the destination directory if needed
-func SCPTransfer(username, password, host, port, keyPath, srcPath, destDir string, createDestDir, insecure bool) error {
+// SCPTransfer handles file transfer using the SCP protocol and creates the destination directory if needed.
+// Status is printed to out and events passed to events; either may be nil.
+func SCPTransfer(username, password, host, port, keyPath, srcPath, destDir string, createDestDir, insecure bool, out io.Writer, events func(Event)) (err error) {
+	r := newReporter(out, events)
+	defer func() { r.finish(err) }()
+
 	// If createDestDir is true, attempt to create the directory on the remote server
 	if createDestDir {
-		fmt.Printf("Creating remote directory: %s\n", destDir)
-		if err := createRemoteDir(username, host, port, keyPath, destDir, insecure); err != nil {
+		r.printf("Creating remote directory: %s\n", destDir)
+		if err := createRemoteDir(r, username, host, port, keyPath, destDir, insecure); err != nil {
 			return fmt.Errorf("failed to create remote directory: %v", err)
 		}
 	}
@@ -44,16 +49,18 @@ func SCPTransfer(username, password, host, port, keyPath, srcPath, destDir strin
 	cmd := exec.Command("scp", scpCmd...)
 	cmd.Stderr = &stderr
 
+	// scp reports no progress and verifies nothing, so the file only starts.
+	r.emit(Event{Kind: EventFileStarted, Name: srcPath, Size: -1, Path: destDir})
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("error running scp command: %v, details: %s", err, stderr.String())
 	}
 
-	fmt.Printf("Successfully transferred file(s) using SCP from %s to %s@%s:%s\n", srcPath, username, host, destDir)
+	r.printf("Successfully transferred file(s) using SCP from %s to %s@%s:%s\n", srcPath, username, host, destDir)
 	return nil
 }
 
 // createRemoteDir creates the specified directory on the remote server using SSH
-func createRemoteDir(username, host, port, keyPath, destDir string, insecure bool) error {
+func createRemoteDir(r *reporter, username, host, port, keyPath, destDir string, insecure bool) error {
 	sshCmd := []string{
 		"-p", port,
 	}
@@ -78,7 +85,7 @@ func createRemoteDir(username, host, port, keyPath, destDir string, insecure boo
 		return fmt.Errorf("error running ssh command to create directory: %v, details: %s", err, stderr.String())
 	}
 
-	fmt.Printf("Remote directory created: %s\n", destDir)
+	r.printf("Remote directory created: %s\n", destDir)
 	return nil
 }
 
@@ -0,0 +1,155 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/JonathanInTheClouds/goxfer/internal/protocol"
+)
+
+// fileFilter chooses which files of a directory the receiver asks for.
+// Patterns use path.Match syntax and are tried against a file's path within
+// the directory, its base name and each of its parent directories, so
+// "*.csv" matches CSV files at any depth and "reports" a whole subtree.
+type fileFilter struct {
+	include []string // empty includes everything
+	exclude []string
+	pick    bool // ask the user which of the remaining files to receive
+
+	// picked remembers the user's answer so a reconnect does not ask again.
+	picked map[string]bool
+}
+
+// validatePatterns reports the first malformed pattern.
+func validatePatterns(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("bad pattern %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// active reports whether the filter can leave anything out.
+func (f *fileFilter) active() bool {
+	return f != nil && (len(f.include) > 0 || len(f.exclude) > 0 || f.pick)
+}
+
+// matches reports whether the include and exclude patterns keep p.
+func (f *fileFilter) matches(p string) bool {
+	if len(f.include) > 0 && !matchAny(f.include, p) {
+		return false
+	}
+	return !matchAny(f.exclude, p)
+}
+
+// matchAny reports whether any pattern matches p, its base name, or one of
+// its parent directories.
+func matchAny(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.TrimSuffix(pattern, "/")
+		if ok, _ := path.Match(pattern, path.Base(p)); ok {
+			return true
+		}
+		for q := p; q != "." && q != "/"; q = path.Dir(q) {
+			if ok, _ := path.Match(pattern, q); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// choose returns the manifest files the receiver wants, in manifest order.
+// Picking lists the files through r.
+func (f *fileFilter) choose(r *reporter, manifest protocol.Message) ([]protocol.ManifestEntry, error) {
+	var files []protocol.ManifestEntry
+	for _, e := range manifest.Entries {
+		if e.Dir || !f.matches(e.Path) {
+			continue
+		}
+		if f.picked != nil && !f.picked[e.Path] {
+			continue
+		}
+		files = append(files, e)
+	}
+	if !f.pick || f.picked != nil || len(files) == 0 {
+		return files, nil
+	}
+
+	files, err := pickFiles(r, files)
+	if err != nil {
+		return nil, err
+	}
+	f.picked = make(map[string]bool, len(files))
+	for _, e := range files {
+		f.picked[e.Path] = true
+	}
+	return files, nil
+}
+
+// pickFiles lists files and asks the user which to receive.
+func pickFiles(r *reporter, files []protocol.ManifestEntry) ([]protocol.ManifestEntry, error) {
+	r.println()
+	for i, e := range files {
+		r.printf("  %3d  %-50s %10s\n", i+1, e.Path, formatBytes(e.Size))
+	}
+	for {
+		r.printf("Files to receive, e.g. 1-3,7 (Enter for all): ")
+		answer, err := promptInput.ReadString('\n')
+		if err != nil && answer == "" {
+			return nil, fmt.Errorf("read selection: %w", err)
+		}
+		answer = strings.TrimSpace(answer)
+		if answer == "" {
+			return files, nil
+		}
+		indexes, err := parseRanges(answer, len(files))
+		if err != nil {
+			r.printf("%v\n", err)
+			continue
+		}
+		picked := make([]protocol.ManifestEntry, 0, len(indexes))
+		for i, e := range files {
+			if indexes[i+1] {
+				picked = append(picked, e)
+			}
+		}
+		return picked, nil
+	}
+}
+
+// parseRanges parses a list such as "1-3,7" of numbers from 1 to n.
+func parseRanges(s string, n int) (map[int]bool, error) {
+	picked := make(map[int]bool)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		lo, hi, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(strings.TrimSpace(lo))
+		if err != nil {
+			return nil, fmt.Errorf("not a number: %q", lo)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(strings.TrimSpace(hi)); err != nil {
+				return nil, fmt.Errorf("not a number: %q", hi)
+			}
+		}
+		if first < 1 || last > n || first > last {
+			return nil, fmt.Errorf("%q is not within 1-%d", part, n)
+		}
+		for i := first; i <= last; i++ {
+			picked[i] = true
+		}
+	}
+	if len(picked) == 0 {
+		return nil, errors.New("no files selected")
+	}
+	return picked, nil
+}
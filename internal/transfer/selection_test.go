@@ -0,0 +1,176 @@
+package transfer
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/JonathanInTheClouds/goxfer/internal/protocol"
+)
+
+func TestMatchAny(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		path     string
+		want     bool
+	}{
+		{[]string{"*.csv"}, "data.csv", true},
+		{[]string{"*.csv"}, "2024/q1/data.csv", true},
+		{[]string{"*.csv"}, "data.json", false},
+		{[]string{"reports"}, "reports/q1.pdf", true},
+		{[]string{"reports/"}, "reports/deep/q1.pdf", true},
+		{[]string{"reports"}, "old-reports/q1.pdf", false},
+		{[]string{"2024/*.jpg"}, "2024/beach.jpg", true},
+		{[]string{"2024/*.jpg"}, "2023/beach.jpg", false},
+		{[]string{"*.tmp", "*.csv"}, "a/b.csv", true},
+		{nil, "a.csv", false},
+	}
+	for _, tt := range tests {
+		if got := matchAny(tt.patterns, tt.path); got != tt.want {
+			t.Errorf("matchAny(%q, %q) = %v, want %v", tt.patterns, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestParseRanges(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []int
+	}{
+		{"1", []int{1}},
+		{"1-3,5", []int{1, 2, 3, 5}},
+		{" 2 - 3 , 5 ", []int{2, 3, 5}},
+		{"1-3,2-4", []int{1, 2, 3, 4}},
+		{"4,4", []int{4}},
+	}
+	for _, tt := range tests {
+		got, err := parseRanges(tt.in, 5)
+		if err != nil {
+			t.Errorf("parseRanges(%q): %v", tt.in, err)
+			continue
+		}
+		want := make(map[int]bool)
+		for _, i := range tt.want {
+			want[i] = true
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("parseRanges(%q) = %v, want %v", tt.in, got, want)
+		}
+	}
+
+	for _, in := range []string{"0", "6", "1-6", "3-2", "a", "1-b", ",", "-1"} {
+		if got, err := parseRanges(in, 5); err == nil {
+			t.Errorf("parseRanges(%q) = %v, want error", in, got)
+		}
+	}
+}
+
+func TestFileFilterChoose(t *testing.T) {
+	manifest := protocol.Message{Type: protocol.MessageTypeManifest, Name: "data", Entries: []protocol.ManifestEntry{
+		{Path: "raw", Dir: true},
+		{Path: "a.csv", Size: 1},
+		{Path: "raw/b.csv", Size: 2},
+		{Path: "raw/c.json", Size: 3},
+		{Path: "tmp/d.csv", Size: 4},
+	}}
+	paths := func(entries []protocol.ManifestEntry) []string {
+		var out []string
+		for _, e := range entries {
+			out = append(out, e.Path)
+		}
+		return out
+	}
+
+	f := &fileFilter{include: []string{"*.csv"}, exclude: []string{"tmp"}}
+	got, err := f.choose(nil, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a.csv", "raw/b.csv"}; !reflect.DeepEqual(paths(got), want) {
+		t.Fatalf("choose = %q, want %q", paths(got), want)
+	}
+
+	// The picker is asked once; a reconnect reuses the answer.
+	old := promptInput
+	defer func() { promptInput = old }()
+	promptInput = bufio.NewReader(strings.NewReader("2-3\n"))
+	f = &fileFilter{pick: true}
+	got, err = f.choose(nil, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"raw/b.csv", "raw/c.json"}; !reflect.DeepEqual(paths(got), want) {
+		t.Fatalf("picked %q, want %q", paths(got), want)
+	}
+	got, err = f.choose(nil, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"raw/b.csv", "raw/c.json"}; !reflect.DeepEqual(paths(got), want) {
+		t.Fatalf("picked again %q, want %q", paths(got), want)
+	}
+}
+
+func TestP2P_TreeSelection(t *testing.T) {
+	senderSess, receiverSess := makePair(t)
+
+	srcDir := filepath.Join(t.TempDir(), "export")
+	for _, name := range []string{"a.csv", "nested/b.csv", "nested/c.json", "logs/d.csv"} {
+		p := filepath.Join(srcDir, name)
+		os.MkdirAll(filepath.Dir(p), 0o750)
+		if err := os.WriteFile(p, []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	destDir := t.TempDir()
+	counter := &chunkCounter{messageConn: senderSess}
+	sendErr := make(chan error, 1)
+	go func() {
+		err := sendDirectory(counter, srcDir, sendConfig{feat: testFeatures(false)})
+		senderSess.Close()
+		sendErr <- err
+	}()
+	filter := &fileFilter{include: []string{"*.csv"}, exclude: []string{"logs"}}
+	if err := receiveFiles(receiverSess, destDir, receiveConfig{feat: testFeatures(false), filter: filter}); err != nil {
+		t.Fatalf("receive error: %v", err)
+	}
+	if err := <-sendErr; err != nil {
+		t.Fatalf("send error: %v", err)
+	}
+
+	for _, name := range []string{"a.csv", "nested/b.csv"} {
+		got, err := os.ReadFile(filepath.Join(destDir, "export", name))
+		if err != nil || string(got) != name {
+			t.Errorf("%s: got %q, %v", name, got, err)
+		}
+	}
+	for _, name := range []string{"nested/c.json", "logs/d.csv", "logs"} {
+		if _, err := os.Stat(filepath.Join(destDir, "export", name)); err == nil {
+			t.Errorf("%s was received, want it left out", name)
+		}
+	}
+	if want := len("a.csv") + len("nested/b.csv"); counter.bytes != want {
+		t.Fatalf("sent %d bytes of file data, want %d", counter.bytes, want)
+	}
+}
+
+func TestReceiveTree_SelectionNeedsCapableSender(t *testing.T) {
+	senderSess, receiverSess := makePair(t)
+	defer senderSess.Close()
+	go readPeerAbort(senderSess)
+
+	feat := testFeatures(false)
+	feat.selection = false
+	manifest := protocol.Message{Type: protocol.MessageTypeManifest, Name: "data", Entries: []protocol.ManifestEntry{{Path: "a.csv", Size: 1}}}
+	cfg := receiveConfig{feat: feat, filter: &fileFilter{include: []string{"*.csv"}}}
+	err := receiveTree(receiverSess, t.TempDir(), manifest, cfg)
+	receiverSess.Close()
+	if !errors.Is(err, ErrIncompatiblePeer) {
+		t.Fatalf("err = %v, want incompatible peer error", err)
+	}
+}
@@ -13,15 +13,17 @@ import (
 
 	"github.com/JonathanInTheClouds/goxfer/internal/utils"
 	"github.com/pkg/sftp"
-	"github.com/schollz/progressbar/v3"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/knownhosts"
 	"golang.org/x/sync/semaphore"
 	"golang.org/x/term"
 )
 
-// SFTPTransfer handles file or directory transfer logic with parallel support, passphrase-protected keys, and retries for checksum mismatches
-func SFTPTransfer(username, password, host, port, keyPath, srcPath, destDir, knownHostsPath string, maxParallel, maxRetries int, insecure bool) error {
+// SFTPTransfer handles file or directory transfer logic with parallel support, passphrase-protected keys, and retries for checksum mismatches.
+// Status and progress bars are printed to out and events passed to events; either may be nil.
+func SFTPTransfer(username, password, host, port, keyPath, srcPath, destDir, knownHostsPath string, maxParallel, maxRetries int, insecure bool, out io.Writer, events func(Event)) (err error) {
+	r := newReporter(out, events)
+	defer func() { r.finish(err) }()
 
 	var authMethod ssh.AuthMethod
 
@@ -33,12 +35,12 @@ func SFTPTransfer(username, password, host, port, keyPath, srcPath, destDir, kno
 		}
 
 		// If the private key is passphrase protected, prompt for passphrase
-		fmt.Print("Enter passphrase for SSH key: ")
+		fmt.Fprint(os.Stderr, "Enter passphrase for SSH key: ")
 		bytePassphrase, err := term.ReadPassword(int(syscall.Stdin))
 		if err != nil {
 			return fmt.Errorf("failed to read passphrase: %v", err)
 		}
-		fmt.Println()
+		fmt.Fprintln(os.Stderr)
 
 		// Parse the private key using the passphrase
 		signer, err := ssh.ParsePrivateKeyWithPassphrase(key, bytePassphrase)
@@ -122,7 +124,7 @@ func SFTPTransfer(username, password, host, port, keyPath, srcPath, destDir, kno
 
 		if info.IsDir() {
 			dirPath := filepath.Dir(remotePath) // Only create directories
-			fmt.Printf("Creating directory: %s\n", dirPath)
+			r.printf("Creating directory: %s\n", dirPath)
 			if err := client.MkdirAll(dirPath); err != nil {
 				return fmt.Errorf("failed to create remote directory: %v", err)
 			}
@@ -134,75 +136,78 @@ func SFTPTransfer(username, password, host, port, keyPath, srcPath, destDir, kno
 				// Retry loop for checksum mismatches
 				for attempt := 1; attempt <= maxRetries+1; attempt++ {
 					if attempt > 1 {
-						fmt.Printf("Retrying transfer of %s (Attempt %d of %d)...\n", path, attempt, maxRetries)
+						r.printf("Retrying transfer of %s (Attempt %d of %d)...\n", path, attempt, maxRetries)
 					}
 
 					// Use context.Background() instead of nil
 					if err := sem.Acquire(context.Background(), 1); err != nil {
-						fmt.Printf("Failed to acquire semaphore for file %s: %v\n", path, err)
+						r.fileFailed(path, "Failed to acquire semaphore for file %s: %v", path, err)
 						return
 					}
 					defer sem.Release(1)
 
-					fmt.Printf("Transferring file: %s to %s\n", path, remotePath)
+					r.printf("Transferring file: %s to %s\n", path, remotePath)
+					r.emit(Event{Kind: EventFileStarted, Name: path, Size: info.Size(), Path: remotePath})
 
 					// Calculate the checksum of the local file before transfer
 					localChecksum, err := utils.CalculateLocalFileChecksum(path)
 					if err != nil {
-						fmt.Printf("Failed to calculate checksum for local file %s: %v\n", path, err)
+						r.fileFailed(path, "Failed to calculate checksum for local file %s: %v", path, err)
 						return
 					}
 
 					// Open the local file for reading
 					srcFile, err := os.Open(path)
 					if err != nil {
-						fmt.Printf("Failed to open local source file %s: %v\n", path, err)
+						r.fileFailed(path, "Failed to open local source file %s: %v", path, err)
 						return
 					}
 					defer srcFile.Close()
 
-					bar := progressbar.DefaultBytes(info.Size(), "Transferring")
+					bar := r.newProgress(path, info.Size())
 
 					// Ensure the parent directory exists
 					parentDir := filepath.Dir(remotePath)
 					if err := client.MkdirAll(parentDir); err != nil {
-						fmt.Printf("Failed to create remote directory %s: %v\n", parentDir, err)
+						r.fileFailed(path, "Failed to create remote directory %s: %v", parentDir, err)
 						return
 					}
 
 					// Create the destination file on the remote server
 					dstFile, err := client.Create(remotePath)
 					if err != nil {
-						fmt.Printf("Failed to create destination file on remote server %s: %v\n", remotePath, err)
+						r.fileFailed(path, "Failed to create destination file on remote server %s: %v", remotePath, err)
 						return
 					}
 					defer dstFile.Close()
 
 					// Copy the file to the remote server with progress tracking
 					_, err = io.Copy(io.MultiWriter(dstFile, bar), srcFile)
+					bar.finish()
 					if err != nil {
-						fmt.Printf("Failed to copy file to remote server %s: %v\n", remotePath, err)
+						r.fileFailed(path, "Failed to copy file to remote server %s: %v", remotePath, err)
 						return
 					}
 
 					// Calculate the checksum of the remote file after the transfer
 					remoteChecksum, err := utils.CalculateRemoteFileChecksum(client, remotePath)
 					if err != nil {
-						fmt.Printf("Failed to calculate checksum for remote file %s: %v\n", remotePath, err)
+						r.fileFailed(path, "Failed to calculate checksum for remote file %s: %v", remotePath, err)
 						return
 					}
 
 					// Compare the checksums
 					if localChecksum == remoteChecksum {
-						fmt.Printf("Successfully transferred: %s (checksum verified)\n", path)
+						r.printf("Successfully transferred: %s (checksum verified)\n", path)
+						r.emit(Event{Kind: EventFileVerified, Name: path, Size: info.Size(), Checksum: localChecksum, Path: remotePath})
 						return
 					} else {
-						fmt.Printf("Checksum mismatch for file %s. Local: %s, Remote: %s\n", path, localChecksum, remoteChecksum)
+						r.fileFailed(path, "Checksum mismatch for file %s. Local: %s, Remote: %s", path, localChecksum, remoteChecksum)
 					}
 
 					// If this was the last attempt, log failure
 					if attempt == maxRetries+1 {
-						fmt.Printf("Failed to transfer %s after %d attempts\n", path, maxRetries)
+						r.fileFailed(path, "Failed to transfer %s after %d attempts", path, maxRetries)
 					}
 				}
 			}(path, remotePath, info)
@@ -216,6 +221,6 @@ func SFTPTransfer(username, password, host, port, keyPath, srcPath, destDir, kno
 	}
 
 	wg.Wait() // Wait for all transfers to complete
-	fmt.Printf("All transfers completed.\n")
+	r.printf("All transfers completed.\n")
 	return nil
 }
@@ -0,0 +1,609 @@
+package transfer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JonathanInTheClouds/goxfer/internal/protocol"
+	"github.com/JonathanInTheClouds/goxfer/internal/utils"
+)
+
+// buildManifest walks srcPath and lists its directories and regular files.
+// Directories come first so the receiver can create the whole layout
+// before any file arrives. Anything else, such as a symlink, is left out.
+func buildManifest(srcPath string) (protocol.Message, error) {
+	manifest := protocol.Message{
+		Type: protocol.MessageTypeManifest,
+		Name: filepath.Base(srcPath),
+	}
+	var files []protocol.ManifestEntry
+	err := filepath.WalkDir(srcPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == srcPath {
+			return nil
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcPath, p)
+		if err != nil {
+			return err
+		}
+		entry := protocol.ManifestEntry{
+			Path:  filepath.ToSlash(rel),
+			Dir:   d.IsDir(),
+			Mode:  uint32(info.Mode().Perm()),
+			MTime: info.ModTime().UnixNano(),
+		}
+		if entry.Dir {
+			manifest.Entries = append(manifest.Entries, entry)
+		} else {
+			entry.Size = info.Size()
+			files = append(files, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return protocol.Message{}, fmt.Errorf("scan directory: %w", err)
+	}
+	manifest.Entries = append(manifest.Entries, files...)
+	return manifest, nil
+}
+
+// sendTree sends srcPath as a manifest followed by each regular file, so
+// every file has its own checksum and metadata. When the peer can take
+// them, the files go over several lanes at once; otherwise one by one.
+func sendTree(sess messageConn, srcPath string, cfg sendConfig) error {
+	manifest, err := buildManifest(srcPath)
+	if err != nil {
+		return abortTransfer(sess, err)
+	}
+	lanes, _ := sess.(laneConn)
+	if cfg.feat.parallel && lanes != nil {
+		manifest.Lanes = min(protocol.MaxLanes, countFiles(manifest))
+	}
+	if cfg.feat.resume {
+		// A stable ID lets the receiver find what it already has of this
+		// tree after an interruption.
+		manifest.FileID = deterministicFileID(srcPath, manifestSize(manifest))
+	}
+	if err := sess.SendMessage(manifest); err != nil {
+		return fmt.Errorf("send manifest: %w", err)
+	}
+
+	wanted, err := awaitSelection(sess, manifest, cfg)
+	if err != nil {
+		return err
+	}
+
+	if manifest.Lanes > 0 {
+		err = sendLanes(lanes, srcPath, manifest, wanted, cfg)
+	} else {
+		for _, e := range manifest.Entries {
+			if e.Dir || !wanted[e.Path] {
+				continue
+			}
+			if err = sendTreeFile(sess, srcPath, e, cfg, nil); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	cfg.report.printf("✓  Sent %s/ — %s\n", manifest.Name, treeSummary(manifest, wanted))
+	return nil
+}
+
+// sendLanes opens the lanes the manifest announced and sends the wanted
+// files over them, each lane taking the next file as it finishes one. The
+// first failure resets the other lanes.
+func sendLanes(conn laneConn, srcPath string, manifest protocol.Message, wanted map[string]bool, cfg sendConfig) error {
+	streams := make([]lane, manifest.Lanes)
+	for i := range streams {
+		st, err := conn.openLane()
+		if err != nil {
+			return fmt.Errorf("open lane: %w", err)
+		}
+		streams[i] = st
+	}
+
+	work := make(chan protocol.ManifestEntry, len(wanted))
+	var size int64
+	for _, e := range manifest.Entries {
+		if !e.Dir && wanted[e.Path] {
+			work <- e
+			size += e.Size
+		}
+	}
+	close(work)
+
+	cfg.report.printf("Sending  %s/  (%s over %d streams)\n", manifest.Name, treeSummary(manifest, wanted), len(streams))
+	bar := cfg.report.newProgress(manifest.Name+"/", size)
+	err := runLanes(streams, func(st lane) error {
+		for e := range work {
+			if err := sendTreeFile(st, srcPath, e, cfg, bar); err != nil {
+				return err
+			}
+		}
+		return st.Close()
+	})
+	if err != nil {
+		return err
+	}
+	bar.finish()
+	cfg.report.println()
+	return nil
+}
+
+// runLanes runs fn on every lane at once and returns the first error. A
+// failing lane has already told the peer why; the others are reset so the
+// peer stops waiting on them.
+func runLanes(streams []lane, fn func(lane) error) error {
+	type result struct {
+		i   int
+		err error
+	}
+	results := make(chan result, len(streams))
+	for i, st := range streams {
+		go func() { results <- result{i, fn(st)} }()
+	}
+
+	var first error
+	for range streams {
+		r := <-results
+		if r.err == nil || first != nil {
+			continue
+		}
+		first = r.err
+		for i, st := range streams {
+			if i != r.i {
+				st.Reset("transfer failed")
+			}
+		}
+	}
+	return first
+}
+
+// sendTreeFile sends the manifest entry e of the directory at srcPath.
+func sendTreeFile(sess messageConn, srcPath string, e protocol.ManifestEntry, cfg sendConfig, bar *progress) error {
+	p := filepath.Join(srcPath, filepath.FromSlash(e.Path))
+	info, err := os.Stat(p)
+	if err != nil {
+		return abortTransfer(sess, fmt.Errorf("stat %s: %w", e.Path, err))
+	}
+	if info.Size() != e.Size {
+		return abortTransfer(sess, fmt.Errorf("%s changed size while sending", e.Path))
+	}
+	start := protocol.Message{
+		Name:  path.Base(e.Path),
+		Path:  e.Path,
+		Mode:  e.Mode,
+		MTime: e.MTime,
+	}
+	return sendFile(sess, p, info, start, cfg, bar)
+}
+
+// awaitSelection returns the manifest paths the receiver asked for. Without
+// the select feature the receiver gets every file.
+func awaitSelection(sess messageConn, manifest protocol.Message, cfg sendConfig) (map[string]bool, error) {
+	files := make(map[string]bool)
+	for _, e := range manifest.Entries {
+		if !e.Dir {
+			files[e.Path] = true
+		}
+	}
+	if !cfg.feat.selection {
+		return files, nil
+	}
+
+	reply, err := receiveMessage(sess)
+	if err != nil {
+		return nil, fmt.Errorf("receive file selection: %w", err)
+	}
+	if reply.Type != protocol.MessageTypeSelect {
+		return nil, abortTransfer(sess, fmt.Errorf("expected manifest_select, got %q", reply.Type))
+	}
+	wanted := make(map[string]bool, len(reply.Entries))
+	for _, e := range reply.Entries {
+		if !files[e.Path] {
+			return nil, abortTransfer(sess, fmt.Errorf("receiver asked for %q, which is not in the manifest", e.Path))
+		}
+		wanted[e.Path] = true
+	}
+	if len(wanted) < len(files) {
+		cfg.report.printf("Receiver selected %d of %d files\n", len(wanted), len(files))
+	}
+	return wanted, nil
+}
+
+// receiveTree recreates the directory described by manifest under destDir,
+// then receives its files. Only files listed in the manifest are accepted,
+// and every path must stay inside the new directory.
+func receiveTree(sess messageConn, destDir string, manifest protocol.Message, cfg receiveConfig) error {
+	if strings.Contains(manifest.Name, "/") {
+		return abortTransfer(sess, fmt.Errorf("rejected unsafe directory name %q", manifest.Name))
+	}
+	root, err := safeJoin(destDir, manifest.Name)
+	if err != nil {
+		return abortTransfer(sess, err)
+	}
+	if err := os.MkdirAll(root, 0o750); err != nil {
+		return abortTransfer(sess, fmt.Errorf("create directory: %w", err))
+	}
+
+	for _, e := range manifest.Entries {
+		if _, err := safeJoin(root, e.Path); err != nil {
+			return abortTransfer(sess, err)
+		}
+	}
+	wanted, err := selectFiles(sess, manifest, cfg)
+	if err != nil {
+		return err
+	}
+
+	// Create the directories up front. With a selection, only those
+	// leading to a wanted file are created.
+	var dirs []protocol.ManifestEntry
+	files := make(map[string]protocol.ManifestEntry)
+	for _, e := range manifest.Entries {
+		if !e.Dir {
+			if wanted[e.Path] {
+				files[e.Path] = e
+			}
+			continue
+		}
+		if cfg.filter.active() && !containsWanted(e.Path, wanted) {
+			continue
+		}
+		target, _ := safeJoin(root, e.Path)
+		if err := os.MkdirAll(target, 0o750); err != nil {
+			return abortTransfer(sess, fmt.Errorf("create directory: %w", err))
+		}
+		dirs = append(dirs, e)
+	}
+
+	// With resume, completed files are recorded as they are verified so a
+	// retry can skip them; a partial file resumes through its own state.
+	r := &treeReceiver{destDir: destDir, root: root, cfg: cfg, files: files}
+	if cfg.feat.resume && validFileID(manifest.FileID) {
+		r.state = loadTreeState(destDir, manifest.FileID)
+		if r.state == nil {
+			r.state = &treeState{FileID: manifest.FileID, Name: manifest.Name, Done: make(map[string]string)}
+		}
+	}
+
+	if manifest.Lanes > 0 {
+		err = r.receiveLanes(sess, manifest, wanted)
+	} else {
+		cfg.report.printf("Receiving  %s/  (%s)\n", manifest.Name, treeSummary(manifest, wanted))
+		for remaining := len(files); remaining > 0 && err == nil; remaining-- {
+			if err = r.receiveNext(sess); err == io.EOF {
+				err = fmt.Errorf("receive file_start: %w", err)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// Directory metadata goes last, deepest first, since writing files
+	// into a directory updates its modification time.
+	slices.Reverse(dirs)
+	for _, e := range dirs {
+		target, _ := safeJoin(root, e.Path)
+		if err := setMetadata(target, e.Mode, e.MTime); err != nil {
+			return abortTransfer(sess, fmt.Errorf("set directory metadata: %w", err))
+		}
+	}
+	if r.state != nil {
+		deleteResumeState(destDir, r.state.FileID)
+	}
+	cfg.report.printf("✓  Saved %s — every file checksum verified\n", root)
+	return nil
+}
+
+// treeReceiver receives the files of one manifest, from one stream or from
+// several lanes at once.
+type treeReceiver struct {
+	destDir string
+	root    string
+	cfg     receiveConfig
+	state   *treeState // nil without resume
+
+	mu    sync.Mutex
+	files map[string]protocol.ManifestEntry // wanted files not yet started
+}
+
+// receiveLanes accepts the lanes the manifest announced and receives files
+// on each until the sender closes it. Every wanted file must have arrived
+// by then.
+func (r *treeReceiver) receiveLanes(sess messageConn, manifest protocol.Message, wanted map[string]bool) error {
+	conn, ok := sess.(laneConn)
+	if !ok || !r.cfg.feat.parallel {
+		return abortTransfer(sess, fmt.Errorf("manifest announced %d lanes, which were not negotiated", manifest.Lanes))
+	}
+	streams := make([]lane, manifest.Lanes)
+	for i := range streams {
+		st, err := conn.acceptLane()
+		if err != nil {
+			return fmt.Errorf("accept lane: %w", err)
+		}
+		streams[i] = st
+	}
+
+	r.cfg.report.printf("Receiving  %s/  (%s over %d streams)\n", manifest.Name, treeSummary(manifest, wanted), len(streams))
+	var size int64
+	for _, e := range r.files {
+		size += e.Size
+	}
+	r.cfg.bar = r.cfg.report.newProgress(manifest.Name+"/", size)
+	err := runLanes(streams, func(st lane) error {
+		for {
+			if err := r.receiveNext(st); err == io.EOF {
+				return st.Close()
+			} else if err != nil {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	r.cfg.bar.finish()
+	r.cfg.report.println()
+	if len(r.files) > 0 {
+		return abortTransfer(sess, fmt.Errorf("sender left out %d of the selected files", len(r.files)))
+	}
+	return nil
+}
+
+// receiveNext receives the next file of the manifest on sess. It returns
+// io.EOF itself, unwrapped, only if the sender closed sess instead of
+// starting another file.
+func (r *treeReceiver) receiveNext(sess messageConn) error {
+	start, err := receiveMessage(sess)
+	if err == io.EOF {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("receive file_start: %w", err)
+	}
+	if start.Type != protocol.MessageTypeFileStart {
+		return abortTransfer(sess, fmt.Errorf("expected file_start, got %q", start.Type))
+	}
+	r.mu.Lock()
+	e, ok := r.files[start.Path]
+	delete(r.files, start.Path)
+	r.mu.Unlock()
+	if !ok {
+		return abortTransfer(sess, fmt.Errorf("file %q is not in the manifest or was already sent", start.Path))
+	}
+	if start.Size != e.Size {
+		return abortTransfer(sess, fmt.Errorf("%s: size %d does not match the manifest", start.Path, start.Size))
+	}
+	if err := r.cfg.limit.countFile(); err != nil {
+		return abortTransfer(sess, err)
+	}
+
+	target, _ := safeJoin(r.root, start.Path)
+	if r.state != nil && start.Resume && r.state.complete(start.Path, target, start.Size, start.Checksum) {
+		if err := sess.SendMessage(protocol.Message{Type: protocol.MessageTypeFileSkip, FileID: start.FileID}); err != nil {
+			return fmt.Errorf("send file_skip: %w", err)
+		}
+		if r.cfg.bar != nil {
+			r.cfg.bar.add(start.Size)
+		}
+		r.cfg.report.printf("Skipping %s — already received\n", start.Path)
+		r.cfg.report.emit(Event{Kind: EventFileSkipped, Name: start.Path, Size: start.Size})
+		return nil
+	}
+	if err := receiveOneFile(sess, r.destDir, target, start, r.cfg, false); err != nil {
+		return err
+	}
+	if r.state != nil && start.Checksum != "" {
+		r.state.markDone(r.destDir, start.Path, start.Checksum)
+	}
+	return nil
+}
+
+// selectFiles decides which of the manifest's files to receive and, when
+// the sender waits for it, tells the sender.
+func selectFiles(sess messageConn, manifest protocol.Message, cfg receiveConfig) (map[string]bool, error) {
+	if cfg.filter.active() && !cfg.feat.selection {
+		return nil, abortTransfer(sess, fmt.Errorf("%w: sender can only send the whole directory; upgrade goxfer on the sending side or drop the file selection", ErrIncompatiblePeer))
+	}
+
+	var files []protocol.ManifestEntry
+	if cfg.filter.active() {
+		var err error
+		if files, err = cfg.filter.choose(cfg.report, manifest); err != nil {
+			return nil, abortTransfer(sess, err)
+		}
+	} else {
+		for _, e := range manifest.Entries {
+			if !e.Dir {
+				files = append(files, e)
+			}
+		}
+	}
+
+	wanted := make(map[string]bool, len(files))
+	reply := protocol.Message{Type: protocol.MessageTypeSelect}
+	for _, e := range files {
+		wanted[e.Path] = true
+		reply.Entries = append(reply.Entries, protocol.ManifestEntry{Path: e.Path})
+	}
+	if cfg.feat.selection {
+		if err := sess.SendMessage(reply); err != nil {
+			return nil, fmt.Errorf("send file selection: %w", err)
+		}
+	}
+	return wanted, nil
+}
+
+// containsWanted reports whether directory dir holds any wanted file.
+func containsWanted(dir string, wanted map[string]bool) bool {
+	for p := range wanted {
+		if strings.HasPrefix(p, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// treeState is persisted in destDir while a directory is being received,
+// recording the SHA-256 of every file already saved and verified.
+type treeState struct {
+	FileID string            `json:"file_id"`
+	Name   string            `json:"name"`
+	Done   map[string]string `json:"done"` // manifest path -> hex SHA-256
+
+	mu sync.Mutex // files finish on several lanes at once
+}
+
+// complete reports whether the file at rel was already received with the
+// given checksum and is still intact at target.
+func (s *treeState) complete(rel, target string, size int64, checksum string) bool {
+	s.mu.Lock()
+	done := s.Done[rel]
+	s.mu.Unlock()
+	if checksum == "" || done != checksum {
+		return false
+	}
+	info, err := os.Stat(target)
+	if err != nil || !info.Mode().IsRegular() || info.Size() != size {
+		return false
+	}
+	sum, err := utils.CalculateLocalFileChecksum(target)
+	return err == nil && sum == checksum
+}
+
+func loadTreeState(destDir, fileID string) *treeState {
+	data, err := os.ReadFile(resumeStatePath(destDir, fileID))
+	if err != nil {
+		return nil
+	}
+	var state treeState
+	if err := json.Unmarshal(data, &state); err != nil || state.Done == nil {
+		return nil
+	}
+	return &state
+}
+
+// markDone records rel as received with checksum and saves the state.
+func (s *treeState) markDone(destDir, rel, checksum string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Done[rel] = checksum
+	saveTreeState(destDir, s)
+}
+
+func saveTreeState(destDir string, state *treeState) {
+	data, _ := json.Marshal(state)
+	os.WriteFile(resumeStatePath(destDir, state.FileID), data, 0o600)
+}
+
+// safeJoin resolves the slash-separated relative path rel under root,
+// rejecting anything that would land outside it or take a reserved name.
+func safeJoin(root, rel string) (string, error) {
+	if rel == "" || strings.Contains(rel, "\\") || path.IsAbs(rel) || filepath.IsAbs(rel) {
+		return "", fmt.Errorf("rejected unsafe path %q", rel)
+	}
+	clean := path.Clean(rel)
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("rejected unsafe path %q", rel)
+	}
+	if slices.ContainsFunc(strings.Split(clean, "/"), reservedName) {
+		return "", fmt.Errorf("rejected reserved path %q", rel)
+	}
+
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	target := filepath.Join(absRoot, filepath.FromSlash(clean))
+	if !strings.HasPrefix(target, absRoot+string(filepath.Separator)) {
+		return "", fmt.Errorf("rejected path escaping destination: %q", rel)
+	}
+	return target, nil
+}
+
+// setMetadata applies the permission bits and modification time a sender
+// reported; zero values are left alone.
+func setMetadata(p string, mode uint32, mtime int64) error {
+	if mode != 0 {
+		if err := os.Chmod(p, fs.FileMode(mode)&fs.ModePerm); err != nil {
+			return err
+		}
+	}
+	if mtime != 0 {
+		t := time.Unix(0, mtime)
+		if err := os.Chtimes(p, t, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countFiles is the number of regular files in a manifest.
+func countFiles(manifest protocol.Message) int {
+	var count int
+	for _, e := range manifest.Entries {
+		if !e.Dir {
+			count++
+		}
+	}
+	return count
+}
+
+// manifestSize is the total size of a manifest's files.
+func manifestSize(manifest protocol.Message) int64 {
+	var size int64
+	for _, e := range manifest.Entries {
+		size += e.Size
+	}
+	return size
+}
+
+// treeSummary describes the wanted files of a manifest, e.g. "3 files,
+// 1.2 MiB".
+func treeSummary(manifest protocol.Message, wanted map[string]bool) string {
+	var count int
+	var size int64
+	for _, e := range manifest.Entries {
+		if !e.Dir && wanted[e.Path] {
+			count++
+			size += e.Size
+		}
+	}
+	files := "1 file"
+	if count != 1 {
+		files = fmt.Sprintf("%d files", count)
+	}
+	return fmt.Sprintf("%s, %s", files, formatBytes(size))
+}
+
+// fileLabel is how a file is named in progress output: its path within a
+// directory being sent, or just its name.
+func fileLabel(start protocol.Message) string {
+	if start.Path != "" {
+		return start.Path
+	}
+	return start.Name
+}
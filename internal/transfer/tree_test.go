@@ -0,0 +1,338 @@
+package transfer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JonathanInTheClouds/goxfer/internal/protocol"
+)
+
+func TestSafeJoin(t *testing.T) {
+	root := t.TempDir()
+	for _, rel := range []string{"a.txt", "sub/deep/b.txt", "./c.txt", "sub/../d.txt"} {
+		got, err := safeJoin(root, rel)
+		if err != nil {
+			t.Errorf("safeJoin(%q): %v", rel, err)
+			continue
+		}
+		if !strings.HasPrefix(got, root+string(filepath.Separator)) {
+			t.Errorf("safeJoin(%q) = %q, outside %q", rel, got, root)
+		}
+	}
+
+	for _, rel := range []string{"", ".", "..", "../evil.txt", "sub/../../evil.txt", "/etc/passwd", `..\evil.txt`, ".goxfer-partial/x", "sub/.goxfer-0123456789abcdef01234567.state"} {
+		if got, err := safeJoin(root, rel); err == nil {
+			t.Errorf("safeJoin(%q) = %q, want error", rel, got)
+		}
+	}
+}
+
+func TestP2P_TreeKeepsLayoutAndMetadata(t *testing.T) {
+	senderSess, receiverSess := makePair(t)
+
+	srcDir := filepath.Join(t.TempDir(), "project")
+	mtime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	files := map[string]os.FileMode{
+		"run.sh":         0o755,
+		"docs/notes.txt": 0o640,
+	}
+	for name, mode := range files {
+		p := filepath.Join(srcDir, name)
+		os.MkdirAll(filepath.Dir(p), 0o750)
+		if err := os.WriteFile(p, []byte(name), mode); err != nil {
+			t.Fatal(err)
+		}
+		os.Chmod(p, mode)
+		os.Chtimes(p, mtime, mtime)
+	}
+	os.MkdirAll(filepath.Join(srcDir, "empty"), 0o750)
+
+	destDir := t.TempDir()
+	sendErr := make(chan error, 1)
+	go func() {
+		err := sendDirectory(senderSess, srcDir, sendConfig{feat: testFeatures(false)})
+		senderSess.Close()
+		sendErr <- err
+	}()
+	if err := receiveFiles(receiverSess, destDir, receiveConfig{feat: testFeatures(false)}); err != nil {
+		t.Fatalf("receive error: %v", err)
+	}
+	if err := <-sendErr; err != nil {
+		t.Fatalf("send error: %v", err)
+	}
+
+	for name, mode := range files {
+		p := filepath.Join(destDir, "project", name)
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatalf("stat %s: %v", name, err)
+		}
+		if info.Mode().Perm() != mode {
+			t.Errorf("%s: mode %v, want %v", name, info.Mode().Perm(), mode)
+		}
+		if !info.ModTime().Equal(mtime) {
+			t.Errorf("%s: mtime %v, want %v", name, info.ModTime(), mtime)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(destDir, "project", "empty")); err != nil || !info.IsDir() {
+		t.Errorf("empty directory not recreated: %v", err)
+	}
+}
+
+func TestP2P_DirectoryArchiveFallback(t *testing.T) {
+	senderSess, receiverSess := makePair(t)
+
+	srcDir := filepath.Join(t.TempDir(), "old")
+	os.MkdirAll(filepath.Join(srcDir, "sub"), 0o750)
+	os.WriteFile(filepath.Join(srcDir, "sub", "a.txt"), []byte("from an older peer"), 0o644)
+
+	// A peer without the tree capability still gets a tar.gz.
+	feat := testFeatures(false)
+	feat.tree = false
+
+	destDir := t.TempDir()
+	sendErr := make(chan error, 1)
+	go func() {
+		err := sendDirectory(senderSess, srcDir, sendConfig{feat: feat})
+		senderSess.Close()
+		sendErr <- err
+	}()
+	if err := receiveFiles(receiverSess, destDir, receiveConfig{feat: testFeatures(false)}); err != nil {
+		t.Fatalf("receive error: %v", err)
+	}
+	if err := <-sendErr; err != nil {
+		t.Fatalf("send error: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(destDir, "old", "sub", "a.txt"))
+	if err != nil || string(got) != "from an older peer" {
+		t.Fatalf("read extracted file = %q, %v", got, err)
+	}
+}
+
+func TestP2P_TreeKeepsArchivesAsFiles(t *testing.T) {
+	senderSess, receiverSess := makePair(t)
+
+	// A tar.gz inside a directory is just a file: it must not be unpacked,
+	// least of all into the top of the destination.
+	srcDir := filepath.Join(t.TempDir(), "release")
+	os.MkdirAll(filepath.Join(srcDir, "dist"), 0o750)
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	tw.WriteHeader(&tar.Header{Name: "planted.txt", Typeflag: tar.TypeReg, Size: 16, Mode: 0o644})
+	tw.Write([]byte("outside the tree"))
+	tw.Close()
+	gw.Close()
+	archive := buf.Bytes()
+	os.WriteFile(filepath.Join(srcDir, "dist", "app.tar.gz"), archive, 0o644)
+
+	destDir := t.TempDir()
+	sendErr := make(chan error, 1)
+	go func() {
+		err := sendDirectory(senderSess, srcDir, sendConfig{feat: testFeatures(false)})
+		senderSess.Close()
+		sendErr <- err
+	}()
+	if err := receiveFiles(receiverSess, destDir, receiveConfig{feat: testFeatures(false)}); err != nil {
+		t.Fatalf("receive error: %v", err)
+	}
+	if err := <-sendErr; err != nil {
+		t.Fatalf("send error: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(destDir, "release", "dist", "app.tar.gz"))
+	if err != nil || !bytes.Equal(got, archive) {
+		t.Fatalf("app.tar.gz not saved as is: %d bytes, %v", len(got), err)
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "planted.txt")); err == nil {
+		t.Fatal("archive was extracted into the destination")
+	}
+}
+
+func TestReceiveTree_RejectsUnsafeManifest(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest protocol.Message
+	}{
+		{"dotdot root", protocol.Message{Type: protocol.MessageTypeManifest, Name: ".."}},
+		{"nested root", protocol.Message{Type: protocol.MessageTypeManifest, Name: "a/../../evil"}},
+		{"dotdot entry", protocol.Message{Type: protocol.MessageTypeManifest, Name: "ok", Entries: []protocol.ManifestEntry{
+			{Path: "../evil.txt", Size: 5},
+		}}},
+		{"absolute entry", protocol.Message{Type: protocol.MessageTypeManifest, Name: "ok", Entries: []protocol.ManifestEntry{
+			{Path: "/etc", Dir: true},
+		}}},
+		{"reserved root", protocol.Message{Type: protocol.MessageTypeManifest, Name: ".goxfer-0123456789abcdef01234567.state"}},
+		{"reserved entry", protocol.Message{Type: protocol.MessageTypeManifest, Name: "ok", Entries: []protocol.ManifestEntry{
+			{Path: "sub/.goxfer-0123456789abcdef01234567.state", Size: 5},
+		}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			senderSess, receiverSess := makePair(t)
+			defer senderSess.Close()
+			go readPeerAbort(senderSess)
+
+			destDir := t.TempDir()
+			if err := receiveTree(receiverSess, destDir, tt.manifest, receiveConfig{feat: testFeatures(false)}); err == nil {
+				t.Fatal("expected error, got nil")
+			}
+			receiverSess.Close()
+			if _, err := os.Stat(filepath.Join(filepath.Dir(destDir), "evil.txt")); err == nil {
+				t.Fatal("file written outside the destination")
+			}
+		})
+	}
+}
+
+// chunkCounter counts the file data sent through a messageConn.
+type chunkCounter struct {
+	messageConn
+	bytes int
+}
+
+func (c *chunkCounter) SendMessage(msg protocol.Message) error {
+	if msg.Type == protocol.MessageTypeFileChunk {
+		c.bytes += len(msg.Chunk)
+	}
+	return c.messageConn.SendMessage(msg)
+}
+
+func TestP2P_TreeResume(t *testing.T) {
+	srcDir := filepath.Join(t.TempDir(), "dataset")
+	os.MkdirAll(srcDir, 0o750)
+	done := []byte("already received")
+	stale := []byte("changed since the last attempt")
+	big := make([]byte, 3*protocol.FileChunkSize+100)
+	for i := range big {
+		big[i] = byte(i % 251)
+	}
+	os.WriteFile(filepath.Join(srcDir, "done.txt"), done, 0o644)
+	os.WriteFile(filepath.Join(srcDir, "stale.txt"), stale, 0o644)
+	os.WriteFile(filepath.Join(srcDir, "big.bin"), big, 0o644)
+
+	// Simulate an interrupted attempt: done.txt was saved and verified,
+	// stale.txt was saved but has since changed, and big.bin is one chunk in.
+	destDir := t.TempDir()
+	os.MkdirAll(filepath.Join(destDir, "dataset"), 0o750)
+	os.WriteFile(filepath.Join(destDir, "dataset", "done.txt"), done, 0o644)
+	os.WriteFile(filepath.Join(destDir, "dataset", "stale.txt"), []byte("old"), 0o644)
+	sum := func(b []byte) string {
+		h := sha256.Sum256(b)
+		return hex.EncodeToString(h[:])
+	}
+	manifest, err := buildManifest(srcDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saveTreeState(destDir, &treeState{
+		FileID: deterministicFileID(srcDir, manifestSize(manifest)),
+		Name:   "dataset",
+		Done:   map[string]string{"done.txt": sum(done), "stale.txt": sum([]byte("old"))},
+	})
+	bigPath := filepath.Join(srcDir, "big.bin")
+	bigID := deterministicFileID(bigPath, int64(len(big)))
+	partial, err := createPartial(destDir, bigID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	partial.Write(big[:protocol.FileChunkSize])
+	partial.Close()
+	saveResumeState(destDir, &resumeState{
+		FileID:    bigID,
+		Name:      "big.bin",
+		Size:      int64(len(big)),
+		NextIndex: 1,
+		Offset:    protocol.FileChunkSize,
+	})
+
+	senderSess, receiverSess := makePair(t)
+	counter := &chunkCounter{messageConn: senderSess}
+	sendErr := make(chan error, 1)
+	go func() {
+		err := sendDirectory(counter, srcDir, sendConfig{feat: testFeatures(true)})
+		senderSess.Close()
+		sendErr <- err
+	}()
+	if err := receiveFiles(receiverSess, destDir, receiveConfig{feat: testFeatures(true)}); err != nil {
+		t.Fatalf("receive error: %v", err)
+	}
+	if err := <-sendErr; err != nil {
+		t.Fatalf("send error: %v", err)
+	}
+
+	for name, want := range map[string][]byte{"done.txt": done, "stale.txt": stale, "big.bin": big} {
+		got, err := os.ReadFile(filepath.Join(destDir, "dataset", name))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("%s: got %d bytes, %v", name, len(got), err)
+		}
+	}
+	if want := len(stale) + len(big) - protocol.FileChunkSize; counter.bytes != want {
+		t.Fatalf("sent %d bytes of file data, want %d", counter.bytes, want)
+	}
+	matches, _ := filepath.Glob(filepath.Join(destDir, ".goxfer-*.state"))
+	if len(matches) != 0 {
+		t.Fatalf("state files left behind: %v", matches)
+	}
+}
+
+func TestP2P_TreeOverLanes(t *testing.T) {
+	senderSess, receiverSess := makePair(t)
+	feat := testFeatures(true)
+
+	srcDir := filepath.Join(t.TempDir(), "photos")
+	contents := make(map[string][]byte)
+	for i := range 9 {
+		name := fmt.Sprintf("day%d/img%d.raw", i%3, i)
+		contents[name] = bytes.Repeat([]byte{byte('a' + i)}, i*protocol.FileChunkSize+i)
+		p := filepath.Join(srcDir, name)
+		os.MkdirAll(filepath.Dir(p), 0o750)
+		if err := os.WriteFile(p, contents[name], 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	destDir := t.TempDir()
+	sendErr := make(chan error, 1)
+	go func() {
+		tc, err := openTransfer(senderSess, feat, false)
+		if err == nil {
+			if _, ok := tc.data.(laneConn); !ok {
+				err = fmt.Errorf("transfer stream has no lanes")
+			} else if err = sendDirectory(tc.data, srcDir, sendConfig{feat: feat}); err == nil {
+				err = tc.close()
+			}
+		}
+		sendErr <- err
+	}()
+	tc, err := openTransfer(receiverSess, feat, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := receiveFiles(tc.data, destDir, receiveConfig{feat: feat}); err != nil {
+		t.Fatalf("receive error: %v", err)
+	}
+	if err := <-sendErr; err != nil {
+		t.Fatalf("send error: %v", err)
+	}
+
+	for name, want := range contents {
+		got, err := os.ReadFile(filepath.Join(destDir, "photos", name))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s: %d bytes, %v; want %d bytes", name, len(got), err, len(want))
+		}
+	}
+	if left, _ := filepath.Glob(filepath.Join(destDir, ".goxfer-*")); len(left) > 0 {
+		t.Errorf("resume state left behind after a complete transfer: %v", left)
+	}
+}
@@ -1,7 +1,9 @@
 package tunnel
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net"
@@ -11,9 +13,22 @@ import (
 
 const DefaultRelayPort = 7835
 
+// maxCodeLen bounds a code a sender asks to reuse.
+const maxCodeLen = 64
+
+// maxPairings bounds how many receivers one code may pair with.
+const maxPairings = 1000
+
+// pairingGrace is how long a code that pairs more than once stays valid
+// with no sender connection waiting, for the sender to register the next.
+const pairingGrace = 30 * time.Second
+
 type relayHandshake struct {
 	Role string `json:"role"`
 	Code string `json:"code,omitempty"`
+	// Pairings is how many receivers a sender's code may pair with, one
+	// at a time; 0 means one.
+	Pairings int `json:"pairings,omitempty"`
 }
 
 type relayAck struct {
@@ -27,6 +42,23 @@ type pendingRelay struct {
 	ch   chan net.Conn
 }
 
+// relayCode is a code a sender registered. Each pairing takes the sender
+// connection waiting under the code; a code that pairs more than once
+// outlives that while the sender registers a fresh connection.
+type relayCode struct {
+	waiting *pendingRelay // nil between two sender connections
+	left    int           // pairings still allowed
+	// next is closed when a sender connection starts waiting or the code
+	// goes away, waking receivers that arrived in between.
+	next chan struct{}
+}
+
+// wake tells receivers waiting for a sender connection to look again.
+func (c *relayCode) wake() {
+	close(c.next)
+	c.next = make(chan struct{})
+}
+
 // RunRelay starts a self-hosted relay server on addr (e.g. ":7835").
 // Sender connects first and receives a code. Receiver connects with the code
 // and the relay bridges the two connections for raw TCP passthrough.
@@ -43,7 +75,7 @@ func RunRelay(addr string) error {
 func Serve(l net.Listener) error {
 	defer l.Close()
 	var mu sync.Mutex
-	pending := map[string]*pendingRelay{}
+	pending := map[string]*relayCode{}
 
 	for {
 		conn, err := l.Accept()
@@ -54,7 +86,7 @@ func Serve(l net.Listener) error {
 	}
 }
 
-func handleRelayConn(conn net.Conn, mu *sync.Mutex, pending map[string]*pendingRelay) {
+func handleRelayConn(conn net.Conn, mu *sync.Mutex, pending map[string]*relayCode) {
 	var msg relayHandshake
 	if err := relayRead(conn, &msg); err != nil {
 		conn.Close()
@@ -63,24 +95,65 @@ func handleRelayConn(conn net.Conn, mu *sync.Mutex, pending map[string]*pendingR
 
 	switch msg.Role {
 	case "sender":
-		code := randomCode()
-		ch := make(chan net.Conn, 1)
+		// A sender may ask for its previous code back to let the same
+		// receiver reconnect after a dropped connection.
+		code := msg.Code
+		if code == "" {
+			code = randomCode()
+		} else if len(code) > maxCodeLen {
+			relayWrite(conn, relayAck{Error: "code too long"})
+			conn.Close()
+			return
+		}
+		if msg.Pairings < 0 || msg.Pairings > maxPairings {
+			relayWrite(conn, relayAck{Error: fmt.Sprintf("pairings must be 1 to %d", maxPairings)})
+			conn.Close()
+			return
+		}
+		p := &pendingRelay{conn: conn, ch: make(chan net.Conn, 1)}
+		ch := p.ch
 
 		mu.Lock()
-		pending[code] = &pendingRelay{conn: conn, ch: ch}
+		c, ok := pending[code]
+		if ok && c.waiting != nil {
+			mu.Unlock()
+			relayWrite(conn, relayAck{Error: "code already in use"})
+			conn.Close()
+			return
+		}
+		if !ok {
+			// An existing entry is a code between two pairings and
+			// keeps its count.
+			c = &relayCode{left: max(msg.Pairings, 1), next: make(chan struct{})}
+			pending[code] = c
+		}
+		c.waiting = p
+		c.wake()
 		mu.Unlock()
 
 		if err := relayWrite(conn, relayAck{Code: code}); err != nil {
 			conn.Close()
-			mu.Lock()
-			delete(pending, code)
-			mu.Unlock()
+			abandonPending(mu, pending, code, ch)
 			return
 		}
 
+		// A waiting sender sends nothing until it hears of a receiver, so
+		// any result from this read means it hung up.
+		gone := make(chan struct{})
+		go func() {
+			var b [1]byte
+			conn.Read(b[:])
+			close(gone)
+		}()
+
 		// Wait for receiver to connect (timeout after 10 minutes)
 		select {
 		case receiverConn := <-ch:
+			// Stop watching before the connection carries data.
+			conn.SetReadDeadline(time.Unix(1, 0))
+			<-gone
+			conn.SetReadDeadline(time.Time{})
+
 			// Signal sender that receiver has connected
 			if err := relayWrite(conn, relayAck{OK: true}); err != nil {
 				conn.Close()
@@ -88,22 +161,17 @@ func handleRelayConn(conn net.Conn, mu *sync.Mutex, pending map[string]*pendingR
 				return
 			}
 			pipe(conn, receiverConn)
+		case <-gone:
+			abandonPending(mu, pending, code, ch)
+			conn.Close()
 		case <-time.After(10 * time.Minute):
 			conn.Close()
-			mu.Lock()
-			delete(pending, code)
-			mu.Unlock()
+			abandonPending(mu, pending, code, ch)
 		}
 
 	case "receiver":
-		mu.Lock()
-		p, ok := pending[msg.Code]
-		if ok {
-			delete(pending, msg.Code)
-		}
-		mu.Unlock()
-
-		if !ok {
+		p := claimPending(mu, pending, msg.Code)
+		if p == nil {
 			relayWrite(conn, relayAck{Error: "unknown or expired code"})
 			conn.Close()
 			return
@@ -122,15 +190,84 @@ func handleRelayConn(conn net.Conn, mu *sync.Mutex, pending map[string]*pendingR
 	}
 }
 
+// claimPending takes the sender connection waiting under code for a
+// receiver. Under a code that pairs more than once it waits for the sender
+// to register its next connection. It returns nil for an unknown code.
+func claimPending(mu *sync.Mutex, pending map[string]*relayCode, code string) *pendingRelay {
+	mu.Lock()
+	defer mu.Unlock()
+	for {
+		c, ok := pending[code]
+		if !ok {
+			return nil
+		}
+		if p := c.waiting; p != nil {
+			c.waiting = nil
+			c.left--
+			if c.left == 0 {
+				delete(pending, code)
+			} else {
+				expireIdle(mu, pending, code, c)
+			}
+			return p
+		}
+		next := c.next
+		mu.Unlock()
+		<-next
+		mu.Lock()
+	}
+}
+
+// expireIdle drops c unless a sender connection starts waiting under it
+// within pairingGrace.
+func expireIdle(mu *sync.Mutex, pending map[string]*relayCode, code string, c *relayCode) {
+	time.AfterFunc(pairingGrace, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if pending[code] == c && c.waiting == nil {
+			delete(pending, code)
+			c.wake()
+		}
+	})
+}
+
+// abandonPending frees the code of a sender that stopped waiting, so it can
+// reconnect with the same code. A receiver that claimed the code in the
+// meantime is disconnected.
+func abandonPending(mu *sync.Mutex, pending map[string]*relayCode, code string, ch chan net.Conn) {
+	mu.Lock()
+	c, ok := pending[code]
+	mine := ok && c.waiting != nil && c.waiting.ch == ch
+	if mine {
+		delete(pending, code)
+		c.wake()
+	}
+	mu.Unlock()
+	if !mine {
+		// The receiver took the entry and is about to hand over its
+		// connection; ch is buffered, so this does not wait long.
+		(<-ch).Close()
+	}
+}
+
 // ConnectAsSender connects to a self-hosted relay as sender.
 // Returns the raw conn (ready for Noise handshake after receiver connects) and the session code.
 func ConnectAsSender(relayAddr string) (net.Conn, string, error) {
+	return RegisterSender(relayAddr, "", 1)
+}
+
+// RegisterSender connects to a self-hosted relay as sender under code, or a
+// new code when empty, which may pair with up to pairings receivers. The
+// sender registers a fresh connection under the same code for each
+// receiver after the first; a relay that pairs each code once frees it
+// after every pairing instead.
+func RegisterSender(relayAddr, code string, pairings int) (net.Conn, string, error) {
 	conn, err := net.DialTimeout("tcp", relayAddr, 10*time.Second)
 	if err != nil {
 		return nil, "", fmt.Errorf("connect to relay: %w", err)
 	}
 
-	if err := relayWrite(conn, relayHandshake{Role: "sender"}); err != nil {
+	if err := relayWrite(conn, relayHandshake{Role: "sender", Code: code, Pairings: pairings}); err != nil {
 		conn.Close()
 		return nil, "", fmt.Errorf("send role: %w", err)
 	}
@@ -148,6 +285,23 @@ func ConnectAsSender(relayAddr string) (net.Conn, string, error) {
 	return conn, ack.Code, nil
 }
 
+// ReconnectAsSender registers with a self-hosted relay as sender under the
+// code from an earlier ConnectAsSender or RegisterSender, so a receiver can
+// connect again with the same code. Relays that cannot reuse codes are
+// reported as errors.
+func ReconnectAsSender(relayAddr, code string, pairings int) (net.Conn, error) {
+	conn, got, err := RegisterSender(relayAddr, code, pairings)
+	if err != nil {
+		return nil, err
+	}
+	if got != code {
+		conn.Close()
+		return nil, errors.New("relay does not support reconnecting; upgrade the relay")
+	}
+
+	return conn, nil
+}
+
 // WaitForReceiver blocks until the relay signals that a receiver has connected.
 // After it returns, conn is ready for a raw Noise handshake.
 func WaitForReceiver(conn net.Conn) error {
@@ -162,31 +316,47 @@ func WaitForReceiver(conn net.Conn) error {
 }
 
 // ConnectAsReceiver connects to a self-hosted relay as receiver using a code.
-// Returns the raw conn ready for a Noise handshake.
-func ConnectAsReceiver(relayAddr, code string) (net.Conn, error) {
-	conn, err := net.DialTimeout("tcp", relayAddr, 10*time.Second)
+// Returns the raw conn ready for a Noise handshake. Canceling ctx abandons
+// the wait for the relay to pair it.
+func ConnectAsReceiver(ctx context.Context, relayAddr, code string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", relayAddr)
 	if err != nil {
 		return nil, fmt.Errorf("connect to relay: %w", err)
 	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
 
 	if err := relayWrite(conn, relayHandshake{Role: "receiver", Code: code}); err != nil {
 		conn.Close()
-		return nil, fmt.Errorf("send code: %w", err)
+		return nil, fmt.Errorf("send code: %w", canceled(ctx, err))
 	}
 
 	var ack relayAck
 	if err := relayRead(conn, &ack); err != nil {
 		conn.Close()
-		return nil, fmt.Errorf("receive ack: %w", err)
+		return nil, fmt.Errorf("receive ack: %w", canceled(ctx, err))
 	}
 	if ack.Error != "" {
 		conn.Close()
 		return nil, fmt.Errorf("relay: %s", ack.Error)
 	}
-
+	if !stop() {
+		// ctx was canceled just as the relay answered.
+		return nil, ctx.Err()
+	}
 	return conn, nil
 }
 
+// canceled explains err, from a connection closed because ctx was
+// canceled, as the cancellation.
+func canceled(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
 func relayWrite(conn net.Conn, v interface{}) error {
 	data, err := json.Marshal(v)
 	if err != nil {
@@ -2,6 +2,8 @@ package tunnel
 
 import (
 	"bytes"
+	"context"
+	"io"
 	"net"
 	"testing"
 	"time"
@@ -35,7 +37,7 @@ func TestRelay_SenderReceiver(t *testing.T) {
 	var receiverConn net.Conn
 	go func() {
 		var e error
-		receiverConn, e = ConnectAsReceiver(addr, code)
+		receiverConn, e = ConnectAsReceiver(context.Background(), addr, code)
 		errCh <- e
 	}()
 
@@ -74,7 +76,7 @@ func TestRelay_BidirectionalData(t *testing.T) {
 	var receiverConn net.Conn
 	go func() {
 		var e error
-		receiverConn, e = ConnectAsReceiver(addr, code)
+		receiverConn, e = ConnectAsReceiver(context.Background(), addr, code)
 		errCh <- e
 	}()
 
@@ -113,7 +115,7 @@ func TestRelay_BidirectionalData(t *testing.T) {
 func TestRelay_InvalidCode(t *testing.T) {
 	addr := startTestRelay(t)
 
-	_, err := ConnectAsReceiver(addr, "doesnotexist")
+	_, err := ConnectAsReceiver(context.Background(), addr, "doesnotexist")
 	if err == nil {
 		t.Fatal("expected error for invalid relay code, got nil")
 	}
@@ -152,7 +154,7 @@ func TestRelay_CodeConsumedOnConnect(t *testing.T) {
 	var receiverConn net.Conn
 	go func() {
 		var e error
-		receiverConn, e = ConnectAsReceiver(addr, code)
+		receiverConn, e = ConnectAsReceiver(context.Background(), addr, code)
 		errCh <- e
 	}()
 
@@ -163,8 +165,149 @@ func TestRelay_CodeConsumedOnConnect(t *testing.T) {
 	defer receiverConn.Close()
 
 	// A second receiver with the same code must fail — code is consumed
-	_, err = ConnectAsReceiver(addr, code)
+	_, err = ConnectAsReceiver(context.Background(), addr, code)
 	if err == nil {
 		t.Fatal("expected error when reusing a relay code, got nil")
 	}
 }
+
+func TestRelay_ReconnectWithSameCode(t *testing.T) {
+	addr := startTestRelay(t)
+
+	first, code, err := ConnectAsSender(addr)
+	if err != nil {
+		t.Fatalf("ConnectAsSender: %v", err)
+	}
+	if _, err := ReconnectAsSender(addr, code, 1); err == nil {
+		t.Fatal("reclaiming a code that is still waiting should fail")
+	}
+
+	// Pair and drop the first connection, as a network failure would.
+	receiver, err := ConnectAsReceiver(context.Background(), addr, code)
+	if err != nil {
+		t.Fatalf("ConnectAsReceiver: %v", err)
+	}
+	if err := WaitForReceiver(first); err != nil {
+		t.Fatalf("WaitForReceiver: %v", err)
+	}
+	first.Close()
+	receiver.Close()
+
+	again, err := ReconnectAsSender(addr, code, 1)
+	if err != nil {
+		t.Fatalf("ReconnectAsSender: %v", err)
+	}
+	defer again.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		conn, err := ConnectAsReceiver(context.Background(), addr, code)
+		if err == nil {
+			conn.Close()
+		}
+		errCh <- err
+	}()
+	if err := WaitForReceiver(again); err != nil {
+		t.Fatalf("WaitForReceiver after reconnect: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("ConnectAsReceiver after reconnect: %v", err)
+	}
+}
+
+func TestRelay_ReconnectAfterDropBeforePairing(t *testing.T) {
+	addr := startTestRelay(t)
+
+	first, code, err := ConnectAsSender(addr)
+	if err != nil {
+		t.Fatalf("ConnectAsSender: %v", err)
+	}
+	first.Close()
+
+	// The relay frees the code once it notices the sender is gone.
+	var again net.Conn
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if again, err = ReconnectAsSender(addr, code, 1); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("ReconnectAsSender after drop: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer again.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		conn, err := ConnectAsReceiver(context.Background(), addr, code)
+		if err == nil {
+			conn.Close()
+		}
+		errCh <- err
+	}()
+	if err := WaitForReceiver(again); err != nil {
+		t.Fatalf("WaitForReceiver after reconnect: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("ConnectAsReceiver after reconnect: %v", err)
+	}
+}
+
+func TestRelay_CodeAllowsSeveralPairings(t *testing.T) {
+	addr := startTestRelay(t)
+
+	first, code, err := RegisterSender(addr, "", 2)
+	if err != nil {
+		t.Fatalf("RegisterSender: %v", err)
+	}
+	defer first.Close()
+	receiver, err := ConnectAsReceiver(context.Background(), addr, code)
+	if err != nil {
+		t.Fatalf("first receiver: %v", err)
+	}
+	defer receiver.Close()
+	if err := WaitForReceiver(first); err != nil {
+		t.Fatalf("WaitForReceiver: %v", err)
+	}
+
+	// The next receiver arrives before the sender registers again, and
+	// waits for it instead of being turned away.
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	second := make(chan result, 1)
+	go func() {
+		conn, err := ConnectAsReceiver(context.Background(), addr, code)
+		second <- result{conn, err}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	again, got, err := RegisterSender(addr, code, 2)
+	if err != nil || got != code {
+		t.Fatalf("RegisterSender again = %q, %v; want %q", got, err, code)
+	}
+	defer again.Close()
+	if err := WaitForReceiver(again); err != nil {
+		t.Fatalf("WaitForReceiver for the second receiver: %v", err)
+	}
+	r := <-second
+	if r.err != nil {
+		t.Fatalf("second receiver: %v", r.err)
+	}
+	defer r.conn.Close()
+
+	msg := []byte("second copy")
+	go again.Write(msg)
+	buf := make([]byte, len(msg))
+	r.conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(r.conn, buf); err != nil || !bytes.Equal(buf, msg) {
+		t.Fatalf("second receiver read %q, %v; want %q", buf, err, msg)
+	}
+
+	// Both pairings are used up.
+	if _, err := ConnectAsReceiver(context.Background(), addr, code); err == nil {
+		t.Fatal("third receiver paired with a code that allows two")
+	}
+}
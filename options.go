@@ -0,0 +1,221 @@
+package goxfer
+
+import (
+	"io"
+	"time"
+
+	"github.com/JonathanInTheClouds/goxfer/internal/transfer"
+)
+
+// Option configures a Sender or a Receiver. Options meant for one side
+// only say so, and the other side ignores them.
+type Option func(*settings)
+
+// settings holds the options of both sides; each side takes its own.
+type settings struct {
+	send transfer.SendOptions
+	recv transfer.ReceiveOptions
+}
+
+func newSettings(opts []Option) *settings {
+	s := &settings{}
+	s.send.Retry = DefaultRetryPolicy
+	s.recv.Retry = DefaultRetryPolicy
+	// Offers are declined until WithAcceptOffer or WithAcceptAll says
+	// how to decide them.
+	s.recv.AcceptOffer = declineOffers
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// WithIdentity makes id this side's identity. Without it each transfer
+// uses a throwaway one.
+func WithIdentity(id *Identity) Option {
+	return func(s *settings) {
+		s.send.Identity = id
+		s.recv.Identity = id
+	}
+}
+
+// WithEvents calls fn with each Event of a transfer. fn runs on the
+// transfer's goroutines and must not block for long.
+func WithEvents(fn func(Event)) Option {
+	return func(s *settings) {
+		s.send.Events = fn
+		s.recv.Events = fn
+	}
+}
+
+// WithOutput prints status and progress bars to w as the goxfer command
+// does. Status meant for stdout goes to stderr while data is piped.
+func WithOutput(w io.Writer) Option {
+	return func(s *settings) {
+		s.send.Output = w
+		s.recv.Output = w
+	}
+}
+
+// WithRelay makes this side wait for the other at a self-hosted relay:
+// a Sender instead of at bore.pub, a Receiver instead of dialing the
+// sender. The other side reaches it WithCode.
+func WithRelay(addr string) Option {
+	return func(s *settings) {
+		s.send.RelayAddr = addr
+		s.recv.RelayAddr = addr
+	}
+}
+
+// WithCode is the session code to reach the other side waiting at a
+// relay, or WithRelay the code to wait under instead of a new one.
+func WithCode(code string) Option {
+	return func(s *settings) {
+		s.send.Code = code
+		s.recv.Code = code
+	}
+}
+
+// WithListen makes this side wait for the other to dial addr directly,
+// e.g. ":9000"; public, when not empty, is the address to tell the other
+// side.
+func WithListen(addr, public string) Option {
+	return func(s *settings) {
+		s.send.ListenAddr, s.send.PublicAddr = addr, public
+		s.recv.ListenAddr, s.recv.PublicAddr = addr, public
+	}
+}
+
+// WithReceiverAddr makes a Sender dial a receiver waiting WithListen at
+// addr, or WithRelay at the relay addr along WithCode.
+func WithReceiverAddr(addr string) Option {
+	return func(s *settings) { s.send.ReceiverAddr = addr }
+}
+
+// WithoutResume turns off resuming interrupted transfers.
+func WithoutResume() Option {
+	return func(s *settings) {
+		s.send.NoResume = true
+		s.recv.NoResume = true
+	}
+}
+
+// WithExpectedFingerprint aborts the transfer unless the peer's
+// fingerprint matches fp.
+func WithExpectedFingerprint(fp string) Option {
+	return func(s *settings) {
+		s.send.ExpectFingerprint = fp
+		s.recv.ExpectFingerprint = fp
+	}
+}
+
+// WithKnownPeers identifies the peer by the fingerprints in known. With an
+// alias, the peer must match the fingerprint recorded for it, and is
+// recorded on first use.
+func WithKnownPeers(known *KnownPeers, alias string) Option {
+	return func(s *settings) {
+		s.send.KnownPeers, s.send.To = known, alias
+		s.recv.KnownPeers, s.recv.From = known, alias
+	}
+}
+
+// WithVerify has confirm answer whether the verification symbols match
+// what the peer shows before any data moves; nil asks on stdin.
+func WithVerify(confirm func(symbols string) (bool, error)) Option {
+	return func(s *settings) {
+		s.send.Verify, s.send.ConfirmSymbols = true, confirm
+		s.recv.Verify, s.recv.ConfirmSymbols = true, confirm
+	}
+}
+
+// WithIdleTimeout abandons the transfer when the peer goes silent for d.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *settings) {
+		s.send.IdleTimeout = d
+		s.recv.IdleTimeout = d
+	}
+}
+
+// WithRetry sets how to reconnect after the connection drops; the zero
+// RetryPolicy never reconnects.
+func WithRetry(p RetryPolicy) Option {
+	return func(s *settings) {
+		s.send.Retry = p
+		s.recv.Retry = p
+	}
+}
+
+// WithMaxReceivers makes a Sender serve up to n receivers, each over its
+// own session at the same time.
+func WithMaxReceivers(n int) Option {
+	return func(s *settings) { s.send.MaxReceivers = n }
+}
+
+// WithExpiry makes a Sender stop waiting for receivers after d.
+func WithExpiry(d time.Duration) Option {
+	return func(s *settings) { s.send.Expires = d }
+}
+
+// WithPipeName is the file name a Sender's receiver saves stdin as.
+func WithPipeName(name string) Option {
+	return func(s *settings) { s.send.PipeName = name }
+}
+
+// WithAcceptOffer has accept decide each offer a Receiver gets within
+// WithMaxSize; nil asks on stdin. Without it or WithAcceptAll, a Receiver
+// declines every offer.
+func WithAcceptOffer(accept func(Offer) (bool, error)) Option {
+	return func(s *settings) {
+		s.recv.Yes = false
+		s.recv.AcceptOffer = accept
+	}
+}
+
+// WithAcceptAll makes a Receiver accept every offer within WithMaxSize
+// without asking.
+func WithAcceptAll() Option {
+	return func(s *settings) {
+		s.recv.Yes = true
+		s.recv.AcceptOffer = nil
+	}
+}
+
+// declineOffers is how a Receiver decides offers when no option says.
+func declineOffers(Offer) (bool, error) {
+	return false, nil
+}
+
+// WithMaxSize makes a Receiver decline offers larger than n bytes.
+func WithMaxSize(n int64) Option {
+	return func(s *settings) { s.recv.MaxSize = n }
+}
+
+// WithInclude makes a Receiver take only the files of a directory that
+// match one of the glob patterns.
+func WithInclude(patterns ...string) Option {
+	return func(s *settings) { s.recv.Include = append(s.recv.Include, patterns...) }
+}
+
+// WithExclude makes a Receiver skip the files of a directory that match
+// one of the glob patterns.
+func WithExclude(patterns ...string) Option {
+	return func(s *settings) { s.recv.Exclude = append(s.recv.Exclude, patterns...) }
+}
+
+// WithAllowedSender lets the sender with fingerprint deliver to a
+// Receiver's inbox, filed in the subdirectory name; an empty name uses the
+// fingerprint. Only Serve uses it.
+func WithAllowedSender(fingerprint, name string) Option {
+	return func(s *settings) {
+		if s.recv.Allowed == nil {
+			s.recv.Allowed = make(map[string]string)
+		}
+		s.recv.Allowed[fingerprint] = name
+	}
+}
+
+// WithPick makes a Receiver list the files of a directory and ask on stdin
+// which to take.
+func WithPick() Option {
+	return func(s *settings) { s.recv.Pick = true }
+}